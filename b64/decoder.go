@@ -7,24 +7,50 @@ package b64
 import (
 	"encoding/base64"
 	"errors"
+	"strings"
 )
 
 var (
 	ErrInvalidData = errors.New("b64: invalid base64 data")
 )
 
-// Decode decodes base64 data, handling invalid characters gracefully.
-// It first tries the standard decoder, then falls back to a more robust
-// FBReader-compatible algorithm that skips invalid characters.
+// Decode decodes base64 data, handling malformed input gracefully.
+// Whitespace (FB2 binaries are usually wrapped and indented) is stripped
+// and missing padding is tolerated before trying the standard decoders;
+// anything else falls back to a more robust FBReader-compatible algorithm
+// that skips invalid characters. ErrInvalidData is returned only when
+// the data holds no base64 at all.
 func Decode(raw []byte) ([]byte, error) {
+	clean := stripSpace(raw)
+
 	// Try standard base64 first (faster)
-	std, err := base64.StdEncoding.DecodeString(string(raw))
-	if err == nil {
+	if std, err := base64.StdEncoding.DecodeString(clean); err == nil {
 		return std, nil
 	}
+	if raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "=")); err == nil {
+		return raw, nil
+	}
 
 	// Fall back to robust decoder
-	return robustDecode(raw)
+	out, err := robustDecode([]byte(clean))
+	if err == nil && len(out) == 0 && clean != "" {
+		return nil, ErrInvalidData
+	}
+	return out, err
+}
+
+// stripSpace removes all ASCII whitespace from raw
+func stripSpace(raw []byte) string {
+	var b strings.Builder
+	b.Grow(len(raw))
+	for _, c := range raw {
+		switch c {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
 
 // robustDecode implements FBReader-compatible base64 decoding.
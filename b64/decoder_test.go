@@ -47,6 +47,31 @@ func TestDecode(t *testing.T) {
 			input: "QUE=", // "AA"
 			want:  "AA",
 		},
+		{
+			name:  "wrapped and indented",
+			input: "\n\t\tSGVsbG8g\r\n\t\tV29ybGQ=\n\t",
+			want:  "Hello World",
+		},
+		{
+			name:  "missing padding",
+			input: "SGVsbG8gV29ybGQ", // "Hello World" without '='
+			want:  "Hello World",
+		},
+		{
+			name:  "short padding",
+			input: "QQ=", // "A" with one '=' of two
+			want:  "A",
+		},
+		{
+			name:  "wrapped without padding",
+			input: "SGVs\n  bG8gV29y\n  bGQ\n",
+			want:  "Hello World",
+		},
+		{
+			name:    "no base64 at all",
+			input:   "!!! ???",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,99 @@
+package fb2c
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fb2Extensions are the input file suffixes ConvertDir picks up, longest
+// first so that ".fb2.zip" isn't taken for ".zip"
+var fb2Extensions = []string{".fb2.zip", ".fbz", ".fb2"}
+
+// formatExtensions maps ConvertOptions.Format to output file extensions
+var formatExtensions = map[string]string{
+	"":     ".mobi",
+	"mobi": ".mobi",
+	"azw3": ".azw3",
+	"kf8":  ".azw3",
+	"epub": ".epub",
+	"txt":  ".txt",
+}
+
+// ConvertResult is the outcome of converting one file with ConvertDir
+type ConvertResult struct {
+	Input    string   // Path of the FB2 or FBZ file
+	Output   string   // Path of the converted book
+	Err      error    // Conversion error, nil on success
+	Warnings []string // Problems that didn't stop conversion (see Converter.Warnings)
+}
+
+// ConvertDir converts every .fb2, .fb2.zip and .fbz file under inputDir to
+// opts.Format, writing each book to the same relative directory under
+// outputDir with its base name kept (a/book.fb2.zip becomes a/book.mobi).
+// A failed book doesn't stop the others: the results list every input
+// file in walk order with its own error. The returned error is only for
+// problems with the directories themselves.
+func ConvertDir(inputDir, outputDir string, opts ConvertOptions) ([]ConvertResult, error) {
+	ext, ok := formatExtensions[strings.ToLower(opts.Format)]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format: %s", opts.Format)
+	}
+	if ext == ".azw3" {
+		opts.MobiType = "new"
+	}
+
+	var inputs []string
+	err := filepath.WalkDir(inputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && fb2BaseName(d.Name()) != "" {
+			inputs = append(inputs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input directory: %w", err)
+	}
+
+	converter := NewConverter()
+	converter.SetOptions(opts)
+
+	results := make([]ConvertResult, 0, len(inputs))
+	for _, input := range inputs {
+		rel, err := filepath.Rel(inputDir, filepath.Dir(input))
+		if err != nil {
+			return results, err
+		}
+		dir := filepath.Join(outputDir, rel)
+		result := ConvertResult{
+			Input:  input,
+			Output: filepath.Join(dir, fb2BaseName(filepath.Base(input))+ext),
+		}
+
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			result.Err = fmt.Errorf("failed to create output directory: %w", err)
+		} else {
+			result.Err = converter.Convert(input, result.Output)
+			result.Warnings = converter.Warnings()
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// fb2BaseName returns the file name without its FB2 extension, or "" if
+// it isn't an FB2 or FBZ file
+func fb2BaseName(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range fb2Extensions {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return ""
+}
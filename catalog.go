@@ -0,0 +1,97 @@
+package fb2c
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"os"
+	"time"
+
+	"github.com/htol/fb2c/fb2"
+)
+
+// OPDS link relations for cover images
+const (
+	OPDSRelImage     = "http://opds-spec.org/image"
+	OPDSRelThumbnail = "http://opds-spec.org/image/thumbnail"
+)
+
+// OPDSEntry holds the fields of an OPDS catalog (Atom) entry for a book
+type OPDSEntry struct {
+	ID         string // Atom id: the FB2 document id as a URN, or a content hash
+	Title      string
+	Authors    []string
+	Language   string
+	Summary    string   // Annotation as plain text
+	Categories []string // FB2 genre codes
+	Updated    time.Time
+	Links      []OPDSLink
+
+	// Cover image data, served by the catalog at the cover link's href
+	Cover     []byte
+	CoverType string
+}
+
+// OPDSLink is an Atom link of a catalog entry. Hrefs are relative; catalog
+// servers resolve them against their own URL scheme.
+type OPDSLink struct {
+	Rel  string
+	Type string
+	Href string
+}
+
+// CatalogEntry builds an OPDS catalog entry from the metadata and cover of
+// an FB2 file without converting the book
+func CatalogEntry(path string) (*OPDSEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FB2 file: %w", err)
+	}
+
+	metadata, err := ExtractMetadataFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract metadata: %w", err)
+	}
+
+	entry := &OPDSEntry{
+		ID:         catalogID(metadata, data),
+		Title:      metadata.Title,
+		Authors:    metadata.Authors,
+		Language:   metadata.Language,
+		Summary:    metadata.Annotation,
+		Categories: metadata.Genres,
+	}
+	if info, err := os.Stat(path); err == nil {
+		entry.Updated = info.ModTime().UTC()
+	}
+
+	if len(metadata.Cover) > 0 {
+		entry.Cover = metadata.Cover
+		entry.CoverType = mime.TypeByExtension(metadata.CoverExt)
+		if entry.CoverType == "" {
+			entry.CoverType = "image/jpeg"
+		}
+		href := "cover" + metadata.CoverExt
+		entry.Links = append(entry.Links,
+			OPDSLink{Rel: OPDSRelImage, Type: entry.CoverType, Href: href},
+			OPDSLink{Rel: OPDSRelThumbnail, Type: entry.CoverType, Href: href},
+		)
+	}
+
+	return entry, nil
+}
+
+// catalogID returns a stable Atom id for a book: its FB2 document id, its
+// ISBN, or a hash of the file when it has neither
+func catalogID(m *fb2.Metadata, data []byte) string {
+	switch {
+	case m.DocumentID != "":
+		return fb2.DocumentURN(m.DocumentID)
+	case m.ISBNValid:
+		return "urn:isbn:" + m.ISBN
+	default:
+		sum := sha1.Sum(data)
+		return "urn:sha1:" + hex.EncodeToString(sum[:])
+	}
+}
@@ -2,15 +2,18 @@
 package fb2c
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/htol/fb2c/b64"
 	"github.com/htol/fb2c/epub"
 	"github.com/htol/fb2c/fb2"
+	"github.com/htol/fb2c/fb2encoding"
 	"github.com/htol/fb2c/mobi"
 	"github.com/htol/fb2c/mobi/kf8"
 	"github.com/htol/fb2c/opf"
@@ -23,19 +26,116 @@ type ConvertOptions struct {
 	Compression bool   // Enable PalmDOC compression
 
 	// Content options
-	NoInlineTOC   bool // Don't generate inline TOC
-	ExtractImages bool // Extract embedded images
+	NoInlineTOC   bool    // Don't generate inline TOC
+	ExtractImages bool    // Extract embedded images
+	ExtractDir    string  // Also write embedded binaries to this directory
+	Typography    bool    // Apply language-aware typography (quotes, dashes, spacing)
+	ImageCaptions bool    // Show image titles as visible captions
+	StableAnchors bool    // Give paragraphs reproducible id anchors (see fb2.ParagraphAnchor)
+	CodeWrap      int     // Break unbroken code text every CodeWrap characters (0 = off)
+	CodeFontScale float64 // Font size of code blocks relative to text (0 = unchanged)
+
+	// SectionAnnotationStyle is "summary" (default) or "pullquote"; see
+	// fb2.SectionAnnotationSummary. Other values render as "summary".
+	SectionAnnotationStyle string
+
+	// Direction is the reading direction: "auto" (default, right to left
+	// for languages such as Hebrew and Arabic), "ltr" or "rtl"
+	Direction string
+
+	// MaxParagraphLength splits paragraphs longer than this many characters
+	// (0 = never). The default only catches broken files, not normal prose.
+	MaxParagraphLength int
+
+	// PreferLargestCover uses the largest cover candidate binary as the cover
+	// and the coverpage image as the MOBI thumbnail
+	PreferLargestCover bool
+
+	// ForceEncoding decodes the input with this encoding (e.g.
+	// "windows-1251"), ignoring the BOM, the declaration and detection.
+	// Conversion fails if the encoding is unsupported.
+	ForceEncoding string
+
+	// CSS is added to the EPUB stylesheet (styles.css) after the FB2
+	// document's own stylesheets, so its rules take precedence
+	CSS string
+
+	// GenerateTitlePage opens the book with a title page showing the
+	// title, authors, series, publisher and annotation. It follows the
+	// cover unless TitlePageBeforeCover is set. EPUB books always open on
+	// their cover page (cover.xhtml), so the option only applies to MOBI.
+	GenerateTitlePage    bool
+	TitlePageBeforeCover bool
 
 	// Metadata overrides
 	Title      string
 	Authors    []string
 	CoverImage string
 
+	// MaxDescriptionLength caps the MOBI EXTH description in characters
+	// (0 = no cap). The full annotation is still rendered in the book.
+	MaxDescriptionLength int
+
 	// KF8-specific options
 	EnableChunking  bool
 	TargetChunkSize int
+
+	// TOCOverride, if set, replaces the table of contents extracted from
+	// the FB2 document
+	TOCOverride []TOCOverrideEntry
+
+	// Bookmarks are written as a secondary navigation list (NCX navList,
+	// EPUB 3 nav), separate from the table of contents
+	Bookmarks []Bookmark
+
+	// FixedLayout writes image-only books (comics, picture books) as
+	// pre-paginated EPUB 3 / fixed-layout KF8. Books with text are written
+	// reflowable.
+	FixedLayout bool
+
+	// AccentColor adds the dominant color of the cover to EPUB metadata
+	// for readers that theme around the cover
+	AccentColor bool
+
+	// EPUBVersion selects the EPUB package version: 3 adds a nav document
+	// alongside the NCX; anything else writes EPUB 2. Fixed-layout books
+	// are always EPUB 3.
+	EPUBVersion int
+
+	// Strict makes conversion fail with a *DegradedError instead of
+	// skipping undecodable images, a missing cover or unresolved TOC and
+	// bookmark anchors. Without it those problems are reported by Warnings.
+	Strict bool
+
+	// Deterministic makes output byte-for-byte reproducible by deriving
+	// unique IDs from the book instead of generating random ones
+	Deterministic bool
+
+	// ValidateEPUB checks the structure of written EPUB books with
+	// epub.Validator and fails conversion with the validator's errors.
+	// Its warnings are reported by Warnings.
+	ValidateEPUB bool
+
+	// Format is the output format of ConvertDir: "mobi" (default, variant
+	// chosen by MobiType), "azw3" (KF8), "epub" or "txt". Convert takes the
+	// format from the output file extension instead.
+	Format string
+
+	// Progress, if set, is called as conversion passes each stage (see
+	// StageParsed and the following constants) with the approximate
+	// fraction of the work done, from 0 to 1
+	Progress func(stage string, pct float64)
 }
 
+// Conversion stages reported to ConvertOptions.Progress, in order
+const (
+	StageParsed    = "parsed"    // FB2 document parsed
+	StageMetadata  = "metadata"  // Metadata extracted
+	StageHTML      = "html"      // Book HTML generated
+	StageRecords   = "records"   // Output written
+	StageFinalized = "finalized" // Output file closed
+)
+
 // DefaultConvertOptions returns default conversion options
 func DefaultConvertOptions() ConvertOptions {
 	return ConvertOptions{
@@ -45,13 +145,21 @@ func DefaultConvertOptions() ConvertOptions {
 		ExtractImages:   true,
 		EnableChunking:  true,
 		TargetChunkSize: 4096,
+
+		MaxDescriptionLength: mobi.DefaultMaxDescriptionLength,
+		MaxParagraphLength:   fb2.DefaultMaxParagraphLength,
 	}
 }
 
 // Converter handles FB2 to MOBI conversion
 type Converter struct {
-	options ConvertOptions
-	parser  *fb2.Parser
+	options      ConvertOptions
+	parser       *fb2.Parser
+	linkResolver fb2.LinkResolver
+	warnings     []string
+	problems     []string // Warnings that Strict turns into errors
+	fixedLayout  bool     // FixedLayout applies to the current book
+	sample       fb2.SampleInfo
 }
 
 // NewConverter creates a new converter
@@ -65,20 +173,49 @@ func NewConverter() *Converter {
 // SetOptions sets conversion options
 func (c *Converter) SetOptions(options ConvertOptions) {
 	c.options = options
+	c.parser.PreferLargestCover = options.PreferLargestCover
+	c.parser.ForceEncoding = options.ForceEncoding
+	c.parser.ExtractDir = options.ExtractDir
+}
+
+// SetLinkResolver sets a callback used to rewrite links that point outside
+// the book (e.g. to other books of a series). When the resolver returns
+// false the link is left unchanged.
+func (c *Converter) SetLinkResolver(resolver func(href string) (string, bool)) {
+	c.linkResolver = resolver
 }
 
 // Convert converts an FB2 to supported formats
 func (c *Converter) Convert(inputPath, outputPath string) error {
+	return c.ConvertFileContext(context.Background(), inputPath, outputPath)
+}
+
+// ConvertFileContext is Convert with cancellation: it returns ctx.Err()
+// if ctx is done between conversion stages. The output file isn't
+// created when conversion is cancelled before writing.
+func (c *Converter) ConvertFileContext(ctx context.Context, inputPath, outputPath string) error {
+	c.warnings = nil
+	c.problems = nil
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	fb2Data, err := os.ReadFile(inputPath)
 	if err != nil {
 		return fmt.Errorf("failed to read FB2 file: %w", err)
 	}
+	if fb2Data, err = fb2.UnpackFBZ(fb2Data); err != nil {
+		return fmt.Errorf("failed to read FBZ file: %w", err)
+	}
 
 	// Encoding conversion is handled by the parser using fb2encoding package
 	fb2Doc, err := c.parser.ParseBytes(fb2Data)
 	if err != nil {
 		return fmt.Errorf("failed to parse FB2: %w", err)
 	}
+	if err := c.reached(ctx, StageParsed, 0.2); err != nil {
+		return err
+	}
 
 	metadata, err := c.parser.ExtractMetadata(fb2Doc)
 	if err != nil {
@@ -87,6 +224,13 @@ func (c *Converter) Convert(inputPath, outputPath string) error {
 
 	// Apply metadata overrides
 	c.applyMetadataOverrides(metadata)
+	if err := c.reached(ctx, StageMetadata, 0.3); err != nil {
+		return err
+	}
+	c.checkFixedLayout(fb2Doc)
+	c.checkEncoding(fb2Data)
+	c.checkSample(fb2Doc)
+	c.checkParseProblems(metadata)
 
 	// Detect output format from file extension
 	ext := strings.ToLower(filepath.Ext(outputPath))
@@ -94,72 +238,149 @@ func (c *Converter) Convert(inputPath, outputPath string) error {
 	// Transform to HTML
 	transformer := fb2.NewTransformer()
 	transformer.NoInlineTOC = c.options.NoInlineTOC
+	transformer.LinkResolver = c.linkResolver
+	transformer.Typography = c.options.Typography
+	transformer.ImageCaptions = c.options.ImageCaptions
+	transformer.StableAnchors = c.options.StableAnchors
+	transformer.CodeWrap = c.options.CodeWrap
+	transformer.SectionAnnotationStyle = c.options.SectionAnnotationStyle
+	transformer.MaxParagraphLength = c.options.MaxParagraphLength
+	transformer.CodeFontScale = c.options.CodeFontScale
+	transformer.ForceEncoding = c.options.ForceEncoding
+	transformer.Direction = c.options.Direction
+	transformer.TitlePage = c.titlePage(metadata)
+	transformer.TitlePageBeforeCover = c.options.TitlePageBeforeCover
+	// The EPUB writer opens the book on its own cover page
+	transformer.NoCoverPage = ext == ".epub"
 	// Enable MOBI mode for MOBI/KF8 output to ensure compatibility
 	if ext != ".epub" {
 		transformer.MOBIMode = true
 	}
+	transformer.TextMode = ext == ".txt"
 
-	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	html, css, _, err := transformer.ConvertBytes(fb2Data)
 	if err != nil {
 		return fmt.Errorf("failed to transform FB2: %w", err)
 	}
+	if err := c.reached(ctx, StageHTML, 0.6); err != nil {
+		return err
+	}
+
+	// Plain text is written as is, without assembling a book
+	if transformer.TextMode {
+		if err := c.strictError(); err != nil {
+			return err
+		}
+		return c.writeFile(ctx, outputPath, func(w io.Writer) error {
+			_, err := io.WriteString(w, html)
+			return err
+		})
+	}
 
 	// Extract TOC from FB2 document
 	tocData, err := c.parser.ExtractTOC(fb2Doc)
 	if err != nil {
 		return fmt.Errorf("failed to extract TOC: %w", err)
 	}
+	if len(c.options.TOCOverride) > 0 {
+		tocData = c.buildTOCOverride(html)
+	}
 
 	// Create OPF book
 	book := c.createOPFBook(metadata, html, tocData, fb2Doc)
+	c.addStylesheet(book, css)
+	book.Bookmarks = c.buildBookmarks(html)
+	if err := c.strictError(); err != nil {
+		return err
+	}
 
-	// Detect output format from file extension
-	ext = strings.ToLower(filepath.Ext(outputPath))
+	// MOBI format unless EPUB is asked for
+	format := "mobi"
+	if ext == ".epub" {
+		format = "epub"
+	}
+	return c.writeFile(ctx, outputPath, func(w io.Writer) error {
+		return c.writeBook(book, format, w)
+	})
+}
+
+// writeFile creates the output file and fills it with write, reporting the
+// records and finalized stages. The file isn't created if ctx is done.
+func (c *Converter) writeFile(ctx context.Context, outputPath string, write func(io.Writer) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Write output based on format
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
 	defer outputFile.Close()
 
-	// EPUB format
-	if ext == ".epub" {
-		return c.writeEPUB(book, outputFile)
+	if err := write(outputFile); err != nil {
+		return err
 	}
+	c.progress(StageRecords, 0.9)
 
-	// MOBI format (default)
-	switch c.options.MobiType {
-	case "old", "6":
-		return c.writeMOBI6(book, outputFile)
-	case "new", "8":
-		return c.writeKF8(book, outputFile)
-	case "both":
-		return c.writeJoint(book, outputFile)
-	default:
-		return fmt.Errorf("unknown MOBI type: %s", c.options.MobiType)
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("failed to close output file: %w", err)
 	}
+	c.progress(StageFinalized, 1)
+
+	return nil
 }
 
 // ConvertStream converts FB2 from reader to MOBI writer
 func (c *Converter) ConvertStream(input io.Reader, output io.Writer) error {
+	return c.ConvertContext(context.Background(), input, output)
+}
+
+// ConvertContext is ConvertStream with cancellation: it returns ctx.Err()
+// if ctx is done between conversion stages. Nothing is written to output
+// when conversion is cancelled before writing.
+func (c *Converter) ConvertContext(ctx context.Context, input io.Reader, output io.Writer) error {
+	return c.convertStream(ctx, input, "mobi", output)
+}
+
+// convertStream converts FB2 from input to output in the given format:
+// "txt" for plain text, or a writeBook format
+func (c *Converter) convertStream(ctx context.Context, input io.Reader, format string, output io.Writer) error {
+	c.warnings = nil
+	c.problems = nil
+
 	// Read FB2
 	data, err := io.ReadAll(input)
 	if err != nil {
 		return fmt.Errorf("failed to read input: %w", err)
 	}
+	if data, err = fb2.UnpackFBZ(data); err != nil {
+		return fmt.Errorf("failed to read FBZ input: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	// Parse FB2
 	fb2Doc, err := c.parser.ParseBytes(data)
 	if err != nil {
 		return fmt.Errorf("failed to parse FB2: %w", err)
 	}
+	if err := c.reached(ctx, StageParsed, 0.2); err != nil {
+		return err
+	}
 
 	// Extract metadata
 	metadata, err := c.parser.ExtractMetadata(fb2Doc)
 	if err != nil {
 		return fmt.Errorf("failed to extract metadata: %w", err)
 	}
+	if err := c.reached(ctx, StageMetadata, 0.3); err != nil {
+		return err
+	}
+	c.checkFixedLayout(fb2Doc)
+	c.checkEncoding(data)
+	c.checkSample(fb2Doc)
+	c.checkParseProblems(metadata)
 
 	// Extract TOC from FB2 document
 	tocData, err := c.parser.ExtractTOC(fb2Doc)
@@ -170,37 +391,165 @@ func (c *Converter) ConvertStream(input io.Reader, output io.Writer) error {
 	// Transform to HTML
 	transformer := fb2.NewTransformer()
 	transformer.NoInlineTOC = c.options.NoInlineTOC
+	transformer.LinkResolver = c.linkResolver
+	transformer.Typography = c.options.Typography
+	transformer.ImageCaptions = c.options.ImageCaptions
+	transformer.StableAnchors = c.options.StableAnchors
+	transformer.CodeWrap = c.options.CodeWrap
+	transformer.SectionAnnotationStyle = c.options.SectionAnnotationStyle
+	transformer.MaxParagraphLength = c.options.MaxParagraphLength
+	transformer.CodeFontScale = c.options.CodeFontScale
+	transformer.ForceEncoding = c.options.ForceEncoding
+	transformer.Direction = c.options.Direction
+	transformer.TitlePage = c.titlePage(metadata)
+	transformer.TitlePageBeforeCover = c.options.TitlePageBeforeCover
+	transformer.NoCoverPage = strings.EqualFold(format, "epub")
 	// Stream usually defaults to MOBI unless extension known (not known here)
 	transformer.MOBIMode = true
+	transformer.TextMode = format == "txt"
 
-	html, _, _, err := transformer.ConvertBytes(data)
+	html, css, _, err := transformer.ConvertBytes(data)
 	if err != nil {
 		return fmt.Errorf("failed to transform FB2: %w", err)
 	}
+	if err := c.reached(ctx, StageHTML, 0.6); err != nil {
+		return err
+	}
+
+	// Plain text is written as is, without assembling a book
+	if transformer.TextMode {
+		if err := c.strictError(); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(output, html); err != nil {
+			return fmt.Errorf("failed to write text: %w", err)
+		}
+		c.progress(StageRecords, 0.9)
+		c.progress(StageFinalized, 1)
+		return nil
+	}
+	if len(c.options.TOCOverride) > 0 {
+		tocData = c.buildTOCOverride(html)
+	}
 
 	// Create OPF book
 	book := c.createOPFBook(metadata, html, tocData, fb2Doc)
+	c.addStylesheet(book, css)
+	book.Bookmarks = c.buildBookmarks(html)
+	if err := c.strictError(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The caller owns the output, so it is final once written
+	if err := c.writeBook(book, format, output); err != nil {
+		return err
+	}
+	c.progress(StageRecords, 0.9)
+	c.progress(StageFinalized, 1)
+
+	return nil
+}
+
+// progress reports a conversion stage to the Progress option, if set
+func (c *Converter) progress(stage string, pct float64) {
+	if c.options.Progress != nil {
+		c.options.Progress(stage, pct)
+	}
+}
+
+// reached reports that conversion passed a stage and returns ctx.Err(),
+// so that a cancelled conversion stops before the next stage
+func (c *Converter) reached(ctx context.Context, stage string, pct float64) error {
+	c.progress(stage, pct)
+	return ctx.Err()
+}
 
-	// Write MOBI
-	switch c.options.MobiType {
-	case "old", "6":
+// writeBook writes the book in the given format. The "mobi" format uses
+// the MobiType option to pick between MOBI 6, KF8 and joint output.
+func (c *Converter) writeBook(book *opf.OEBBook, format string, output io.Writer) error {
+	switch strings.ToLower(strings.TrimPrefix(format, ".")) {
+	case "epub":
+		return c.writeEPUB(book, output)
+	case "mobi6":
 		return c.writeMOBI6(book, output)
-	case "new", "8":
+	case "kf8", "azw3":
 		return c.writeKF8(book, output)
-	case "both":
+	case "joint", "both":
 		return c.writeJoint(book, output)
+	case "mobi":
+		switch c.options.MobiType {
+		case "old", "6":
+			return c.writeMOBI6(book, output)
+		case "new", "8":
+			return c.writeKF8(book, output)
+		case "both":
+			return c.writeJoint(book, output)
+		default:
+			return fmt.Errorf("unknown MOBI type: %s", c.options.MobiType)
+		}
 	default:
-		return fmt.Errorf("unknown MOBI type: %s", c.options.MobiType)
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// checkFixedLayout decides whether the fixed layout option applies to the
+// book, warning when it's requested for a book with text
+func (c *Converter) checkFixedLayout(fb2Doc *fb2.FictionBook) {
+	c.fixedLayout = false
+	if !c.options.FixedLayout {
+		return
+	}
+	if !fb2Doc.IsImageOnly() {
+		c.addWarning("fixed layout requested but the book contains text; writing reflowable output")
+		return
+	}
+	c.fixedLayout = true
+}
+
+// checkEncoding warns when the input's byte order mark contradicts its
+// encoding declaration. The BOM is trusted, but such files were often
+// re-saved by an editor and may have other damage.
+func (c *Converter) checkEncoding(data []byte) {
+	if c.options.ForceEncoding != "" {
+		return
 	}
+	if result := fb2encoding.Detect(data); result.Conflict {
+		c.addWarning(fmt.Sprintf("byte order mark says %s but the declaration says %s; decoding as %s",
+			result.Encoding, result.DeclaredEncoding, result.Encoding))
+	}
+}
+
+// checkSample runs the sample/stub heuristic on the book, warning when it
+// looks like a promotional sample
+func (c *Converter) checkSample(fb2Doc *fb2.FictionBook) {
+	c.sample = fb2.DetectSample(fb2Doc)
+	if c.sample.Likely {
+		c.addWarning(fmt.Sprintf("book looks like a sample or stub (confidence %.1f): %s",
+			c.sample.Confidence, strings.Join(c.sample.Reasons, "; ")))
+	}
+}
+
+// Sample returns the sample/stub classification of the last converted book
+func (c *Converter) Sample() fb2.SampleInfo {
+	return c.sample
 }
 
 // applyMetadataOverrides applies user-specified metadata overrides
 func (c *Converter) applyMetadataOverrides(metadata *fb2.Metadata) {
 	if c.options.Title != "" {
 		metadata.Title = c.options.Title
+		metadata.TitleMarkup = ""
 	}
 	if len(c.options.Authors) > 0 {
 		metadata.Authors = c.options.Authors
+		metadata.AuthorSorts = c.options.Authors
+		metadata.AuthorSort = strings.Join(c.options.Authors, " & ")
 	}
 }
 
@@ -208,28 +557,63 @@ func (c *Converter) applyMetadataOverrides(metadata *fb2.Metadata) {
 func (c *Converter) createOPFBook(metadata *fb2.Metadata, html string, tocData *fb2.TOCData, fb2Doc *fb2.FictionBook) *opf.OEBBook {
 	book := opf.NewOEBBook()
 
+	// Only a valid ISBN identifies the book; the writers fall back to a
+	// UUID otherwise
+	isbn := ""
+	if metadata.ISBNValid {
+		isbn = metadata.ISBN
+	}
+
 	// Set metadata
 	book.Metadata = opf.ConvertMetadataFromFB2(
 		metadata.Title,
 		metadata.Authors,
 		metadata.AuthorSort,
 		metadata.Publisher,
-		metadata.ISBN,
+		isbn,
 		metadata.Year,
 		metadata.Language,
 		metadata.PubDate,
 		metadata.Series,
 		metadata.SeriesIndex,
-		metadata.Genres,
+		metadata.GenreLabels,
 		metadata.Keywords,
 		metadata.Annotation,
 		metadata.Cover,
 		metadata.CoverID,
 		metadata.CoverExt,
 	)
+	book.Metadata.Thumbnail = metadata.Thumbnail
+	book.Metadata.TitleMarkup = metadata.TitleMarkup
+	book.Metadata.AnnotationHTML = metadata.AnnotationHTML
+	book.Metadata.Sources = metadata.Sources()
+	book.Metadata.SourceOCR = metadata.SrcOCR
+	book.Metadata.GenreCodes = metadata.Genres
+	book.Metadata.DocumentID = metadata.DocumentID
+	book.Metadata.Direction = fb2.ResolveDirection(c.options.Direction, metadata.Language)
+	for i, series := range metadata.AllSeries {
+		if i > 0 {
+			book.Metadata.OtherSeries = append(book.Metadata.OtherSeries, opf.SeriesInfo{Name: series.Name, Index: series.Index})
+		}
+	}
+	for i := range book.Metadata.Authors {
+		if i < len(metadata.AuthorSorts) {
+			book.Metadata.Authors[i].SortName = metadata.AuthorSorts[i]
+		}
+	}
+	for i, name := range metadata.Translators {
+		book.Metadata.Translator = append(book.Metadata.Translator, opf.Author{
+			FullName: name,
+			SortName: metadata.TranslatorSorts[i],
+			Role:     "trl",
+		})
+	}
 
 	// Set content
 	book.Content = html
+	if c.options.GenerateTitlePage {
+		book.TitlePage = fb2.TitlePageID
+	}
 
 	// Build TOC from extracted data
 	if tocData != nil && len(tocData.Entries) > 0 {
@@ -240,29 +624,24 @@ func (c *Converter) createOPFBook(metadata *fb2.Metadata, html string, tocData *
 	if metadata.CoverID != "" && len(metadata.Cover) > 0 {
 		// CoverID already includes the extension (e.g., "cover.jpg")
 		book.AddResource(metadata.CoverID, metadata.CoverID,
-			"image/"+metadata.CoverExt[1:], metadata.Cover)
+			imageMediaType(mime.TypeByExtension(metadata.CoverExt)), metadata.Cover)
 	}
 
 	// Add all embedded binaries as resources
 	// This ensures that inline images (like in with_cover.fb2) are included
 	if fb2Doc != nil && len(fb2Doc.Binaries) > 0 {
+		imageData := c.parser.GetImageData()
 		for _, binary := range fb2Doc.Binaries {
-			if binary.ID == "" {
+			// The parser has already decoded the binaries and reported
+			// those it couldn't decode
+			data, ok := imageData[binary.ID]
+			if binary.ID == "" || !ok {
 				continue
 			}
 
-			// Decode base64 data
-			data, err := b64.Decode([]byte(binary.Data))
-			if err != nil {
-				continue
-			}
-
-			// Determine media type from content-type
-			mediaType := binary.ContentType
-			if mediaType == "" {
-				// Default to jpeg if unknown
-				mediaType = "image/jpeg"
-			}
+			// Media type as sniffed by the parser, falling back to the
+			// declared content-type
+			mediaType := imageMediaType(c.parser.GetImageType(binary.ID))
 
 			// Use the binary ID as the resource ID (already has extension in most FB2 files)
 			// The href will be the same for EPUB
@@ -273,6 +652,43 @@ func (c *Converter) createOPFBook(metadata *fb2.Metadata, html string, tocData *
 	return book
 }
 
+// titlePage returns the HTML of the title page of the book, or "" unless
+// GenerateTitlePage is set
+func (c *Converter) titlePage(metadata *fb2.Metadata) string {
+	if !c.options.GenerateTitlePage {
+		return ""
+	}
+	return opf.NewHTMLProcessor().GenerateTitlePage(c.createOPFBook(metadata, "", nil, nil).Metadata)
+}
+
+// imageMediaType normalizes the content type of an image resource. The
+// common misspelling image/jpg becomes image/jpeg, which EPUB requires,
+// and an unknown type defaults to JPEG.
+func imageMediaType(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType {
+	case "", "image/jpg", "image/pjpeg":
+		return "image/jpeg"
+	default:
+		return contentType
+	}
+}
+
+// addStylesheet adds the document CSS followed by the CSS option to the
+// book as styles.css
+func (c *Converter) addStylesheet(book *opf.OEBBook, documentCSS string) {
+	var sheets []string
+	for _, css := range []string{documentCSS, c.options.CSS} {
+		if css = strings.TrimSpace(css); css != "" {
+			sheets = append(sheets, css)
+		}
+	}
+	if len(sheets) == 0 {
+		return
+	}
+	book.AddResource("styles.css", "styles.css", "text/css", []byte(strings.Join(sheets, "\n\n")+"\n"))
+}
+
 // buildOPFTOC builds OPF TOC from extracted FB2 TOC data
 func (c *Converter) buildOPFTOC(tocData *fb2.TOCData, book *opf.OEBBook) {
 	// The OPF TOC starts with a root entry
@@ -307,12 +723,37 @@ func (c *Converter) buildOPFTOC(tocData *fb2.TOCData, book *opf.OEBBook) {
 
 // writeEPUB writes EPUB format
 func (c *Converter) writeEPUB(book *opf.OEBBook, output io.Writer) error {
-	return epub.ConvertOEBToEPUB(book, output)
+	opts := epub.DefaultWriteOptions()
+	opts.Deterministic = c.options.Deterministic
+	opts.FixedLayout = c.fixedLayout
+	opts.AccentColor = c.options.AccentColor
+	opts.EPUBVersion = c.options.EPUBVersion
+
+	if !c.options.ValidateEPUB {
+		return epub.ConvertOEBToEPUBWithOptions(book, output, opts)
+	}
+
+	var buf bytes.Buffer
+	if err := epub.ConvertOEBToEPUBWithOptions(book, &buf, opts); err != nil {
+		return err
+	}
+	validator := epub.NewValidator(buf.Bytes())
+	valid := validator.Validate()
+	for _, msg := range validator.Warnings() {
+		c.addWarning(msg)
+	}
+	if !valid {
+		return fmt.Errorf("invalid EPUB: %s", strings.Join(validator.Errors(), "; "))
+	}
+	_, err := output.Write(buf.Bytes())
+	return err
 }
 
 // writeMOBI6 writes MOBI 6 format
 func (c *Converter) writeMOBI6(book *opf.OEBBook, output io.Writer) error {
 	opts := mobi.DefaultWriteOptions()
+	opts.Deterministic = c.options.Deterministic
+	opts.MaxDescriptionLength = c.options.MaxDescriptionLength
 	if !c.options.Compression {
 		opts.CompressionType = mobi.NoCompression
 	}
@@ -320,6 +761,7 @@ func (c *Converter) writeMOBI6(book *opf.OEBBook, output io.Writer) error {
 	// Pass cover image from book metadata if available
 	if book.Metadata.Cover != nil {
 		opts.CoverImage = book.Metadata.Cover
+		opts.ThumbnailImage = book.Metadata.Thumbnail
 	}
 
 	return mobi.ConvertOEBToMOBIWithOptions(book, output, opts)
@@ -330,6 +772,13 @@ func (c *Converter) writeKF8(book *opf.OEBBook, output io.Writer) error {
 	opts := kf8.DefaultKF8WriteOptions()
 	opts.EnableChunking = c.options.EnableChunking
 	opts.TargetChunkSize = c.options.TargetChunkSize
+	opts.Deterministic = c.options.Deterministic
+	opts.MaxDescriptionLength = c.options.MaxDescriptionLength
+	opts.FixedLayout = c.fixedLayout
+	if book.Metadata.Cover != nil {
+		opts.CoverImage = book.Metadata.Cover
+		opts.ThumbnailImage = book.Metadata.Thumbnail
+	}
 
 	return kf8.ConvertOEBToKF8WithOptions(book, output, opts)
 }
@@ -340,6 +789,9 @@ func (c *Converter) writeJoint(book *opf.OEBBook, output io.Writer) error {
 	opts := kf8.DefaultKF8WriteOptions()
 	opts.KF8Boundary = true
 	opts.EnableChunking = c.options.EnableChunking
+	opts.Deterministic = c.options.Deterministic
+	opts.MaxDescriptionLength = c.options.MaxDescriptionLength
+	opts.FixedLayout = c.fixedLayout
 	writer.SetOptions(opts)
 
 	return writer.WriteJointFile(output)
@@ -358,6 +810,29 @@ func ConvertFileWithOptions(inputPath, outputPath string, options ConvertOptions
 	return converter.Convert(inputPath, outputPath)
 }
 
+// WriteBook writes an already assembled OEB book in the given format:
+// "epub", "mobi" (variant chosen by opts.MobiType), "mobi6", "kf8"/"azw3"
+// or "joint"/"both". This allows books built from non-FB2 sources to use the
+// format writers directly.
+func WriteBook(book *opf.OEBBook, format string, opts ConvertOptions, w io.Writer) error {
+	converter := NewConverter()
+	converter.SetOptions(opts)
+	converter.fixedLayout = opts.FixedLayout
+	return converter.writeBook(book, format, w)
+}
+
+// ConvertBytes converts FB2 data in memory and returns the output in the
+// given format: "mobi" (MOBI 6), "kf8", "both" (joint MOBI 6 and KF8),
+// "epub" or "txt" (plain text). Default options are used.
+func ConvertBytes(data []byte, format string) ([]byte, error) {
+	var output bytes.Buffer
+	converter := NewConverter()
+	if err := converter.convertStream(context.Background(), bytes.NewReader(data), format, &output); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
 // ExtractMetadata extracts metadata from an FB2 file
 func ExtractMetadata(path string) (*fb2.Metadata, error) {
 	return fb2.GetMetadataFromFile(path)
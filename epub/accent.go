@@ -0,0 +1,60 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// accentSamples is the approximate number of pixels sampled along each
+// axis when looking for the dominant color
+const accentSamples = 64
+
+// accentColor returns the dominant color of an encoded image as "#rrggbb".
+// Pixels are grouped into coarse color buckets (4 bits per channel) and the
+// average of the most populated bucket is returned, which picks the main
+// color of the cover instead of the muddy average of all pixels. It
+// returns false if the image can't be decoded.
+func accentColor(data []byte) (string, bool) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", false
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return "", false
+	}
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[uint16]*bucket)
+	var best *bucket
+
+	stepX := max(bounds.Dx()/accentSamples, 1)
+	stepY := max(bounds.Dy()/accentSamples, 1)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r, g, b = r>>8, g>>8, b>>8
+			key := uint16(r>>4)<<8 | uint16(g>>4)<<4 | uint16(b>>4)
+
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += int(r)
+			bk.g += int(g)
+			bk.b += int(b)
+
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count), true
+}
@@ -0,0 +1,76 @@
+package epub
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// writeNavList writes the book's bookmarks as an NCX navList following the
+// navMap. Pages map anchors to fixed-layout pages; nil means reflowable
+// content.
+func (w *EPUBWriter) writeNavList(buf *bytes.Buffer, pages []fixedPage) {
+	if len(w.book.Bookmarks) == 0 {
+		return
+	}
+
+	buf.WriteString(`  <navList id="bookmarks">
+    <navLabel>
+      <text>Bookmarks</text>
+    </navLabel>
+`)
+	for i, bookmark := range w.book.Bookmarks {
+		playOrder := w.getNextPlayOrder()
+		buf.WriteString(fmt.Sprintf(`    <navTarget id="bookmark-%d" playOrder="%d">
+      <navLabel>
+        <text>%s</text>
+      </navLabel>
+      <content src="%s"/>
+    </navTarget>
+`, i+1, playOrder, escapeXML(bookmark.Label), escapeXML(w.bookmarkHref(bookmark.Anchor, pages))))
+	}
+	buf.WriteString(`  </navList>
+`)
+}
+
+// writeBookmarkNav writes the book's bookmarks as a custom nav element of
+// the EPUB 3 navigation document
+func (w *EPUBWriter) writeBookmarkNav(buf *bytes.Buffer, pages []fixedPage) {
+	if len(w.book.Bookmarks) == 0 {
+		return
+	}
+
+	buf.WriteString(`  <nav id="bookmarks">
+    <h2>Bookmarks</h2>
+    <ol>
+`)
+	for _, bookmark := range w.book.Bookmarks {
+		buf.WriteString(fmt.Sprintf(`      <li><a href="%s">%s</a></li>
+`, escapeXML(w.bookmarkHref(bookmark.Anchor, pages)), escapeXML(bookmark.Label)))
+	}
+	buf.WriteString(`    </ol>
+  </nav>
+`)
+}
+
+// bookmarkHref returns the link target of an anchor. In a fixed-layout book
+// it is the page showing the first image at or after the anchor.
+func (w *EPUBWriter) bookmarkHref(anchor string, pages []fixedPage) string {
+	if pages == nil {
+		return "content.xhtml#" + anchor
+	}
+
+	pos := strings.Index(w.book.Content, `id="`+anchor+`"`)
+	if pos == -1 {
+		return pages[0].Href
+	}
+	for _, m := range imgSrcRegex.FindAllStringSubmatchIndex(w.book.Content[pos:], -1) {
+		src := w.book.Content[pos+m[2] : pos+m[3]]
+		for _, page := range pages {
+			if page.Image == src {
+				return page.Href
+			}
+		}
+	}
+	return pages[len(pages)-1].Href
+}
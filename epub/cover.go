@@ -0,0 +1,57 @@
+package epub
+
+import (
+	"archive/zip"
+	"fmt"
+	"strings"
+)
+
+// coverPage is the file name of the generated cover page
+const coverPage = "cover.xhtml"
+
+// hasCover reports whether the book's cover image is in the manifest
+func (w *EPUBWriter) hasCover() bool {
+	id := w.book.Metadata.CoverID
+	if id == "" {
+		return false
+	}
+	res, ok := w.book.GetResource(id)
+	return ok && strings.HasPrefix(res.MediaType, "image/")
+}
+
+// writeCoverPage writes a page showing the cover image scaled to fit the
+// screen, so readers open the book on its cover
+func (w *EPUBWriter) writeCoverPage(zipWriter *zip.Writer) error {
+	xhtml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+%s
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+  <title>%s</title>
+  <style type="text/css">
+    html, body { margin: 0; padding: 0; height: 100%%; text-align: center; }
+    img { height: 100%%; max-width: 100%%; }
+  </style>
+</head>
+<body>
+  <div><img src="%s" alt="Cover"/></div>
+</body>
+</html>
+`, w.doctype(), escapeXML(w.book.Metadata.Title), escapeXML(w.book.Metadata.CoverID))
+	xhtml = relativizeResourceRefs(xhtml, coverPage)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/%s", w.ocfPath, coverPage))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(xhtml))
+	return err
+}
+
+// coverProperty returns the EPUB 3 manifest properties attribute marking
+// the resource id as the cover image, or "" for other resources
+func (w *EPUBWriter) coverProperty(id string) string {
+	if !w.epub3() || id != w.book.Metadata.CoverID || !w.hasCover() {
+		return ""
+	}
+	return ` properties="cover-image"`
+}
@@ -0,0 +1,261 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// imgSrcRegex matches the src attribute of img tags
+var imgSrcRegex = regexp.MustCompile(`<img\s[^>]*src="([^"]+)"`)
+
+// fixedPage is a single page of a fixed-layout book
+type fixedPage struct {
+	ID     string // Manifest item ID
+	Href   string // Page XHTML file name
+	Image  string // Image resource ID
+	Width  int
+	Height int
+}
+
+// fixedPages returns one page per distinct image, in content order
+func (w *EPUBWriter) fixedPages() []fixedPage {
+	var pages []fixedPage
+	seen := make(map[string]bool)
+
+	for _, m := range imgSrcRegex.FindAllStringSubmatch(w.book.Content, -1) {
+		src := m[1]
+		if seen[src] {
+			continue
+		}
+		width, height, ok := w.book.ImageSize(src)
+		if !ok {
+			continue
+		}
+		seen[src] = true
+
+		n := len(pages) + 1
+		pages = append(pages, fixedPage{
+			ID:     fmt.Sprintf("page-%d", n),
+			Href:   fmt.Sprintf("page-%04d.xhtml", n),
+			Image:  src,
+			Width:  width,
+			Height: height,
+		})
+	}
+
+	return pages
+}
+
+// writeFixedLayout writes the package files of a pre-paginated EPUB 3 book
+func (w *EPUBWriter) writeFixedLayout(zipWriter *zip.Writer) error {
+	pages := w.fixedPages()
+	if len(pages) == 0 {
+		return fmt.Errorf("fixed layout requires at least one decodable image")
+	}
+
+	if err := w.writeFixedOPF(zipWriter, pages); err != nil {
+		return fmt.Errorf("failed to write content.opf: %w", err)
+	}
+
+	if err := w.writeFixedNCX(zipWriter, pages); err != nil {
+		return fmt.Errorf("failed to write toc.ncx: %w", err)
+	}
+
+	if err := w.writeFixedNav(zipWriter, pages); err != nil {
+		return fmt.Errorf("failed to write nav.xhtml: %w", err)
+	}
+
+	for i, page := range pages {
+		if err := w.writeFixedPage(zipWriter, page, i+1); err != nil {
+			return fmt.Errorf("failed to write %s: %w", page.Href, err)
+		}
+	}
+
+	if err := w.writeResources(zipWriter); err != nil {
+		return fmt.Errorf("failed to write resources: %w", err)
+	}
+
+	return nil
+}
+
+// writeModified writes the dcterms:modified meta of an EPUB 3 package
+func (w *EPUBWriter) writeModified(buf *bytes.Buffer) {
+	modified := time.Now().UTC()
+	if w.options.Deterministic {
+		modified = time.Unix(0, 0).UTC()
+	}
+
+	buf.WriteString(fmt.Sprintf(`    <meta property="dcterms:modified">%s</meta>
+`, modified.Format("2006-01-02T15:04:05Z")))
+}
+
+// writeFixedLayoutMetadata writes the EPUB 3 rendition properties
+func (w *EPUBWriter) writeFixedLayoutMetadata(buf *bytes.Buffer) {
+	buf.WriteString(`    <meta property="rendition:layout">pre-paginated</meta>
+    <meta property="rendition:orientation">auto</meta>
+    <meta property="rendition:spread">auto</meta>
+`)
+}
+
+// writeFixedOPF writes content.opf for a fixed-layout book
+func (w *EPUBWriter) writeFixedOPF(zipWriter *zip.Writer, pages []fixedPage) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="bookid">
+`)
+
+	// Metadata
+	w.writeMetadata(&buf)
+
+	// Manifest
+	buf.WriteString(`  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+`)
+	for _, page := range pages {
+		buf.WriteString(fmt.Sprintf(`    <item id="%s" href="%s" media-type="application/xhtml+xml"/>
+`, page.ID, page.Href))
+	}
+	for _, id := range w.book.GetManifestIDs() {
+		res, ok := w.book.GetResource(id)
+		if !ok {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf(`    <item id="res-%s" href="%s" media-type="%s"%s/>
+`, id, id, res.MediaType, w.coverProperty(id)))
+	}
+	buf.WriteString(`  </manifest>
+`)
+
+	// Spine
+	buf.WriteString(fmt.Sprintf(`  <spine toc="ncx"%s>
+`, w.spineDirection()))
+	for _, page := range pages {
+		buf.WriteString(fmt.Sprintf(`    <itemref idref="%s"/>
+`, page.ID))
+	}
+	buf.WriteString(`  </spine>
+</package>
+`)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/content.opf", w.ocfPath))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(writer)
+	return err
+}
+
+// writeFixedNCX writes toc.ncx with one entry per page
+func (w *EPUBWriter) writeFixedNCX(zipWriter *zip.Writer, pages []fixedPage) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <head>
+    <meta name="dtb:uid" content="`)
+	buf.WriteString(w.bookID)
+	buf.WriteString(fmt.Sprintf(`"/>
+    <meta name="dtb:depth" content="1"/>
+    <meta name="dtb:totalPageCount" content="%d"/>
+    <meta name="dtb:maxPageNumber" content="%d"/>
+  </head>
+  <docTitle>
+    <text>%s</text>
+  </docTitle>
+  <navMap>
+`, len(pages), len(pages), escapeXML(w.book.Metadata.Title)))
+
+	for i, page := range pages {
+		buf.WriteString(fmt.Sprintf(`    <navPoint id="navPoint-%d" playOrder="%d">
+      <navLabel>
+        <text>Page %d</text>
+      </navLabel>
+      <content src="%s"/>
+    </navPoint>
+`, i+1, i+1, i+1, page.Href))
+	}
+
+	buf.WriteString(`  </navMap>
+`)
+	w.playOrder = len(pages)
+	w.writeNavList(&buf, pages)
+	buf.WriteString(`</ncx>
+`)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/toc.ncx", w.ocfPath))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(writer)
+	return err
+}
+
+// writeFixedNav writes the EPUB 3 navigation document
+func (w *EPUBWriter) writeFixedNav(zipWriter *zip.Writer, pages []fixedPage) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+  <title>%s</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <ol>
+`, escapeXML(w.book.Metadata.Title)))
+
+	for i, page := range pages {
+		buf.WriteString(fmt.Sprintf(`      <li><a href="%s">Page %d</a></li>
+`, page.Href, i+1))
+	}
+
+	buf.WriteString(`    </ol>
+  </nav>
+`)
+	w.writeBookmarkNav(&buf, pages)
+	buf.WriteString(`</body>
+</html>
+`)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/nav.xhtml", w.ocfPath))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(writer)
+	return err
+}
+
+// writeFixedPage writes a single page whose viewport matches its image
+func (w *EPUBWriter) writeFixedPage(zipWriter *zip.Writer, page fixedPage, number int) error {
+	xhtml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+  <title>%s - %d</title>
+  <meta name="viewport" content="width=%d, height=%d"/>
+  <style type="text/css">
+    html, body { margin: 0; padding: 0; width: %dpx; height: %dpx; }
+    img { display: block; width: 100%%; height: 100%%; }
+  </style>
+</head>
+<body>
+  <img src="%s" alt=""/>
+</body>
+</html>
+`, escapeXML(w.book.Metadata.Title), number, page.Width, page.Height,
+		page.Width, page.Height, escapeXML(page.Image))
+	xhtml = relativizeResourceRefs(xhtml, page.Href)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/%s", w.ocfPath, page.Href))
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(xhtml))
+	return err
+}
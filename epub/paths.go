@@ -0,0 +1,57 @@
+package epub
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// resourceRefRegex matches attributes that reference publication resources
+var resourceRefRegex = regexp.MustCompile(`(\s(?:src|xlink:href|poster)=")([^"]+)(")`)
+
+// relativeHref returns the href of target as seen from the document at
+// from. Both are paths inside the OCF content directory.
+func relativeHref(from, target string) string {
+	fromDir := strings.Split(path.Dir(from), "/")
+	if fromDir[0] == "." {
+		fromDir = nil
+	}
+	parts := strings.Split(target, "/")
+
+	common := 0
+	for common < len(fromDir) && common < len(parts)-1 && fromDir[common] == parts[common] {
+		common++
+	}
+
+	rel := make([]string, 0, len(fromDir)-common+len(parts)-common)
+	for range fromDir[common:] {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, parts[common:]...)
+	return strings.Join(rel, "/")
+}
+
+// relativizeResourceRefs rewrites resource references in a content
+// document so they resolve from its location. Content is generated with
+// references relative to the content directory root (e.g.
+// "images/map.png"), which only holds for documents stored at the root.
+// External URLs, data URIs and same-document fragments are left as is.
+func relativizeResourceRefs(xhtml, docPath string) string {
+	if path.Dir(docPath) == "." {
+		return xhtml
+	}
+	return resourceRefRegex.ReplaceAllStringFunc(xhtml, func(m string) string {
+		parts := resourceRefRegex.FindStringSubmatch(m)
+		ref := parts[2]
+		if strings.HasPrefix(ref, "#") || strings.Contains(ref, ":") {
+			return m
+		}
+		target, fragment, _ := strings.Cut(ref, "#")
+		target = path.Clean(strings.TrimPrefix(target, "/"))
+		rewritten := relativeHref(docPath, target)
+		if fragment != "" {
+			rewritten += "#" + fragment
+		}
+		return parts[1] + rewritten + parts[3]
+	})
+}
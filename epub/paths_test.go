@@ -0,0 +1,57 @@
+package epub
+
+import "testing"
+
+func TestRelativizeResourceRefs(t *testing.T) {
+	tests := []struct {
+		name    string
+		docPath string
+		html    string
+		want    string
+	}{
+		{
+			"root document is unchanged",
+			"content.xhtml",
+			`<img src="images/map.png"/>`,
+			`<img src="images/map.png"/>`,
+		},
+		{
+			"chapter in a subfolder",
+			"text/ch01.xhtml",
+			`<p><img src="images/map.png" alt=""/></p>`,
+			`<p><img src="../images/map.png" alt=""/></p>`,
+		},
+		{
+			"root-relative reference",
+			"text/part1/ch01.xhtml",
+			`<img src="/images/map.png"/>`,
+			`<img src="../../images/map.png"/>`,
+		},
+		{
+			"shared directory prefix",
+			"text/ch01.xhtml",
+			`<image xlink:href="text/figures/f1.svg"/>`,
+			`<image xlink:href="figures/f1.svg"/>`,
+		},
+		{
+			"fragment is kept",
+			"text/ch01.xhtml",
+			`<img src="images/sprite.svg#icon"/>`,
+			`<img src="../images/sprite.svg#icon"/>`,
+		},
+		{
+			"external and inline references are left alone",
+			"text/ch01.xhtml",
+			`<img src="https://example.org/a.png"/><img src="data:image/png;base64,AAAA"/>`,
+			`<img src="https://example.org/a.png"/><img src="data:image/png;base64,AAAA"/>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := relativizeResourceRefs(tt.html, tt.docPath); got != tt.want {
+				t.Errorf("relativizeResourceRefs() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Validator validates EPUB file structure
+type Validator struct {
+	data     []byte
+	entries  []*zip.File
+	files    map[string]*zip.File // Entries by name
+	errors   []string
+	warnings []string
+}
+
+// NewValidator creates a new EPUB validator for the bytes of an EPUB file
+func NewValidator(data []byte) *Validator {
+	return &Validator{
+		data:     data,
+		errors:   make([]string, 0),
+		warnings: make([]string, 0),
+	}
+}
+
+// opfPackage is the part of content.opf the validator checks
+type opfPackage struct {
+	Manifest []struct {
+		ID        string `xml:"id,attr"`
+		Href      string `xml:"href,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC      string `xml:"toc,attr"`
+		ItemRefs []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// Validate performs all validation checks
+func (v *Validator) Validate() bool {
+	v.errors = make([]string, 0)
+	v.warnings = make([]string, 0)
+
+	zr, err := zip.NewReader(bytes.NewReader(v.data), int64(len(v.data)))
+	if err != nil {
+		v.addError(fmt.Sprintf("Not a ZIP archive: %v", err))
+		return false
+	}
+	v.entries = zr.File
+	v.files = make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		v.files[f.Name] = f
+	}
+
+	v.validateMimetype()
+	if opfPath := v.validateContainer(); opfPath != "" {
+		v.validatePackage(opfPath)
+	}
+
+	return len(v.errors) == 0
+}
+
+// validateMimetype checks that the archive starts with a stored mimetype
+// entry, which readers use to identify the file
+func (v *Validator) validateMimetype() {
+	if len(v.entries) == 0 || v.entries[0].Name != "mimetype" {
+		v.addError("First archive entry is not mimetype")
+		return
+	}
+	if v.entries[0].Method != zip.Store {
+		v.addError("mimetype entry is compressed")
+	}
+	if data, err := v.read("mimetype"); err != nil || string(data) != "application/epub+zip" {
+		v.addError(fmt.Sprintf("mimetype is %q, not application/epub+zip", data))
+	}
+}
+
+// validateContainer checks META-INF/container.xml and returns the path of
+// the OPF it points at, or "" if there is none
+func (v *Validator) validateContainer() string {
+	data, err := v.read("META-INF/container.xml")
+	if err != nil {
+		v.addError("Missing META-INF/container.xml")
+		return ""
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(data, &container); err != nil {
+		v.addError(fmt.Sprintf("Malformed container.xml: %v", err))
+		return ""
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		v.addError("container.xml has no rootfile")
+		return ""
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	if _, ok := v.files[opfPath]; !ok {
+		v.addError(fmt.Sprintf("container.xml points at missing package %s", opfPath))
+		return ""
+	}
+	return opfPath
+}
+
+// validatePackage checks that the spine and the manifest of the OPF refer
+// to items and files that exist, then checks the NCX
+func (v *Validator) validatePackage(opfPath string) {
+	data, _ := v.read(opfPath)
+	var pkg opfPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		v.addError(fmt.Sprintf("Malformed %s: %v", opfPath, err))
+		return
+	}
+
+	dir := path.Dir(opfPath)
+	hrefs := make(map[string]string) // Manifest id -> archive path
+	listed := make(map[string]bool)  // Archive paths in the manifest
+	for _, item := range pkg.Manifest {
+		if _, dup := hrefs[item.ID]; dup {
+			v.addError(fmt.Sprintf("Duplicate manifest id %q", item.ID))
+		}
+		name, ok := v.resolve(dir, item.Href)
+		if !ok {
+			v.addError(fmt.Sprintf("Manifest item %q refers to missing file %s", item.ID, item.Href))
+		}
+		hrefs[item.ID] = name
+		listed[name] = true
+	}
+
+	if len(pkg.Spine.ItemRefs) == 0 {
+		v.addError("Spine is empty")
+	}
+	for _, ref := range pkg.Spine.ItemRefs {
+		if _, ok := hrefs[ref.IDRef]; !ok {
+			v.addError(fmt.Sprintf("Spine itemref %q is not in the manifest", ref.IDRef))
+		}
+	}
+
+	for _, f := range v.entries {
+		name := f.Name
+		if name != "mimetype" && name != opfPath && !strings.HasPrefix(name, "META-INF/") && !strings.HasSuffix(name, "/") && !listed[name] {
+			v.addWarning(fmt.Sprintf("File %s is not in the manifest", name))
+		}
+	}
+
+	if pkg.Spine.TOC == "" {
+		return
+	}
+	ncxPath, ok := hrefs[pkg.Spine.TOC]
+	if !ok {
+		v.addError(fmt.Sprintf("Spine toc %q is not in the manifest", pkg.Spine.TOC))
+		return
+	}
+	v.validateNCX(ncxPath)
+}
+
+// idAttrRegex matches the value of an id attribute
+var idAttrRegex = regexp.MustCompile(`\sid=["']([^"']+)["']`)
+
+// validateNCX checks that every navigation point of the NCX leads to a
+// file in the archive and, for links to a fragment, to an element with
+// that id
+func (v *Validator) validateNCX(ncxPath string) {
+	data, err := v.read(ncxPath)
+	if err != nil {
+		return // Reported as a missing manifest file
+	}
+
+	ids := make(map[string]map[string]bool) // Archive path -> ids in it
+	dir := path.Dir(ncxPath)
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			v.addError(fmt.Sprintf("Malformed %s: %v", ncxPath, err))
+			return
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "content" {
+			continue
+		}
+
+		var src string
+		for _, a := range start.Attr {
+			if a.Name.Local == "src" {
+				src = a.Value
+			}
+		}
+		file, fragment, _ := strings.Cut(src, "#")
+		name, ok := v.resolve(dir, file)
+		if !ok {
+			v.addError(fmt.Sprintf("NCX entry points at missing file %s", src))
+			continue
+		}
+		if fragment == "" {
+			continue
+		}
+		if ids[name] == nil {
+			ids[name] = make(map[string]bool)
+			content, _ := v.read(name)
+			for _, m := range idAttrRegex.FindAllSubmatch(content, -1) {
+				ids[name][string(m[1])] = true
+			}
+		}
+		if !ids[name][fragment] {
+			v.addWarning(fmt.Sprintf("NCX entry points at missing anchor %s", src))
+		}
+	}
+}
+
+// resolve returns the archive path of an href relative to dir and whether
+// the archive has that file
+func (v *Validator) resolve(dir, href string) (string, bool) {
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	name := path.Join(dir, href)
+	_, ok := v.files[name]
+	return name, ok
+}
+
+// read returns the contents of an archive file
+func (v *Validator) read(name string) ([]byte, error) {
+	f, ok := v.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// addError adds an error
+func (v *Validator) addError(msg string) {
+	v.errors = append(v.errors, msg)
+}
+
+// addWarning adds a warning
+func (v *Validator) addWarning(msg string) {
+	v.warnings = append(v.warnings, msg)
+}
+
+// Errors returns all errors
+func (v *Validator) Errors() []string {
+	return v.errors
+}
+
+// Warnings returns all warnings
+func (v *Validator) Warnings() []string {
+	return v.warnings
+}
+
+// HasErrors returns true if there are errors
+func (v *Validator) HasErrors() bool {
+	return len(v.errors) > 0
+}
+
+// HasWarnings returns true if there are warnings
+func (v *Validator) HasWarnings() bool {
+	return len(v.warnings) > 0
+}
+
+// String returns a formatted validation report
+func (v *Validator) String() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("EPUB Validation Report\n")
+	buf.WriteString("======================\n\n")
+
+	if len(v.errors) == 0 && len(v.warnings) == 0 {
+		buf.WriteString("✓ File is valid\n")
+		return buf.String()
+	}
+
+	if len(v.errors) > 0 {
+		buf.WriteString("Errors:\n")
+		for _, err := range v.errors {
+			buf.WriteString(fmt.Sprintf("  ✗ %s\n", err))
+		}
+		buf.WriteString("\n")
+	}
+
+	if len(v.warnings) > 0 {
+		buf.WriteString("Warnings:\n")
+		for _, warn := range v.warnings {
+			buf.WriteString(fmt.Sprintf("  ⚠ %s\n", warn))
+		}
+	}
+
+	if len(v.errors) > 0 {
+		buf.WriteString("\n✗ File is NOT valid\n")
+	} else {
+		buf.WriteString("\n✓ File is valid (with warnings)\n")
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,188 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/htol/fb2c/opf"
+)
+
+// createTestEPUB writes a small EPUB with a chapter in the TOC and an image
+func createTestEPUB(t *testing.T) []byte {
+	t.Helper()
+	book := opf.NewOEBBook()
+	book.Metadata.Title = "Valid Book"
+	book.Metadata.Language = "en"
+	book.Content = `<html><body><h1 id="ch1">Chapter</h1><p>Text</p><img src="pic.png"/></body></html>`
+	book.TOC.AddChild("ch1", "Chapter", "#ch1")
+	book.AddResource("pic.png", "pic.png", "image/png", []byte("png"))
+
+	var buf bytes.Buffer
+	if err := ConvertOEBToEPUB(book, &buf); err != nil {
+		t.Fatalf("ConvertOEBToEPUB() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// rewriteEPUB copies an EPUB through edit, which returns the new contents
+// of each entry and whether to keep it. Entries are stored uncompressed
+// unless deflate is set.
+func rewriteEPUB(t *testing.T, data []byte, deflate bool, edit func(name string, content []byte) ([]byte, bool)) []byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content bytes.Buffer
+		content.ReadFrom(rc)
+		rc.Close()
+
+		newContent, keep := edit(f.Name, content.Bytes())
+		if !keep {
+			continue
+		}
+		method := zip.Store
+		if deflate {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(newContent)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestValidateValidEPUB(t *testing.T) {
+	validator := NewValidator(createTestEPUB(t))
+	if !validator.Validate() || validator.HasWarnings() {
+		t.Errorf("Valid EPUB failed validation:\n%s", validator.String())
+	}
+}
+
+func TestValidateBrokenEPUB(t *testing.T) {
+	replace := func(file, old, new string) func(string, []byte) ([]byte, bool) {
+		return func(name string, content []byte) ([]byte, bool) {
+			if name == file {
+				content = []byte(strings.ReplaceAll(string(content), old, new))
+			}
+			return content, true
+		}
+	}
+	keep := func(name string, content []byte) ([]byte, bool) {
+		return content, true
+	}
+	drop := func(file string) func(string, []byte) ([]byte, bool) {
+		return func(name string, content []byte) ([]byte, bool) {
+			return content, name != file
+		}
+	}
+
+	tests := []struct {
+		name        string
+		deflate     bool
+		edit        func(string, []byte) ([]byte, bool)
+		wantError   string
+		wantWarning string
+	}{
+		{
+			name:      "compressed mimetype",
+			deflate:   true,
+			edit:      keep,
+			wantError: "mimetype entry is compressed",
+		},
+		{
+			name:      "no mimetype",
+			edit:      drop("mimetype"),
+			wantError: "First archive entry is not mimetype",
+		},
+		{
+			name:      "no container",
+			edit:      drop("META-INF/container.xml"),
+			wantError: "Missing META-INF/container.xml",
+		},
+		{
+			name:      "container points at missing OPF",
+			edit:      replace("META-INF/container.xml", "OEBPS/content.opf", "OEBPS/book.opf"),
+			wantError: "container.xml points at missing package OEBPS/book.opf",
+		},
+		{
+			name:      "malformed OPF",
+			edit:      replace("OEBPS/content.opf", "</manifest>", ""),
+			wantError: "Malformed OEBPS/content.opf",
+		},
+		{
+			name:      "spine item not in manifest",
+			edit:      replace("OEBPS/content.opf", `<itemref idref="content"/>`, `<itemref idref="chapter"/>`),
+			wantError: `Spine itemref "chapter" is not in the manifest`,
+		},
+		{
+			name:      "manifest file missing",
+			edit:      drop("OEBPS/pic.png"),
+			wantError: `Manifest item "res-pic.png" refers to missing file pic.png`,
+		},
+		{
+			name:      "NCX points at missing file",
+			edit:      replace("OEBPS/toc.ncx", `src="content.xhtml#`, `src="chapter.xhtml#`),
+			wantError: "NCX entry points at missing file chapter.xhtml#",
+		},
+		{
+			name:        "NCX points at missing anchor",
+			edit:        replace("OEBPS/toc.ncx", `src="content.xhtml#`, `src="content.xhtml#x`),
+			wantWarning: "NCX entry points at missing anchor content.xhtml#x",
+		},
+		{
+			name:        "file not in manifest",
+			edit:        replace("OEBPS/content.opf", `<item id="res-pic.png" href="pic.png" media-type="image/png"/>`, ""),
+			wantWarning: "File OEBPS/pic.png is not in the manifest",
+		},
+	}
+
+	good := createTestEPUB(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(rewriteEPUB(t, good, tt.deflate, tt.edit))
+			valid := validator.Validate()
+
+			if tt.wantError != "" {
+				if valid || !hasMessage(validator.Errors(), tt.wantError) {
+					t.Errorf("Errors() = %q, want one starting with %q", validator.Errors(), tt.wantError)
+				}
+			} else if !valid {
+				t.Errorf("Validate() = false: %q", validator.Errors())
+			}
+			if tt.wantWarning != "" && !hasMessage(validator.Warnings(), tt.wantWarning) {
+				t.Errorf("Warnings() = %q, want one starting with %q", validator.Warnings(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestValidateNotZip(t *testing.T) {
+	validator := NewValidator([]byte("not an epub"))
+	if validator.Validate() || !validator.HasErrors() {
+		t.Error("Should have error for a file that isn't a ZIP archive")
+	}
+}
+
+// hasMessage reports whether one of msgs starts with prefix
+func hasMessage(msgs []string, prefix string) bool {
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
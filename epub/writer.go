@@ -5,10 +5,12 @@ import (
 	"archive/zip"
 	"bytes"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/htol/fb2c/opf"
@@ -17,6 +19,19 @@ import (
 // Regex to match id attributes: id="value" or id='value'
 var idRegex = regexp.MustCompile(`id=["']([^"']+)["']`)
 
+// WriteOptions contains options for writing EPUB files
+type WriteOptions struct {
+	Deterministic bool // Derive the book identifier from the book instead of a random UUID
+	FixedLayout   bool // Write an EPUB 3 pre-paginated book with one page per image
+	AccentColor   bool // Emit the dominant cover color as an accent-color meta
+	EPUBVersion   int  // 3 writes an EPUB 3 package with a nav document; otherwise EPUB 2
+}
+
+// DefaultWriteOptions returns default write options
+func DefaultWriteOptions() WriteOptions {
+	return WriteOptions{}
+}
+
 // EPUBWriter writes EPUB files
 type EPUBWriter struct {
 	book       *opf.OEBBook
@@ -24,15 +39,28 @@ type EPUBWriter struct {
 	uuid       string
 	ocfPath    string // Default: OEBPS
 	tocFragments []string // Fragment IDs generated for TOC entries
+	playOrder  int
+	options    WriteOptions
 }
 
 // NewEPUBWriter creates a new EPUB writer
 func NewEPUBWriter(book *opf.OEBBook) *EPUBWriter {
+	bookID := bookIdentifier(book, false)
 	return &EPUBWriter{
 		book:    book,
-		bookID:  generateUUID(),
-		uuid:    generateUUID(),
+		bookID:  bookID,
+		uuid:    bookID,
 		ocfPath: "OEBPS",
+		options: DefaultWriteOptions(),
+	}
+}
+
+// SetOptions sets write options
+func (w *EPUBWriter) SetOptions(options WriteOptions) {
+	w.options = options
+	if options.Deterministic {
+		w.bookID = bookIdentifier(w.book, true)
+		w.uuid = w.bookID
 	}
 }
 
@@ -52,6 +80,10 @@ func (w *EPUBWriter) Write(output io.Writer) error {
 		return fmt.Errorf("failed to write container.xml: %w", err)
 	}
 
+	if w.options.FixedLayout {
+		return w.writeFixedLayout(zipWriter)
+	}
+
 	// 3. Write content.opf
 	if err := w.writeOPF(zipWriter); err != nil {
 		return fmt.Errorf("failed to write content.opf: %w", err)
@@ -62,12 +94,24 @@ func (w *EPUBWriter) Write(output io.Writer) error {
 		return fmt.Errorf("failed to write toc.ncx: %w", err)
 	}
 
-	// 5. Write content XHTML
+	// 5. Write nav.xhtml (EPUB 3)
+	if w.epub3() {
+		if err := w.writeNav(zipWriter); err != nil {
+			return fmt.Errorf("failed to write nav.xhtml: %w", err)
+		}
+	}
+
+	// 6. Write the cover page and content XHTML
+	if w.hasCover() {
+		if err := w.writeCoverPage(zipWriter); err != nil {
+			return fmt.Errorf("failed to write %s: %w", coverPage, err)
+		}
+	}
 	if err := w.writeContent(zipWriter); err != nil {
 		return fmt.Errorf("failed to write content.xhtml: %w", err)
 	}
 
-	// 6. Write resources (images, etc.)
+	// 7. Write resources (images, etc.)
 	if err := w.writeResources(zipWriter); err != nil {
 		return fmt.Errorf("failed to write resources: %w", err)
 	}
@@ -111,10 +155,14 @@ func (w *EPUBWriter) writeContainer(zipWriter *zip.Writer) error {
 func (w *EPUBWriter) writeOPF(zipWriter *zip.Writer) error {
 	var buf bytes.Buffer
 
-	// Header - use EPUB 2.0 for simpler compatibility
-	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
-<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="bookid">
-`)
+	// Header - EPUB 2.0 unless EPUB 3 was asked for
+	version := "2.0"
+	if w.epub3() {
+		version = "3.0"
+	}
+	buf.WriteString(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="%s" unique-identifier="bookid">
+`, version))
 
 	// Metadata
 	w.writeMetadata(&buf)
@@ -125,6 +173,9 @@ func (w *EPUBWriter) writeOPF(zipWriter *zip.Writer) error {
 	// Spine
 	w.writeSpine(&buf)
 
+	// Guide
+	w.writeGuide(&buf)
+
 	// Footer
 	buf.WriteString(`</package>
 `)
@@ -141,7 +192,7 @@ func (w *EPUBWriter) writeOPF(zipWriter *zip.Writer) error {
 func (w *EPUBWriter) writeMetadata(buf *bytes.Buffer) {
 	m := w.book.Metadata
 
-	buf.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+	buf.WriteString(`  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
 `)
 
 	// Identifier (required)
@@ -154,10 +205,42 @@ func (w *EPUBWriter) writeMetadata(buf *bytes.Buffer) {
 `, escapeXML(m.Title)))
 	}
 
-	// Authors
-	for _, author := range m.Authors {
-		buf.WriteString(fmt.Sprintf(`    <dc:creator>%s</dc:creator>
-`, escapeXML(author.FullName)))
+	// Authors, with the name they are filed under. EPUB 3 replaced the
+	// opf:file-as attribute with a refining meta.
+	for i, author := range m.Authors {
+		sortName := author.SortName
+		if sortName == "" {
+			sortName = author.FullName
+		}
+		role := author.Role
+		if role == "" {
+			role = "aut"
+		}
+		if w.epub3() {
+			buf.WriteString(fmt.Sprintf(`    <dc:creator id="creator%d">%s</dc:creator>
+    <meta refines="#creator%d" property="file-as">%s</meta>
+`, i+1, escapeXML(author.FullName), i+1, escapeXML(sortName)))
+		} else {
+			buf.WriteString(fmt.Sprintf(`    <dc:creator opf:role="%s" opf:file-as="%s">%s</dc:creator>
+`, role, escapeXML(sortName), escapeXML(author.FullName)))
+		}
+	}
+
+	// Translators, as contributors
+	for i, translator := range m.Translator {
+		sortName := translator.SortName
+		if sortName == "" {
+			sortName = translator.FullName
+		}
+		if w.epub3() {
+			buf.WriteString(fmt.Sprintf(`    <dc:contributor id="contributor%d">%s</dc:contributor>
+    <meta refines="#contributor%d" property="role" scheme="marc:relators">trl</meta>
+    <meta refines="#contributor%d" property="file-as">%s</meta>
+`, i+1, escapeXML(translator.FullName), i+1, i+1, escapeXML(sortName)))
+		} else {
+			buf.WriteString(fmt.Sprintf(`    <dc:contributor opf:role="trl" opf:file-as="%s">%s</dc:contributor>
+`, escapeXML(sortName), escapeXML(translator.FullName)))
+		}
 	}
 
 	// Publisher
@@ -190,8 +273,50 @@ func (w *EPUBWriter) writeMetadata(buf *bytes.Buffer) {
 `, escapeXML(m.Language)))
 	}
 
-	// Annotation (description)
-	if m.Annotation != "" {
+	// Subjects: genres, then keywords, each once whatever its case
+	seen := make(map[string]bool)
+	for _, subject := range append(slices.Clone(m.Genres), m.Keywords...) {
+		key := strings.ToLower(strings.TrimSpace(subject))
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		buf.WriteString(fmt.Sprintf(`    <dc:subject>%s</dc:subject>
+`, escapeXML(strings.TrimSpace(subject))))
+	}
+
+	// Provenance
+	for _, source := range m.Sources {
+		buf.WriteString(fmt.Sprintf(`    <dc:source>%s</dc:source>
+`, escapeXML(source)))
+	}
+
+	if m.SourceOCR != "" {
+		buf.WriteString(fmt.Sprintf(`    <meta name="fb2:src-ocr" content="%s"/>
+`, escapeXML(m.SourceOCR)))
+	}
+
+	// Series and author sort for calibre, KOReader and other readers that
+	// know calibre's metadata
+	w.writeSeries(buf)
+	if len(m.Authors) > 0 {
+		sortNames := make([]string, len(m.Authors))
+		for i, author := range m.Authors {
+			sortNames[i] = author.SortName
+			if sortNames[i] == "" {
+				sortNames[i] = author.FullName
+			}
+		}
+		buf.WriteString(fmt.Sprintf(`    <meta name="calibre:author_sort" content="%s"/>
+`, escapeXML(strings.Join(sortNames, " & "))))
+	}
+
+	// Annotation (description). EPUB 3 readers render an XHTML
+	// description, so it keeps its paragraphs and emphasis there.
+	if w.epub3() && m.AnnotationHTML != "" {
+		buf.WriteString(fmt.Sprintf(`    <dc:description>%s</dc:description>
+`, escapeXML(strings.TrimSpace(m.AnnotationHTML))))
+	} else if m.Annotation != "" {
 		buf.WriteString(`    <dc:description>
 `)
 		// Indent each line of annotation
@@ -203,17 +328,73 @@ func (w *EPUBWriter) writeMetadata(buf *bytes.Buffer) {
 `)
 	}
 
-	// Cover
-	if m.CoverID != "" {
-		coverID := "cover-" + m.CoverID
-		buf.WriteString(fmt.Sprintf(`    <meta name="cover" content="%s"/>
-`, coverID))
+	// Cover, referring to the manifest item of the cover image
+	if w.hasCover() {
+		buf.WriteString(fmt.Sprintf(`    <meta name="cover" content="res-%s"/>
+`, escapeXML(m.CoverID)))
+	}
+
+	// Accent color sampled from the cover, for readers that theme around it
+	if w.options.AccentColor && len(m.Cover) > 0 {
+		if color, ok := accentColor(m.Cover); ok {
+			buf.WriteString(fmt.Sprintf(`    <meta name="accent-color" content="%s"/>
+`, color))
+		}
+	}
+
+	// Last modification date (required by EPUB 3)
+	if w.epub3() {
+		w.writeModified(buf)
+	}
+
+	// Fixed-layout rendition properties (EPUB 3)
+	if w.options.FixedLayout {
+		w.writeFixedLayoutMetadata(buf)
 	}
 
 	buf.WriteString(`  </metadata>
 `)
 }
 
+// writeSeries writes the series of the book. calibre keeps a single
+// series; further ones keep their FB2 name, as in the OPF of MOBI books.
+// EPUB 3 collections list every series.
+func (w *EPUBWriter) writeSeries(buf *bytes.Buffer) {
+	m := w.book.Metadata
+	if m.Series == "" {
+		return
+	}
+
+	buf.WriteString(fmt.Sprintf(`    <meta name="calibre:series" content="%s"/>
+`, escapeXML(m.Series)))
+	if m.SeriesIndex > 0 {
+		buf.WriteString(fmt.Sprintf(`    <meta name="calibre:series_index" content="%d"/>
+`, m.SeriesIndex))
+	}
+	for _, series := range m.OtherSeries {
+		content := series.Name
+		if series.Index > 0 {
+			content += fmt.Sprintf(" (#%d)", series.Index)
+		}
+		buf.WriteString(fmt.Sprintf(`    <meta name="fb2:sequence" content="%s"/>
+`, escapeXML(content)))
+	}
+
+	if !w.epub3() {
+		return
+	}
+	all := append([]opf.SeriesInfo{{Name: m.Series, Index: m.SeriesIndex}}, m.OtherSeries...)
+	for i, series := range all {
+		buf.WriteString(fmt.Sprintf(`    <meta property="belongs-to-collection" id="collection%d">%s</meta>
+    <meta refines="#collection%d" property="collection-type">series</meta>
+`, i+1, escapeXML(series.Name), i+1))
+		if series.Index > 0 {
+			buf.WriteString(fmt.Sprintf(`    <meta refines="#collection%d" property="group-position">%d</meta>
+`, i+1, series.Index))
+		}
+	}
+}
+
 // writeManifest writes the manifest section of content.opf
 func (w *EPUBWriter) writeManifest(buf *bytes.Buffer) {
 	buf.WriteString(`  <manifest>
@@ -223,6 +404,18 @@ func (w *EPUBWriter) writeManifest(buf *bytes.Buffer) {
 	buf.WriteString(fmt.Sprintf(`    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
 `))
 
+	// Navigation document (EPUB 3)
+	if w.epub3() {
+		buf.WriteString(`    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+`)
+	}
+
+	// Cover page
+	if w.hasCover() {
+		buf.WriteString(fmt.Sprintf(`    <item id="cover" href="%s" media-type="application/xhtml+xml"/>
+`, coverPage))
+	}
+
 	// Content
 	buf.WriteString(fmt.Sprintf(`    <item id="content" href="content.xhtml" media-type="application/xhtml+xml"/>
 `))
@@ -237,8 +430,8 @@ func (w *EPUBWriter) writeManifest(buf *bytes.Buffer) {
 		// Add prefix for resource IDs
 		itemID := "res-" + id
 		href := id // Already includes subdirectory if any (e.g., Images/cover.jpg)
-		buf.WriteString(fmt.Sprintf(`    <item id="%s" href="%s" media-type="%s"/>
-`, itemID, href, res.MediaType))
+		buf.WriteString(fmt.Sprintf(`    <item id="%s" href="%s" media-type="%s"%s/>
+`, itemID, href, res.MediaType, w.coverProperty(id)))
 	}
 
 	buf.WriteString(`  </manifest>
@@ -247,23 +440,60 @@ func (w *EPUBWriter) writeManifest(buf *bytes.Buffer) {
 
 // writeSpine writes the spine section of content.opf
 func (w *EPUBWriter) writeSpine(buf *bytes.Buffer) {
-	buf.WriteString(`  <spine toc="ncx">
-`)
+	buf.WriteString(fmt.Sprintf(`  <spine toc="ncx"%s>
+`, w.spineDirection()))
 
-	// Main content
+	// Cover page first, then the main content
+	if w.hasCover() {
+		buf.WriteString(`    <itemref idref="cover"/>
+`)
+	}
 	buf.WriteString(`    <itemref idref="content"/>
 `)
 
+	// The nav document is reachable from the reader's TOC, not by paging
+	if w.epub3() {
+		buf.WriteString(`    <itemref idref="nav" linear="no"/>
+`)
+	}
+
 	buf.WriteString(`  </spine>
 `)
 }
 
+// writeGuide writes the guide section of content.opf, pointing readers at
+// the title page
+func (w *EPUBWriter) writeGuide(buf *bytes.Buffer) {
+	if w.book.TitlePage == "" {
+		return
+	}
+	buf.WriteString(fmt.Sprintf(`  <guide>
+    <reference type="title-page" title="Title Page" href="content.xhtml#%s"/>
+  </guide>
+`, escapeXML(w.book.TitlePage)))
+}
+
+// writeLandmarks writes the landmarks nav of the EPUB 3 navigation
+// document, the counterpart of the guide
+func (w *EPUBWriter) writeLandmarks(buf *bytes.Buffer) {
+	if w.book.TitlePage == "" {
+		return
+	}
+	buf.WriteString(fmt.Sprintf(`  <nav epub:type="landmarks" id="landmarks" hidden="">
+    <ol>
+      <li><a epub:type="titlepage" href="content.xhtml#%s">Title Page</a></li>
+    </ol>
+  </nav>
+`, escapeXML(w.book.TitlePage)))
+}
+
 // writeNCX writes the toc.ncx file
 func (w *EPUBWriter) writeNCX(zipWriter *zip.Writer) error {
 	var buf bytes.Buffer
 
 	// Reset and collect fragment IDs
 	w.tocFragments = nil
+	w.playOrder = 0
 
 	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
 <ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
@@ -290,7 +520,9 @@ func (w *EPUBWriter) writeNCX(zipWriter *zip.Writer) error {
 	}
 
 	buf.WriteString(`  </navMap>
-</ncx>
+`)
+	w.writeNavList(&buf, nil)
+	buf.WriteString(`</ncx>
 `)
 
 	writer, err := zipWriter.Create(fmt.Sprintf("%s/toc.ncx", w.ocfPath))
@@ -334,11 +566,89 @@ func (w *EPUBWriter) writeTOCEntries(buf *bytes.Buffer, entry *opf.TOCEntry, dep
 `)
 }
 
-var playOrderCounter int = 0
+// writeNav writes the EPUB 3 navigation document. It links the same
+// fragments as the NCX, so it must be written after writeNCX.
+func (w *EPUBWriter) writeNav(zipWriter *zip.Writer) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+  <title>%s</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+`, escapeXML(w.book.Metadata.Title)))
+
+	next := 0
+	if slices.ContainsFunc(w.book.TOC.Children, func(e *opf.TOCEntry) bool { return e != nil }) {
+		w.writeNavEntries(&buf, w.book.TOC.Children, &next, "    ")
+	} else {
+		// The toc nav must have a list with at least one entry
+		buf.WriteString(fmt.Sprintf(`    <ol>
+      <li><a href="content.xhtml">%s</a></li>
+    </ol>
+`, escapeXML(w.navFallbackLabel())))
+	}
+
+	buf.WriteString(`  </nav>
+`)
+	w.writeBookmarkNav(&buf, nil)
+	w.writeLandmarks(&buf)
+	buf.WriteString(`</body>
+</html>
+`)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/nav.xhtml", w.ocfPath))
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(writer)
+	return err
+}
+
+// writeNavEntries writes TOC entries as a nested nav list. next indexes
+// tocFragments, which writeTOCEntries filled in the same order.
+func (w *EPUBWriter) writeNavEntries(buf *bytes.Buffer, entries []*opf.TOCEntry, next *int, indent string) {
+	buf.WriteString(indent + "<ol>\n")
+	for _, entry := range entries {
+		if entry == nil {
+			continue
+		}
+		href := "content.xhtml"
+		if *next < len(w.tocFragments) {
+			href += "#" + w.tocFragments[*next]
+		}
+		*next++
+
+		// Nav links must have text; untitled sections get the book's title
+		label := entry.Label
+		if strings.TrimSpace(label) == "" {
+			label = w.navFallbackLabel()
+		}
+		buf.WriteString(fmt.Sprintf(`%s  <li><a href="%s">%s</a>`, indent, href, escapeXML(label)))
+		if len(entry.Children) > 0 {
+			buf.WriteString("\n")
+			w.writeNavEntries(buf, entry.Children, next, indent+"    ")
+			buf.WriteString(indent + "  ")
+		}
+		buf.WriteString("</li>\n")
+	}
+	buf.WriteString(indent + "</ol>\n")
+}
+
+// navFallbackLabel returns the label of nav entries that have none
+func (w *EPUBWriter) navFallbackLabel() string {
+	if w.book.Metadata.Title != "" {
+		return w.book.Metadata.Title
+	}
+	return "Start"
+}
 
 func (w *EPUBWriter) getNextPlayOrder() int {
-	playOrderCounter++
-	return playOrderCounter
+	w.playOrder++
+	return w.playOrder
 }
 
 // rewriteDuplicateIDs finds and rewrites duplicate IDs in HTML content
@@ -397,6 +707,28 @@ func (w *EPUBWriter) rewriteDuplicateIDs(html string) string {
 	return result
 }
 
+// epub3 reports whether the book is written as an EPUB 3 package
+func (w *EPUBWriter) epub3() bool {
+	return w.options.FixedLayout || w.options.EPUBVersion == 3
+}
+
+// dirAttr returns the dir attribute of right-to-left content documents
+func (w *EPUBWriter) dirAttr() string {
+	if w.book.Metadata.Direction == "rtl" {
+		return ` dir="rtl"`
+	}
+	return ""
+}
+
+// spineDirection returns the page-progression-direction attribute of the
+// spine of a right-to-left book
+func (w *EPUBWriter) spineDirection() string {
+	if w.book.Metadata.Direction == "rtl" {
+		return ` page-progression-direction="rtl"`
+	}
+	return ""
+}
+
 // writeContent writes the main content XHTML file
 func (w *EPUBWriter) writeContent(zipWriter *zip.Writer) error {
 	content := w.book.Content
@@ -409,7 +741,10 @@ func (w *EPUBWriter) writeContent(zipWriter *zip.Writer) error {
 	// Fix any duplicate IDs in the content
 	xhtml = w.rewriteDuplicateIDs(xhtml)
 
-	writer, err := zipWriter.Create(fmt.Sprintf("%s/content.xhtml", w.ocfPath))
+	const name = "content.xhtml"
+	xhtml = relativizeResourceRefs(xhtml, name)
+
+	writer, err := zipWriter.Create(fmt.Sprintf("%s/%s", w.ocfPath, name))
 	if err != nil {
 		return err
 	}
@@ -417,61 +752,46 @@ func (w *EPUBWriter) writeContent(zipWriter *zip.Writer) error {
 	return err
 }
 
-// convertToXHTML converts HTML content to XHTML format for EPUB
+// convertToXHTML converts HTML content to XHTML format for EPUB. The body
+// of the document is re-serialized as well-formed XHTML and wrapped in an
+// XHTML 1.1 document, or an HTML5 one for EPUB 3.
 func (w *EPUBWriter) convertToXHTML(html string) string {
-	// Simple approach: wrap in XHTML with proper namespace
-	// In production, would use html/parser to extract body content
-
-	// Check if content starts with <!DOCTYPE
-	if strings.HasPrefix(html, "<!DOCTYPE") || strings.HasPrefix(html, "<html") {
-		// Extract body content
-		bodyStart := strings.Index(html, "<body")
-		if bodyStart == -1 {
-			bodyStart = strings.Index(html, "<BODY")
+	bodyContent := htmlBodyToXHTML(html)
+
+	// Build body with optional anchor navigation markers
+	bodyWithContent := bodyContent
+	if len(w.tocFragments) > 0 {
+		// Wrap anchors in a div for XHTML 1.1 compliance
+		var anchorsBuilder strings.Builder
+		anchorsBuilder.WriteString(`<div class="toc-anchors">`)
+		for _, fragID := range w.tocFragments {
+			anchorsBuilder.WriteString(fmt.Sprintf(`<span id="%s"></span>%s`, fragID, "\n"))
 		}
-		if bodyStart != -1 {
-			// Find opening >
-			bodyStart = strings.Index(html[bodyStart:], ">") + bodyStart + 1
-			bodyEnd := strings.Index(html[bodyStart:], "</body")
-			if bodyEnd == -1 {
-				bodyEnd = strings.Index(html[bodyStart:], "</BODY")
-			}
-			if bodyEnd != -1 {
-				bodyContent := html[bodyStart : bodyStart+bodyEnd]
-
-				// Build body with optional anchor navigation markers
-				bodyWithContent := bodyContent
-				if len(w.tocFragments) > 0 {
-					// Wrap anchors in a div for XHTML 1.1 compliance
-					var anchorsBuilder strings.Builder
-					anchorsBuilder.WriteString(`<div class="toc-anchors">`)
-					for _, fragID := range w.tocFragments {
-						anchorsBuilder.WriteString(fmt.Sprintf(`<span id="%s"></span>%s`, fragID, "\n"))
-					}
-					anchorsBuilder.WriteString(`</div>`)
-					bodyWithContent = anchorsBuilder.String() + "\n" + bodyContent
-				}
-
-				// Wrap in XHTML
-				return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
-<html xmlns="http://www.w3.org/1999/xhtml">
+		anchorsBuilder.WriteString(`</div>`)
+		bodyWithContent = anchorsBuilder.String() + "\n" + bodyContent
+	}
+
+	// Wrap in XHTML
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+%s
+<html xmlns="http://www.w3.org/1999/xhtml"%s>
 <head>
   <title>%s</title>
-</head>
-<body>
+%s</head>
+<body%s>
 %s
 </body>
 </html>
-`, escapeXML(w.book.Metadata.Title), bodyWithContent)
-			}
-		}
-	}
+`, w.doctype(), w.dirAttr(), escapeXML(w.book.Metadata.Title), w.stylesheetLinks(), w.dirAttr(), bodyWithContent)
+}
 
-	// Fallback: just add XML declaration
-	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
-%s
-`, html)
+// doctype returns the document type declaration of content documents:
+// XHTML 1.1 for EPUB 2, HTML5 for EPUB 3
+func (w *EPUBWriter) doctype() string {
+	if w.epub3() {
+		return "<!DOCTYPE html>"
+	}
+	return `<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN" "http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">`
 }
 
 // writeResources writes resources (images, etc.) to the EPUB
@@ -487,7 +807,10 @@ func (w *EPUBWriter) writeResources(zipWriter *zip.Writer) error {
 		// If href already has subdirectory (e.g., Images/cover.jpg), keep it
 		path := fmt.Sprintf("%s/%s", w.ocfPath, id)
 
-		writer, err := zipWriter.Create(path)
+		writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:   path,
+			Method: compressionMethod(res.MediaType),
+		})
 		if err != nil {
 			return err
 		}
@@ -497,12 +820,41 @@ func (w *EPUBWriter) writeResources(zipWriter *zip.Writer) error {
 		}
 	}
 
-	// Write CSS if we had any (placeholder for now)
-	// Could be extended to extract CSS from FB2 or use a default
-
 	return nil
 }
 
+// stylesheetLinks returns the <link> elements for the CSS resources of the
+// book, which writeResources stores with the other resources
+func (w *EPUBWriter) stylesheetLinks() string {
+	var buf strings.Builder
+	for _, id := range w.book.GetManifestIDs() {
+		res, ok := w.book.GetResource(id)
+		if !ok || res.MediaType != "text/css" {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("  <link rel=\"stylesheet\" type=\"text/css\" href=\"%s\"/>\n", escapeXML(id)))
+	}
+	return buf.String()
+}
+
+// compressionMethod returns the zip method for a resource. Images, fonts
+// and media are already compressed, so deflating them only costs time.
+func compressionMethod(mediaType string) uint16 {
+	switch {
+	case mediaType == "image/svg+xml":
+		return zip.Deflate
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "font/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "application/font-"),
+		mediaType == "application/vnd.ms-opentype":
+		return zip.Store
+	default:
+		return zip.Deflate
+	}
+}
+
 // escapeXML escapes special XML characters
 func escapeXML(s string) string {
 	s = strings.ReplaceAll(s, "&", "&amp;")
@@ -513,11 +865,15 @@ func escapeXML(s string) string {
 	return s
 }
 
+// uuidRand is the source of random UUIDs. Tests may replace it with a
+// seeded reader to get a known identifier.
+var uuidRand io.Reader = rand.Reader
+
 // generateUUID generates a random UUID for the book
 func generateUUID() string {
 	// Generate 16 random bytes
 	rnd := make([]byte, 16)
-	if _, err := rand.Read(rnd); err != nil {
+	if _, err := io.ReadFull(uuidRand, rnd); err != nil {
 		// Fallback to simple ID if random fails
 		return "urn:uuid:fb2c-book-id"
 	}
@@ -534,8 +890,78 @@ func generateUUID() string {
 		binary.BigEndian.Uint64(rnd[8:16])&0x0FFFFFFFFFFFF)
 }
 
+// uuidRegex matches a UUID, optionally in URN form
+var uuidRegex = regexp.MustCompile(`^(?i:urn:uuid:)?([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`)
+
+// bookIdentifier picks a stable identifier for the book: its FB2 document
+// id if that is a UUID, else a UUID derived from the title and authors.
+// Books with neither get a random UUID, or one derived from their content
+// if deterministic is set.
+func bookIdentifier(book *opf.OEBBook, deterministic bool) string {
+	if id := documentUUID(book); id != "" {
+		return id
+	}
+	m := book.Metadata
+	if m.Title == "" && len(m.Authors) == 0 {
+		if deterministic {
+			return bookUUID(book)
+		}
+		return generateUUID()
+	}
+	parts := []string{m.Title}
+	for _, author := range m.Authors {
+		parts = append(parts, author.FullName)
+	}
+	return nameUUID(parts...)
+}
+
+// documentUUID returns the book's FB2 document id as a URN, or "" if the
+// id is missing or not a UUID
+func documentUUID(book *opf.OEBBook) string {
+	match := uuidRegex.FindStringSubmatch(strings.TrimSpace(book.Metadata.DocumentID))
+	if match == nil {
+		return ""
+	}
+	return "urn:uuid:" + strings.ToLower(match[1])
+}
+
+// bookUUID derives a name-based UUID from the book title and content
+func bookUUID(book *opf.OEBBook) string {
+	return nameUUID(book.Metadata.Title, book.Content)
+}
+
+// nameUUID derives a version 5 (SHA-1, name-based) UUID from parts
+func nameUUID(parts ...string) string {
+	h := sha1.New()
+	for i, part := range parts {
+		if i > 0 {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(part))
+	}
+	sum := h.Sum(nil)
+
+	// Set version (5) and variant bits
+	sum[6] = (sum[6] & 0x0f) | 0x50 // Version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // Variant 1
+
+	return fmt.Sprintf("urn:uuid:%08x-%04x-%04x-%04x-%012x",
+		binary.BigEndian.Uint32(sum[0:4]),
+		binary.BigEndian.Uint16(sum[4:6]),
+		binary.BigEndian.Uint16(sum[6:8]),
+		binary.BigEndian.Uint16(sum[8:10]),
+		binary.BigEndian.Uint64(sum[8:16])&0x0FFFFFFFFFFFF)
+}
+
 // ConvertOEBToEPUB converts an OEBBook to EPUB
 func ConvertOEBToEPUB(book *opf.OEBBook, output io.Writer) error {
 	writer := NewEPUBWriter(book)
 	return writer.Write(output)
 }
+
+// ConvertOEBToEPUBWithOptions converts an OEBBook to EPUB with options
+func ConvertOEBToEPUBWithOptions(book *opf.OEBBook, output io.Writer, options WriteOptions) error {
+	writer := NewEPUBWriter(book)
+	writer.SetOptions(options)
+	return writer.Write(output)
+}
@@ -0,0 +1,84 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/htol/fb2c/opf"
+)
+
+func TestGenerateUUIDSeeded(t *testing.T) {
+	saved := uuidRand
+	t.Cleanup(func() { uuidRand = saved })
+
+	seed := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	uuidRand = bytes.NewReader(seed)
+	if got, want := generateUUID(), "urn:uuid:00010203-0405-4607-8809-0a0b0c0d0e0f"; got != want {
+		t.Errorf("generateUUID() = %s, want %s", got, want)
+	}
+}
+
+func TestWriteReproducible(t *testing.T) {
+	saved := uuidRand
+	t.Cleanup(func() { uuidRand = saved })
+
+	// A book without title or authors gets a random identifier, fixed by
+	// seeding uuidRand
+	write := func() []byte {
+		uuidRand = bytes.NewReader(make([]byte, 16))
+		book := opf.NewOEBBook()
+		book.Content = "<html><body><p>Text</p><img src=\"b.png\"/><img src=\"a.png\"/></body></html>"
+		for _, id := range []string{"c.css", "b.png", "a.png", "d.jpg"} {
+			book.AddResource(id, id, "image/png", []byte(id))
+		}
+
+		var buf bytes.Buffer
+		writer := NewEPUBWriter(book)
+		writer.SetOptions(DefaultWriteOptions())
+		if err := writer.Write(&buf); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	first := write()
+	for range 5 {
+		if !bytes.Equal(write(), first) {
+			t.Fatal("writing the same book twice gave different EPUBs")
+		}
+	}
+}
+
+func TestEPUB3NavWithoutTOC(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata.Title = "No Chapters"
+	book.Content = "<html><body><p>Text</p></body></html>"
+
+	var buf bytes.Buffer
+	writer := NewEPUBWriter(book)
+	options := DefaultWriteOptions()
+	options.EPUBVersion = 3
+	writer.SetOptions(options)
+	if err := writer.Write(&buf); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := zr.Open("OEBPS/nav.xhtml")
+	if err != nil {
+		t.Fatalf("EPUB has no nav.xhtml: %v", err)
+	}
+	defer rc.Close()
+	nav, _ := io.ReadAll(rc)
+
+	want := "<ol>\n      <li><a href=\"content.xhtml\">No Chapters</a></li>\n    </ol>"
+	if !strings.Contains(string(nav), want) {
+		t.Errorf("nav.xhtml doesn't link the content:\n%s", nav)
+	}
+}
@@ -0,0 +1,220 @@
+package epub
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// voidElements are the HTML elements that never have content. XHTML
+// writes them self-closed.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// booleanAttrs are the HTML attributes that may be written bare. XHTML
+// gives them their own name as value.
+var booleanAttrs = map[string]bool{
+	"async": true, "autofocus": true, "autoplay": true, "checked": true,
+	"compact": true, "controls": true, "declare": true, "defer": true,
+	"disabled": true, "hidden": true, "ismap": true, "loop": true,
+	"multiple": true, "muted": true, "nohref": true, "noresize": true,
+	"noshade": true, "nowrap": true, "open": true, "readonly": true,
+	"required": true, "reversed": true, "selected": true,
+}
+
+// htmlTokenType is the kind of an htmlToken
+type htmlTokenType int
+
+const (
+	textToken htmlTokenType = iota
+	startTagToken
+	endTagToken
+)
+
+// htmlToken is a piece of an HTML document. Text is unescaped, except in
+// script and style elements; tag and attribute names are lowercased.
+type htmlToken struct {
+	Type        htmlTokenType
+	Data        string // Text, or the tag name
+	Attrs       []htmlAttr
+	SelfClosing bool
+}
+
+// htmlAttr is an attribute of a start tag, with its value unescaped
+type htmlAttr struct {
+	Name  string
+	Value string
+}
+
+// tokenizeHTML splits an HTML document into text and tag tokens with the
+// HTML5 tokenizer, so it is forgiving like a browser. Comments, doctypes
+// and processing instructions are dropped.
+func tokenizeHTML(s string) []htmlToken {
+	var tokens []htmlToken
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// io.EOF, as the input is a string
+			return tokens
+		case html.TextToken:
+			tokens = append(tokens, htmlToken{Type: textToken, Data: string(z.Text())})
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			ht := htmlToken{
+				Type:        startTagToken,
+				Data:        tok.Data,
+				SelfClosing: tok.Type == html.SelfClosingTagToken,
+			}
+			for _, attr := range tok.Attr {
+				if attr.Val == "" && booleanAttrs[attr.Key] {
+					attr.Val = attr.Key
+				}
+				ht.Attrs = append(ht.Attrs, htmlAttr{Name: attr.Key, Value: attr.Val})
+			}
+			tokens = append(tokens, ht)
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			tokens = append(tokens, htmlToken{Type: endTagToken, Data: string(name)})
+		}
+	}
+}
+
+// isASCIILetter reports whether c is an ASCII letter
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// htmlBodyToXHTML returns the content of the body element of an HTML
+// document as well-formed XHTML: lowercase tags, self-closed void
+// elements, escaped text and attribute values and every element closed.
+// Stray end tags are dropped. A document without a body element is taken
+// as a fragment, leaving out its html and head elements.
+func htmlBodyToXHTML(doc string) string {
+	tokens := tokenizeHTML(doc)
+
+	hasBody := false
+	for _, tok := range tokens {
+		if tok.Type == startTagToken && tok.Data == "body" {
+			hasBody = true
+			break
+		}
+	}
+
+	var buf strings.Builder
+	var open []string // Open elements inside the body
+	inBody := !hasBody
+	inHead := false
+
+	for _, tok := range tokens {
+		switch {
+		case !hasBody && tok.Data == "html" && tok.Type != textToken:
+			continue
+		case !hasBody && tok.Data == "head" && tok.Type != textToken:
+			inHead = tok.Type == startTagToken && !tok.SelfClosing
+			continue
+		case inHead:
+			continue
+		case !inBody:
+			if tok.Type == startTagToken && tok.Data == "body" {
+				inBody = true
+			}
+			continue
+		}
+
+		switch tok.Type {
+		case textToken:
+			xmlTextEscaper.WriteString(&buf, tok.Data)
+
+		case startTagToken:
+			if tok.Data == "body" || tok.Data == "html" || tok.Data == "head" || !isXMLName(tok.Data) {
+				continue
+			}
+			buf.WriteString("<" + tok.Data)
+			seen := make(map[string]bool, len(tok.Attrs))
+			attrs := tok.Attrs
+			if tok.Data == "a" {
+				attrs = anchorAttrs(attrs)
+			}
+			for _, attr := range attrs {
+				if seen[attr.Name] || !isXMLName(attr.Name) {
+					continue
+				}
+				seen[attr.Name] = true
+				buf.WriteString(" " + attr.Name + `="` + escapeXML(attr.Value) + `"`)
+			}
+			switch {
+			case voidElements[tok.Data]:
+				buf.WriteString("/>")
+			case tok.SelfClosing:
+				buf.WriteString("></" + tok.Data + ">")
+			default:
+				buf.WriteString(">")
+				open = append(open, tok.Data)
+			}
+
+		case endTagToken:
+			if tok.Data == "body" && hasBody {
+				inBody = false
+				continue
+			}
+			// Close the element and any left open inside it
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.Data {
+					for j := len(open) - 1; j >= i; j-- {
+						buf.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+
+	return buf.String()
+}
+
+// anchorAttrs returns the attributes of an anchor with its name, which
+// HTML5 made obsolete, turned into its id, or dropped beside an id. The
+// transformer writes name anchors for MOBI readers.
+func anchorAttrs(attrs []htmlAttr) []htmlAttr {
+	hasID := slices.ContainsFunc(attrs, func(a htmlAttr) bool { return a.Name == "id" })
+	kept := make([]htmlAttr, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.Name == "name" {
+			if hasID {
+				continue
+			}
+			attr.Name = "id"
+			hasID = true
+		}
+		kept = append(kept, attr)
+	}
+	return kept
+}
+
+// xmlTextEscaper escapes text content for XML. Unlike escapeXML it leaves
+// quotes alone, which keeps text readable.
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// isXMLName reports whether a tag or attribute name is usable in XML
+func isXMLName(name string) bool {
+	if name == "" || !(isASCIILetter(name[0]) || name[0] == '_') {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !(isASCIILetter(c) || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
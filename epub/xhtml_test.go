@@ -0,0 +1,103 @@
+package epub
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHTMLBodyToXHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"body with attributes",
+			`<html><head><title>T</title></head><body class="book" dir="ltr"><p>Text</p></body></html>`,
+			`<p>Text</p>`,
+		},
+		{
+			"uppercase tags",
+			`<HTML><BODY><P ID="a">Text</P></BODY></HTML>`,
+			`<p id="a">Text</p>`,
+		},
+		{
+			"end tag in an attribute value",
+			`<html><body><p title="a </body> b">Text</p></body></html>`,
+			`<p title="a &lt;/body&gt; b">Text</p>`,
+		},
+		{
+			"end tag in a script string",
+			`<html><body><script>var s = "</body" + ">";</script><p>After</p></body></html>`,
+			`<script>var s = "&lt;/body" + "&gt;";</script><p>After</p>`,
+		},
+		{
+			"uppercase script end tag",
+			`<body><STYLE>p { color: red; }</STYLE ><p>x</p></body>`,
+			`<style>p { color: red; }</style><p>x</p>`,
+		},
+		{
+			"name anchors",
+			`<body><a name="ch1"></a><a name="x" id="y">Link</a><a href="#ch1">Back</a></body>`,
+			`<a id="ch1"></a><a id="y">Link</a><a href="#ch1">Back</a>`,
+		},
+		{
+			"void elements",
+			`<body><p>a<br>b<img src="x.png" alt=""></p><hr></body>`,
+			`<p>a<br/>b<img src="x.png" alt=""/></p><hr/>`,
+		},
+		{
+			"ampersands and entities",
+			`<body><p>Tom & Jerry &amp; friends&nbsp;<a href="?a=1&b=2">link</a></p></body>`,
+			"<p>Tom &amp; Jerry &amp; friends <a href=\"?a=1&amp;b=2\">link</a></p>",
+		},
+		{
+			"unclosed and stray tags",
+			`<body><div><p><em>open</div></span><p>last</body>`,
+			`<div><p><em>open</em></p></div><p>last</p>`,
+		},
+		{
+			"unquoted and bare attributes",
+			`<body><td colspan=2 nowrap>x</td></body>`,
+			`<td colspan="2" nowrap="nowrap">x</td>`,
+		},
+		{
+			"fragment without body",
+			`<p>One</p><p>Two</p>`,
+			`<p>One</p><p>Two</p>`,
+		},
+		{
+			"comments and doctype dropped",
+			`<!DOCTYPE html><html><body><!-- note --><p>x</p></body></html>`,
+			`<p>x</p>`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := htmlBodyToXHTML(tt.in)
+			if got != tt.want {
+				t.Errorf("htmlBodyToXHTML() = %q, want %q", got, tt.want)
+			}
+			if !wellFormed(got) {
+				t.Errorf("htmlBodyToXHTML() = %q is not well-formed XML", got)
+			}
+		})
+	}
+}
+
+// wellFormed reports whether s is a well-formed XML fragment
+func wellFormed(s string) bool {
+	d := xml.NewDecoder(strings.NewReader("<root>" + s + "</root>"))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package fb2
+
+import "strings"
+
+// Text directions
+const (
+	DirectionAuto = "auto" // From the book language (default)
+	DirectionLTR  = "ltr"  // Left to right
+	DirectionRTL  = "rtl"  // Right to left
+)
+
+// rtlLanguages are the primary language subtags of languages written right
+// to left
+var rtlLanguages = map[string]bool{
+	"ar":  true, // Arabic
+	"arc": true, // Aramaic
+	"ckb": true, // Central Kurdish
+	"dv":  true, // Divehi
+	"fa":  true, // Persian
+	"he":  true, // Hebrew
+	"iw":  true, // Hebrew (deprecated code)
+	"ji":  true, // Yiddish (deprecated code)
+	"ks":  true, // Kashmiri
+	"ps":  true, // Pashto
+	"sd":  true, // Sindhi
+	"syr": true, // Syriac
+	"ug":  true, // Uyghur
+	"ur":  true, // Urdu
+	"yi":  true, // Yiddish
+}
+
+// IsRTLLanguage reports whether a language code such as "he" or "ar-EG"
+// names a language written right to left
+func IsRTLLanguage(lang string) bool {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i != -1 {
+		lang = lang[:i]
+	}
+	return rtlLanguages[lang]
+}
+
+// ResolveDirection returns the text direction of a book, DirectionLTR or
+// DirectionRTL. An explicit direction wins; DirectionAuto or "" picks RTL
+// for right-to-left languages.
+func ResolveDirection(direction, lang string) string {
+	switch strings.ToLower(direction) {
+	case DirectionLTR:
+		return DirectionLTR
+	case DirectionRTL:
+		return DirectionRTL
+	}
+	if IsRTLLanguage(lang) {
+		return DirectionRTL
+	}
+	return DirectionLTR
+}
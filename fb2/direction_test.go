@@ -0,0 +1,25 @@
+package fb2
+
+import "testing"
+
+func TestResolveDirection(t *testing.T) {
+	tests := []struct {
+		direction string
+		lang      string
+		want      string
+	}{
+		{"", "he", DirectionRTL},
+		{"auto", "ar-EG", DirectionRTL},
+		{"", "fa_IR", DirectionRTL},
+		{"", "ru", DirectionLTR},
+		{"", "", DirectionLTR},
+		{"ltr", "he", DirectionLTR},
+		{"RTL", "en", DirectionRTL},
+	}
+
+	for _, tt := range tests {
+		if got := ResolveDirection(tt.direction, tt.lang); got != tt.want {
+			t.Errorf("ResolveDirection(%q, %q) = %q, want %q", tt.direction, tt.lang, got, tt.want)
+		}
+	}
+}
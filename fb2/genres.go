@@ -0,0 +1,162 @@
+package fb2
+
+import "strings"
+
+// genreLabels maps FB2 genre codes to English subject labels. It covers
+// the genre list of the FB2 2.1 schema and the most common extensions.
+var genreLabels = map[string]string{
+	// Science fiction and fantasy
+	"sf":                 "Science Fiction",
+	"sf_history":         "Alternative History",
+	"sf_action":          "Action Science Fiction",
+	"sf_epic":            "Epic Science Fiction",
+	"sf_heroic":          "Heroic Fantasy",
+	"sf_detective":       "Science Fiction Mystery",
+	"sf_cyberpunk":       "Cyberpunk",
+	"sf_space":           "Space Opera",
+	"sf_social":          "Social Science Fiction",
+	"sf_horror":          "Horror",
+	"sf_humor":           "Humorous Science Fiction",
+	"sf_fantasy":         "Fantasy",
+	"sf_fantasy_city":    "Urban Fantasy",
+	"sf_postapocalyptic": "Post-Apocalyptic Fiction",
+	"sf_mystic":          "Mystic Fiction",
+	"sf_etc":             "Science Fiction",
+	"child_sf":           "Children's Science Fiction",
+
+	// Detective and thriller
+	"det_classic":   "Classic Detective Fiction",
+	"det_police":    "Police Procedural",
+	"det_action":    "Action",
+	"det_irony":     "Ironic Detective Fiction",
+	"det_history":   "Historical Mystery",
+	"det_espionage": "Espionage",
+	"det_crime":     "Crime Fiction",
+	"det_political": "Political Thriller",
+	"det_maniac":    "Psychological Thriller",
+	"det_hard":      "Hardboiled",
+	"detective":     "Detective Fiction",
+	"thriller":      "Thriller",
+	"child_det":     "Children's Mystery",
+
+	// Prose
+	"prose_classic":      "Classic Fiction",
+	"prose_history":      "Historical Fiction",
+	"prose_contemporary": "Contemporary Fiction",
+	"prose_counter":      "Counterculture",
+	"prose_rus_classic":  "Russian Classics",
+	"prose_su_classics":  "Soviet Classics",
+	"prose_military":     "War Fiction",
+	"prose":              "Fiction",
+
+	// Romance
+	"love_contemporary": "Contemporary Romance",
+	"love_history":      "Historical Romance",
+	"love_detective":    "Romantic Suspense",
+	"love_short":        "Short Romance",
+	"love_erotica":      "Erotica",
+	"love_sf":           "Romantic Fantasy",
+	"love":              "Romance",
+
+	// Adventure
+	"adv_western":  "Western",
+	"adv_history":  "Historical Adventure",
+	"adv_indian":   "Adventure",
+	"adv_maritime": "Sea Adventure",
+	"adv_geo":      "Travel and Geography",
+	"adv_animal":   "Nature and Animals",
+	"adventure":    "Adventure",
+	"child_adv":    "Children's Adventure",
+
+	// Children's
+	"child_tale":      "Fairy Tales",
+	"child_verse":     "Children's Poetry",
+	"child_prose":     "Children's Fiction",
+	"child_education": "Children's Education",
+	"children":        "Children's Books",
+
+	// Poetry and drama
+	"poetry":     "Poetry",
+	"dramaturgy": "Drama",
+
+	// Antique and folklore
+	"antique_ant":      "Ancient Literature",
+	"antique_european": "European Literature",
+	"antique_russian":  "Old Russian Literature",
+	"antique_east":     "Eastern Literature",
+	"antique_myths":    "Myths and Legends",
+	"antique":          "Classical Literature",
+	"folklore":         "Folklore",
+
+	// Science and education
+	"sci_history":    "History",
+	"sci_psychology": "Psychology",
+	"sci_culture":    "Cultural Studies",
+	"sci_religion":   "Religious Studies",
+	"sci_philosophy": "Philosophy",
+	"sci_politics":   "Politics",
+	"sci_business":   "Business",
+	"sci_juris":      "Law",
+	"sci_linguistic": "Linguistics",
+	"sci_medicine":   "Medicine",
+	"sci_phys":       "Physics",
+	"sci_math":       "Mathematics",
+	"sci_chem":       "Chemistry",
+	"sci_biology":    "Biology",
+	"sci_tech":       "Technology",
+	"science":        "Science",
+
+	// Computers
+	"comp_www":         "Internet",
+	"comp_programming": "Programming",
+	"comp_hard":        "Computer Hardware",
+	"comp_soft":        "Software",
+	"comp_db":          "Databases",
+	"comp_osnet":       "Operating Systems and Networking",
+	"computers":        "Computers",
+
+	// Reference and nonfiction
+	"ref_encyc":      "Encyclopedias",
+	"ref_dict":       "Dictionaries",
+	"ref_ref":        "Reference",
+	"ref_guide":      "Guides",
+	"reference":      "Reference",
+	"nonf_biography": "Biography",
+	"nonf_publicism": "Essays",
+	"nonf_criticism": "Criticism",
+	"design":         "Art and Design",
+	"nonfiction":     "Nonfiction",
+
+	// Religion
+	"religion_rel":       "Religion",
+	"religion_esoterics": "Esoterica",
+	"religion_self":      "Self-Improvement",
+	"religion":           "Religion",
+
+	// Humor
+	"humor_anecdote": "Jokes",
+	"humor_prose":    "Humorous Fiction",
+	"humor_verse":    "Humorous Poetry",
+	"humor":          "Humor",
+
+	// Home and family
+	"home_cooking":   "Cooking",
+	"home_pets":      "Pets",
+	"home_crafts":    "Crafts and Hobbies",
+	"home_entertain": "Entertainment",
+	"home_health":    "Health",
+	"home_garden":    "Gardening",
+	"home_diy":       "Do It Yourself",
+	"home_sport":     "Sports",
+	"home_sex":       "Sexuality",
+	"home":           "Home and Family",
+}
+
+// GenreLabel returns the human-readable subject for an FB2 genre code.
+// Unknown codes are returned unchanged.
+func GenreLabel(code string) string {
+	if label, ok := genreLabels[strings.ToLower(strings.TrimSpace(code))]; ok {
+		return label
+	}
+	return code
+}
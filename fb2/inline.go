@@ -0,0 +1,244 @@
+package fb2
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// InlineText is a metadata field that may contain inline markup such as
+// <sub> and <sup> (e.g. chemical formulas in titles). It keeps a plain-text
+// form for machine metadata and an XHTML form for display.
+type InlineText struct {
+	Plain  string // Text with sub/superscripts folded into Unicode where possible
+	Markup string // Escaped XHTML with <sub>/<sup> preserved
+}
+
+// String returns the plain-text form
+func (t InlineText) String() string {
+	return t.Plain
+}
+
+// UnmarshalXML collects the text of the element, keeping <sub>/<sup>
+// markup. Other inline elements contribute their text only.
+func (t *InlineText) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var plain, markup strings.Builder
+	var script []string // Stack of open sub/sup elements
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name.Local == "sub" || tok.Name.Local == "sup" {
+				script = append(script, tok.Name.Local)
+				markup.WriteString("<" + tok.Name.Local + ">")
+			}
+		case xml.EndElement:
+			if tok.Name == start.Name {
+				t.Plain = strings.TrimSpace(plain.String())
+				t.Markup = strings.TrimSpace(markup.String())
+				return nil
+			}
+			if tok.Name.Local == "sub" || tok.Name.Local == "sup" {
+				if len(script) > 0 {
+					script = script[:len(script)-1]
+				}
+				markup.WriteString("</" + tok.Name.Local + ">")
+			}
+		case xml.CharData:
+			text := string(tok)
+			markup.WriteString(htmlEscape(text))
+			if len(script) > 0 {
+				text = toScript(text, script[len(script)-1] == "sup")
+			}
+			plain.WriteString(text)
+		}
+	}
+}
+
+var (
+	subscripts   = map[rune]rune{'0': '₀', '1': '₁', '2': '₂', '3': '₃', '4': '₄', '5': '₅', '6': '₆', '7': '₇', '8': '₈', '9': '₉', '+': '₊', '-': '₋', '=': '₌', '(': '₍', ')': '₎'}
+	superscripts = map[rune]rune{'0': '⁰', '1': '¹', '2': '²', '3': '³', '4': '⁴', '5': '⁵', '6': '⁶', '7': '⁷', '8': '⁸', '9': '⁹', '+': '⁺', '-': '⁻', '=': '⁼', '(': '⁽', ')': '⁾', 'n': 'ⁿ', 'i': 'ⁱ'}
+)
+
+// toScript converts text to Unicode sub- or superscript characters. Text
+// with characters that have no such form is returned unchanged.
+func toScript(text string, sup bool) string {
+	table := subscripts
+	if sup {
+		table = superscripts
+	}
+	var buf strings.Builder
+	for _, r := range text {
+		mapped, ok := table[r]
+		if !ok {
+			return text
+		}
+		buf.WriteRune(mapped)
+	}
+	return buf.String()
+}
+
+// InlineNode is a piece of paragraph content in document order: a text
+// run (Name is empty) or an inline element with its own content
+type InlineNode struct {
+	Name     string     // Element local name, empty for text runs
+	Text     string     // Text of a text run
+	Attrs    []xml.Attr // Element attributes
+	Children []InlineNode
+}
+
+// Href returns the link of an <a> or <image> node (see hrefAttr)
+func (n InlineNode) Href() string {
+	return hrefAttr(n.Attrs)
+}
+
+// attr returns the value of the attribute with the given local name
+func (n InlineNode) attr(local string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// image returns an <image> node as an Image
+func (n InlineNode) image() Image {
+	return Image{Alt: n.attr("alt"), Title: n.attr("title"), Attrs: n.Attrs}
+}
+
+// UnmarshalXML keeps the paragraph content as inline nodes. Text is the
+// plain text of the paragraph including that of inline elements.
+func (p *P) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	p.XMLName = start.Name
+	for _, a := range start.Attr {
+		if a.Name.Local == "id" {
+			p.ID = a.Value
+		}
+	}
+
+	nodes, err := decodeInline(d)
+	if err != nil {
+		return err
+	}
+	p.Inline = nodes
+
+	var text strings.Builder
+	writeInlineText(&text, nodes)
+	p.Text = text.String()
+	return nil
+}
+
+// writeInlineText writes the text runs of the content in document order
+func writeInlineText(buf *strings.Builder, nodes []InlineNode) {
+	for _, n := range nodes {
+		if n.Name == "" {
+			buf.WriteString(n.Text)
+		} else {
+			writeInlineText(buf, n.Children)
+		}
+	}
+}
+
+// inlineTags maps FB2 inline formatting elements to their HTML tags
+var inlineTags = map[string]string{
+	"emphasis":      "em",
+	"strong":        "strong",
+	"strikethrough": "s",
+	"sub":           "sub",
+	"sup":           "sup",
+	"code":          "code",
+}
+
+// inlineMarkup renders inline content as standalone XHTML: formatting
+// elements map to their HTML tags and links to external URLs are kept.
+// Links within the book, note references and images only contribute
+// their text, since the markup is used outside the book's content.
+func inlineMarkup(nodes []InlineNode) string {
+	var buf strings.Builder
+	for _, n := range nodes {
+		switch {
+		case n.Name == "":
+			buf.WriteString(htmlEscape(n.Text))
+		case inlineTags[n.Name] != "":
+			tag := inlineTags[n.Name]
+			buf.WriteString("<" + tag + ">" + inlineMarkup(n.Children) + "</" + tag + ">")
+		case n.Name == "a" && isExternalLink(n.Href()):
+			buf.WriteString("<a href=\"" + htmlEscape(n.Href()) + "\">" + inlineMarkup(n.Children) + "</a>")
+		default:
+			buf.WriteString(inlineMarkup(n.Children))
+		}
+	}
+	return buf.String()
+}
+
+// isExternalLink reports whether href points outside the book
+func isExternalLink(href string) bool {
+	lower := strings.ToLower(href)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:")
+}
+
+// hasMarkup reports whether the content has inline elements, i.e. it is
+// more than a single run of text
+func hasMarkup(nodes []InlineNode) bool {
+	for _, n := range nodes {
+		if n.Name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeInline reads inline content up to the end of the current element
+func decodeInline(d *xml.Decoder) ([]InlineNode, error) {
+	var nodes []InlineNode
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			children, err := decodeInline(d)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, InlineNode{
+				Name:     tok.Name.Local,
+				Attrs:    tok.Attr,
+				Children: children,
+			})
+		case xml.EndElement:
+			return nodes, nil
+		case xml.CharData:
+			nodes = append(nodes, InlineNode{Text: string(tok)})
+		}
+	}
+}
+
+// hasLinkedImage reports whether the content has an <a> wrapping an
+// <image>, i.e. a clickable illustration
+func hasLinkedImage(nodes []InlineNode) bool {
+	for _, n := range nodes {
+		if n.Name == "a" && hasImage(n.Children) {
+			return true
+		}
+		if hasLinkedImage(n.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasImage reports whether the content has an <image>
+func hasImage(nodes []InlineNode) bool {
+	for _, n := range nodes {
+		if n.Name == "image" || hasImage(n.Children) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,40 +5,79 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
+// uuidRegex matches a UUID in canonical form
+var uuidRegex = regexp.MustCompile(`^(?i)[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// isbnPrefixRegex matches an "ISBN" prefix with an optional -10 or -13
+// qualifier, as in "ISBN-13: 978-..."
+var isbnPrefixRegex = regexp.MustCompile(`^(?i)isbn(?:[- ]?1[03](?:\s|:))?[\s:-]*`)
+
 // Metadata represents extracted book metadata
 type Metadata struct {
 	Title       string
+	TitleMarkup string // Title as XHTML, keeping <sub>/<sup>
 	Authors     []string
 	AuthorSort  string
+	AuthorSorts []string // Sort name of each author, parallel to Authors
 	AuthorsFull string // Formatted "Last, First Middle"
 	Publisher   string
-	ISBN        string
+	ISBN        string // Canonical digits when ISBNValid, otherwise as written
+	ISBNValid   bool   // ISBN has a correct ISBN-10 or ISBN-13 checksum
 	Year        string
 	PubDate     time.Time
 	Language    string
 	Languages   []string
 	Series      string
 	SeriesIndex int
-	Genres      []string
+	AllSeries   []SeriesInfo // Every series of the book; the first is Series
+	Genres      []string // FB2 genre codes
+	GenreLabels []string // Readable subject of each genre, parallel to Genres
 	Keywords    []string
 	Annotation  string
 	Comments    string // Alias for annotation
 
+	// AnnotationHTML is the annotation as XHTML paragraphs, keeping
+	// emphasis and external links
+	AnnotationHTML string
+
+	// Translators of a translated work
+	Translators     []string
+	TranslatorSorts []string // Sort name of each translator, parallel to Translators
+
 	// Cover image
 	Cover     []byte
 	CoverExt  string // jpg, png, etc.
 	CoverID   string // Binary ID
+	Thumbnail []byte // Coverpage image when a larger cover was preferred
+
+	// Provenance
+	DocumentID      string   // document-info/id
+	DocumentVersion string   // document-info/version: revision of the file
+	DocumentDate    string   // document-info/date: ISO value if given, else the text
+	ProgramUsed     string   // document-info/program-used
+	SrcISBN         string   // ISBN of the original edition of a translation
+	SrcURLs         []string // document-info/src-url: where the file came from
+	SrcOCR          string   // document-info/src-ocr: who scanned or recognized the text
 
 	// Additional metadata
 	FilePath  string
 }
 
+// SeriesInfo is a series (FB2 sequence) the book belongs to
+type SeriesInfo struct {
+	Name  string
+	Index int // Number of the book in the series, 0 if unknown
+}
+
 // ExtractMetadata extracts metadata from an FB2 document
 func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 	m := &Metadata{
@@ -49,32 +88,21 @@ func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 
 	// Extract from TitleInfo
 	ti := fb2.Description.TitleInfo
-	if ti.BookTitle != "" {
-		m.Title = strings.TrimSpace(ti.BookTitle)
+	if ti.BookTitle.Plain != "" {
+		m.Title = ti.BookTitle.Plain
+		m.TitleMarkup = ti.BookTitle.Markup
 	}
 
 	// Authors
 	for _, author := range ti.Author {
 		name := formatAuthorName(author)
-		if name != "" {
-			m.Authors = append(m.Authors, name)
-		}
-		// Build author sort: "Last, First Middle"
-		if author.LastName != "" {
-			sortName := author.LastName
-			if author.FirstName != "" {
-				sortName += ", " + author.FirstName
-				if author.MiddleName != "" {
-					sortName += " " + author.MiddleName
-				}
-			}
-			if m.AuthorSort == "" {
-				m.AuthorSort = sortName
-			} else {
-				m.AuthorSort += " & " + sortName
-			}
+		if name == "" {
+			continue
 		}
+		m.Authors = append(m.Authors, name)
+		m.AuthorSorts = append(m.AuthorSorts, authorSortName(author))
 	}
+	m.AuthorSort = strings.Join(m.AuthorSorts, " & ")
 
 	// Full authors string (for display)
 	m.AuthorsFull = strings.Join(m.Authors, " & ")
@@ -87,11 +115,25 @@ func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 
 	// Genres
 	m.Genres = append(m.Genres, ti.Genre...)
+	for _, genre := range m.Genres {
+		m.GenreLabels = append(m.GenreLabels, GenreLabel(genre))
+	}
 
 	// Annotation
 	if ti.Annotation != nil {
 		m.Annotation = extractTextContent(ti.Annotation)
 		m.Comments = m.Annotation
+		m.AnnotationHTML = annotationHTML(ti.Annotation)
+	}
+
+	// Translators
+	for _, translator := range ti.Translator {
+		name := formatAuthorName(translator)
+		if name == "" {
+			continue
+		}
+		m.Translators = append(m.Translators, name)
+		m.TranslatorSorts = append(m.TranslatorSorts, authorSortName(translator))
 	}
 
 	// Keywords
@@ -99,11 +141,26 @@ func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 		m.Keywords = parseKeywords(ti.Keywords.Text)
 	}
 
-	// Sequence (series)
-	if len(ti.Sequence) > 0 {
-		seq := ti.Sequence[0] // Use first sequence
-		m.Series = seq.Name
-		m.SeriesIndex = seq.Number
+	// Sequences (series), those of the title-info first
+	m.AllSeries = appendSeries(m.AllSeries, ti.Sequence)
+
+	// Provenance from DocumentInfo and the original edition
+	di := fb2.Description.DocumentInfo
+	m.DocumentID = strings.TrimSpace(di.ID)
+	m.DocumentVersion = strings.TrimSpace(di.Version)
+	m.DocumentDate = strings.TrimSpace(di.Date.Value)
+	if m.DocumentDate == "" {
+		m.DocumentDate = strings.TrimSpace(di.Date.Text)
+	}
+	m.ProgramUsed = strings.TrimSpace(di.ProgramUsed)
+	for _, url := range di.SrcURL {
+		if url = strings.TrimSpace(url); url != "" {
+			m.SrcURLs = append(m.SrcURLs, url)
+		}
+	}
+	m.SrcOCR = strings.TrimSpace(di.SrcOCR)
+	if src := fb2.Description.SrcTitleInfo; src != nil {
+		m.SrcISBN = strings.TrimSpace(src.ISBN)
 	}
 
 	// Extract from PublishInfo
@@ -113,6 +170,9 @@ func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 	}
 	if pi.ISBN != "" {
 		m.ISBN = strings.TrimSpace(pi.ISBN)
+		if isbn, ok := NormalizeISBN(m.ISBN); ok {
+			m.ISBN, m.ISBNValid = isbn, true
+		}
 	}
 	if pi.Year != "" {
 		m.Year = pi.Year
@@ -121,47 +181,24 @@ func (p *Parser) ExtractMetadata(fb2 *FictionBook) (*Metadata, error) {
 			m.PubDate = year
 		}
 	}
-	if len(pi.Sequence) > 0 && m.Series == "" {
-		// Use publish-info sequence if title-info didn't have one
-		seq := pi.Sequence[0]
-		m.Series = seq.Name
-		m.SeriesIndex = seq.Number
+	m.AllSeries = appendSeries(m.AllSeries, pi.Sequence)
+	if len(m.AllSeries) > 0 {
+		m.Series = m.AllSeries[0].Name
+		m.SeriesIndex = m.AllSeries[0].Index
 	}
 
 	// Cover image
-	if ti.Coverpage.PrimaryImage.Href != "" || ti.Coverpage.PrimaryImage.LHref != "" ||
-	   ti.Coverpage.PrimaryImage.LHref2 != "" || len(ti.Coverpage.PrimaryImage.AnyAttr) > 0 {
-		href := ti.Coverpage.PrimaryImage.Href
-
-		// Try local href if regular href is empty
-		if href == "" && ti.Coverpage.PrimaryImage.LHref != "" {
-			href = ti.Coverpage.PrimaryImage.LHref
-		}
-
-		// Try namespaced href (l:href with xmlns:l="...")
-		if href == "" && ti.Coverpage.PrimaryImage.LHref2 != "" {
-			href = ti.Coverpage.PrimaryImage.LHref2
-		}
-
-		// Fallback: check AnyAttr for l:href or xlink:href
-		if href == "" && len(ti.Coverpage.PrimaryImage.AnyAttr) > 0 {
-			for _, attr := range ti.Coverpage.PrimaryImage.AnyAttr {
-				if (attr.Name.Local == "href" && (attr.Name.Space == "l" || attr.Name.Space == "xlink")) ||
-				   attr.Name.Local == "l:href" || attr.Name.Local == "xlink:href" {
-					href = attr.Value
-					break
-				}
-			}
-		}
+	if href := ti.Coverpage.PrimaryImage.Href(); href != "" {
+		// Remove # prefix if present
+		href = strings.TrimPrefix(href, "#")
+		m.CoverID = href
 
-		if href != "" {
-			// Remove # prefix if present
-			href = strings.TrimPrefix(href, "#")
-			m.CoverID = href
+		// Try to extract cover from binaries
+		m.Cover, m.CoverExt = p.extractCoverImage(href)
+	}
 
-			// Try to extract cover from binaries
-			m.Cover, m.CoverExt = p.extractCoverImage(href)
-		}
+	if p.PreferLargestCover {
+		p.preferLargestCover(m)
 	}
 
 	return m, nil
@@ -188,6 +225,125 @@ func formatAuthorName(author Author) string {
 	return author.Nickname
 }
 
+// authorSortName returns the name an author is filed under: "Last, First
+// Middle" for real names, and the name itself for pseudonyms given only as
+// a nickname or authors known by a single name
+func authorSortName(author Author) string {
+	if author.LastName == "" {
+		return formatAuthorName(author)
+	}
+	sortName := author.LastName
+	if author.FirstName != "" {
+		sortName += ", " + author.FirstName
+		if author.MiddleName != "" {
+			sortName += " " + author.MiddleName
+		}
+	}
+	return sortName
+}
+
+// appendSeries appends the named sequences to series, skipping those
+// already listed (publish-info often repeats the title-info sequence)
+func appendSeries(series []SeriesInfo, sequences []Sequence) []SeriesInfo {
+	for _, seq := range sequences {
+		name := strings.TrimSpace(seq.Name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, s := range series {
+			if strings.EqualFold(s.Name, name) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			series = append(series, SeriesInfo{Name: name, Index: seq.Number})
+		}
+	}
+	return series
+}
+
+// NormalizeISBN strips an ISBN of spaces, hyphens and an "ISBN" prefix
+// (with an optional -10 or -13 qualifier) and checks its ISBN-10 or
+// ISBN-13 checksum. It returns the canonical form (digits, with a final X
+// for an ISBN-10 check digit of 10) and whether the ISBN is valid.
+func NormalizeISBN(isbn string) (string, bool) {
+	isbn = strings.TrimSpace(isbn)
+	isbn = isbnPrefixRegex.ReplaceAllString(isbn, "")
+
+	var digits []byte
+	for _, r := range isbn {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r == 'x' || r == 'X':
+			digits = append(digits, 'X')
+		case r == '-' || r == ' ' || r == '\u00A0':
+		default:
+			return "", false
+		}
+	}
+
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, d := range digits {
+			v := int(d - '0')
+			if d == 'X' {
+				if i != 9 {
+					return "", false
+				}
+				v = 10
+			}
+			sum += v * (10 - i)
+		}
+		return string(digits), sum%11 == 0
+	case 13:
+		sum := 0
+		for i, d := range digits {
+			if d == 'X' {
+				return "", false
+			}
+			v := int(d - '0')
+			if i%2 == 1 {
+				v *= 3
+			}
+			sum += v
+		}
+		return string(digits), sum%10 == 0
+	}
+	return "", false
+}
+
+// Sources returns dc:source values for the book: the FB2 document id as a
+// URN, the original ISBN of a translation, if valid, and the URLs the file
+// came from
+func (m *Metadata) Sources() []string {
+	var sources []string
+	if m.DocumentID != "" {
+		sources = append(sources, DocumentURN(m.DocumentID))
+	}
+	if isbn, ok := NormalizeISBN(m.SrcISBN); ok {
+		sources = append(sources, "urn:isbn:"+isbn)
+	}
+	sources = append(sources, m.SrcURLs...)
+	return sources
+}
+
+// DocumentURN returns an FB2 document id in URN form. Most ids are UUIDs
+// and become urn:uuid; ids already in URN form are kept.
+func DocumentURN(id string) string {
+	switch {
+	case strings.HasPrefix(strings.ToLower(id), "urn:"):
+		return id
+	case uuidRegex.MatchString(id):
+		return "urn:uuid:" + strings.ToLower(id)
+	default:
+		return "urn:fb2:" + id
+	}
+}
+
 // extractTextContent extracts text from a TextContainer
 func extractTextContent(tc *TextContainer) string {
 	if tc == nil {
@@ -211,6 +367,25 @@ func extractTextContent(tc *TextContainer) string {
 	return strings.TrimSpace(buf.String())
 }
 
+// annotationHTML renders an annotation as XHTML, a <p> per paragraph
+// with its inline markup
+func annotationHTML(tc *TextContainer) string {
+	if tc == nil {
+		return ""
+	}
+
+	var buf strings.Builder
+	if text := strings.TrimSpace(tc.Text); text != "" {
+		buf.WriteString("<p>" + htmlEscape(text) + "</p>\n")
+	}
+	for _, p := range tc.P {
+		if strings.TrimSpace(p.Text) != "" {
+			buf.WriteString("<p>" + strings.TrimSpace(inlineMarkup(p.Inline)) + "</p>\n")
+		}
+	}
+	return buf.String()
+}
+
 // parseKeywords parses keywords from a string
 func parseKeywords(text string) []string {
 	if text == "" {
@@ -256,7 +431,59 @@ func parseYear(yearStr string) (time.Time, error) {
 	return time.Date(year, time.June, 2, 0, 0, 0, 0, time.UTC), nil
 }
 
-// extractCoverImage extracts cover image data from binaries
+// preferLargestCover replaces the coverpage image with the largest cover
+// candidate binary by decoded dimensions. Candidates are the coverpage
+// image and image binaries whose ID mentions "cover". The original
+// coverpage image is kept as the thumbnail.
+func (p *Parser) preferLargestCover(m *Metadata) {
+	bestID, bestArea := "", 0
+	if m.CoverID != "" {
+		bestArea = imageArea(p.imageData[m.CoverID])
+		if bestArea > 0 {
+			bestID = m.CoverID
+		}
+	}
+
+	ids := make([]string, 0, len(p.imageData))
+	for id := range p.imageData {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if id == m.CoverID || !strings.Contains(strings.ToLower(id), "cover") {
+			continue
+		}
+		if area := imageArea(p.imageData[id]); area > bestArea {
+			bestID, bestArea = id, area
+		}
+	}
+
+	if bestID == "" || bestID == m.CoverID {
+		return
+	}
+	if m.Cover != nil {
+		m.Thumbnail = m.Cover
+	}
+	m.CoverID = bestID
+	m.Cover, m.CoverExt = p.extractCoverImage(bestID)
+}
+
+// imageArea returns width*height of an encoded image, or 0 if it can't be decoded
+func imageArea(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	return cfg.Width * cfg.Height
+}
+
+// extractCoverImage returns the decoded data and file extension of a cover
+// binary. It uses the binaries decoded into memory during parsing and never
+// touches the filesystem.
 func (p *Parser) extractCoverImage(binaryID string) ([]byte, string) {
 	// Look for the binary data in imageData
 	if data, ok := p.imageData[binaryID]; ok {
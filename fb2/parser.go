@@ -6,9 +6,12 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"image"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/htol/fb2c/b64"
@@ -24,11 +27,19 @@ const (
 
 // FictionBook represents the root FB2 document structure
 type FictionBook struct {
-	XMLName     xml.Name    `xml:"FictionBook"`
-	XMLNS       string      `xml:"xmlns,attr"`
-	Description Description `xml:"description"`
-	Bodies      []Body      `xml:"body"`
-	Binaries    []Binary    `xml:"binary"`
+	XMLName     xml.Name     `xml:"FictionBook"`
+	XMLNS       string       `xml:"xmlns,attr"`
+	Stylesheets []Stylesheet `xml:"stylesheet"`
+	Description Description  `xml:"description"`
+	Bodies      []Body       `xml:"body"`
+	Binaries    []Binary     `xml:"binary"`
+}
+
+// Stylesheet is a document stylesheet; FB2 allows any type, in practice
+// text/css
+type Stylesheet struct {
+	Type    string `xml:"type,attr"`
+	Content string `xml:",chardata"`
 }
 
 // Description contains book metadata
@@ -43,7 +54,8 @@ type Description struct {
 type TitleInfo struct {
 	Genre      []string       `xml:"genre"`
 	Author     []Author       `xml:"author"`
-	BookTitle  string         `xml:"book-title"`
+	Translator []Author       `xml:"translator"`
+	BookTitle  InlineText     `xml:"book-title"`
 	Annotation *TextContainer `xml:"annotation"`
 	Keywords   *TextContainer `xml:"keywords"`
 	Date       Date           `xml:"date"`
@@ -51,6 +63,7 @@ type TitleInfo struct {
 	Language   string         `xml:"lang"`
 	SrcLang    string         `xml:"src-lang"`
 	Sequence   []Sequence     `xml:"sequence"`
+	ISBN       string         `xml:"isbn"` // Non-standard; some producers put the original ISBN in src-title-info
 }
 
 // Author represents a book author
@@ -83,11 +96,25 @@ type Coverpage struct {
 
 // ImageRef is a reference to an image
 type ImageRef struct {
-	Href   string `xml:"href,attr"`
-	LHref  string `xml:"l:href,attr"`                            // Local href (FB2 specific)
-	LHref2 string `xml:"http://www.w3.org/1999/xlink href,attr"` // Namespaced href
-	// AnyAttr will capture all attributes for fallback processing
-	AnyAttr []xml.Attr `xml:",any,attr"`
+	Attrs []xml.Attr `xml:",any,attr"`
+}
+
+// Href returns the image link (see hrefAttr)
+func (r ImageRef) Href() string {
+	return hrefAttr(r.Attrs)
+}
+
+// hrefAttr returns the first href attribute in any namespace. FB2 producers
+// spell the link as l:href, xlink:href or plain href, with the prefix bound
+// to the XLink namespace or not declared at all, so only the local name is
+// reliable.
+func hrefAttr(attrs []xml.Attr) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == "href" && attr.Value != "" {
+			return strings.TrimSpace(attr.Value)
+		}
+	}
+	return ""
 }
 
 // TextContainer contains text with possible markup
@@ -100,7 +127,9 @@ type TextContainer struct {
 // P represents a paragraph
 type P struct {
 	XMLName xml.Name
-	Text    string `xml:",chardata"`
+	ID      string       `xml:"id,attr"`
+	Text    string       `xml:",chardata"`
+	Inline  []InlineNode `xml:"-"` // Content in document order, see UnmarshalXML
 }
 
 // PublishInfo contains publishing metadata
@@ -118,6 +147,8 @@ type DocumentInfo struct {
 	Author      []Author  `xml:"author"`
 	ProgramUsed string    `xml:"program-used"`
 	Date        Date      `xml:"date"`
+	SrcURL      []string  `xml:"src-url"`
+	SrcOCR      string    `xml:"src-ocr"`
 	ID          string    `xml:"id"`
 	Version     string    `xml:"version"`
 	History     []History `xml:"history"`
@@ -150,22 +181,83 @@ type Title struct {
 
 // Section represents a book section
 type Section struct {
-	XMLName   xml.Name   `xml:"section"`
-	ID        string     `xml:"id,attr"`
-	Name      string     `xml:"name,attr"`
-	Title     *Title     `xml:"title"`
-	Epigraphs []Epigraph `xml:"epigraph"`
-	Sections  []Section  `xml:"section"`
+	XMLName    xml.Name       `xml:"section"`
+	ID         string         `xml:"id,attr"`
+	Name       string         `xml:"name,attr"`
+	Title      *Title         `xml:"title"`
+	Epigraphs  []Epigraph     `xml:"epigraph"`
+	Annotation *TextContainer `xml:"annotation"`
+	Sections   []Section      `xml:"section"`
 	// Various content elements
 	Paragraphs []P      `xml:"p"`
-	Subtitle   *P       `xml:"subtitle"`
+	Subtitles  []P      `xml:"subtitle"`
 	Cite       []Cite   `xml:"cite"`
 	Stanza     []Stanza `xml:"stanza"`
+	Poem       []Poem   `xml:"poem"`
 	Code       []Code   `xml:"code"`
 	Table      []Table  `xml:"table"`
 	Image      []Image  `xml:"image"`
 	// Content nodes
 	Content []ContentNode `xml:",any"`
+	// Order of the child elements in the document (see Section.UnmarshalXML)
+	Order []SectionChild `xml:"-"`
+}
+
+// IsNotes reports whether the body holds notes or comments rather than
+// the main text
+func (b *Body) IsNotes() bool {
+	return b.Name == "notes" || b.Name == "comments"
+}
+
+// MainBody returns the body holding the main text: the first body that is
+// not a notes or comments body. It returns nil if there is none.
+func (fb2 *FictionBook) MainBody() *Body {
+	for i := range fb2.Bodies {
+		if !fb2.Bodies[i].IsNotes() {
+			return &fb2.Bodies[i]
+		}
+	}
+	return nil
+}
+
+// IsImageOnly reports whether the book content consists of images only,
+// as in comics or scanned picture books. Titles are allowed.
+func (fb2 *FictionBook) IsImageOnly() bool {
+	images := 0
+	for _, body := range fb2.Bodies {
+		for _, section := range body.Sections {
+			n, ok := sectionImageCount(section)
+			if !ok {
+				return false
+			}
+			images += n
+		}
+	}
+	return images > 0
+}
+
+// sectionImageCount counts the images of a section and its subsections.
+// It returns false if the section has any text content.
+func sectionImageCount(section Section) (int, bool) {
+	for _, p := range section.Paragraphs {
+		if strings.TrimSpace(p.Text) != "" {
+			return 0, false
+		}
+	}
+	if len(section.Epigraphs) > 0 || len(section.Cite) > 0 || len(section.Stanza) > 0 ||
+		len(section.Poem) > 0 || len(section.Code) > 0 || len(section.Table) > 0 {
+		return 0, false
+	}
+
+	images := len(section.Image)
+	for _, sub := range section.Sections {
+		n, ok := sectionImageCount(sub)
+		if !ok {
+			return 0, false
+		}
+		images += n
+	}
+	return images, true
 }
 
 // Epigraph represents an epigraph
@@ -190,6 +282,33 @@ type Stanza struct {
 	Author  []Author `xml:"author"`
 	Date    Date     `xml:"date"`
 	V       []V      `xml:"v"`
+	// TextAuthors belong to the poem, but some documents put them at the
+	// end of the last stanza
+	TextAuthors []string `xml:"text-author"`
+}
+
+// Poem represents a poem. Verses are normally grouped into stanzas, but
+// some documents put <v> elements directly under <poem>.
+type Poem struct {
+	XMLName     xml.Name   `xml:"poem"`
+	ID          string     `xml:"id,attr"`
+	Title       *Title     `xml:"title"`
+	Epigraphs   []Epigraph `xml:"epigraph"`
+	Stanzas     []Stanza   `xml:"stanza"`
+	V           []V        `xml:"v"`
+	TextAuthors []string   `xml:"text-author"`
+	Date        Date       `xml:"date"`
+}
+
+// AllStanzas returns the poem's stanzas, treating verses placed directly
+// under <poem> as a single implicit stanza.
+func (p Poem) AllStanzas() []Stanza {
+	if len(p.V) == 0 {
+		return p.Stanzas
+	}
+	stanzas := make([]Stanza, 0, len(p.Stanzas)+1)
+	stanzas = append(stanzas, Stanza{V: p.V})
+	return append(stanzas, p.Stanzas...)
 }
 
 // V represents a verse line
@@ -217,11 +336,13 @@ type TR struct {
 	Cells   []TableCell `xml:",any"`
 }
 
-// TableCell is a table cell
+// TableCell is a table cell, a <td> or a <th> (see XMLName)
 type TableCell struct {
 	XMLName xml.Name
 	ColSpan int    `xml:"colspan,attr"`
 	RowSpan int    `xml:"rowspan,attr"`
+	Align   string `xml:"align,attr"`
+	VAlign  string `xml:"valign,attr"`
 	Style   string `xml:"style,attr"`
 	Class   string `xml:"class,attr"`
 	Content string `xml:",chardata"`
@@ -229,11 +350,15 @@ type TableCell struct {
 
 // Image represents an inline image
 type Image struct {
-	XMLName   xml.Name `xml:"image"`
-	Href      string   `xml:"href,attr"`
-	Alt       string   `xml:"alt,attr"`
-	Title     string   `xml:"title,attr"`
-	XLinkHref string   `xml:"http://www.w3.org/1999/xlink href,attr"`
+	XMLName xml.Name   `xml:"image"`
+	Alt     string     `xml:"alt,attr"`
+	Title   string     `xml:"title,attr"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+// Href returns the image link (see hrefAttr)
+func (img Image) Href() string {
+	return hrefAttr(img.Attrs)
 }
 
 // Binary contains embedded binary data
@@ -253,9 +378,20 @@ type ContentNode struct {
 // Parser parses FB2 files
 type Parser struct {
 	// Options
-	NoInlineTOC   bool
-	ProcessCSS    bool
+	NoInlineTOC bool
+	ProcessCSS  bool
+	// ExtractImages decodes the embedded binaries into memory for covers
+	// and images. Nothing is written to disk unless ExtractDir is set.
 	ExtractImages bool
+	// ExtractDir, if set, is a directory the decoded binaries are also
+	// written to, named by their binary id
+	ExtractDir string
+	// PreferLargestCover picks the largest cover candidate binary instead of
+	// trusting the coverpage image, which is sometimes a low-res thumbnail
+	PreferLargestCover bool
+	// ForceEncoding decodes input with this encoding instead of the
+	// detected or declared one. Unsupported encodings are an error.
+	ForceEncoding string
 
 	// Internal state
 	imageData   map[string][]byte // binary ID -> decoded image data
@@ -264,6 +400,9 @@ type Parser struct {
 
 	// Detected namespace
 	fbNamespace string
+
+	// Non-fatal problems found by the last parse
+	warnings []string
 }
 
 // NewParser creates a new FB2 parser
@@ -290,15 +429,38 @@ func (p *Parser) Parse(r io.Reader) (*FictionBook, error) {
 
 // ParseBytes parses FB2 data from bytes
 func (p *Parser) ParseBytes(data []byte) (*FictionBook, error) {
-	// Remove null bytes
-	data = bytes.ReplaceAll(data, []byte{0x00}, nil)
+	p.warnings = nil
+
+	// Binaries belong to the document being parsed; a reused parser must
+	// not serve images of the previous one
+	p.imageData = make(map[string][]byte)
+	p.imageTypes = make(map[string]string)
+
+	// Drop anything before the XML declaration or root element
+	data = trimLeadingJunk(data)
 
 	// Detect encoding and convert to UTF-8
-	text, _, err := fb2encoding.ToUTF8WithStrip(data, true)
-	if err != nil {
-		return nil, fmt.Errorf("fb2: encoding detection failed: %w", err)
+	var text string
+	var err error
+	if p.ForceEncoding != "" {
+		text, err = fb2encoding.ToUTF8WithEncoding(data, p.ForceEncoding, true)
+		if err != nil {
+			return nil, fmt.Errorf("fb2: forced encoding %q: %w", p.ForceEncoding, err)
+		}
+	} else {
+		text, _, err = fb2encoding.ToUTF8WithStrip(data, true)
+		if err != nil {
+			return nil, fmt.Errorf("fb2: encoding detection failed: %w", err)
+		}
 	}
 
+	// Remove null characters. This happens after decoding, as UTF-16 and
+	// UTF-32 text is full of zero bytes.
+	text = strings.ReplaceAll(text, "\x00", "")
+
+	// Remove byte order marks left in the middle of the stream
+	text = strings.ReplaceAll(text, "\uFEFF", "")
+
 	// Fix common XML syntax errors
 	text = fixXMLErrors(text)
 
@@ -309,11 +471,10 @@ func (p *Parser) ParseBytes(data []byte) (*FictionBook, error) {
 		return nil, fmt.Errorf("fb2: XML parse failed: %w", err)
 	}
 
-	// Ensure namespace
-	p.fbNamespace = fb2.XMLNS
-	if p.fbNamespace == "" {
-		p.fbNamespace = FB2NS
-	}
+	// Field tags carry no namespace, so elements match by local name and
+	// 2.0, 2.1 and misdeclared documents all parse the same; only the
+	// reported namespace needs normalizing
+	p.fbNamespace = p.normalizeNamespace(fb2.XMLName.Space)
 
 	// Extract embedded content (images, etc.)
 	if p.ExtractImages {
@@ -331,36 +492,60 @@ func (p *Parser) ParseFile(path string) (*FictionBook, error) {
 	}
 
 	// Check if it's a ZIP file (FBZ)
-	if bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04}) ||
-		bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x05, 0x06}) ||
-		bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x07, 0x08}) {
-		return p.ParseFBZ(path)
+	if isZip(data) {
+		return p.ParseFBZReader(bytes.NewReader(data), int64(len(data)))
 	}
 
 	return p.ParseBytes(data)
 }
 
-// ParseFBZ parses a zipped FB2 file
-func (p *Parser) ParseFBZ(path string) (*FictionBook, error) {
-	// Open ZIP archive
-	r, err := zip.OpenReader(path)
+// isZip reports whether data starts with a ZIP signature
+func isZip(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x03, 0x04}) ||
+		bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x05, 0x06}) ||
+		bytes.HasPrefix(data, []byte{0x50, 0x4B, 0x07, 0x08})
+}
+
+// UnpackFBZ returns the FB2 document of FBZ (zipped FB2) data, or data
+// itself if it isn't a ZIP archive
+func UnpackFBZ(data []byte) ([]byte, error) {
+	if !isZip(data) {
+		return data, nil
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
 		return nil, fmt.Errorf("fb2: failed to open ZIP: %w", err)
 	}
-	defer r.Close()
+	return readFB2Entry(r.File)
+}
 
-	// Find .fb2 file in archive
+// readFB2Entry reads the .fb2 file of an FBZ archive. Archives made on
+// macOS carry __MACOSX/ resource forks and ._ dotfiles named like the
+// book, and some hold more than one document; the largest real .fb2 is
+// taken, and a tie for largest is an error naming the candidates.
+func readFB2Entry(files []*zip.File) ([]byte, error) {
 	var fb2File *zip.File
-	for _, f := range r.File {
-		if strings.HasSuffix(f.Name, ".fb2") {
+	var tied []string
+	for _, f := range files {
+		if !isFB2Entry(f.Name) {
+			continue
+		}
+		switch {
+		case fb2File == nil || f.UncompressedSize64 > fb2File.UncompressedSize64:
 			fb2File = f
-			break
+			tied = nil
+		case f.UncompressedSize64 == fb2File.UncompressedSize64:
+			tied = append(tied, f.Name)
 		}
 	}
 
 	if fb2File == nil {
 		return nil, fmt.Errorf("fb2: no .fb2 file found in archive")
 	}
+	if len(tied) > 0 {
+		return nil, fmt.Errorf("fb2: archive has several candidate .fb2 files: %s", strings.Join(append([]string{fb2File.Name}, tied...), ", "))
+	}
 
 	// Read FB2 content
 	rc, err := fb2File.Open()
@@ -373,6 +558,51 @@ func (p *Parser) ParseFBZ(path string) (*FictionBook, error) {
 	if err != nil {
 		return nil, fmt.Errorf("fb2: failed to read file in ZIP: %w", err)
 	}
+	return data, nil
+}
+
+// isFB2Entry reports whether an archive entry name is an FB2 document
+// rather than a directory, a macOS resource fork or another hidden file
+func isFB2Entry(name string) bool {
+	if !strings.HasSuffix(strings.ToLower(name), ".fb2") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "__MACOSX" || strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseFBZ parses a zipped FB2 file
+func (p *Parser) ParseFBZ(path string) (*FictionBook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fb2: failed to open ZIP: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("fb2: failed to open ZIP: %w", err)
+	}
+	return p.ParseFBZReader(f, info.Size())
+}
+
+// ParseFBZReader parses zipped FB2 of the given size from r, such as an
+// uploaded file or a bytes.Reader over a buffered stream. Only the chosen
+// .fb2 entry is read into memory.
+func (p *Parser) ParseFBZReader(r io.ReaderAt, size int64) (*FictionBook, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("fb2: failed to open ZIP: %w", err)
+	}
+
+	data, err := readFB2Entry(zr.File)
+	if err != nil {
+		return nil, err
+	}
 
 	return p.ParseBytes(data)
 }
@@ -389,30 +619,93 @@ func (p *Parser) extractEmbeddedContent(fb2 *FictionBook) error {
 		// Decode base64 data
 		data, err := b64.Decode([]byte(binary.Data))
 		if err != nil {
-			// Use robust decoder
+			p.warnings = append(p.warnings, fmt.Sprintf("binary %q could not be decoded: %v", binary.ID, err))
 			continue
 		}
 
+		// The declared content-type is often missing or wrong; trust the
+		// data when it is recognizable
+		contentType := binary.ContentType
+		if sniffed := SniffImageType(data); sniffed != "" {
+			contentType = sniffed
+		} else if contentType == "" {
+			// Default to jpeg if unknown
+			contentType = "image/jpeg"
+		}
+		if isRasterImage(contentType) {
+			if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+				p.warnings = append(p.warnings, fmt.Sprintf("binary %q is not a readable image: %v", binary.ID, err))
+			}
+		}
+
 		// Store decoded data in memory
 		p.imageData[binary.ID] = data
 
-		// Store content-type for data URL generation
-		if binary.ContentType != "" {
-			p.imageTypes[binary.ID] = binary.ContentType
-		} else {
-			// Default to jpeg if unknown
-			p.imageTypes[binary.ID] = "image/jpeg"
+		if p.ExtractDir != "" {
+			if err := writeExtractedFile(p.ExtractDir, binary.ID, data); err != nil {
+				p.warnings = append(p.warnings, fmt.Sprintf("binary %q could not be extracted: %v", binary.ID, err))
+			}
 		}
+
+		// Store content-type for data URL generation
+		p.imageTypes[binary.ID] = contentType
 	}
 
 	return nil
 }
 
+// writeExtractedFile writes a decoded binary into dir. Only the last
+// element of the id is used as the file name, so ids can't point outside
+// the directory.
+func writeExtractedFile(dir, id string, data []byte) error {
+	name := filepath.Base(filepath.FromSlash(strings.ReplaceAll(id, "\\", "/")))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name")
+	}
+	return os.WriteFile(filepath.Join(dir, name), data, 0o644)
+}
+
 // GetImageData returns the map of binary IDs to decoded image data
 func (p *Parser) GetImageData() map[string][]byte {
 	return p.imageData
 }
 
+// isRasterImage reports whether a content type is a bitmap image format
+func isRasterImage(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") && contentType != "image/svg+xml"
+}
+
+// SniffImageType returns the media type of image data judging by its
+// first bytes: image/jpeg, image/png, image/gif, image/webp or
+// image/svg+xml. It returns "" when the format isn't recognized.
+func SniffImageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xFF\xD8\xFF")):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1A\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	}
+
+	// SVG is XML: look for the root element near the start, past an
+	// optional BOM, XML declaration, comments and doctype
+	head := data[:min(len(data), 1024)]
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF")), " \t\r\n")
+	if bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// Warnings returns the non-fatal problems found by the last parse, such as
+// binaries that could not be decoded and were skipped
+func (p *Parser) Warnings() []string {
+	return p.warnings
+}
+
 // GetImageType returns the content-type for a binary ID
 func (p *Parser) GetImageType(binaryID string) string {
 	if ct, ok := p.imageTypes[binaryID]; ok {
@@ -421,18 +714,178 @@ func (p *Parser) GetImageType(binaryID string) string {
 	return "image/jpeg" // Default fallback
 }
 
-// GetNamespace returns the detected FB2 namespace
+// GetNamespace returns the detected FB2 namespace: FB2NS or FB21NS, with
+// FB2NS standing in for a missing or unknown one
 func (p *Parser) GetNamespace() string {
 	return p.fbNamespace
 }
 
-// fixXMLErrors fixes common XML syntax errors in FB2 files
+// normalizeNamespace maps the namespace of the root element to a known FB2
+// namespace. Producers leave it out, mistype it or vary its case and
+// trailing slash; anything unrecognized is read as FB2NS with a warning.
+func (p *Parser) normalizeNamespace(ns string) string {
+	switch strings.TrimSuffix(strings.ToLower(strings.TrimSpace(ns)), "/") {
+	case "", FB2NS:
+		return FB2NS
+	case FB21NS:
+		return FB21NS
+	}
+	p.warnings = append(p.warnings, fmt.Sprintf("unknown FictionBook namespace %q, reading as %s", ns, FB2NS))
+	return FB2NS
+}
+
+// xmlStartRegex matches the XML declaration or the FictionBook root element,
+// which may carry a namespace prefix
+var xmlStartRegex = regexp.MustCompile(`<\?xml\s|<(?:[\w.-]+:)?FictionBook[\s>]`)
+
+// trimLeadingJunk discards whitespace, stray bytes or BOMs preceding the
+// XML declaration (or the root element if there is no declaration). A BOM
+// directly at the start is kept for encoding detection.
+func trimLeadingJunk(data []byte) []byte {
+	loc := xmlStartRegex.FindIndex(data)
+	if loc == nil || loc[0] == 0 {
+		return data
+	}
+
+	junk := data[:loc[0]]
+	for _, bom := range [][]byte{{0xEF, 0xBB, 0xBF}, {0xFF, 0xFE}, {0xFE, 0xFF}} {
+		if bytes.Equal(junk, bom) {
+			return data
+		}
+	}
+
+	return data[loc[0]:]
+}
+
+// fixXMLErrors fixes common XML syntax errors in FB2 files in a single
+// pass over the text:
+//   - an ampersand that doesn't start an XML entity or character
+//     reference is escaped, except that HTML entities such as &nbsp; are
+//     replaced with their character
+//   - a '<' that can't start markup (e.g. "a < b") is escaped
+//   - control characters that XML 1.0 doesn't allow are dropped
+//
+// CDATA sections are copied unchanged.
 func fixXMLErrors(text string) string {
-	// Fix unescaped ampersands (common issue)
-	// Replace '& ' (ampersand followed by space) with '&amp; '
-	text = strings.ReplaceAll(text, "& ", "&amp; ")
+	var buf strings.Builder
+	last := 0 // text[last:i] is still to be copied to buf
+	replace := func(i, n int, with string) {
+		if buf.Len() == 0 {
+			buf.Grow(len(text) + 64)
+		}
+		buf.WriteString(text[last:i])
+		buf.WriteString(with)
+		last = i + n
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '&':
+			ref, ok := entityRef(text[i+1:])
+			switch {
+			case ok && isXMLReference(ref):
+				if !isXMLCharReference(ref) {
+					// A reference to a character XML does not allow
+					// breaks the parser like the character itself
+					replace(i, len(ref)+2, "")
+				}
+				i += len(ref) + 1
+			case ok && xml.HTMLEntity[ref] != "":
+				replace(i, len(ref)+2, xml.HTMLEntity[ref])
+				i += len(ref) + 1
+			default:
+				replace(i, 1, "&amp;")
+			}
+		case c == '<':
+			if strings.HasPrefix(text[i:], "<![CDATA[") {
+				if end := strings.Index(text[i:], "]]>"); end >= 0 {
+					i += end + 2
+				} else {
+					i = len(text)
+				}
+			} else if i+1 == len(text) || !startsMarkup(text[i+1]) {
+				replace(i, 1, "&lt;")
+			}
+		case c < 0x20 && c != '\t' && c != '\n' && c != '\r':
+			replace(i, 1, "")
+		case c == 0xEF && (strings.HasPrefix(text[i:], "\uFFFE") || strings.HasPrefix(text[i:], "\uFFFF")):
+			replace(i, 3, "")
+			i += 2
+		}
+	}
+
+	if last == 0 {
+		return text
+	}
+	buf.WriteString(text[last:])
+	return buf.String()
+}
+
+// entityRef returns the name of the entity or character reference at the
+// start of s, the text after an ampersand, if it is terminated by ';'
+func entityRef(s string) (string, bool) {
+	for j := 0; j < len(s) && j <= 32; j++ {
+		c := s[j]
+		switch {
+		case c == ';':
+			return s[:j], j > 0
+		case c == '#' && j == 0,
+			'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// isXMLReference reports whether ref is one of the predefined XML
+// entities or a well-formed character reference
+func isXMLReference(ref string) bool {
+	switch ref {
+	case "amp", "lt", "gt", "quot", "apos":
+		return true
+	}
+	digits := "0123456789"
+	if after, ok := strings.CutPrefix(ref, "#x"); ok {
+		ref, digits = after, "0123456789abcdefABCDEF"
+	} else if after, ok := strings.CutPrefix(ref, "#"); ok {
+		ref = after
+	} else {
+		return false
+	}
+	return ref != "" && strings.Trim(ref, digits) == ""
+}
+
+// isXMLCharReference reports whether a well-formed reference ref is an
+// entity or refers to a character matching the XML 1.0 Char production
+func isXMLCharReference(ref string) bool {
+	var n uint64
+	var err error
+	if after, ok := strings.CutPrefix(ref, "#x"); ok {
+		n, err = strconv.ParseUint(after, 16, 32)
+	} else if after, ok := strings.CutPrefix(ref, "#"); ok {
+		n, err = strconv.ParseUint(after, 10, 32)
+	} else {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	switch {
+	case n == 0x9, n == 0xA, n == 0xD,
+		0x20 <= n && n <= 0xD7FF,
+		0xE000 <= n && n <= 0xFFFD,
+		0x10000 <= n && n <= 0x10FFFF:
+		return true
+	}
+	return false
+}
 
-	return text
+// startsMarkup reports whether c, following a '<', can start a tag, a
+// comment, a declaration or a processing instruction
+func startsMarkup(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80 ||
+		c == '_' || c == ':' || c == '/' || c == '!' || c == '?'
 }
 
 // sanitizeFilename sanitizes a filename by removing dangerous characters
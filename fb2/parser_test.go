@@ -1,8 +1,22 @@
 package fb2
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
 )
 
 func TestParseSimpleFB2(t *testing.T) {
@@ -36,7 +50,7 @@ func TestParseSimpleFB2(t *testing.T) {
 		t.Fatalf("ParseBytes() error = %v", err)
 	}
 
-	if fb2.Description.TitleInfo.BookTitle != "Test Book" {
+	if fb2.Description.TitleInfo.BookTitle.Plain != "Test Book" {
 		t.Errorf("BookTitle = %v, want 'Test Book'", fb2.Description.TitleInfo.BookTitle)
 	}
 
@@ -422,3 +436,887 @@ func TestImageDataToDataURL(t *testing.T) {
 		t.Error("HTML doesn't contain img tag")
 	}
 }
+
+func TestParseLeadingJunk(t *testing.T) {
+	data, err := os.ReadFile("testdata/leading_junk.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	parser := NewParser()
+	fb2, err := parser.ParseBytes(data)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	if fb2.Description.TitleInfo.BookTitle.Plain != "Junk Before Declaration" {
+		t.Errorf("BookTitle = %q, want 'Junk Before Declaration'", fb2.Description.TitleInfo.BookTitle)
+	}
+
+	// A BOM in the middle of the document is dropped as well
+	withBOM := bytes.Replace(data, []byte("<body>"), []byte("<body>\xef\xbb\xbf"), 1)
+	if _, err := parser.ParseBytes(withBOM); err != nil {
+		t.Errorf("ParseBytes() with mid-stream BOM error = %v", err)
+	}
+}
+
+func TestParseWideEncodings(t *testing.T) {
+	const fb2Data = `<?xml version="1.0" encoding="%s"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>Широкая книга</book-title><lang>ru</lang></title-info></description>
+	<body><section><p>Текст</p></section></body>
+</FictionBook>`
+
+	tests := []struct {
+		name     string
+		encoding encoding.Encoding
+	}{
+		{"UTF-16", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)},
+		{"UTF-16BE", unicode.UTF16(unicode.BigEndian, unicode.UseBOM)},
+		{"UTF-32", utf32.UTF32(utf32.LittleEndian, utf32.UseBOM)},
+		{"UTF-32BE", utf32.UTF32(utf32.BigEndian, utf32.UseBOM)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.encoding.NewEncoder().Bytes([]byte(fmt.Sprintf(fb2Data, tt.name)))
+			if err != nil {
+				t.Fatalf("Encode error = %v", err)
+			}
+
+			fb2, err := NewParser().ParseBytes(data)
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			if got := fb2.Description.TitleInfo.BookTitle.Plain; got != "Широкая книга" {
+				t.Errorf("BookTitle = %q, want 'Широкая книга'", got)
+			}
+		})
+	}
+}
+
+func TestTrimLeadingJunk(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"clean", "<?xml version=\"1.0\"?><FictionBook/>", "<?xml version=\"1.0\"?><FictionBook/>"},
+		{"whitespace", "\n\n  <?xml version=\"1.0\"?>", "<?xml version=\"1.0\"?>"},
+		{"no declaration", "junk<FictionBook xmlns=\"x\">", "<FictionBook xmlns=\"x\">"},
+		{"leading BOM kept", "\xef\xbb\xbf<?xml version=\"1.0\"?>", "\xef\xbb\xbf<?xml version=\"1.0\"?>"},
+		{"prefixed root", "junk<fb:FictionBook xmlns:fb=\"x\">", "<fb:FictionBook xmlns:fb=\"x\">"},
+		{"no markup", "garbage", "garbage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(trimLeadingJunk([]byte(tt.input)))
+			if got != tt.want {
+				t.Errorf("trimLeadingJunk(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferLargestCover(t *testing.T) {
+	encodePNG := func(w, h int) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	fb2Data := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<coverpage><image l:href="#thumb.png"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="thumb.png" content-type="image/png">%s</binary>
+	<binary id="cover_full.png" content-type="image/png">%s</binary>
+	<binary id="map.png" content-type="image/png">%s</binary>
+</FictionBook>`, encodePNG(10, 15), encodePNG(200, 300), encodePNG(1000, 1000))
+
+	tests := []struct {
+		name          string
+		prefer        bool
+		wantCoverID   string
+		wantThumbnail bool
+	}{
+		{"coverpage image", false, "thumb.png", false},
+		{"largest candidate", true, "cover_full.png", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := NewParser()
+			parser.PreferLargestCover = tt.prefer
+			doc, err := parser.ParseBytes([]byte(fb2Data))
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			m, err := parser.ExtractMetadata(doc)
+			if err != nil {
+				t.Fatalf("ExtractMetadata() error = %v", err)
+			}
+
+			if m.CoverID != tt.wantCoverID {
+				t.Errorf("CoverID = %q, want %q", m.CoverID, tt.wantCoverID)
+			}
+			if m.CoverExt != ".png" {
+				t.Errorf("CoverExt = %q, want .png", m.CoverExt)
+			}
+			if (m.Thumbnail != nil) != tt.wantThumbnail {
+				t.Errorf("Thumbnail set = %v, want %v", m.Thumbnail != nil, tt.wantThumbnail)
+			}
+			if tt.wantThumbnail && imageArea(m.Thumbnail) != 10*15 {
+				t.Errorf("Thumbnail area = %d, want %d", imageArea(m.Thumbnail), 10*15)
+			}
+		})
+	}
+}
+
+func TestInlineMarkupTitle(t *testing.T) {
+	tests := []struct {
+		title      string
+		wantPlain  string
+		wantMarkup string
+	}{
+		{"Test Book", "Test Book", "Test Book"},
+		{"H<sub>2</sub>O", "H₂O", "H<sub>2</sub>O"},
+		{"E=mc<sup>2</sup> &amp; more", "E=mc² & more", "E=mc<sup>2</sup> &amp; more"},
+		{"Vitamin B<sub>x</sub>", "Vitamin Bx", "Vitamin B<sub>x</sub>"},
+		{"<emphasis>Plain</emphasis> text", "Plain text", "Plain text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantPlain, func(t *testing.T) {
+			fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>` + tt.title + `</book-title><lang>en</lang></title-info></description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+			parser := NewParser()
+			doc, err := parser.ParseBytes([]byte(fb2Data))
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			m, err := parser.ExtractMetadata(doc)
+			if err != nil {
+				t.Fatalf("ExtractMetadata() error = %v", err)
+			}
+			if m.Title != tt.wantPlain {
+				t.Errorf("Title = %q, want %q", m.Title, tt.wantPlain)
+			}
+			if m.TitleMarkup != tt.wantMarkup {
+				t.Errorf("TitleMarkup = %q, want %q", m.TitleMarkup, tt.wantMarkup)
+			}
+		})
+	}
+}
+
+func TestImageHrefSpellings(t *testing.T) {
+	tests := []struct {
+		name  string
+		xmlns string
+		href  string
+	}{
+		{"l:href", `xmlns:l="http://www.w3.org/1999/xlink"`, `l:href="#pic.png"`},
+		{"xlink:href", `xmlns:xlink="http://www.w3.org/1999/xlink"`, `xlink:href="#pic.png"`},
+		{"undeclared prefix", ``, `l:href="#pic.png"`},
+		{"plain href", ``, `href="#pic.png"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" ` + tt.xmlns + `>
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<coverpage><image ` + tt.href + `/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><image ` + tt.href + ` alt="Picture"/></section></body>
+	<binary id="pic.png" content-type="image/png">iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==</binary>
+</FictionBook>`
+
+			parser := NewParser()
+			doc, err := parser.ParseBytes([]byte(fb2Data))
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+
+			if got := doc.Description.TitleInfo.Coverpage.PrimaryImage.Href(); got != "#pic.png" {
+				t.Errorf("Coverpage href = %q, want '#pic.png'", got)
+			}
+			img := doc.Bodies[0].Sections[0].Image[0]
+			if got := img.Href(); got != "#pic.png" {
+				t.Errorf("Image href = %q, want '#pic.png'", got)
+			}
+			if img.Alt != "Picture" {
+				t.Errorf("Image alt = %q, want 'Picture'", img.Alt)
+			}
+
+			m, err := parser.ExtractMetadata(doc)
+			if err != nil {
+				t.Fatalf("ExtractMetadata() error = %v", err)
+			}
+			if m.CoverID != "pic.png" || len(m.Cover) == 0 {
+				t.Errorf("Cover = %q (%d bytes), want 'pic.png' with data", m.CoverID, len(m.Cover))
+			}
+		})
+	}
+}
+
+func TestAuthorSortNames(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<author><first-name>John</first-name><middle-name>Q</middle-name><last-name>Doe</last-name></author>
+			<author><nickname>Dark Quill</nickname></author>
+			<author><first-name>Homer</first-name></author>
+			<book-title>Anthology</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes([]byte(fb2Data))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+
+	wantSorts := []string{"Doe, John Q", "Dark Quill", "Homer"}
+	if strings.Join(m.AuthorSorts, "|") != strings.Join(wantSorts, "|") {
+		t.Errorf("AuthorSorts = %q, want %q", m.AuthorSorts, wantSorts)
+	}
+	if m.AuthorSort != "Doe, John Q & Dark Quill & Homer" {
+		t.Errorf("AuthorSort = %q", m.AuthorSort)
+	}
+}
+
+func TestMetadataSources(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>Translated</book-title><lang>ru</lang></title-info>
+		<src-title-info><book-title>Original</book-title><lang>en</lang><isbn>978-0-00-000000-2</isbn></src-title-info>
+		<document-info>
+			<src-url>http://lib.example.org/b/12345</src-url>
+			<src-ocr>Scanned by Ivan</src-ocr>
+			<id>0B3C2A9E-7F41-4D2C-9A55-3F1E2D4C5B6A</id>
+		</document-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes([]byte(fb2Data))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+
+	want := []string{"urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a", "urn:isbn:9780000000002", "http://lib.example.org/b/12345"}
+	if got := m.Sources(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Sources() = %q, want %q", got, want)
+	}
+
+	m.SrcISBN = "978-0-00-000000-3"
+	want = []string{"urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a", "http://lib.example.org/b/12345"}
+	if got := m.Sources(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Sources() with an invalid ISBN = %q, want %q", got, want)
+	}
+	if m.SrcOCR != "Scanned by Ivan" {
+		t.Errorf("SrcOCR = %q, want %q", m.SrcOCR, "Scanned by Ivan")
+	}
+}
+
+func TestDocumentURN(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a", "urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a"},
+		{"urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a", "urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a"},
+		{"Lib.rus.ec-12345", "urn:fb2:Lib.rus.ec-12345"},
+	}
+
+	for _, tt := range tests {
+		if got := DocumentURN(tt.id); got != tt.want {
+			t.Errorf("DocumentURN(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestCoverFromBytes(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 6))); err != nil {
+		t.Fatal(err)
+	}
+	book := func(binary string) []byte {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<coverpage><image l:href="#cover.png"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	` + binary + `
+</FictionBook>`)
+	}
+
+	// Run from an empty directory so nothing can come from disk
+	t.Chdir(t.TempDir())
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes(book(`<binary id="cover.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(img.Bytes()) + `</binary>`))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+	if !bytes.Equal(m.Cover, img.Bytes()) || m.CoverExt != ".png" {
+		t.Errorf("Cover = %d bytes with extension %q, want the %d byte PNG", len(m.Cover), m.CoverExt, img.Len())
+	}
+
+	// A book without the binary gets no cover, even from a reused parser
+	doc, err = parser.ParseBytes(book(""))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err = parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+	if m.Cover != nil {
+		t.Errorf("Cover = %d bytes from the previous book", len(m.Cover))
+	}
+}
+
+func TestExtractDir(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="pic.png" content-type="image/png">iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==</binary>
+	<binary id="../escape.png" content-type="image/png">iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==</binary>
+</FictionBook>`)
+
+	cwd := t.TempDir()
+	t.Chdir(cwd)
+
+	parser := NewParser()
+	if _, err := parser.ParseBytes(fb2Data); err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if len(parser.GetImageData()) != 2 {
+		t.Errorf("Decoded %d binaries, want 2", len(parser.GetImageData()))
+	}
+	if entries, _ := os.ReadDir(cwd); len(entries) != 0 {
+		t.Errorf("Parsing without ExtractDir created %d files", len(entries))
+	}
+
+	dir := filepath.Join(cwd, "images")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	parser.ExtractDir = dir
+	if _, err := parser.ParseBytes(fb2Data); err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	for _, name := range []string{"pic.png", "escape.png"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s not extracted: %v", name, err)
+		}
+	}
+	if entries, _ := os.ReadDir(cwd); len(entries) != 1 {
+		t.Errorf("Extraction wrote %d entries outside ExtractDir", len(entries)-1)
+	}
+}
+
+func TestMetadataAllSeries(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<sequence name="Main Cycle" number="2"/>
+			<sequence name="Collected Works" number="7"/>
+			<lang>en</lang>
+		</title-info>
+		<publish-info>
+			<sequence name="Main Cycle" number="2"/>
+			<sequence name="Pocket Library"/>
+		</publish-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes([]byte(fb2Data))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+
+	want := []SeriesInfo{{"Main Cycle", 2}, {"Collected Works", 7}, {"Pocket Library", 0}}
+	if fmt.Sprint(m.AllSeries) != fmt.Sprint(want) {
+		t.Errorf("AllSeries = %v, want %v", m.AllSeries, want)
+	}
+	if m.Series != "Main Cycle" || m.SeriesIndex != 2 {
+		t.Errorf("Series = %q #%d, want the first sequence", m.Series, m.SeriesIndex)
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		isbn  string
+		want  string
+		valid bool
+	}{
+		{"978-0-306-40615-7", "9780306406157", true},
+		{"ISBN 0-306-40615-2", "0306406152", true},
+		{"0-8044-2957-x", "080442957X", true},
+		{"ISBN-13: 978-0-306-40615-7", "9780306406157", true},
+		{"ISBN-10: 0-306-40615-2", "0306406152", true},
+		{"ISBN13 9780306406157", "9780306406157", true},
+		{"isbn 10: 0306406152", "0306406152", true},
+		{"ISBN:978-0-306-40615-7", "9780306406157", true},
+		{"978-0-306-40615-8", "", false},
+		{"12345", "", false},
+		{"n/a", "", false},
+	}
+
+	for _, tt := range tests {
+		got, valid := NormalizeISBN(tt.isbn)
+		if valid != tt.valid || (valid && got != tt.want) {
+			t.Errorf("NormalizeISBN(%q) = %q, %v, want %q, %v", tt.isbn, got, valid, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestMetadataDocumentInfo(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>Test Book</book-title><lang>en</lang></title-info>
+		<document-info>
+			<program-used>FictionBook Editor 2.6</program-used>
+			<date value="2011-03-14">14 March 2011</date>
+			<id>4a7c2e1b-9d3f-4c6a-8b2e-1f0d3c5a7e9b</id>
+			<version>1.2</version>
+		</document-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes([]byte(fb2Data))
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	m, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+
+	if m.DocumentID != "4a7c2e1b-9d3f-4c6a-8b2e-1f0d3c5a7e9b" {
+		t.Errorf("DocumentID = %q", m.DocumentID)
+	}
+	if m.DocumentVersion != "1.2" {
+		t.Errorf("DocumentVersion = %q, want 1.2", m.DocumentVersion)
+	}
+	if m.DocumentDate != "2011-03-14" {
+		t.Errorf("DocumentDate = %q, want 2011-03-14", m.DocumentDate)
+	}
+	if m.ProgramUsed != "FictionBook Editor 2.6" {
+		t.Errorf("ProgramUsed = %q", m.ProgramUsed)
+	}
+}
+
+func TestParseWrappedBinary(t *testing.T) {
+	// The PNG split over indented lines and its "==" padding dropped, as
+	// some FB2 editors write it
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="pic.png" content-type="image/png">
+		iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJ
+		AAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5E
+		rkJggg
+	</binary>
+	<binary id="broken.png" content-type="image/png">***</binary>
+</FictionBook>`)
+
+	parser := NewParser()
+	if _, err := parser.ParseBytes(fb2Data); err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	data, ok := parser.GetImageData()["pic.png"]
+	if !ok {
+		t.Fatal("pic.png was not decoded")
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("pic.png decoded to an unreadable image: %v", err)
+	}
+
+	if _, ok := parser.GetImageData()["broken.png"]; ok {
+		t.Error("broken.png was decoded")
+	}
+	warnings := parser.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"broken.png"`) {
+		t.Errorf("Warnings() = %q, want one about broken.png", warnings)
+	}
+}
+
+func TestSniffImageType(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", "image/jpeg"},
+		{"png", "\x89PNG\r\n\x1A\n\x00\x00\x00\rIHDR", "image/png"},
+		{"gif", "GIF89a\x01\x00\x01\x00", "image/gif"},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"svg", `<svg xmlns="http://www.w3.org/2000/svg"/>`, "image/svg+xml"},
+		{"svg with prolog", "\xEF\xBB\xBF<?xml version=\"1.0\"?>\n<!DOCTYPE svg>\n<svg/>", "image/svg+xml"},
+		{"other riff", "RIFF\x24\x00\x00\x00WAVEfmt ", ""},
+		{"other xml", `<?xml version="1.0"?><html/>`, ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffImageType([]byte(tt.data)); got != tt.want {
+				t.Errorf("SniffImageType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotationHTML(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<annotation>
+				<p>First <emphasis>paragraph</emphasis> &amp; more.</p>
+				<p>Second with <strong>bold</strong>, a <a l:href="https://example.com/?a=1&amp;b=2">site</a> and a note<a l:href="#n1" type="note">1</a>.</p>
+				<empty-line/>
+				<p>Third &lt;script&gt;</p>
+			</annotation>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`)
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	metadata, err := parser.ExtractMetadata(doc)
+	if err != nil {
+		t.Fatalf("ExtractMetadata() error = %v", err)
+	}
+
+	want := "<p>First <em>paragraph</em> &amp; more.</p>\n" +
+		"<p>Second with <strong>bold</strong>, a <a href=\"https://example.com/?a=1&amp;b=2\">site</a> and a note1.</p>\n" +
+		"<p>Third &lt;script&gt;</p>\n"
+	if metadata.AnnotationHTML != want {
+		t.Errorf("AnnotationHTML = %q, want %q", metadata.AnnotationHTML, want)
+	}
+	if strings.Contains(metadata.Annotation, "<em>") {
+		t.Errorf("Annotation = %q, want plain text", metadata.Annotation)
+	}
+}
+
+func TestFixXMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"valid markup", `<p id="a">x &amp; y &lt;&gt; &quot;&apos; &#169; &#xA9; &#XA9;</p>`, `<p id="a">x &amp; y &lt;&gt; &quot;&apos; &#169; &#xA9; &amp;#XA9;</p>`},
+		{"ampersand before space", "<p>Tom & Jerry</p>", "<p>Tom &amp; Jerry</p>"},
+		{"ampersand in URL", `<a l:href="http://example.com/?a=1&b=2">x</a>`, `<a l:href="http://example.com/?a=1&amp;b=2">x</a>`},
+		{"ampersand at end", "AT&", "AT&amp;"},
+		{"unterminated reference", "<p>&amp</p>", "<p>&amp;amp</p>"},
+		{"HTML entity", "<p>a&nbsp;b&mdash;c</p>", "<p>a b—c</p>"},
+		{"unknown entity", "<p>&bogus;</p>", "<p>&amp;bogus;</p>"},
+		{"less-than in text", "<p>a < b, 1<2</p>", "<p>a &lt; b, 1&lt;2</p>"},
+		{"control characters", "<p>a\x01b\x0Bc\td\r\ne￾f</p>", "<p>abc\td\r\nef</p>"},
+		{"control character references", "<p>a&#1;b&#11;c&#x1F;d&#9;&#xA;</p>", "<p>abcd&#9;&#xA;</p>"},
+		{"out of range references", "<p>a&#99999999999;b&#xD800;c&#xFFFE;d&#x110000;e&#x10FFFF;</p>", "<p>abcde&#x10FFFF;</p>"},
+		{"comment and declaration", "<?xml version=\"1.0\"?><!-- & --><p/>", "<?xml version=\"1.0\"?><!-- &amp; --><p/>"},
+		{"CDATA", "<p><![CDATA[a & b < c\x01]]> & d</p>", "<p><![CDATA[a & b < c\x01]]> &amp; d</p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fixXMLErrors(tt.in); got != tt.want {
+				t.Errorf("fixXMLErrors() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformedXML(t *testing.T) {
+	fb2Data := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		`<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Q&A` + "\x07" + `</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>See <a l:href="https://example.com/search?q=fb2&lang=en">this</a> &copy; 2020</p></section></body>
+</FictionBook>`)
+
+	doc, err := NewParser().ParseBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+	if got := doc.Description.TitleInfo.BookTitle.String(); got != "Q&A" {
+		t.Errorf("book title = %q, want %q", got, "Q&A")
+	}
+	p := doc.Bodies[0].Sections[0].Paragraphs[0]
+	if href := p.Inline[1].Href(); href != "https://example.com/search?q=fb2&lang=en" {
+		t.Errorf("link href = %q", href)
+	}
+	if !strings.HasSuffix(p.Text, "this © 2020") {
+		t.Errorf("paragraph text = %q", p.Text)
+	}
+}
+
+func TestParseNamespaces(t *testing.T) {
+	const book = `<description>
+		<title-info>
+			<genre>sf</genre>
+			<author><first-name>Ann</first-name><last-name>Smith</last-name></author>
+			<book-title>Namespaced</book-title>
+			<annotation><p>About <emphasis>it</emphasis>.</p></annotation>
+			<lang>en</lang>
+			<sequence name="Cycle" number="2"/>
+			<coverpage><image l:href="#cover.png"/></coverpage>
+		</title-info>
+		<document-info><id>doc-1</id></document-info>
+	</description>
+	<body><section><p>Text with a <a l:href="#n1" type="note">note</a>.</p></section></body>
+	<body name="notes"><section id="n1"><p>Note.</p></section></body>
+</FictionBook>`
+
+	parse := func(t *testing.T, root string) (*Parser, *Metadata) {
+		t.Helper()
+		body := book
+		if prefix, _, ok := strings.Cut(strings.TrimPrefix(root, "<"), ":FictionBook"); ok {
+			body = regexp.MustCompile(`<(/?)([a-z])`).ReplaceAllString(book, "<${1}"+prefix+":$2")
+			body = strings.Replace(body, "</FictionBook>", "</"+prefix+":FictionBook>", 1)
+		}
+		p := NewParser()
+		fb2, err := p.ParseBytes([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" + root + body))
+		if err != nil {
+			t.Fatalf("ParseBytes() error = %v", err)
+		}
+		if len(fb2.Bodies) != 2 || fb2.Bodies[0].Sections[0].Paragraphs[0].Inline[1].Href() != "#n1" {
+			t.Errorf("body not parsed: %+v", fb2.Bodies)
+		}
+		metadata, err := p.ExtractMetadata(fb2)
+		if err != nil {
+			t.Fatalf("ExtractMetadata() error = %v", err)
+		}
+		return p, metadata
+	}
+
+	_, want := parse(t, `<FictionBook xmlns="`+FB2NS+`" xmlns:l="`+XLINKNS+`">`)
+	if want.Title != "Namespaced" || want.Series != "Cycle" || want.CoverID != "cover.png" {
+		t.Fatalf("unexpected 2.0 metadata: %+v", want)
+	}
+
+	tests := []struct {
+		name     string
+		root     string
+		wantNS   string
+		wantWarn bool
+	}{
+		{"2.0", `<FictionBook xmlns="` + FB2NS + `" xmlns:l="` + XLINKNS + `">`, FB2NS, false},
+		{"2.1", `<FictionBook xmlns="` + FB21NS + `" xmlns:l="` + XLINKNS + `">`, FB21NS, false},
+		{"trailing slash", `<FictionBook xmlns="` + FB21NS + `/" xmlns:l="` + XLINKNS + `">`, FB21NS, false},
+		{"missing", `<FictionBook xmlns:l="` + XLINKNS + `">`, FB2NS, false},
+		{"typo", `<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbok/2.0" xmlns:l="` + XLINKNS + `">`, FB2NS, true},
+		{"prefixed", `<fb:FictionBook xmlns:fb="` + FB21NS + `" xmlns:l="` + XLINKNS + `">`, FB21NS, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, got := parse(t, tt.root)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("metadata = %+v, want %+v", got, want)
+			}
+			if ns := p.GetNamespace(); ns != tt.wantNS {
+				t.Errorf("GetNamespace() = %q, want %q", ns, tt.wantNS)
+			}
+			if warned := len(p.Warnings()) > 0; warned != tt.wantWarn {
+				t.Errorf("Warnings() = %v, want warning %v", p.Warnings(), tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestFBZEntrySelection(t *testing.T) {
+	book := func(title string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>` + title + `</book-title><lang>en</lang></title-info></description>
+	<body><section><p>Text.</p></section></body>
+</FictionBook>`
+	}
+	fork := strings.Repeat("\x00\x05\x16\x07", 1024) // AppleDouble junk, larger than the book
+
+	type entry struct{ name, data string }
+	tests := []struct {
+		name      string
+		entries   []entry
+		wantTitle string
+		wantErr   string
+	}{
+		{
+			name: "macOS shadow",
+			entries: []entry{
+				{"__MACOSX/", ""},
+				{"__MACOSX/._book.fb2", fork},
+				{"book.fb2", book("Real")},
+			},
+			wantTitle: "Real",
+		},
+		{
+			name: "dotfiles",
+			entries: []entry{
+				{"books/._book.fb2", fork},
+				{".hidden/book.fb2", fork},
+				{"books/book.FB2", book("Real")},
+			},
+			wantTitle: "Real",
+		},
+		{
+			name: "largest",
+			entries: []entry{
+				{"sample.fb2", book("Sample")},
+				{"full.fb2", book("Full text of the book")},
+			},
+			wantTitle: "Full text of the book",
+		},
+		{
+			name: "ambiguous",
+			entries: []entry{
+				{"one.fb2", book("One")},
+				{"two.fb2", book("Two")},
+			},
+			wantErr: "one.fb2, two.fb2",
+		},
+		{
+			name: "none",
+			entries: []entry{
+				{"__MACOSX/._book.fb2", fork},
+				{"cover.jpg", "jpeg"},
+			},
+			wantErr: "no .fb2 file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			for _, e := range tt.entries {
+				w, err := zw.Create(e.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write([]byte(e.data))
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), "book.fbz")
+			if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			parses := map[string]func() (*FictionBook, error){
+				"ParseFile": func() (*FictionBook, error) { return NewParser().ParseFile(path) },
+				"ParseFBZ":  func() (*FictionBook, error) { return NewParser().ParseFBZ(path) },
+				"ParseFBZReader": func() (*FictionBook, error) {
+					return NewParser().ParseFBZReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				},
+			}
+			for name, parse := range parses {
+				fb2, err := parse()
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("%s() error = %v, want %q", name, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s() error = %v", name, err)
+				}
+				if got := fb2.Description.TitleInfo.BookTitle.Plain; got != tt.wantTitle {
+					t.Errorf("%s() BookTitle = %q, want %q", name, got, tt.wantTitle)
+				}
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			data, err := UnpackFBZ(buf.Bytes())
+			if err != nil {
+				t.Fatalf("UnpackFBZ() error = %v", err)
+			}
+			if !strings.Contains(string(data), tt.wantTitle) {
+				t.Errorf("UnpackFBZ() picked another entry: %.80q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package fb2
+
+import (
+	"slices"
+	"strings"
+)
+
+// Placeholders standing in for content that has no text form
+const (
+	TextImagePlaceholder = "[Image]"
+	TextTablePlaceholder = "[Table]"
+)
+
+// transformToText renders the book as plain UTF-8 text for indexing,
+// search and text-to-speech. It walks the document like transformToHTML:
+// the annotation, then the main text and the notes, with section content
+// in document order. Titles, paragraphs and stanzas are blocks separated
+// by blank lines; verses keep one line each. Images and tables are
+// reduced to placeholders.
+func (t *Transformer) transformToText(fb2 *FictionBook) string {
+	t.typography = nil
+	if t.Typography {
+		rules := GetTypographyRules(fb2.Description.TitleInfo.Language)
+		t.typography = &rules
+	}
+
+	w := &textWriter{t: t}
+
+	if fb2.Description.TitleInfo.Annotation != nil {
+		w.block(extractTextContent(fb2.Description.TitleInfo.Annotation))
+	}
+
+	for _, body := range fb2.Bodies {
+		if !body.IsNotes() {
+			w.body(body)
+		}
+	}
+	for _, body := range fb2.Bodies {
+		if body.IsNotes() {
+			w.body(body)
+		}
+	}
+
+	if len(w.blocks) == 0 {
+		return ""
+	}
+	return strings.Join(w.blocks, "\n\n") + "\n"
+}
+
+// textWriter collects the text blocks of a book
+type textWriter struct {
+	t      *Transformer
+	blocks []string
+}
+
+// block adds a block of the given lines, leaving out empty ones
+func (w *textWriter) block(lines ...string) {
+	var kept []string
+	for _, line := range lines {
+		if line = w.line(line); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) > 0 {
+		w.blocks = append(w.blocks, strings.Join(kept, "\n"))
+	}
+}
+
+// line collapses the whitespace of a text run, as HTML rendering does,
+// and applies the typography pass when enabled
+func (w *textWriter) line(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if w.t.typography != nil && s != "" {
+		s = ApplyTypography(s, *w.t.typography)
+	}
+	return s
+}
+
+// body writes a body: the heading of a named body, then its sections
+func (w *textWriter) body(body Body) {
+	if body.Name != "" {
+		heading := []string{body.Name}
+		if body.Title != nil && len(body.Title.P) > 0 {
+			heading = paragraphTexts(body.Title.P)
+		}
+		w.block(heading...)
+	}
+	for _, section := range body.Sections {
+		w.section(section)
+	}
+}
+
+// section writes the children of a section in document order
+func (w *textWriter) section(section Section) {
+	for _, child := range section.children() {
+		switch child.Name {
+		case "title":
+			if section.Title != nil {
+				w.block(paragraphTexts(section.Title.P)...)
+			}
+		case "subtitle":
+			w.block(section.Subtitles[child.Index].Text)
+		case "epigraph":
+			w.epigraph(section.Epigraphs[child.Index])
+		case "annotation":
+			annotation := section.Annotation
+			w.block(annotation.Text)
+			for _, p := range annotation.P {
+				w.block(p.Text)
+			}
+		case "cite":
+			cite := section.Cite[child.Index]
+			for _, node := range cite.Content {
+				w.block(node.Content)
+			}
+			w.block(authorNames(cite.Authors)...)
+		case "stanza":
+			w.stanza(section.Stanza[child.Index])
+		case "poem":
+			w.poem(section.Poem[child.Index])
+		case "code":
+			// Code keeps its line breaks and indentation
+			if code := strings.Trim(section.Code[child.Index].Text, "\n"); strings.TrimSpace(code) != "" {
+				w.blocks = append(w.blocks, code)
+			}
+		case "table":
+			w.block(TextTablePlaceholder)
+		case "image":
+			w.block(TextImagePlaceholder)
+		case "p":
+			w.block(section.Paragraphs[child.Index].Text)
+		case "section":
+			w.section(section.Sections[child.Index])
+		}
+	}
+}
+
+// epigraph writes the text of an epigraph followed by its authors
+func (w *textWriter) epigraph(epigraph Epigraph) {
+	for _, node := range epigraph.Content {
+		w.block(node.Content)
+	}
+	w.block(authorNames(epigraph.Authors)...)
+}
+
+// stanza writes a stanza as one block, a line per verse
+func (w *textWriter) stanza(stanza Stanza) {
+	if stanza.Title != nil {
+		w.block(paragraphTexts(stanza.Title.P)...)
+	}
+	lines := make([]string, len(stanza.V))
+	for i, v := range stanza.V {
+		lines[i] = v.Text
+	}
+	w.block(lines...)
+	w.block(stanza.TextAuthors...)
+}
+
+// poem writes a poem: title, epigraphs, stanzas and attribution
+func (w *textWriter) poem(poem Poem) {
+	if poem.Title != nil {
+		w.block(paragraphTexts(poem.Title.P)...)
+	}
+	for _, epigraph := range poem.Epigraphs {
+		w.epigraph(epigraph)
+	}
+	for _, stanza := range poem.AllStanzas() {
+		w.stanza(stanza)
+	}
+	w.block(append(slices.Clone(poem.TextAuthors), poem.Date.Text)...)
+}
+
+// paragraphTexts returns the text of each paragraph
+func paragraphTexts(paragraphs []P) []string {
+	texts := make([]string, len(paragraphs))
+	for i, p := range paragraphs {
+		texts[i] = p.Text
+	}
+	return texts
+}
+
+// authorNames returns the display name of each author
+func authorNames(authors []Author) []string {
+	names := make([]string, len(authors))
+	for i, author := range authors {
+		names[i] = formatAuthorName(author)
+	}
+	return names
+}
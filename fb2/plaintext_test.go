@@ -0,0 +1,69 @@
+package fb2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextMode(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<title><p>Chapter One</p></title>
+	<p>First paragraph with <emphasis>emphasis</emphasis> &amp; an ampersand.</p>
+	<p>Second
+	paragraph.</p>
+	<image l:href="#pic.png"/>
+	<poem>
+		<stanza>
+			<v>Roses are red,</v>
+			<v>Violets are blue.</v>
+		</stanza>
+	</poem>
+	<table><tr><td>Cell</td></tr></table>
+	<section>
+		<title><p>Part A</p></title>
+		<p>Nested text.</p>
+	</section>
+</section>
+<section>
+	<title><p>Chapter Two</p></title>
+	<p>Last paragraph.</p>
+</section>`)
+
+	transformer := NewTransformer()
+	transformer.TextMode = true
+	text, css, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if css != "" {
+		t.Errorf("text mode returned CSS %q", css)
+	}
+
+	want := `Chapter One
+
+First paragraph with emphasis & an ampersand.
+
+Second paragraph.
+
+[Image]
+
+Roses are red,
+Violets are blue.
+
+[Table]
+
+Part A
+
+Nested text.
+
+Chapter Two
+
+Last paragraph.
+`
+	if text != want {
+		t.Errorf("text =\n%s\nwant\n%s", text, want)
+	}
+	if strings.ContainsAny(text, "<>") {
+		t.Error("text contains markup")
+	}
+}
@@ -0,0 +1,117 @@
+package fb2
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// sampleMinBodyChars is the body length below which a book is suspiciously
+// short for a full book
+const sampleMinBodyChars = 2000
+
+// samplePhrases are lowercase phrases stores put into promotional stubs
+var samplePhrases = []string{
+	"ознакомительный фрагмент",
+	"ознакомительного фрагмента",
+	"полную версию книги",
+	"купить полную версию",
+	"купить книгу",
+	"end of sample",
+	"this is a sample",
+	"buy the full book",
+	"buy the full version",
+	"full version of this book",
+}
+
+// SampleInfo is the result of the sample/stub heuristic. It is a hint for
+// the caller, not a validation error.
+type SampleInfo struct {
+	Likely     bool     // Confidence is high enough to treat the book as a sample
+	Confidence float64  // 0 (full book) to 1 (certainly a stub)
+	BodyChars  int      // Characters of text in the main bodies
+	Reasons    []string // Human-readable evidence
+}
+
+// DetectSample guesses whether the document is a promotional sample or a
+// stub whose body was replaced with a "buy the full book" notice. It looks
+// at the amount of body text compared to the metadata and for phrases such
+// stubs typically contain. Notes and comments bodies are ignored.
+func DetectSample(fb2 *FictionBook) SampleInfo {
+	var text strings.Builder
+	for _, body := range fb2.Bodies {
+		if body.IsNotes() {
+			continue
+		}
+		for _, section := range body.Sections {
+			writeSectionText(&text, section)
+		}
+	}
+
+	body := text.String()
+	info := SampleInfo{BodyChars: utf8.RuneCountInString(strings.Join(strings.Fields(body), " "))}
+
+	lower := strings.ToLower(body)
+	for _, phrase := range samplePhrases {
+		if strings.Contains(lower, phrase) {
+			info.Confidence += 0.6
+			info.Reasons = append(info.Reasons, fmt.Sprintf("body contains %q", phrase))
+			break
+		}
+	}
+
+	if info.BodyChars < sampleMinBodyChars {
+		info.Confidence += 0.3
+		info.Reasons = append(info.Reasons, fmt.Sprintf("body has only %d characters of text", info.BodyChars))
+	}
+
+	if annotation := annotationLength(fb2.Description.TitleInfo.Annotation); annotation > info.BodyChars {
+		info.Confidence += 0.3
+		info.Reasons = append(info.Reasons, fmt.Sprintf("body is shorter than the annotation (%d characters)", annotation))
+	}
+
+	info.Confidence = min(info.Confidence, 1)
+	info.Likely = info.Confidence >= 0.5
+	return info
+}
+
+// writeSectionText appends the plain text of a section and its subsections
+func writeSectionText(buf *strings.Builder, section Section) {
+	if section.Title != nil {
+		for _, p := range section.Title.P {
+			buf.WriteString(p.Text)
+			buf.WriteByte('\n')
+		}
+	}
+	for _, p := range section.Paragraphs {
+		buf.WriteString(p.Text)
+		buf.WriteByte('\n')
+	}
+	for _, node := range section.Content {
+		buf.WriteString(node.Content)
+		buf.WriteByte('\n')
+	}
+	for _, poem := range section.Poem {
+		for _, stanza := range poem.AllStanzas() {
+			for _, v := range stanza.V {
+				buf.WriteString(v.Text)
+				buf.WriteByte('\n')
+			}
+		}
+	}
+	for _, sub := range section.Sections {
+		writeSectionText(buf, sub)
+	}
+}
+
+// annotationLength returns the number of characters in an annotation
+func annotationLength(annotation *TextContainer) int {
+	if annotation == nil {
+		return 0
+	}
+	parts := strings.Fields(annotation.Text)
+	for _, p := range annotation.P {
+		parts = append(parts, strings.Fields(p.Text)...)
+	}
+	return utf8.RuneCountInString(strings.Join(parts, " "))
+}
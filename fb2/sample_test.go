@@ -0,0 +1,57 @@
+package fb2
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDetectSample(t *testing.T) {
+	fullText := strings.Repeat("<p>It was a long and winding story that went on for pages.</p>\n", 100)
+	book := func(annotation, body string) string {
+		return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<annotation><p>%s</p></annotation>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section>%s</section></body>
+	<body name="notes"><section>%s</section></body>
+</FictionBook>`, annotation, body, fullText)
+	}
+
+	tests := []struct {
+		name       string
+		fb2        string
+		wantLikely bool
+	}{
+		{"full book", book("A story.", fullText), false},
+		{"short story", book("A story.", "<p>A very short story.</p>"), false},
+		{"stub phrase", book("A story.", fullText+"<p>This is a sample. Buy the full book!</p>"), true},
+		{"russian stub", book("Роман.", "<p>Конец ознакомительного фрагмента.</p>"), true},
+		{"body shorter than annotation", book(strings.Repeat("Long annotation. ", 20), "<p>Chapter one.</p>"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := NewParser().ParseBytes([]byte(tt.fb2))
+			if err != nil {
+				t.Fatalf("ParseBytes() error = %v", err)
+			}
+			info := DetectSample(doc)
+			if info.Likely != tt.wantLikely {
+				t.Errorf("Likely = %v, want %v (confidence %.1f, reasons %q)",
+					info.Likely, tt.wantLikely, info.Confidence, info.Reasons)
+			}
+			if info.Confidence < 0 || info.Confidence > 1 {
+				t.Errorf("Confidence = %v, want within [0, 1]", info.Confidence)
+			}
+			if info.Likely && len(info.Reasons) == 0 {
+				t.Error("Likely sample has no reasons")
+			}
+		})
+	}
+}
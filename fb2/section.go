@@ -0,0 +1,117 @@
+package fb2
+
+import "encoding/xml"
+
+// SectionChild refers to a child element of a section: its element name
+// and its index in the section field holding elements of that kind
+type SectionChild struct {
+	Name  string
+	Index int
+}
+
+// UnmarshalXML decodes the section into its fields like the default
+// decoding would, and records the document order of the child elements in
+// Order so content can be rendered as it was written (an image between two
+// paragraphs, a subtitle in the middle of a chapter).
+func (s *Section) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	s.XMLName = start.Name
+	for _, a := range start.Attr {
+		switch a.Name.Local {
+		case "id":
+			s.ID = a.Value
+		case "name":
+			s.Name = a.Value
+		}
+	}
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			index := 0
+			switch tok.Name.Local {
+			case "title":
+				s.Title = new(Title)
+				err = d.DecodeElement(s.Title, &tok)
+			case "annotation":
+				s.Annotation = new(TextContainer)
+				err = d.DecodeElement(s.Annotation, &tok)
+			case "epigraph":
+				index, err = decodeAppend(d, &tok, &s.Epigraphs)
+			case "section":
+				index, err = decodeAppend(d, &tok, &s.Sections)
+			case "p":
+				index, err = decodeAppend(d, &tok, &s.Paragraphs)
+			case "subtitle":
+				index, err = decodeAppend(d, &tok, &s.Subtitles)
+			case "cite":
+				index, err = decodeAppend(d, &tok, &s.Cite)
+			case "stanza":
+				index, err = decodeAppend(d, &tok, &s.Stanza)
+			case "poem":
+				index, err = decodeAppend(d, &tok, &s.Poem)
+			case "code":
+				index, err = decodeAppend(d, &tok, &s.Code)
+			case "table":
+				index, err = decodeAppend(d, &tok, &s.Table)
+			case "image":
+				index, err = decodeAppend(d, &tok, &s.Image)
+			default:
+				index, err = decodeAppend(d, &tok, &s.Content)
+			}
+			if err != nil {
+				return err
+			}
+			s.Order = append(s.Order, SectionChild{Name: tok.Name.Local, Index: index})
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// decodeAppend decodes the element into a new item of the list and
+// returns its index
+func decodeAppend[T any](d *xml.Decoder, start *xml.StartElement, list *[]T) (int, error) {
+	var v T
+	if err := d.DecodeElement(&v, start); err != nil {
+		return 0, err
+	}
+	*list = append(*list, v)
+	return len(*list) - 1, nil
+}
+
+// children returns the child elements of the section in document order.
+// Sections that weren't decoded from XML have no recorded order; their
+// children are listed by kind.
+func (s *Section) children() []SectionChild {
+	if s.Order != nil {
+		return s.Order
+	}
+
+	var order []SectionChild
+	add := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			order = append(order, SectionChild{Name: name, Index: i})
+		}
+	}
+	if s.Title != nil {
+		add("title", 1)
+	}
+	add("subtitle", len(s.Subtitles))
+	add("epigraph", len(s.Epigraphs))
+	if s.Annotation != nil {
+		add("annotation", 1)
+	}
+	add("cite", len(s.Cite))
+	add("stanza", len(s.Stanza))
+	add("poem", len(s.Poem))
+	add("code", len(s.Code))
+	add("table", len(s.Table))
+	add("image", len(s.Image))
+	add("p", len(s.Paragraphs))
+	add("section", len(s.Sections))
+	return order
+}
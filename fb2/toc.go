@@ -7,7 +7,8 @@ import (
 
 // ExtractTOC extracts table of contents from FB2 document structure
 func (p *Parser) ExtractTOC(fb2 *FictionBook) (*TOCData, error) {
-	if len(fb2.Bodies) == 0 || len(fb2.Bodies[0].Sections) == 0 {
+	body := fb2.MainBody()
+	if body == nil || len(body.Sections) == 0 {
 		return nil, nil // No TOC available
 	}
 
@@ -15,8 +16,8 @@ func (p *Parser) ExtractTOC(fb2 *FictionBook) (*TOCData, error) {
 		Entries: []*TOCEntry{},
 	}
 
-	// Extract TOC from main body sections (usually the first one)
-	for _, section := range fb2.Bodies[0].Sections {
+	// Extract TOC from main body sections
+	for _, section := range body.Sections {
 		p.extractSectionTOC(&section, toc.Root, 1, toc)
 	}
 
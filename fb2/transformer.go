@@ -7,9 +7,56 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// linkRegex matches anchors with a double-quoted href, capturing the href,
+// remaining attributes and the link text
+var linkRegex = regexp.MustCompile(`(?s)<a\s+href="([^"]*)"([^>]*)>(.*?)</a>`)
+
+// LinkResolver maps a link target to a new one. It returns false when the
+// link is not handled, in which case the original href is kept. Returning
+// an empty href with true removes the link and keeps only its text.
+type LinkResolver func(href string) (string, bool)
+
+// Section annotation styles
+const (
+	SectionAnnotationSummary   = "summary"   // Inline summary block
+	SectionAnnotationPullQuote = "pullquote" // Magazine-style pull-quote
+)
+
+// defaultCSS is the built-in stylesheet of modern (non-MOBI) HTML output
+const defaultCSS = `body { text-align: justify; margin: 2em; }
+h1, h2, h3, h4, h5, h6 { font-weight: bold; page-break-before: always; }
+h1 { font-size: 160%; border: 1px solid black; background-color: #E7E7E7; padding: 0.5em; }
+h2 { font-size: 130%; border: 1px solid gray; background-color: #EEEEEE; padding: 0.5em; }
+h3 { font-size: 110%; border: 1px solid silver; background-color: #F1F1F1; padding: 0.5em; }
+h4 { font-size: 100%; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
+h5 { font-size: 100%; font-style: italic; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
+h6 { font-size: 100%; font-style: italic; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
+.epigraph { width: 75%; margin-left: 25%; font-style: italic; }
+.subtitle { text-align: center; }
+.paragraph { text-indent: 2em; margin-top: 0; margin-bottom: 0; }
+blockquote { margin-left: 4em; margin-top: 1em; margin-right: 0.2em; }
+code { font-family: monospace; }
+table { border-collapse: collapse; margin: 1em auto; }
+td, th { border: 1px solid black; padding: 0.3em; }
+.figure { text-align: center; margin: 1em 0; }
+.caption { font-style: italic; }
+.annotation { margin: 1em 2em; font-size: 90%; }
+.notes { font-size: 90%; }
+.empty-line { height: 1em; }
+a.noteref { text-decoration: none; }
+div.pullquote { margin: 1.5em 10%; padding: 0.5em 0; border-top: 2px solid gray; border-bottom: 2px solid gray; font-size: 130%; font-style: italic; text-align: center; }
+`
+
+// DefaultMaxParagraphLength is a paragraph length well above normal prose,
+// used as the default threshold for splitting paragraphs
+const DefaultMaxParagraphLength = 10000
+
 // Transformer converts FB2 to HTML
 type Transformer struct {
 	parser *Parser
@@ -21,9 +68,83 @@ type Transformer struct {
 	Title       string // Override title
 	MOBIMode    bool   // If true, generate minimalist HTML for MOBI
 
+	// TextMode makes ConvertBytes return plain UTF-8 text instead of HTML
+	// (titles, paragraphs and verses; images and tables as placeholders)
+	TextMode bool
+
+	// LinkResolver, if set, rewrites links that point outside the book
+	LinkResolver LinkResolver
+
+	// Typography enables the typography pass on text runs (quotes, dashes,
+	// ellipses, non-breaking spaces) using the rules of the book language
+	Typography bool
+	typography *TypographyRules
+
+	// ImageCaptions renders the title (or alt) of block images as a visible
+	// caption beneath the image
+	ImageCaptions bool
+
+	// StableAnchors gives every section paragraph an id attribute that is
+	// the same each time the book is converted. Paragraphs keep their FB2
+	// id if they have one, otherwise see ParagraphAnchor.
+	StableAnchors bool
+
+	// SectionAnnotationStyle selects how section annotations render:
+	// SectionAnnotationSummary (default) or SectionAnnotationPullQuote.
+	// Unknown styles render as summaries.
+	SectionAnnotationStyle string
+
+	// MaxParagraphLength, if positive, splits paragraphs longer than this
+	// many characters into several at sentence or word boundaries. It is a
+	// safeguard for broken files with the whole book in one paragraph,
+	// which otherwise can't be chunked and make readers sluggish.
+	MaxParagraphLength int
+
+	// CodeWrap, if positive, inserts a line break opportunity every CodeWrap
+	// characters of unbroken <code> text so long identifiers and URLs wrap
+	// instead of being clipped on small screens
+	CodeWrap int
+
+	// CodeFontScale, if positive, scales the font size of <code> blocks
+	// (e.g. 0.8 for 80%)
+	CodeFontScale float64
+
+	// ForceEncoding decodes the input with this encoding instead of the
+	// detected one (see Parser.ForceEncoding)
+	ForceEncoding string
+
+	// NoDefaultCSS omits the built-in style block from modern HTML output,
+	// leaving the look to ExtraCSS or the reading system
+	NoDefaultCSS bool
+
+	// ExtraCSS is added to the head of modern HTML output as a style block
+	// after the built-in one, so its rules take precedence. Converted
+	// books take their user CSS from ConvertOptions.CSS instead.
+	ExtraCSS string
+
+	// Direction is the text direction: DirectionAuto (default, from the
+	// book language), DirectionLTR or DirectionRTL. Right-to-left books
+	// get dir="rtl" on the html and body elements.
+	Direction string
+
+	// TitlePage is the HTML of a title page to open the book with, e.g.
+	// from opf.HTMLProcessor.GenerateTitlePage. It is placed after the
+	// cover page, or before it with TitlePageBeforeCover, in a div with
+	// the id TitlePageID.
+	TitlePage            string
+	TitlePageBeforeCover bool
+
+	// NoCoverPage leaves the cover page out of the text, for writers that
+	// add a cover page of their own (EPUB's cover.xhtml)
+	NoCoverPage bool
+
 	// CSS processing
 	cssContent string
 
+	// noteRefs maps a note id to the id of the first reference to it, the
+	// target of the back link from the note
+	noteRefs map[string]string
+
 	// Output
 	HTML     string
 	CSS      string
@@ -53,6 +174,7 @@ func (t *Transformer) Convert(input io.Reader) (string, string, *Metadata, error
 // ConvertBytes converts FB2 bytes to HTML
 func (t *Transformer) ConvertBytes(data []byte) (string, string, *Metadata, error) {
 	// Parse FB2
+	t.parser.ForceEncoding = t.ForceEncoding
 	fb2, err := t.parser.ParseBytes(data)
 	if err != nil {
 		return "", "", nil, err
@@ -65,6 +187,10 @@ func (t *Transformer) ConvertBytes(data []byte) (string, string, *Metadata, erro
 	}
 	t.Metadata = metadata
 
+	if t.TextMode {
+		return t.transformToText(fb2), "", metadata, nil
+	}
+
 	// Process stylesheets (if any)
 	t.processStylesheets(fb2)
 
@@ -84,67 +210,110 @@ func (t *Transformer) ConvertFile(path string) (string, string, *Metadata, error
 	return t.ConvertBytes(data)
 }
 
-// processStylesheets extracts and processes CSS stylesheets
+// processStylesheets collects the CSS of the document's text/css
+// stylesheets. It is returned by ConvertBytes and linked from modern HTML
+// output as styles.css.
 func (t *Transformer) processStylesheets(fb2 *FictionBook) {
-	var css strings.Builder
+	var sheets []string
+	if t.ProcessCSS {
+		for _, sheet := range fb2.Stylesheets {
+			if sheet.Type != "" && sheet.Type != "text/css" {
+				continue
+			}
+			if css := strings.TrimSpace(sheet.Content); css != "" {
+				sheets = append(sheets, css)
+			}
+		}
+	}
+	t.cssContent = strings.Join(sheets, "\n\n")
+}
 
-	// In a full implementation, we'd extract and process stylesheets
-	// For now, we'll just note where CSS would go
+// inlineTOCID is the anchor of the inline TOC in MOBI output, which the
+// guide's toc reference points at
+const inlineTOCID = "inline_toc"
 
-	t.cssContent = css.String()
-}
+// TitlePageID is the id of the element holding Transformer.TitlePage
+const TitlePageID = "title_page"
+
+// coverPageID is the anchor of the cover page in MOBI output when the
+// title page comes before it
+const coverPageID = "cover_page"
 
 // transformToHTML transforms FB2 to HTML
 func (t *Transformer) transformToHTML(fb2 *FictionBook) string {
 	var buf bytes.Buffer
 
+	t.noteRefs = make(map[string]string)
+	t.typography = nil
+	if t.Typography {
+		rules := GetTypographyRules(fb2.Description.TitleInfo.Language)
+		t.typography = &rules
+	}
+
+	dirAttr := ""
+	if ResolveDirection(t.Direction, fb2.Description.TitleInfo.Language) == DirectionRTL {
+		dirAttr = ` dir="rtl"`
+	}
+
+	hasCover := !t.NoCoverPage && fb2.Description.TitleInfo.Coverpage.PrimaryImage.Href() != ""
+	hasInlineTOC := !t.NoInlineTOC && fb2.MainBody() != nil
+	hasTitlePage := t.TitlePage != ""
+	titlePageFirst := hasTitlePage && (t.TitlePageBeforeCover || !hasCover)
+
 	if t.MOBIMode {
 		// Minimalist MOBI HTML with mandatory head/guide
-		buf.WriteString("<html>\n<head>\n")
-		// Add guide for TOC if generated
-		if !t.NoInlineTOC && fb2.Description.TitleInfo.Coverpage.PrimaryImage.Href != "" {
-			// Note: filepos will be resolved by the reader or binary TOC
+		buf.WriteString("<html" + dirAttr + ">\n<head>\n")
+		// The guide backs the Kindle "Go To" menu. The text starts with
+		// the cover or title page; the MOBI writer resolves the other
+		// hrefs to a filepos.
+		if hasCover || hasInlineTOC || hasTitlePage {
 			buf.WriteString("<guide>\n")
-			buf.WriteString("  <reference type=\"cover\" title=\"Cover\" filepos=\"0000000000\" />\n")
+			switch {
+			case hasCover && titlePageFirst:
+				buf.WriteString("  <reference type=\"cover\" title=\"Cover\" href=\"#" + coverPageID + "\" />\n")
+			case hasCover:
+				buf.WriteString("  <reference type=\"cover\" title=\"Cover\" filepos=\"0000000000\" />\n")
+			}
+			if hasTitlePage {
+				buf.WriteString("  <reference type=\"title-page\" title=\"Title Page\" href=\"#" + TitlePageID + "\" />\n")
+			}
+			if hasInlineTOC {
+				buf.WriteString("  <reference type=\"toc\" title=\"Table of Contents\" href=\"#" + inlineTOCID + "\" />\n")
+			}
 			buf.WriteString("</guide>\n")
 		}
 		buf.WriteString("</head>\n")
 	} else {
 		// Modern HTML header
 		buf.WriteString(`<!DOCTYPE html>
-<html lang="` + fb2.Description.TitleInfo.Language + `">
+<html lang="` + fb2.Description.TitleInfo.Language + `"` + dirAttr + `>
 <head>
     <meta charset="UTF-8">
     <title>` + htmlEscape(t.getDisplayTitle(fb2)) + `</title>
-    <style type="text/css">
-        body { text-align: justify; margin: 2em; }
-        h1, h2, h3, h4, h5, h6 { font-weight: bold; page-break-before: always; }
-        h1 { font-size: 160%; border: 1px solid black; background-color: #E7E7E7; padding: 0.5em; }
-        h2 { font-size: 130%; border: 1px solid gray; background-color: #EEEEEE; padding: 0.5em; }
-        h3 { font-size: 110%; border: 1px solid silver; background-color: #F1F1F1; padding: 0.5em; }
-        h4 { font-size: 100%; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
-        h5 { font-size: 100%; font-style: italic; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
-        h6 { font-size: 100%; font-style: italic; border: 1px solid gray; background-color: #F4F4F4; padding: 0.5em; }
-        .epigraph { width: 75%; margin-left: 25%; font-style: italic; }
-        .subtitle { text-align: center; }
-        .paragraph { text-indent: 2em; margin-top: 0; margin-bottom: 0; }
-        blockquote { margin-left: 4em; margin-top: 1em; margin-right: 0.2em; }
-        code { font-family: monospace; }
-        table { border-collapse: collapse; margin: 1em auto; }
-        td, th { border: 1px solid black; padding: 0.3em; }
-    </style>
 `)
+		if !t.NoDefaultCSS {
+			buf.WriteString("    <style type=\"text/css\">\n" + defaultCSS + "    </style>\n")
+		}
+		if t.ExtraCSS != "" {
+			buf.WriteString("    <style type=\"text/css\">\n" + t.ExtraCSS + "\n    </style>\n")
+		}
 		if t.cssContent != "" {
-			buf.WriteString("    <link rel=\"stylesheet\" type=\"text/css\" href=\"inline-styles.css\" />\n")
+			buf.WriteString("    <link rel=\"stylesheet\" type=\"text/css\" href=\"styles.css\" />\n")
 		}
 		buf.WriteString("</head>\n")
 	}
 
 	// Body content
-	buf.WriteString("<body>\n")
+	buf.WriteString("<body" + dirAttr + ">\n")
 
-	// Render cover page if present
-	if fb2.Description.TitleInfo.Coverpage.PrimaryImage.Href != "" {
+	// Render the title page and the cover page if present
+	if titlePageFirst {
+		buf.WriteString(t.renderTitlePage())
+	}
+	if hasCover {
+		if t.MOBIMode && titlePageFirst {
+			buf.WriteString("<a id=\"" + coverPageID + "\"></a>\n")
+		}
 		buf.WriteString(t.renderCoverPage(fb2.Description.TitleInfo.Coverpage))
 		if t.MOBIMode {
 			buf.WriteString("<p>&nbsp;</p>\n")
@@ -152,31 +321,88 @@ func (t *Transformer) transformToHTML(fb2 *FictionBook) string {
 			buf.WriteString("<hr/>\n")
 		}
 	}
+	if hasTitlePage && !titlePageFirst {
+		buf.WriteString(t.renderTitlePage())
+	}
 
-	// Annotation
-	if fb2.Description.TitleInfo.Annotation != nil {
-		annotation := extractTextContent(fb2.Description.TitleInfo.Annotation)
-		if annotation != "" {
-			buf.WriteString("<div>")
-			buf.WriteString(htmlEscape(annotation))
-			buf.WriteString("</div>\n<hr/>\n")
+	// Annotation, a paragraph at a time with its markup. A title page
+	// already shows it.
+	if annotation := fb2.Description.TitleInfo.Annotation; !hasTitlePage && annotation != nil && extractTextContent(annotation) != "" {
+		buf.WriteString("<div>\n")
+		if text := strings.TrimSpace(annotation.Text); text != "" {
+			buf.WriteString(fmt.Sprintf("<p>%s</p>\n", t.text(text)))
 		}
+		for _, p := range annotation.P {
+			if strings.TrimSpace(p.Text) != "" {
+				buf.WriteString(fmt.Sprintf("<p>%s</p>\n", strings.TrimSpace(t.renderInline(p.Inline, t.typographer()))))
+			}
+		}
+		buf.WriteString("</div>\n<hr/>\n")
 	}
 
 	// Table of Contents
-	if !t.NoInlineTOC && len(fb2.Bodies) > 0 {
-		buf.WriteString(t.generateTOC(fb2.Bodies[0].Sections, 1))
+	if hasInlineTOC {
+		if t.MOBIMode {
+			buf.WriteString("<a id=\"" + inlineTOCID + "\"></a>\n")
+		}
+		buf.WriteString(t.generateTOC(fb2.MainBody().Sections, 1))
 		buf.WriteString("<hr/>\n")
 	}
 
-	// Body content
-	for _, body := range fb2.Bodies {
-		buf.WriteString(t.renderBody(body))
+	// Body content: the main text first, then the notes and comments
+	// bodies as endnotes. Bodies keep their document index so anchors
+	// don't depend on the rendering order.
+	for i, body := range fb2.Bodies {
+		if !body.IsNotes() {
+			buf.WriteString(t.renderBody(body, i+1))
+		}
+	}
+	for i, body := range fb2.Bodies {
+		if body.IsNotes() {
+			buf.WriteString(t.renderBody(body, i+1))
+		}
 	}
 
 	buf.WriteString("</body>\n</html>")
 
-	return buf.String()
+	return t.resolveLinks(buf.String())
+}
+
+// resolveLinks passes every non-internal link through the LinkResolver
+func (t *Transformer) resolveLinks(html string) string {
+	if t.LinkResolver == nil {
+		return html
+	}
+
+	return linkRegex.ReplaceAllStringFunc(html, func(match string) string {
+		parts := linkRegex.FindStringSubmatch(match)
+		href := parts[1]
+
+		// Internal links are resolved by the transformer itself
+		if strings.HasPrefix(href, "#") {
+			return match
+		}
+
+		resolved, ok := t.LinkResolver(unescapeHref(href))
+		if !ok {
+			return match
+		}
+		if resolved == "" {
+			// Strip the link, keep the text
+			return parts[3]
+		}
+		return fmt.Sprintf("<a href=\"%s\"%s>%s</a>", htmlEscape(resolved), parts[2], parts[3])
+	})
+}
+
+// unescapeHref reverses htmlEscape for an attribute value
+func unescapeHref(href string) string {
+	href = strings.ReplaceAll(href, "&quot;", "\"")
+	href = strings.ReplaceAll(href, "&apos;", "'")
+	href = strings.ReplaceAll(href, "&lt;", "<")
+	href = strings.ReplaceAll(href, "&gt;", ">")
+	href = strings.ReplaceAll(href, "&amp;", "&")
+	return href
 }
 
 // getDisplayTitle returns the title for display
@@ -184,7 +410,7 @@ func (t *Transformer) getDisplayTitle(fb2 *FictionBook) string {
 	if t.Title != "" {
 		return t.Title
 	}
-	return fb2.Description.TitleInfo.BookTitle
+	return fb2.Description.TitleInfo.BookTitle.Plain
 }
 
 // generateTOC generates a table of contents
@@ -219,9 +445,9 @@ func (t *Transformer) generateTOC(sections []Section, depth int) string {
 			if depth > 1 {
 				indent = strings.Repeat("&nbsp;&nbsp;", depth-1)
 			}
-			buf.WriteString(fmt.Sprintf("<p>%s<a href=\"#%s\">%s</a></p>\n", indent, id, htmlEscape(title)))
+			buf.WriteString(fmt.Sprintf("<p>%s<a href=\"#%s\">%s</a></p>\n", indent, id, t.text(title)))
 		} else {
-			buf.WriteString(fmt.Sprintf("  <li><a href=\"#%s\">%s</a>", id, htmlEscape(title)))
+			buf.WriteString(fmt.Sprintf("  <li><a href=\"#%s\">%s</a>", id, t.text(title)))
 		}
 
 		// Recurse for subsections
@@ -245,25 +471,41 @@ func (t *Transformer) generateTOC(sections []Section, depth int) string {
 }
 
 // renderBody renders the body content
-func (t *Transformer) renderBody(body Body) string {
+func (t *Transformer) renderBody(body Body, index int) string {
 	var buf strings.Builder
 
 	if !t.MOBIMode {
-		buf.WriteString("<div>\n")
+		if body.IsNotes() {
+			buf.WriteString("<div class=\"notes\">\n")
+		} else {
+			buf.WriteString("<div>\n")
+		}
 	}
 
-	// Body name if present
+	// Heading of a named body: its title, falling back to the name
 	if body.Name != "" {
+		heading := htmlEscape(body.Name)
+		if body.Title != nil && len(body.Title.P) > 0 {
+			var parts []string
+			for _, p := range body.Title.P {
+				if text := strings.TrimSpace(p.Text); text != "" {
+					parts = append(parts, t.text(text))
+				}
+			}
+			if len(parts) > 0 {
+				heading = strings.Join(parts, "<br/>")
+			}
+		}
 		if t.MOBIMode {
-			buf.WriteString(fmt.Sprintf("<p align=\"center\"><b>%s</b></p>\n", htmlEscape(body.Name)))
+			buf.WriteString(fmt.Sprintf("<p align=\"center\"><b>%s</b></p>\n", heading))
 		} else {
-			buf.WriteString(fmt.Sprintf("<h4 align=\"center\">%s</h4>\n", htmlEscape(body.Name)))
+			buf.WriteString(fmt.Sprintf("<h4 align=\"center\">%s</h4>\n", heading))
 		}
 	}
 
 	// Process sections
 	for i, section := range body.Sections {
-		buf.WriteString(t.renderSection(section, i+1))
+		buf.WriteString(t.renderSection(section, []int{index, i + 1}))
 	}
 
 	if !t.MOBIMode {
@@ -273,9 +515,11 @@ func (t *Transformer) renderBody(body Body) string {
 	return buf.String()
 }
 
-// renderSection renders a section
-func (t *Transformer) renderSection(section Section, index int) string {
+// renderSection renders a section. The path holds the 1-based body index
+// followed by the 1-based index of each section from the body down.
+func (t *Transformer) renderSection(section Section, path []int) string {
 	var buf strings.Builder
+	index := path[len(path)-1]
 
 	// Section ID
 	id := section.ID
@@ -289,70 +533,271 @@ func (t *Transformer) renderSection(section Section, index int) string {
 		buf.WriteString(fmt.Sprintf("<div id=\"%s\">\n", id))
 	}
 
-	// Section title
-	if section.Title != nil && len(section.Title.P) > 0 {
-		// Determine heading level based on depth (h1-h6)
-		level := t.getHeadingLevel(section)
-		buf.WriteString(fmt.Sprintf("<h%d>", level))
-
-		for _, p := range section.Title.P {
-			buf.WriteString(htmlEscape(p.Text))
-			buf.WriteString("<br/>\n")
+	// Child elements in document order
+	for _, child := range section.children() {
+		switch child.Name {
+		case "title":
+			buf.WriteString(t.renderSectionTitle(section, len(path)-1))
+		case "subtitle":
+			buf.WriteString(fmt.Sprintf("<h5 class=\"subtitle\">%s</h5>\n", t.text(section.Subtitles[child.Index].Text)))
+		case "epigraph":
+			buf.WriteString(t.renderEpigraph(section.Epigraphs[child.Index]))
+		case "annotation":
+			buf.WriteString(t.renderSectionAnnotation(section.Annotation))
+		case "cite":
+			buf.WriteString(t.renderCite(section.Cite[child.Index]))
+		case "stanza":
+			buf.WriteString(t.renderStanza(section.Stanza[child.Index]))
+		case "poem":
+			buf.WriteString(t.renderPoem(section.Poem[child.Index]))
+		case "code":
+			buf.WriteString(t.renderCode(section.Code[child.Index]))
+		case "table":
+			buf.WriteString(t.renderTable(section.Table[child.Index]))
+		case "image":
+			buf.WriteString(t.renderBlockImage(section.Image[child.Index]))
+		case "p":
+			buf.WriteString(t.renderParagraph(section.Paragraphs[child.Index], path, child.Index))
+		case "empty-line":
+			buf.WriteString(t.renderEmptyLine())
+		case "section":
+			subPath := append(append([]int{}, path...), child.Index+1)
+			buf.WriteString(t.renderSection(section.Sections[child.Index], subPath))
 		}
+	}
 
-		buf.WriteString(fmt.Sprintf("</h%d>\n", level))
+	// Back link from a note to where it is referenced
+	if ref, ok := t.noteRefs[section.ID]; ok && section.ID != "" {
+		buf.WriteString(fmt.Sprintf("<p class=\"backlink\"><a href=\"#%s\">&#8617;</a></p>\n", htmlEscape(ref)))
 	}
 
-	// Subtitle
-	if section.Subtitle != nil {
-		buf.WriteString(fmt.Sprintf("<h5 class=\"subtitle\">%s</h5>\n", htmlEscape(section.Subtitle.Text)))
+	if !t.MOBIMode {
+		buf.WriteString("</div>\n")
 	}
 
-	// Epigraphs
-	for _, epigraph := range section.Epigraphs {
-		buf.WriteString(t.renderEpigraph(epigraph))
+	return buf.String()
+}
+
+// renderSectionTitle renders the title of a section at the given nesting
+// depth as a heading
+func (t *Transformer) renderSectionTitle(section Section, depth int) string {
+	if section.Title == nil || len(section.Title.P) == 0 {
+		return ""
 	}
 
-	// Cites
-	for _, cite := range section.Cite {
-		buf.WriteString(t.renderCite(cite))
+	var buf strings.Builder
+	level := t.getHeadingLevel(depth)
+	buf.WriteString(fmt.Sprintf("<h%d>", level))
+	for _, p := range section.Title.P {
+		buf.WriteString(t.text(p.Text))
+		buf.WriteString("<br/>\n")
 	}
+	buf.WriteString(fmt.Sprintf("</h%d>\n", level))
+	return buf.String()
+}
 
-	// Stanza (poems)
-	for _, stanza := range section.Stanza {
-		buf.WriteString(t.renderStanza(stanza))
+// renderEmptyLine renders an <empty-line/>, a blank line of vertical space
+func (t *Transformer) renderEmptyLine() string {
+	if t.MOBIMode {
+		return "<p>&nbsp;</p>\n"
+	}
+	return "<div class=\"empty-line\"></div>\n"
+}
+
+// renderParagraph renders the i-th (0-based) paragraph of the section at
+// path
+func (t *Transformer) renderParagraph(p P, path []int, i int) string {
+	// Paragraph ids may be link targets, so they are always kept
+	id := p.ID
+	if id == "" && t.StableAnchors {
+		id = ParagraphAnchor(path, i+1)
+	}
+	idAttr := ""
+	if id != "" {
+		idAttr = fmt.Sprintf(" id=\"%s\"", htmlEscape(id))
+	}
+
+	// One typographer for the whole paragraph, so quotes pair up across
+	// markup and split parts
+	ty := t.typographer()
+	var buf strings.Builder
+	if hasMarkup(p.Inline) {
+		for _, part := range splitLongInline(p.Inline, t.MaxParagraphLength) {
+			buf.WriteString(fmt.Sprintf("<p class=\"paragraph\"%s>%s</p>\n", idAttr, t.renderInline(part, ty)))
+			idAttr = ""
+		}
+		return buf.String()
 	}
 
-	// Code
-	for _, code := range section.Code {
-		buf.WriteString(fmt.Sprintf("<code>%s</code><br/>\n", htmlEscape(code.Text)))
+	for _, part := range splitLongText(p.Text, t.MaxParagraphLength) {
+		buf.WriteString(fmt.Sprintf("<p class=\"paragraph\"%s>%s</p>\n", idAttr, htmlEscape(ty.apply(part))))
+		// The anchor stays on the first part
+		idAttr = ""
 	}
+	return buf.String()
+}
 
-	// Tables
-	for _, table := range section.Table {
-		buf.WriteString(t.renderTable(table))
+// renderInline renders paragraph content in document order. Formatting
+// elements map to their HTML tags and links to anchors (FB2 ids are kept
+// as HTML ids) or external URLs; other inline elements contribute their
+// text. Text runs go through ty in order.
+func (t *Transformer) renderInline(nodes []InlineNode, ty *typographer) string {
+	var buf strings.Builder
+	for _, n := range nodes {
+		switch {
+		case n.Name == "":
+			buf.WriteString(htmlEscape(ty.apply(n.Text)))
+		case n.Name == "image":
+			buf.WriteString(strings.TrimSuffix(t.renderImage(n.image()), "\n"))
+		case inlineTags[n.Name] != "":
+			tag := inlineTags[n.Name]
+			buf.WriteString(fmt.Sprintf("<%s>%s</%s>", tag, t.renderInline(n.Children, ty), tag))
+		case n.Name == "a" && n.attr("type") == "note" && strings.HasPrefix(n.Href(), "#"):
+			buf.WriteString(t.renderNoteRef(n, ty))
+		case n.Name == "a" && n.Href() != "":
+			buf.WriteString(fmt.Sprintf("<a href=\"%s\">%s</a>", htmlEscape(n.Href()), t.renderInline(n.Children, ty)))
+		default:
+			buf.WriteString(t.renderInline(n.Children, ty))
+		}
 	}
+	return buf.String()
+}
+
+// renderNoteRef renders a footnote reference as a superscript link to the
+// note. The first reference to each note gets an id for the back link.
+func (t *Transformer) renderNoteRef(n InlineNode, ty *typographer) string {
+	href := n.Href()
+	note := strings.TrimPrefix(href, "#")
+	idAttr := ""
+	if _, ok := t.noteRefs[note]; !ok {
+		ref := "ref_" + note
+		t.noteRefs[note] = ref
+		idAttr = fmt.Sprintf(" id=\"%s\"", htmlEscape(ref))
+	}
+	return fmt.Sprintf("<a href=\"%s\"%s class=\"noteref\"><sup>%s</sup></a>",
+		htmlEscape(href), idAttr, t.renderInline(n.Children, ty))
+}
+
+// splitLongText splits text longer than maxLen characters into parts of at
+// most maxLen characters, preferring to break after a sentence and then at
+// whitespace in the second half of each part. Shorter text, or any text
+// when maxLen isn't positive, is returned as is.
+func splitLongText(text string, maxLen int) []string {
+	runes := []rune(text)
+	if maxLen <= 0 || len(runes) <= maxLen {
+		return []string{text}
+	}
+
+	// start moves through runes, which is never copied, to keep long
+	// paragraphs linear
+	var parts []string
+	start := 0
+	for len(runes)-start > maxLen {
+		rest := runes[start:]
+		cut := breakIndex(rest, maxLen)
+		if cut == -1 {
+			cut = maxLen
+		}
 
-	// Images
-	for _, img := range section.Image {
-		buf.WriteString(t.renderImage(img))
+		if part := strings.TrimSpace(string(rest[:cut])); part != "" {
+			parts = append(parts, part)
+		}
+		start = skipSpace(runes, start+cut)
 	}
+	if start < len(runes) {
+		parts = append(parts, string(runes[start:]))
+	}
+	return parts
+}
 
-	// Paragraphs
-	for _, p := range section.Paragraphs {
-		buf.WriteString(fmt.Sprintf("<p class=\"paragraph\">%s</p>\n", htmlEscape(p.Text)))
+// breakIndex returns where to break runes to keep at most maxLen of them:
+// at whitespace after a sentence, or else at any whitespace, in the second
+// half of the limit. It returns -1 if there is no such whitespace.
+func breakIndex(runes []rune, maxLen int) int {
+	if maxLen > len(runes) {
+		maxLen = len(runes)
 	}
+	low := max(maxLen/2, 1)
+	for i := maxLen - 1; i >= low; i-- {
+		if unicode.IsSpace(runes[i]) && strings.ContainsRune(".!?…", runes[i-1]) {
+			return i
+		}
+	}
+	for i := maxLen - 1; i >= low; i-- {
+		if unicode.IsSpace(runes[i]) {
+			return i
+		}
+	}
+	return -1
+}
 
-	// subsections
-	for i, subsection := range section.Sections {
-		buf.WriteString(t.renderSection(subsection, i+1))
+// skipSpace returns the index of the first non-space rune in runes at or
+// after i
+func skipSpace(runes []rune, i int) int {
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
 	}
+	return i
+}
 
-	if !t.MOBIMode {
-		buf.WriteString("</div>\n")
+// splitLongInline is splitLongText for paragraph content with markup. It
+// breaks between top-level nodes, or inside a text run that crosses the
+// limit; inline elements are kept whole, so a part may exceed maxLen when
+// a single element does.
+func splitLongInline(nodes []InlineNode, maxLen int) [][]InlineNode {
+	if maxLen <= 0 {
+		return [][]InlineNode{nodes}
 	}
 
-	return buf.String()
+	var parts [][]InlineNode
+	var part []InlineNode
+	length := 0 // Characters of text in part
+	flush := func() {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+		part, length = nil, 0
+	}
+
+	for _, n := range nodes {
+		if n.Name != "" {
+			var text strings.Builder
+			writeInlineText(&text, n.Children)
+			size := utf8.RuneCountInString(text.String())
+			if length > 0 && length+size > maxLen {
+				flush()
+			}
+			part = append(part, n)
+			length += size
+			continue
+		}
+
+		runes := []rune(n.Text)
+		start := 0
+		for length+len(runes)-start > maxLen {
+			rest := runes[start:]
+			cut := breakIndex(rest, maxLen-length)
+			if cut == -1 {
+				if length > 0 {
+					// Try again from the start of a new part
+					flush()
+					continue
+				}
+				cut = maxLen
+			}
+			if head := strings.TrimRightFunc(string(rest[:cut]), unicode.IsSpace); head != "" {
+				part = append(part, InlineNode{Text: head})
+			}
+			flush()
+			start = skipSpace(runes, start+cut)
+		}
+		if start < len(runes) {
+			part = append(part, InlineNode{Text: string(runes[start:])})
+			length += len(runes) - start
+		}
+	}
+	flush()
+	return parts
 }
 
 // renderEpigraph renders an epigraph
@@ -373,7 +818,7 @@ func (t *Transformer) renderEpigraph(epigraph Epigraph) string {
 
 	// Content
 	for _, node := range epigraph.Content {
-		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", htmlEscape(node.Content)))
+		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", t.text(node.Content)))
 	}
 
 	buf.WriteString("</blockquote>\n")
@@ -381,6 +826,48 @@ func (t *Transformer) renderEpigraph(epigraph Epigraph) string {
 	return buf.String()
 }
 
+// renderSectionAnnotation renders a section annotation in the configured
+// SectionAnnotationStyle
+func (t *Transformer) renderSectionAnnotation(annotation *TextContainer) string {
+	var paras []string
+	if text := strings.TrimSpace(annotation.Text); text != "" {
+		paras = append(paras, text)
+	}
+	for _, p := range annotation.P {
+		if text := strings.TrimSpace(p.Text); text != "" {
+			paras = append(paras, text)
+		}
+	}
+	if len(paras) == 0 {
+		return ""
+	}
+
+	var buf strings.Builder
+	pullQuote := t.SectionAnnotationStyle == SectionAnnotationPullQuote
+	switch {
+	case pullQuote && t.MOBIMode:
+		// MOBI 6 has no CSS; approximate with a centered bold quote
+		buf.WriteString("<blockquote>\n")
+		for _, p := range paras {
+			buf.WriteString(fmt.Sprintf("  <p align=\"center\"><b>%s</b></p>\n", t.text(p)))
+		}
+		buf.WriteString("</blockquote>\n")
+	case pullQuote:
+		buf.WriteString("<div class=\"pullquote\">\n")
+		for _, p := range paras {
+			buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", t.text(p)))
+		}
+		buf.WriteString("</div>\n")
+	default:
+		buf.WriteString("<div class=\"annotation\">\n")
+		for _, p := range paras {
+			buf.WriteString(fmt.Sprintf("  <p><i>%s</i></p>\n", t.text(p)))
+		}
+		buf.WriteString("</div>\n")
+	}
+	return buf.String()
+}
+
 // renderCite renders a citation
 func (t *Transformer) renderCite(cite Cite) string {
 	var buf strings.Builder
@@ -394,7 +881,7 @@ func (t *Transformer) renderCite(cite Cite) string {
 
 	// Content
 	for _, node := range cite.Content {
-		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", htmlEscape(node.Content)))
+		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", t.text(node.Content)))
 	}
 
 	buf.WriteString("</blockquote>\n")
@@ -411,7 +898,7 @@ func (t *Transformer) renderStanza(stanza Stanza) string {
 	// Title
 	if stanza.Title != nil && len(stanza.Title.P) > 0 {
 		for _, p := range stanza.Title.P {
-			buf.WriteString(fmt.Sprintf("  <p><strong>%s</strong></p>\n", htmlEscape(p.Text)))
+			buf.WriteString(fmt.Sprintf("  <p><strong>%s</strong></p>\n", t.text(p.Text)))
 		}
 	}
 
@@ -425,10 +912,20 @@ func (t *Transformer) renderStanza(stanza Stanza) string {
 		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", htmlEscape(stanza.Date.Text)))
 	}
 
-	// Verses
-	for _, v := range stanza.V {
-		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", htmlEscape(v.Text)))
-		buf.WriteString("<br/>\n")
+	// Verses, one line each
+	if len(stanza.V) > 0 {
+		lines := make([]string, len(stanza.V))
+		for i, v := range stanza.V {
+			lines[i] = t.text(strings.TrimSpace(v.Text))
+		}
+		buf.WriteString(fmt.Sprintf("  <p>%s</p>\n", strings.Join(lines, "<br/>\n")))
+	}
+
+	// Attribution, if misplaced in the stanza instead of the poem
+	for _, author := range stanza.TextAuthors {
+		if author = strings.TrimSpace(author); author != "" {
+			buf.WriteString(fmt.Sprintf("  <p align=\"right\"><em>%s</em></p>\n", htmlEscape(author)))
+		}
 	}
 
 	buf.WriteString("</blockquote>\n")
@@ -436,6 +933,59 @@ func (t *Transformer) renderStanza(stanza Stanza) string {
 	return buf.String()
 }
 
+// renderPoem renders a poem with its title, epigraphs, stanzas and attribution
+func (t *Transformer) renderPoem(poem Poem) string {
+	var buf strings.Builder
+
+	if t.MOBIMode {
+		if poem.ID != "" {
+			buf.WriteString(fmt.Sprintf("<a name=\"%s\"></a>\n", poem.ID))
+		}
+	} else if poem.ID != "" {
+		buf.WriteString(fmt.Sprintf("<div class=\"poem\" id=\"%s\">\n", poem.ID))
+	} else {
+		buf.WriteString("<div class=\"poem\">\n")
+	}
+
+	// Title
+	if poem.Title != nil {
+		for _, p := range poem.Title.P {
+			buf.WriteString(fmt.Sprintf("<p><strong>%s</strong></p>\n", t.text(p.Text)))
+		}
+	}
+
+	// Epigraphs
+	for _, epigraph := range poem.Epigraphs {
+		buf.WriteString(t.renderEpigraph(epigraph))
+	}
+
+	// Stanzas (direct verses form an implicit stanza)
+	for i, stanza := range poem.AllStanzas() {
+		if i > 0 {
+			buf.WriteString(t.renderEmptyLine())
+		}
+		buf.WriteString(t.renderStanza(stanza))
+	}
+
+	// Attribution
+	for _, author := range poem.TextAuthors {
+		author = strings.TrimSpace(author)
+		if author != "" {
+			buf.WriteString(fmt.Sprintf("<p align=\"right\"><em>%s</em></p>\n", htmlEscape(author)))
+		}
+	}
+
+	if poem.Date.Text != "" {
+		buf.WriteString(fmt.Sprintf("<p align=\"right\">%s</p>\n", htmlEscape(poem.Date.Text)))
+	}
+
+	if !t.MOBIMode {
+		buf.WriteString("</div>\n")
+	}
+
+	return buf.String()
+}
+
 // renderTable renders a table
 func (t *Transformer) renderTable(table Table) string {
 	var buf strings.Builder
@@ -445,18 +995,28 @@ func (t *Transformer) renderTable(table Table) string {
 	for _, row := range table.Rows {
 		buf.WriteString("  <tr")
 		if row.Align != "" {
-			buf.WriteString(fmt.Sprintf(" align=\"%s\"", row.Align))
+			buf.WriteString(fmt.Sprintf(" align=\"%s\"", htmlEscape(row.Align)))
 		}
 		buf.WriteString(">\n")
 
 		for _, cell := range row.Cells {
-			buf.WriteString("    <td")
-			if cell.ColSpan > 0 {
+			tag := "td"
+			if cell.XMLName.Local == "th" {
+				tag = "th"
+			}
+			buf.WriteString("    <" + tag)
+			if cell.ColSpan > 1 {
 				buf.WriteString(fmt.Sprintf(" colspan=\"%d\"", cell.ColSpan))
 			}
-			if cell.RowSpan > 0 {
+			if cell.RowSpan > 1 {
 				buf.WriteString(fmt.Sprintf(" rowspan=\"%d\"", cell.RowSpan))
 			}
+			if cell.Align != "" {
+				buf.WriteString(fmt.Sprintf(" align=\"%s\"", htmlEscape(cell.Align)))
+			}
+			if cell.VAlign != "" {
+				buf.WriteString(fmt.Sprintf(" valign=\"%s\"", htmlEscape(cell.VAlign)))
+			}
 			if cell.Style != "" {
 				buf.WriteString(fmt.Sprintf(" style=\"%s\"", htmlEscape(cell.Style)))
 			}
@@ -465,9 +1025,9 @@ func (t *Transformer) renderTable(table Table) string {
 			}
 			buf.WriteString(">")
 
-			buf.WriteString(htmlEscape(cell.Content))
+			buf.WriteString(t.text(cell.Content))
 
-			buf.WriteString("</td>\n")
+			buf.WriteString("</" + tag + ">\n")
 		}
 
 		buf.WriteString("  </tr>\n")
@@ -478,12 +1038,58 @@ func (t *Transformer) renderTable(table Table) string {
 	return buf.String()
 }
 
+// renderCode renders a code block, applying CodeWrap and CodeFontScale
+func (t *Transformer) renderCode(code Code) string {
+	text := htmlEscape(code.Text)
+	if t.CodeWrap > 0 {
+		// Old Kindles ignore <wbr>, but honor a zero-width space
+		brk := "<wbr/>"
+		if t.MOBIMode {
+			brk = "\u200b"
+		}
+		lines := strings.Split(code.Text, "\n")
+		for i, line := range lines {
+			lines[i] = wrapCodeLine(line, t.CodeWrap, brk)
+		}
+		text = strings.Join(lines, "\n")
+	}
+
+	if t.CodeFontScale <= 0 || t.CodeFontScale == 1 {
+		return fmt.Sprintf("<code>%s</code><br/>\n", text)
+	}
+	if t.MOBIMode {
+		// MOBI 6 has no CSS font sizes; only shrinking is supported
+		if t.CodeFontScale < 1 {
+			return fmt.Sprintf("<small><code>%s</code></small><br/>\n", text)
+		}
+		return fmt.Sprintf("<code>%s</code><br/>\n", text)
+	}
+	return fmt.Sprintf("<code style=\"font-size: %d%%\">%s</code><br/>\n", int(t.CodeFontScale*100+0.5), text)
+}
+
+// wrapCodeLine escapes a line of code, inserting brk after every width
+// characters that run without whitespace
+func wrapCodeLine(line string, width int, brk string) string {
+	var buf strings.Builder
+	run := 0
+	for _, r := range line {
+		if unicode.IsSpace(r) {
+			run = 0
+		} else if run == width {
+			buf.WriteString(brk)
+			run = 0
+		}
+		if !unicode.IsSpace(r) {
+			run++
+		}
+		buf.WriteString(htmlEscape(string(r)))
+	}
+	return buf.String()
+}
+
 // renderImage renders an image
 func (t *Transformer) renderImage(img Image) string {
-	href := img.Href
-	if href == "" {
-		href = img.XLinkHref
-	}
+	href := img.Href()
 
 	// Remove # prefix if present to get binary ID
 	binaryID := strings.TrimPrefix(href, "#")
@@ -526,11 +1132,29 @@ func (t *Transformer) renderImage(img Image) string {
 	return fmt.Sprintf("<img src=\"%s\"%s%s/>\n", href, altAttr, titleAttr)
 }
 
+// renderBlockImage renders a block-level image, with a visible caption
+// when ImageCaptions is enabled
+func (t *Transformer) renderBlockImage(img Image) string {
+	caption := img.Title
+	if caption == "" {
+		caption = img.Alt
+	}
+	if !t.ImageCaptions || caption == "" {
+		return t.renderImage(img)
+	}
+
+	if t.MOBIMode {
+		return fmt.Sprintf("%s<p align=\"center\"><i>%s</i></p>\n", t.renderImage(img), t.text(caption))
+	}
+
+	return fmt.Sprintf("<div class=\"figure\">\n%s<p class=\"caption\">%s</p>\n</div>\n", t.renderImage(img), t.text(caption))
+}
+
 // renderCoverPage renders the cover page
 func (t *Transformer) renderCoverPage(cover Coverpage) string {
 	img := Image{
-		Href: cover.PrimaryImage.Href,
-		Alt:  "Cover",
+		Alt:   "Cover",
+		Attrs: cover.PrimaryImage.Attrs,
 	}
 
 	if t.MOBIMode {
@@ -542,21 +1166,56 @@ func (t *Transformer) renderCoverPage(cover Coverpage) string {
 	return fmt.Sprintf("<div style=\"text-align: center; page-break-after: always;\">\n%s</div>\n", t.renderImage(img))
 }
 
-// getHeadingLevel determines the heading level (h1-h6) based on nesting
-func (t *Transformer) getHeadingLevel(section Section) int {
-	// Count ancestor sections
-	depth := t.countSectionDepth(section)
+// renderTitlePage renders TitlePage in its own page
+func (t *Transformer) renderTitlePage() string {
+	page := "<div id=\"" + TitlePageID + "\">\n" + strings.TrimSuffix(t.TitlePage, "\n") + "\n</div>\n"
+	if t.MOBIMode {
+		// MOBI 6 ignores the page-break style of the page
+		page += "<p>&nbsp;</p>\n"
+	}
+	return page
+}
+
+// ParagraphAnchor returns the stable anchor of a paragraph without an FB2
+// id. The anchor is "p-" followed by the section path and the paragraph
+// index, joined with hyphens: path is the 1-based body index followed by
+// the 1-based position of each enclosing section, and index is the 1-based
+// position of the paragraph among the section's own paragraphs. For
+// example the third paragraph of the first subsection of the second
+// section of the main body is "p-1-2-1-3".
+func ParagraphAnchor(path []int, index int) string {
+	var buf strings.Builder
+	buf.WriteString("p")
+	for _, n := range path {
+		buf.WriteString(fmt.Sprintf("-%d", n))
+	}
+	buf.WriteString(fmt.Sprintf("-%d", index))
+	return buf.String()
+}
+
+// getHeadingLevel determines the heading level (h1-h6) of a section title
+// from the section's nesting depth, 1 for sections directly in the body.
+// h1 is left for the book title.
+func (t *Transformer) getHeadingLevel(depth int) int {
 	if depth > 5 {
 		return 6
 	}
 	return depth + 1
 }
 
-// countSectionDepth counts the nesting depth of a section
-func (t *Transformer) countSectionDepth(section Section) int {
-	// This is a simplified version - a full implementation would track parent hierarchy
-	// For now, we'll just use a heuristic
-	return 1 // Default to h2 for top-level sections under body
+// text prepares a text run for output, applying the typography pass when
+// enabled
+func (t *Transformer) text(s string) string {
+	return htmlEscape(t.typographer().apply(s))
+}
+
+// typographer returns a typographer for one paragraph, or nil when the
+// typography pass is off
+func (t *Transformer) typographer() *typographer {
+	if t.typography == nil {
+		return nil
+	}
+	return &typographer{rules: *t.typography}
 }
 
 // htmlEscape escapes HTML special characters
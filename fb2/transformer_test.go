@@ -0,0 +1,667 @@
+package fb2
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// wrapFB2Body wraps section markup in a minimal FB2 document
+func wrapFB2Body(body string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body>
+` + body + `
+	</body>
+</FictionBook>`)
+}
+
+func TestPoemWithStanzas(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<poem>
+		<title><p>Winter</p></title>
+		<stanza>
+			<v>First line</v>
+			<v>Second line</v>
+		</stanza>
+		<stanza>
+			<v>Third line</v>
+		</stanza>
+		<text-author>A. Poet</text-author>
+	</poem>
+</section>`)
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	poems := doc.Bodies[0].Sections[0].Poem
+	if len(poems) != 1 {
+		t.Fatalf("Poem count = %d, want 1", len(poems))
+	}
+	if got := len(poems[0].AllStanzas()); got != 2 {
+		t.Errorf("AllStanzas() count = %d, want 2", got)
+	}
+
+	transformer := NewTransformer()
+	transformer.MOBIMode = false
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	for _, want := range []string{"Winter", "First line", "Second line", "Third line", "A. Poet"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %q", want)
+		}
+	}
+}
+
+func TestPoemWithDirectVerses(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<poem>
+		<v>Only line one</v>
+		<v>Only line two</v>
+	</poem>
+</section>`)
+
+	parser := NewParser()
+	doc, err := parser.ParseBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ParseBytes() error = %v", err)
+	}
+
+	stanzas := doc.Bodies[0].Sections[0].Poem[0].AllStanzas()
+	if len(stanzas) != 1 {
+		t.Fatalf("AllStanzas() count = %d, want 1 implicit stanza", len(stanzas))
+	}
+	if len(stanzas[0].V) != 2 {
+		t.Errorf("Implicit stanza verse count = %d, want 2", len(stanzas[0].V))
+	}
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	first := strings.Index(html, "Only line one")
+	second := strings.Index(html, "Only line two")
+	if first == -1 || second == -1 {
+		t.Fatal("HTML doesn't contain the poem verses")
+	}
+	if first > second {
+		t.Error("Verses rendered out of order")
+	}
+}
+
+func TestResolveLinks(t *testing.T) {
+	transformer := NewTransformer()
+	transformer.LinkResolver = func(href string) (string, bool) {
+		switch href {
+		case "isbn:978-5-17-000000-0":
+			return "library://book/42", true
+		case "http://example.com/dead":
+			return "", true
+		}
+		return "", false
+	}
+
+	input := `<a href="#section_1">Inside</a> ` +
+		`<a href="isbn:978-5-17-000000-0">Next book</a> ` +
+		`<a href="http://example.com/dead">Dead</a> ` +
+		`<a href="http://example.com/other">Other</a>`
+	got := transformer.resolveLinks(input)
+
+	want := `<a href="#section_1">Inside</a> ` +
+		`<a href="library://book/42">Next book</a> ` +
+		`Dead ` +
+		`<a href="http://example.com/other">Other</a>`
+	if got != want {
+		t.Errorf("resolveLinks() = %q, want %q", got, want)
+	}
+}
+
+func TestImageCaptions(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<image l:href="#map.png" title="Map of the island"/>
+	<image l:href="#plain.png"/>
+</section>`)
+
+	transformer := NewTransformer()
+	transformer.MOBIMode = false
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if strings.Contains(html, "class=\"caption\"") {
+		t.Error("Caption rendered while ImageCaptions is disabled")
+	}
+
+	transformer = NewTransformer()
+	transformer.MOBIMode = false
+	transformer.ImageCaptions = true
+	html, _, _, err = transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if !strings.Contains(html, "<p class=\"caption\">Map of the island</p>") {
+		t.Error("HTML doesn't contain the caption")
+	}
+	if strings.Count(html, "<div class=\"figure\">") != 1 {
+		t.Error("Image without caption should not be wrapped in a figure")
+	}
+
+	transformer = NewTransformer()
+	transformer.ImageCaptions = true
+	html, _, _, err = transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if !strings.Contains(html, "<p align=\"center\"><i>Map of the island</i></p>") {
+		t.Error("MOBI HTML doesn't contain centered italic caption")
+	}
+}
+
+func TestStableAnchors(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>First</p>
+	<p id="keep">Second</p>
+	<section>
+		<p>Nested</p>
+	</section>
+</section>
+<section>
+	<p>Other</p>
+</section>`)
+
+	transformer := NewTransformer()
+	transformer.StableAnchors = true
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	for _, want := range []string{
+		`<p class="paragraph" id="p-1-1-1">First</p>`,
+		`<p class="paragraph" id="keep">Second</p>`,
+		`<p class="paragraph" id="p-1-1-1-1">Nested</p>`,
+		`<p class="paragraph" id="p-1-2-1">Other</p>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %s", want)
+		}
+	}
+
+	transformer = NewTransformer()
+	transformer.StableAnchors = true
+	again, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if again != html {
+		t.Error("Anchors differ between conversions")
+	}
+}
+
+func TestCodeWrap(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<code>call(abcdefghij&amp;klm) ok</code>
+</section>`)
+
+	tests := []struct {
+		name     string
+		mobi     bool
+		wrap     int
+		scale    float64
+		wantCode string
+	}{
+		{"default", false, 0, 0, "<code>call(abcdefghij&amp;klm) ok</code>"},
+		{"wbr", false, 8, 0, "<code>call(abc<wbr/>defghij&amp;<wbr/>klm) ok</code>"},
+		{"zero-width space", true, 8, 0, "<code>call(abc\u200bdefghij&amp;\u200bklm) ok</code>"},
+		{"font scale", false, 0, 0.8, `<code style="font-size: 80%">call(abcdefghij&amp;klm) ok</code>`},
+		{"mobi font scale", true, 0, 0.8, "<small><code>call(abcdefghij&amp;klm) ok</code></small>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer := NewTransformer()
+			transformer.MOBIMode = tt.mobi
+			transformer.CodeWrap = tt.wrap
+			transformer.CodeFontScale = tt.scale
+			html, _, _, err := transformer.ConvertBytes(fb2Data)
+			if err != nil {
+				t.Fatalf("ConvertBytes() error = %v", err)
+			}
+			if !strings.Contains(html, tt.wantCode) {
+				t.Errorf("HTML doesn't contain %q:\n%s", tt.wantCode, html)
+			}
+		})
+	}
+}
+
+func TestSplitLongText(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		maxLen int
+		want   []string
+	}{
+		{"disabled", "One. Two. Three.", 0, []string{"One. Two. Three."}},
+		{"short", "One. Two.", 20, []string{"One. Two."}},
+		{"sentence", "First sentence here. Second one, longer text.", 30, []string{"First sentence here.", "Second one, longer text."}},
+		{"whitespace", "aaaa bbbb cccc dddd", 12, []string{"aaaa bbbb", "cccc dddd"}},
+		{"hard cut", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitLongText(tt.text, tt.maxLen)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("splitLongText() = %q, want %q", got, tt.want)
+			}
+			for _, part := range got {
+				if tt.maxLen > 0 && len([]rune(part)) > tt.maxLen {
+					t.Errorf("Part %q is longer than %d", part, tt.maxLen)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxParagraphLength(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>` + strings.Repeat("A sentence of prose. ", 50) + `</p>
+</section>`)
+
+	transformer := NewTransformer()
+	transformer.StableAnchors = true
+	transformer.MaxParagraphLength = 200
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if n := strings.Count(html, `<p class="paragraph"`); n < 5 {
+		t.Errorf("Paragraph count = %d, want the long paragraph split", n)
+	}
+	if n := strings.Count(html, `id="p-1-1-1"`); n != 1 {
+		t.Errorf("Anchor count = %d, want 1 on the first part", n)
+	}
+}
+
+func TestMaxParagraphLengthMarkup(t *testing.T) {
+	sentence := "A sentence of <emphasis>prose</emphasis> with a <a l:href=\"https://example.com\">link</a>. "
+	fb2Data := wrapFB2Body(`<section>
+	<p>` + strings.Repeat(sentence, 40) + strings.Repeat("Plain words without markup ", 30) + `</p>
+</section>`)
+
+	transformer := NewTransformer()
+	transformer.StableAnchors = true
+	transformer.MaxParagraphLength = 200
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	paragraphs := regexp.MustCompile(`(?s)<p class="paragraph"[^>]*>(.*?)</p>`).FindAllStringSubmatch(html, -1)
+	if len(paragraphs) < 8 {
+		t.Fatalf("Paragraph count = %d, want the long paragraph split", len(paragraphs))
+	}
+	for _, p := range paragraphs {
+		text := regexp.MustCompile(`<[^>]+>`).ReplaceAllString(p[1], "")
+		if n := utf8.RuneCountInString(text); n > 200 {
+			t.Errorf("Part has %d characters, want at most 200: %q", n, text)
+		}
+	}
+	if n := strings.Count(html, "<em>prose</em>"); n != 40 {
+		t.Errorf("Emphasis count = %d, want 40", n)
+	}
+	if n := strings.Count(html, `id="p-1-1-1"`); n != 1 {
+		t.Errorf("Anchor count = %d, want 1 on the first part", n)
+	}
+}
+
+func TestSectionAnnotationStyle(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<title><p>Chapter</p></title>
+	<annotation><p>The quote that matters.</p></annotation>
+	<p>Body text.</p>
+</section>`)
+
+	tests := []struct {
+		name  string
+		style string
+		mobi  bool
+		want  string
+	}{
+		{"summary", "", false, "<div class=\"annotation\">\n  <p><i>The quote that matters.</i></p>\n</div>"},
+		{"pullquote", SectionAnnotationPullQuote, false, "<div class=\"pullquote\">\n  <p>The quote that matters.</p>\n</div>"},
+		{"unknown style", "sidebar", false, "<div class=\"annotation\">\n  <p><i>The quote that matters.</i></p>\n</div>"},
+		{"mobi pullquote", SectionAnnotationPullQuote, true, "<p align=\"center\"><b>The quote that matters.</b></p>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer := NewTransformer()
+			transformer.MOBIMode = tt.mobi
+			transformer.SectionAnnotationStyle = tt.style
+			html, _, _, err := transformer.ConvertBytes(fb2Data)
+			if err != nil {
+				t.Fatalf("ConvertBytes() error = %v", err)
+			}
+			if !strings.Contains(html, tt.want) {
+				t.Errorf("HTML doesn't contain %q:\n%s", tt.want, html)
+			}
+			if strings.Index(html, "The quote") > strings.Index(html, "Body text.") {
+				t.Error("Annotation rendered after the section text")
+			}
+		})
+	}
+}
+
+func TestNotesBody(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Test Book</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body name="notes">
+		<title><p>Notes</p></title>
+		<section id="n1">
+			<title><p>1</p></title>
+			<p>The note text.</p>
+		</section>
+	</body>
+	<body>
+		<section>
+			<title><p>Chapter One</p></title>
+			<p>Main text.</p>
+		</section>
+	</body>
+</FictionBook>`)
+
+	for _, mobi := range []bool{false, true} {
+		transformer := NewTransformer()
+		transformer.MOBIMode = mobi
+		html, _, _, err := transformer.ConvertBytes(fb2Data)
+		if err != nil {
+			t.Fatalf("ConvertBytes() error = %v", err)
+		}
+
+		main := strings.Index(html, "Main text.")
+		note := strings.Index(html, "The note text.")
+		if main < 0 || note < 0 {
+			t.Fatalf("mobi=%v: HTML is missing a body:\n%s", mobi, html)
+		}
+		if note < main {
+			t.Errorf("mobi=%v: notes body rendered before the main body", mobi)
+		}
+		if !strings.Contains(html, `name="n1"`) && !strings.Contains(html, `id="n1"`) {
+			t.Errorf("mobi=%v: note anchor missing", mobi)
+		}
+		if strings.Contains(html, ">notes<") {
+			t.Errorf("mobi=%v: body name shown instead of its title", mobi)
+		}
+		if !mobi && !strings.Contains(html, `<div class="notes">`) {
+			t.Error("notes body not marked as endnotes")
+		}
+		if toc := strings.Index(html, "Chapter One"); toc > note {
+			t.Errorf("mobi=%v: TOC not built from the main body", mobi)
+		}
+	}
+}
+
+func TestInlineEmphasis(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>Plain <emphasis>soft &amp; slanted</emphasis>, <strong>bold <emphasis>both</emphasis></strong>, <strikethrough>gone</strikethrough>, H<sub>2</sub>O, x<sup>2</sup> and <code>a &lt; b</code>.</p>
+</section>`)
+
+	for _, mobi := range []bool{false, true} {
+		transformer := NewTransformer()
+		transformer.MOBIMode = mobi
+		html, _, _, err := transformer.ConvertBytes(fb2Data)
+		if err != nil {
+			t.Fatalf("ConvertBytes() error = %v", err)
+		}
+
+		want := `Plain <em>soft &amp; slanted</em>, <strong>bold <em>both</em></strong>, <s>gone</s>, H<sub>2</sub>O, x<sup>2</sup> and <code>a &lt; b</code>.`
+		if !strings.Contains(html, want) {
+			t.Errorf("mobi=%v: HTML doesn't contain %q:\n%s", mobi, want, html)
+		}
+	}
+}
+
+func TestSectionElementOrder(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<title><p>Chapter</p></title>
+	<p>First paragraph.</p>
+	<image l:href="#pic.png"/>
+	<p>Second paragraph.</p>
+	<subtitle>Interlude</subtitle>
+	<p>Third paragraph.</p>
+</section>`)
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	last := -1
+	for _, want := range []string{"Chapter", "First paragraph.", "pic.png", "Second paragraph.", "Interlude", "Third paragraph."} {
+		i := strings.Index(html, want)
+		if i < 0 {
+			t.Fatalf("HTML doesn't contain %q:\n%s", want, html)
+		}
+		if i < last {
+			t.Errorf("%q is out of document order:\n%s", want, html)
+		}
+		last = i
+	}
+}
+
+func TestInlineImage(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>Press <image l:href="#key.png" alt="Enter key" title="Enter"/> to continue.</p>
+</section>`)
+
+	for _, mobi := range []bool{false, true} {
+		transformer := NewTransformer()
+		transformer.MOBIMode = mobi
+		html, _, _, err := transformer.ConvertBytes(fb2Data)
+		if err != nil {
+			t.Fatalf("ConvertBytes() error = %v", err)
+		}
+
+		want := `<p class="paragraph">Press <img src="key.png" alt="Enter key" title="Enter"/> to continue.</p>`
+		if !strings.Contains(html, want) {
+			t.Errorf("mobi=%v: HTML doesn't contain %q:\n%s", mobi, want, html)
+		}
+	}
+}
+
+func TestNestedHeadingLevels(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<title><p>Part</p></title>
+	<section>
+		<title><p>Chapter</p></title>
+		<section>
+			<title><p>Scene</p></title>
+			<p>Text.</p>
+		</section>
+	</section>
+</section>`)
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	for _, want := range []string{"<h2>Part<br/>", "<h3>Chapter<br/>", "<h4>Scene<br/>"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestEmptyLine(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>Before.</p>
+	<empty-line/>
+	<empty-line/>
+	<p>After.</p>
+</section>`)
+
+	tests := []struct {
+		mobi bool
+		want string
+	}{
+		{true, "<p class=\"paragraph\">Before.</p>\n<p>&nbsp;</p>\n<p>&nbsp;</p>\n<p class=\"paragraph\">After.</p>"},
+		{false, "<p class=\"paragraph\">Before.</p>\n<div class=\"empty-line\"></div>\n<div class=\"empty-line\"></div>\n<p class=\"paragraph\">After.</p>"},
+	}
+
+	for _, tt := range tests {
+		transformer := NewTransformer()
+		transformer.MOBIMode = tt.mobi
+		html, _, _, err := transformer.ConvertBytes(fb2Data)
+		if err != nil {
+			t.Fatalf("ConvertBytes() error = %v", err)
+		}
+		if !strings.Contains(html, tt.want) {
+			t.Errorf("mobi=%v: HTML doesn't contain %q:\n%s", tt.mobi, tt.want, html)
+		}
+	}
+}
+
+func TestPoemStructure(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<poem>
+		<stanza>
+			<v>First line</v>
+			<v>Second line</v>
+		</stanza>
+		<stanza>
+			<v>Third line</v>
+		</stanza>
+		<text-author>A. Poet</text-author>
+	</poem>
+</section>`)
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"<blockquote>\n  <p>First line<br/>\nSecond line</p>\n</blockquote>\n<p>&nbsp;</p>\n<blockquote>\n  <p>Third line</p>\n</blockquote>",
+		`<p align="right"><em>A. Poet</em></p>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestTableHeaderCells(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<table>
+		<tr><th align="left">Name</th><th>Score</th></tr>
+		<tr><td colspan="1">Ann</td><td rowspan="1">9</td></tr>
+		<tr><td colspan="2" align="center">Total</td></tr>
+	</table>
+</section>`)
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+
+	for _, want := range []string{
+		`<th align="left">Name</th>`,
+		`<th>Score</th>`,
+		`<td>Ann</td>`,
+		`<td>9</td>`,
+		`<td colspan="2" align="center">Total</td>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %s:\n%s", want, html)
+		}
+	}
+}
+
+func TestInlineLinks(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section>
+	<p>See <a l:href="#appendix">the appendix</a> or <a l:href="http://example.com/a?b=1&amp;c=2">the <emphasis>site</emphasis></a>.</p>
+</section>
+<section id="appendix">
+	<p id="fact">Appendix text.</p>
+	<p>Back to <a l:href="#fact">the fact</a>.</p>
+</section>`)
+
+	for _, mobi := range []bool{false, true} {
+		transformer := NewTransformer()
+		transformer.MOBIMode = mobi
+		html, _, _, err := transformer.ConvertBytes(fb2Data)
+		if err != nil {
+			t.Fatalf("ConvertBytes() error = %v", err)
+		}
+
+		for _, want := range []string{
+			`See <a href="#appendix">the appendix</a>`,
+			`<a href="http://example.com/a?b=1&amp;c=2">the <em>site</em></a>`,
+			`<p class="paragraph" id="fact">Appendix text.</p>`,
+			`<a href="#fact">the fact</a>`,
+		} {
+			if !strings.Contains(html, want) {
+				t.Errorf("mobi=%v: HTML doesn't contain %s:\n%s", mobi, want, html)
+			}
+		}
+		if !regexp.MustCompile(`(id|name)="appendix"`).MatchString(html) {
+			t.Errorf("mobi=%v: link target missing", mobi)
+		}
+	}
+}
+
+func TestNoDefaultCSS(t *testing.T) {
+	fb2Data := wrapFB2Body(`<section><p>Text.</p></section>`)
+
+	transformer := NewTransformer()
+	transformer.MOBIMode = false
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if !strings.Contains(html, "text-indent: 2em") {
+		t.Error("Default style block missing")
+	}
+
+	transformer = NewTransformer()
+	transformer.MOBIMode = false
+	transformer.NoDefaultCSS = true
+	transformer.ExtraCSS = "p { color: teal; }"
+	html, _, _, err = transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if strings.Contains(html, "text-indent: 2em") {
+		t.Error("Default style block present with NoDefaultCSS")
+	}
+	if !strings.Contains(html, "<style type=\"text/css\">\np { color: teal; }\n    </style>") {
+		t.Errorf("ExtraCSS missing:\n%s", html)
+	}
+}
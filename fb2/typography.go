@@ -0,0 +1,203 @@
+package fb2
+
+import (
+	"strings"
+	"unicode"
+)
+
+const nbsp = '\u00a0'
+
+// TypographyRules describes the typographic conventions of a language
+type TypographyRules struct {
+	OpenQuote       string // Outer opening quote
+	CloseQuote      string // Outer closing quote
+	InnerOpenQuote  string // Nested opening quote
+	InnerCloseQuote string // Nested closing quote
+
+	// NBSPBeforeDash binds an em dash to the preceding word (Russian rule)
+	NBSPBeforeDash bool
+	// NBSPBeforePunct lists punctuation that takes a non-breaking space
+	// before it (French rule)
+	NBSPBeforePunct string
+	// NBSPInsideQuotes puts non-breaking spaces inside guillemets (French rule)
+	NBSPInsideQuotes bool
+}
+
+// typographyRules maps a language code to its typography rules
+var typographyRules = map[string]TypographyRules{
+	"en": {
+		OpenQuote: "“", CloseQuote: "”",
+		InnerOpenQuote: "‘", InnerCloseQuote: "’",
+	},
+	"ru": {
+		OpenQuote: "«", CloseQuote: "»",
+		InnerOpenQuote: "„", InnerCloseQuote: "“",
+		NBSPBeforeDash: true,
+	},
+	"uk": {
+		OpenQuote: "«", CloseQuote: "»",
+		InnerOpenQuote: "„", InnerCloseQuote: "“",
+		NBSPBeforeDash: true,
+	},
+	"be": {
+		OpenQuote: "«", CloseQuote: "»",
+		InnerOpenQuote: "„", InnerCloseQuote: "“",
+		NBSPBeforeDash: true,
+	},
+	"de": {
+		OpenQuote: "„", CloseQuote: "“",
+		InnerOpenQuote: "‚", InnerCloseQuote: "‘",
+	},
+	"fr": {
+		OpenQuote: "«", CloseQuote: "»",
+		InnerOpenQuote: "“", InnerCloseQuote: "”",
+		NBSPBeforePunct:  ";:!?",
+		NBSPInsideQuotes: true,
+	},
+}
+
+// GetTypographyRules returns the typography rules for a language code such
+// as "ru" or "fr-CA". Unknown languages fall back to English rules.
+func GetTypographyRules(lang string) TypographyRules {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i != -1 {
+		lang = lang[:i]
+	}
+	if rules, ok := typographyRules[lang]; ok {
+		return rules
+	}
+	return typographyRules["en"]
+}
+
+// ApplyTypography converts straight quotes to typographic ones, normalizes
+// dashes and ellipses and inserts non-breaking spaces according to the
+// rules. It expects plain text, not markup.
+func ApplyTypography(text string, rules TypographyRules) string {
+	return (&typographer{rules: rules}).apply(text)
+}
+
+// typographer applies the typography pass to the text runs of a paragraph
+// in order. It carries the quote nesting and the last rune from run to
+// run, so quotes pair up across inline markup. A nil typographer leaves
+// text unchanged.
+type typographer struct {
+	rules TypographyRules
+	depth int  // Open quotes
+	prev  rune // Last rune of the previous run, 0 at the start
+}
+
+// apply runs the typography pass on the next text run
+func (ty *typographer) apply(text string) string {
+	if ty == nil || text == "" {
+		return text
+	}
+	rules := ty.rules
+
+	// Dashes and ellipses
+	text = strings.ReplaceAll(text, "...", "…")
+	text = strings.ReplaceAll(text, "---", "—")
+	text = strings.ReplaceAll(text, "--", "—")
+	text = strings.ReplaceAll(text, " - ", " — ")
+	if ty.prev == 0 && strings.HasPrefix(text, "- ") {
+		// Dialogue dash at the start of a paragraph
+		text = "—" + text[1:]
+	}
+
+	// Quotes
+	runes := []rune(text)
+	var buf strings.Builder
+	for i, r := range runes {
+		prev := ty.prev
+		if i > 0 {
+			prev = runes[i-1]
+		}
+
+		switch r {
+		case '"':
+			if isQuoteOpening(prev, prev == 0) {
+				if ty.depth == 0 {
+					buf.WriteString(rules.OpenQuote)
+				} else {
+					buf.WriteString(rules.InnerOpenQuote)
+				}
+				ty.depth++
+			} else if ty.depth > 1 {
+				buf.WriteString(rules.InnerCloseQuote)
+				ty.depth--
+			} else {
+				buf.WriteString(rules.CloseQuote)
+				if ty.depth > 0 {
+					ty.depth--
+				}
+			}
+		case '\'':
+			// Apostrophe inside or at the end of a word
+			if unicode.IsLetter(prev) || unicode.IsDigit(prev) {
+				buf.WriteRune('’')
+			} else {
+				buf.WriteRune(r)
+			}
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	ty.prev = runes[len(runes)-1]
+	text = buf.String()
+
+	// Non-breaking spaces
+	if rules.NBSPBeforeDash {
+		text = strings.ReplaceAll(text, " —", string(nbsp)+"—")
+	}
+	if rules.NBSPBeforePunct != "" {
+		text = nbspBeforePunct(text, rules.NBSPBeforePunct)
+	}
+	if rules.NBSPInsideQuotes {
+		text = strings.ReplaceAll(text, rules.OpenQuote+" ", rules.OpenQuote)
+		text = strings.ReplaceAll(text, " "+rules.CloseQuote, rules.CloseQuote)
+		text = strings.ReplaceAll(text, rules.OpenQuote, rules.OpenQuote+string(nbsp))
+		text = strings.ReplaceAll(text, rules.CloseQuote, string(nbsp)+rules.CloseQuote)
+	}
+
+	return text
+}
+
+// isQuoteOpening reports whether a straight double quote following prev
+// opens a quotation
+func isQuoteOpening(prev rune, atStart bool) bool {
+	if atStart {
+		return true
+	}
+	return unicode.IsSpace(prev) || strings.ContainsRune("([{—–-«„“", prev)
+}
+
+// nbspBeforePunct replaces the space before each punctuation mark with a
+// non-breaking space, inserting one if it is missing
+func nbspBeforePunct(text, punct string) string {
+	runes := []rune(text)
+	var buf strings.Builder
+	for i, r := range runes {
+		if i > 0 && strings.ContainsRune(punct, r) && endsPunct(runes, i, punct) {
+			prev := runes[i-1]
+			if !unicode.IsSpace(prev) && !strings.ContainsRune(punct, prev) {
+				buf.WriteRune(nbsp)
+			}
+		}
+		if r == ' ' && i+1 < len(runes) && strings.ContainsRune(punct, runes[i+1]) && endsPunct(runes, i+1, punct) {
+			buf.WriteRune(nbsp)
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// endsPunct reports whether the punctuation run at i is followed by a space
+// or the end of text, so that things like "http://" are left alone
+func endsPunct(runes []rune, i int, punct string) bool {
+	for ; i < len(runes); i++ {
+		if !strings.ContainsRune(punct, runes[i]) {
+			return unicode.IsSpace(runes[i]) || strings.ContainsRune("»”)", runes[i])
+		}
+	}
+	return true
+}
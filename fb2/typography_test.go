@@ -0,0 +1,107 @@
+package fb2
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyTypography(t *testing.T) {
+	tests := []struct {
+		name string
+		lang string
+		in   string
+		want string
+	}{
+		{"russian quotes", "ru", `Он сказал "привет"`, "Он сказал «привет»"},
+		{"russian nested quotes", "ru", `"Книга "Война и мир" интересная"`, "«Книга „Война и мир“ интересная»"},
+		{"russian dash", "ru", "Москва - столица", "Москва\u00a0— столица"},
+		{"double hyphen", "ru", "Да--нет", "Да—нет"},
+		{"dialogue dash", "ru", "- Привет", "— Привет"},
+		{"ellipsis", "en", "Wait...", "Wait…"},
+		{"english quotes", "en", `She said "hi"`, "She said “hi”"},
+		{"apostrophe", "en", "don't", "don’t"},
+		{"french punctuation", "fr", "Quoi? Non!", "Quoi\u00a0? Non\u00a0!"},
+		{"french quotes", "fr", `Il dit "oui"`, "Il dit «\u00a0oui\u00a0»"},
+		{"french url untouched", "fr", "http://example.com", "http://example.com"},
+		{"unknown language", "xx", `"a"`, "“a”"},
+		{"region subtag", "ru-RU", `"a"`, "«a»"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ApplyTypography(tt.in, GetTypographyRules(tt.lang))
+			if got != tt.want {
+				t.Errorf("ApplyTypography(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformerTypography(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<book-title>Книга</book-title>
+			<lang>ru</lang>
+		</title-info>
+	</description>
+	<body>
+		<section>
+			<p>Он сказал "да" -- и ушёл...</p>
+		</section>
+	</body>
+</FictionBook>`)
+
+	transformer := NewTransformer()
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if !strings.Contains(html, "&quot;да&quot;") {
+		t.Error("Typography applied while disabled")
+	}
+
+	transformer = NewTransformer()
+	transformer.Typography = true
+	html, _, _, err = transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	if !strings.Contains(html, "Он сказал «да»\u00a0— и ушёл…") {
+		t.Errorf("HTML doesn't contain typographed paragraph: %s", html)
+	}
+}
+
+func TestTransformerTypographyAcrossMarkup(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<book-title>Книга</book-title>
+			<lang>ru</lang>
+		</title-info>
+	</description>
+	<body>
+		<section>
+			<p>Он сказал "<emphasis>стоп</emphasis>" и ушёл.</p>
+			<p>"<strong>Вперёд</strong>, "<emphasis>друзья</emphasis>"!"</p>
+		</section>
+	</body>
+</FictionBook>`)
+
+	transformer := NewTransformer()
+	transformer.Typography = true
+	html, _, _, err := transformer.ConvertBytes(fb2Data)
+	if err != nil {
+		t.Fatalf("ConvertBytes() error = %v", err)
+	}
+	for _, want := range []string{
+		"Он сказал «<em>стоп</em>» и ушёл.",
+		"«<strong>Вперёд</strong>, „<em>друзья</em>“!»",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %q: %s", want, html)
+		}
+	}
+}
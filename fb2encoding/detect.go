@@ -14,7 +14,9 @@ import (
 
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/encoding/unicode/utf32"
 	"golang.org/x/text/transform"
 )
 
@@ -40,18 +42,34 @@ var encodingAliases = map[string]string{
 	"cp1250":            "cp1250",
 	"cp1251":            "cp1251",
 	"cp1252":            "cp1252",
+	// Latin-1 is decoded as its windows-1252 superset, as browsers do:
+	// files declared iso-8859-1 routinely contain cp1252 curly quotes and
+	// dashes in the 0x80-0x9F range
+	"iso-8859-1":        "cp1252",
+	"iso8859-1":         "cp1252",
+	"iso-8859-1:1987":   "cp1252",
+	"latin1":            "cp1252",
+	"latin-1":           "cp1252",
+	"l1":                "cp1252",
+	"us-ascii":          "utf-8",
+	// Russian
+	"koi8-r":            "koi8-r",
+	"koi8r":             "koi8-r",
+	"koi8":              "koi8-r",
+	"cskoi8r":           "koi8-r",
 }
 
-// BOM markers for different encodings
+// BOM markers for different encodings. The UTF-32 LE BOM starts with the
+// UTF-16 LE one, so UTF-32 is checked first.
 var boms = []struct {
 	bom      []byte
 	encoding string
 }{
+	{[]byte{0xFF, 0xFE, 0x00, 0x00}, "utf-32le"}, // UTF-32 LE
+	{[]byte{0x00, 0x00, 0xFE, 0xFF}, "utf-32be"}, // UTF-32 BE
 	{[]byte{0xEF, 0xBB, 0xBF}, "utf-8"},        // UTF-8
 	{[]byte{0xFF, 0xFE}, "utf-16le"},          // UTF-16 LE
 	{[]byte{0xFE, 0xFF}, "utf-16be"},          // UTF-16 BE
-	{[]byte{0xFF, 0xFE, 0x00, 0x00}, "utf-32le"}, // UTF-32 LE
-	{[]byte{0x00, 0x00, 0xFE, 0xFF}, "utf-32be"}, // UTF-32 BE
 }
 
 // Regex patterns for encoding declarations
@@ -67,6 +85,14 @@ type DetectResult struct {
 	Confidence float64 // 0.0 to 1.0
 	BOM        bool
 	Declared   bool // From XML/HTML declaration
+	Heuristic  bool // Guessed from the byte distribution
+
+	// DeclaredEncoding is the normalized encoding of the XML/HTML
+	// declaration, recorded even when a BOM takes precedence over it
+	DeclaredEncoding string
+	// Conflict is set when the BOM and the declaration disagree. The BOM
+	// wins, as the XML specification requires.
+	Conflict bool
 }
 
 // Detect detects the character encoding of raw bytes.
@@ -76,30 +102,36 @@ func Detect(raw []byte) *DetectResult {
 		return &DetectResult{Encoding: "utf-8", Confidence: 0.5}
 	}
 
+	// Look for encoding declaration in first 50KB
+	prefix := raw
+	if len(prefix) > 50*1024 {
+		prefix = prefix[:50*1024]
+	}
+	declared := ""
+	if enc := findEncodingDeclaration(prefix); enc != "" {
+		declared = normalizeEncoding(enc)
+	}
+
 	// Check for BOM
 	for _, bom := range boms {
 		if bytes.HasPrefix(raw, bom.bom) {
 			return &DetectResult{
-				Encoding:   bom.encoding,
-				Confidence: 1.0,
-				BOM:        true,
+				Encoding:         bom.encoding,
+				Confidence:       1.0,
+				BOM:              true,
+				DeclaredEncoding: declared,
+				Conflict:         declared != "" && !sameEncoding(bom.encoding, declared),
 			}
 		}
 	}
 
-	// Look for encoding declaration in first 50KB
-	prefix := raw
-	if len(prefix) > 50*1024 {
-		prefix = prefix[:50*1024]
-	}
-
-	// Try to find XML/HTML encoding declaration
-	if enc := findEncodingDeclaration(prefix); enc != "" {
-		normalized := normalizeEncoding(enc)
+	// Use the XML/HTML encoding declaration
+	if declared != "" {
 		return &DetectResult{
-			Encoding:   normalized,
-			Confidence: 0.9,
-			Declared:   true,
+			Encoding:         declared,
+			Confidence:       0.9,
+			Declared:         true,
+			DeclaredEncoding: declared,
 		}
 	}
 
@@ -118,6 +150,21 @@ func findEncodingDeclaration(data []byte) string {
 	return ""
 }
 
+// sameEncoding reports whether a BOM encoding agrees with a declared one.
+// Declarations of UTF-16 or UTF-32 without a byte order leave it to the
+// BOM.
+func sameEncoding(bomEncoding, declared string) bool {
+	switch declared {
+	case bomEncoding:
+		return true
+	case "utf-16":
+		return strings.HasPrefix(bomEncoding, "utf-16")
+	case "utf-32":
+		return strings.HasPrefix(bomEncoding, "utf-32")
+	}
+	return false
+}
+
 // normalizeEncoding converts encoding names to canonical form.
 func normalizeEncoding(enc string) string {
 	enc = strings.ToLower(strings.TrimSpace(enc))
@@ -160,6 +207,15 @@ func detectHeuristic(raw []byte) *DetectResult {
 		}
 	}
 
+	// Undeclared 8-bit Cyrillic is common in older Russian books
+	if enc, ok := detectCyrillic(raw); ok {
+		return &DetectResult{
+			Encoding:   enc,
+			Confidence: 0.6,
+			Heuristic:  true,
+		}
+	}
+
 	// Last resort: assume UTF-8 with replacement
 	return &DetectResult{
 		Encoding:   "utf-8",
@@ -167,6 +223,62 @@ func detectHeuristic(raw []byte) *DetectResult {
 	}
 }
 
+// cyrillicCandidates are the 8-bit Cyrillic encodings detectCyrillic
+// chooses between
+var cyrillicCandidates = []struct {
+	name    string
+	charmap *charmap.Charmap
+}{
+	{"cp1251", charmap.Windows1251},
+	{"koi8-r", charmap.KOI8R},
+}
+
+// detectCyrillic guesses an 8-bit Cyrillic encoding from the bytes above
+// 0x7F. Each candidate scores the share of those bytes it decodes to
+// Cyrillic letters, lowercase letters counting double as running text is
+// mostly lowercase. windows-1251 and KOI8-R put lowercase and uppercase
+// letters in opposite halves of 0xC0-0xFF, so the case distribution tells
+// them apart. Markup counts as Latin text, so this assumes a book where
+// the text outweighs the tags.
+func detectCyrillic(raw []byte) (string, bool) {
+	high, latin := 0, 0
+	scores := make([]int, len(cyrillicCandidates))
+	for _, b := range raw {
+		if b < 0x80 {
+			if b|0x20 >= 'a' && b|0x20 <= 'z' {
+				latin++
+			}
+			continue
+		}
+		high++
+		for i, c := range cyrillicCandidates {
+			switch r := c.charmap.DecodeByte(b); {
+			case r >= 'а' && r <= 'я', r == 'ё':
+				scores[i] += 2
+			case r >= 'А' && r <= 'Я', r == 'Ё':
+				scores[i]++
+			}
+		}
+	}
+	// Western text with a few accented letters has far fewer high bytes
+	// than Cyrillic text, where every letter is one
+	if high == 0 || high*5 < high+latin {
+		return "", false
+	}
+
+	best := 0
+	for i := range scores {
+		if scores[i] > scores[best] {
+			best = i
+		}
+	}
+	// Mostly non-letters: probably not Cyrillic text at all
+	if float64(scores[best]) < 1.2*float64(high) {
+		return "", false
+	}
+	return cyrillicCandidates[best].name, true
+}
+
 // looksLikeUTF16LE checks if data looks like UTF-16 Little Endian.
 func looksLikeUTF16LE(data []byte) bool {
 	if len(data) < 2 {
@@ -226,6 +338,22 @@ func ToUTF8WithStrip(raw []byte, stripPatterns bool) (string, string, error) {
 	return str, result.Encoding, nil
 }
 
+// ToUTF8WithEncoding converts raw bytes to UTF-8 from the given encoding,
+// skipping detection. It returns an error for encodings it can't decode
+// rather than falling back to a detected one.
+func ToUTF8WithEncoding(raw []byte, enc string, stripPatterns bool) (string, error) {
+	str, err := toUTF8WithEncoding(raw, normalizeEncoding(enc))
+	if err != nil {
+		return "", err
+	}
+
+	if stripPatterns {
+		str = stripEncodingDeclarations(str)
+	}
+
+	return str, nil
+}
+
 // toUTF8WithEncoding converts raw bytes to UTF-8 using a specific encoding.
 func toUTF8WithEncoding(raw []byte, enc string) (string, error) {
 	// Remove BOM if present
@@ -251,6 +379,10 @@ func toUTF8WithEncoding(raw []byte, enc string) (string, error) {
 		return decodeUTF16(raw, unicode.LittleEndian)
 	case "utf-16be", "utf16be", "utf-16-be":
 		return decodeUTF16(raw, unicode.BigEndian)
+	case "utf-32le", "utf32le", "utf-32-le":
+		return decodeUTF32(raw, utf32.LittleEndian)
+	case "utf-32be", "utf32be", "utf-32-be":
+		return decodeUTF32(raw, utf32.BigEndian)
 	}
 
 	// Handle Windows codepages using charmap
@@ -262,9 +394,14 @@ func toUTF8WithEncoding(raw []byte, enc string) (string, error) {
 		encoding = charmap.Windows1251
 	case "cp1252":
 		encoding = charmap.Windows1252
+	case "koi8-r":
+		encoding = charmap.KOI8R
 	default:
-		// For other encodings, return an error
-		return "", fmt.Errorf("unsupported encoding: %s (you may need to add encoding support)", enc)
+		// Any other declared encoding known to x/text
+		encoding = lookupIANA(enc)
+		if encoding == nil {
+			return "", fmt.Errorf("unsupported encoding: %s (you may need to add encoding support)", enc)
+		}
 	}
 
 	// Decode using the selected encoding
@@ -278,6 +415,27 @@ func toUTF8WithEncoding(raw []byte, enc string) (string, error) {
 	return string(result), nil
 }
 
+// ianaNames maps canonical names used here to their IANA registry names
+// where the two differ
+var ianaNames = map[string]string{
+	"mac-roman": "macintosh",
+}
+
+// lookupIANA returns the x/text encoding for a canonical encoding name, or
+// nil if it has none. Names are tried as given and with underscores, which
+// normalizeEncoding turns into hyphens (e.g. shift_jis).
+func lookupIANA(enc string) encoding.Encoding {
+	if name, ok := ianaNames[enc]; ok {
+		enc = name
+	}
+	for _, name := range []string{enc, strings.ReplaceAll(enc, "-", "_")} {
+		if e, err := ianaindex.IANA.Encoding(name); err == nil && e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 // decodeWithReplacement decodes data replacing unconvertible characters
 func decodeWithReplacement(data []byte, transformer transform.Transformer) (string, error) {
 	// Transform with replacement
@@ -305,6 +463,22 @@ func decodeUTF16(data []byte, bo unicode.Endianness) (string, error) {
 	return string(result), nil
 }
 
+// decodeUTF32 decodes UTF-32 data with specified byte order.
+func decodeUTF32(data []byte, bo utf32.Endianness) (string, error) {
+	if len(data)%4 != 0 {
+		return "", fmt.Errorf("invalid UTF-32 data: length %d is not a multiple of 4", len(data))
+	}
+
+	decoder := utf32.UTF32(bo, utf32.IgnoreBOM).NewDecoder()
+
+	result, err := decoder.Bytes(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
 // StripEncodingDeclarations removes encoding declarations from XML/HTML.
 func StripEncodingDeclarations(data string) string {
 	return stripEncodingDeclarations(data)
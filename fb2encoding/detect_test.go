@@ -3,6 +3,8 @@ package fb2encoding
 import (
 	"bytes"
 	"testing"
+
+	"golang.org/x/text/encoding/charmap"
 )
 
 func TestDetectBOM(t *testing.T) {
@@ -34,6 +36,20 @@ func TestDetectBOM(t *testing.T) {
 			wantBOM:  true,
 			wantConf: 1.0,
 		},
+		{
+			name:     "UTF-32 LE BOM",
+			input:    []byte{0xFF, 0xFE, 0x00, 0x00, 'H', 0, 0, 0},
+			wantEnc:  "utf-32le",
+			wantBOM:  true,
+			wantConf: 1.0,
+		},
+		{
+			name:     "UTF-32 BE BOM",
+			input:    []byte{0x00, 0x00, 0xFE, 0xFF, 0, 0, 0, 'H'},
+			wantEnc:  "utf-32be",
+			wantBOM:  true,
+			wantConf: 1.0,
+		},
 		{
 			name:     "no BOM",
 			input:    []byte("Hello World"),
@@ -59,6 +75,38 @@ func TestDetectBOM(t *testing.T) {
 	}
 }
 
+func TestDetectBOMDeclarationConflict(t *testing.T) {
+	bom := "\xef\xbb\xbf"
+	tests := []struct {
+		name         string
+		input        string
+		wantEnc      string
+		wantDeclared string
+		wantConflict bool
+	}{
+		{"agree", bom + `<?xml version="1.0" encoding="UTF-8"?><a/>`, "utf-8", "utf-8", false},
+		{"disagree", bom + `<?xml version="1.0" encoding="windows-1251"?><a/>`, "utf-8", "cp1251", true},
+		{"BOM only", bom + `<?xml version="1.0"?><a/>`, "utf-8", "", false},
+		{"declaration only", `<?xml version="1.0" encoding="windows-1251"?><a/>`, "cp1251", "cp1251", false},
+		{"UTF-16 without byte order", "\xff\xfe" + `<?xml version="1.0" encoding="UTF-16"?>`, "utf-16le", "utf-16", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Detect([]byte(tt.input))
+			if got.Encoding != tt.wantEnc {
+				t.Errorf("Encoding = %q, want %q", got.Encoding, tt.wantEnc)
+			}
+			if got.DeclaredEncoding != tt.wantDeclared {
+				t.Errorf("DeclaredEncoding = %q, want %q", got.DeclaredEncoding, tt.wantDeclared)
+			}
+			if got.Conflict != tt.wantConflict {
+				t.Errorf("Conflict = %v, want %v", got.Conflict, tt.wantConflict)
+			}
+		})
+	}
+}
+
 func TestFindEncodingDeclaration(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -149,6 +197,21 @@ func TestToUTF8(t *testing.T) {
 			input: []byte{0xD0, 0xBF, 0xD1, 0x80, 0xD0, 0xB8, 0xD0, 0xB2, 0xD0, 0xB5, 0xD1, 0x82}, // "привет"
 			want:  "привет",
 		},
+		{
+			name:  "UTF-32 LE with BOM",
+			input: []byte{0xFF, 0xFE, 0x00, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x3F, 0x04, 0x00, 0x00, 0x00, 0xF6, 0x01, 0x00}, // BOM + "<п😀"
+			want:  "<п\U0001F600",
+		},
+		{
+			name:  "UTF-32 BE with BOM",
+			input: []byte{0x00, 0x00, 0xFE, 0xFF, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x00, 0x04, 0x3F}, // BOM + "<п"
+			want:  "<п",
+		},
+		{
+			name:    "UTF-32 with truncated code unit",
+			input:   []byte{0xFF, 0xFE, 0x00, 0x00, 0x3C, 0x00, 0x00},
+			wantErr: true,
+		},
 		{
 			name:    "UTF-16 LE with BOM",
 			input:   []byte{0xFF, 0xFE, 0x3C, 0x00}, // BOM + "<"
@@ -171,6 +234,173 @@ func TestToUTF8(t *testing.T) {
 	}
 }
 
+func TestToUTF8Windows1252(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     string
+	}{
+		{"curly single quotes", "windows-1252", []byte{0x91, 'x', 0x92}, "\u2018x\u2019"},
+		{"curly double quotes", "windows-1252", []byte{0x93, 'x', 0x94}, "\u201cx\u201d"},
+		{"dashes and euro", "cp1252", []byte{0x96, 0x97, 0x80}, "\u2013\u2014\u20ac"},
+		{"latin-1 letters", "iso-8859-1", []byte{'c', 'a', 'f', 0xE9}, "caf\u00e9"},
+		{"latin-1 with cp1252 quotes", "ISO-8859-1", []byte{0x91, 0xE7, 0x92}, "\u2018\u00e7\u2019"},
+		{"latin1 alias", "latin1", []byte{0xDF}, "\u00df"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := append([]byte(`<?xml version="1.0" encoding="`+tt.encoding+`"?><p>`), tt.body...)
+			raw = append(raw, "</p>"...)
+
+			got, enc, err := ToUTF8WithStrip(raw, true)
+			if err != nil {
+				t.Fatalf("ToUTF8WithStrip() error = %v", err)
+			}
+			if enc != "cp1252" {
+				t.Errorf("encoding = %q, want cp1252", enc)
+			}
+			if want := "<p>" + tt.want + "</p>"; got != want {
+				t.Errorf("ToUTF8WithStrip() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestToUTF8KOI8R(t *testing.T) {
+	const text = "Съешь же ещё этих мягких французских булок, да выпей чаю. ЁЖ"
+	body, err := charmap.KOI8R.NewEncoder().String(text)
+	if err != nil {
+		t.Fatalf("KOI8-R encode error = %v", err)
+	}
+
+	for _, declared := range []string{"koi8-r", "KOI8-R", "koi8r"} {
+		t.Run(declared, func(t *testing.T) {
+			raw := []byte(`<?xml version="1.0" encoding="` + declared + `"?>` + body)
+
+			result := Detect(raw)
+			if result.Encoding != "koi8-r" || !result.Declared {
+				t.Errorf("Detect() = %+v, want declared koi8-r", result)
+			}
+
+			got, _, err := ToUTF8WithStrip(raw, true)
+			if err != nil {
+				t.Fatalf("ToUTF8WithStrip() error = %v", err)
+			}
+			if got != text {
+				t.Errorf("ToUTF8WithStrip() = %q, want %q", got, text)
+			}
+		})
+	}
+}
+
+func TestToUTF8LegacyEncodings(t *testing.T) {
+	tests := []struct {
+		encoding string
+		body     []byte
+		want     string
+	}{
+		{"iso-8859-2", []byte{0xA3, 0xF3, 0x64, 0xBC}, "Łódź"},
+		{"ISO_8859-2", []byte{0xA9, 0x61, 0x68}, "Šah"},
+		{"shift_jis", []byte{0x93, 0xFA, 0x96, 0x7B}, "日本"},
+		{"Shift-JIS", []byte{0x82, 0xA0}, "あ"},
+		{"gbk", []byte{0xD6, 0xD0, 0xCE, 0xC4}, "中文"},
+		{"big5", []byte{0xA4, 0xA4, 0xA4, 0xE5}, "中文"},
+		{"macintosh", []byte{0x8E}, "é"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			raw := append([]byte(`<?xml version="1.0" encoding="`+tt.encoding+`"?>`), tt.body...)
+			got, _, err := ToUTF8WithStrip(raw, true)
+			if err != nil {
+				t.Fatalf("ToUTF8WithStrip() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ToUTF8WithStrip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := toUTF8WithEncoding([]byte("x"), "no-such-encoding"); err == nil {
+		t.Error("toUTF8WithEncoding() with an unknown encoding succeeded")
+	}
+}
+
+func TestDetectCyrillic(t *testing.T) {
+	const text = `<FictionBook><body><section><p>Мороз и солнце; день чудесный! Ещё ты дремлешь, друг прелестный.</p></section></body></FictionBook>`
+
+	tests := []struct {
+		name     string
+		encoding *charmap.Charmap
+		want     string
+	}{
+		{"windows-1251", charmap.Windows1251, "cp1251"},
+		{"koi8-r", charmap.KOI8R, "koi8-r"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.encoding.NewEncoder().Bytes([]byte(text))
+			if err != nil {
+				t.Fatalf("Encode error = %v", err)
+			}
+
+			result := Detect(raw)
+			if result.Encoding != tt.want || !result.Heuristic || result.Declared {
+				t.Errorf("Detect() = %+v, want heuristic %s", result, tt.want)
+			}
+
+			got, err := ToUTF8(raw)
+			if err != nil {
+				t.Fatalf("ToUTF8() error = %v", err)
+			}
+			if got != text {
+				t.Errorf("ToUTF8() = %q, want %q", got, text)
+			}
+		})
+	}
+
+	// Western text with a few accented letters isn't taken for Cyrillic
+	latin1, _ := charmap.Windows1252.NewEncoder().Bytes([]byte("<p>The café served crème brûlée.</p>"))
+	if result := Detect(latin1); result.Heuristic {
+		t.Errorf("Detect() on Latin-1 text = %+v, want no Cyrillic guess", result)
+	}
+}
+
+func TestToUTF8Windows1251Punctuation(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"em dash", []byte{0x97}, "—"},
+		{"en dash", []byte{0x96}, "–"},
+		{"ellipsis", []byte{0x85}, "…"},
+		{"guillemets", []byte{0xAB, 0xE4, 0xE0, 0xBB}, "«да»"},
+		{"low and high quotes", []byte{0x84, 0xE4, 0xE0, 0x93}, "„да“"},
+		{"numero sign", []byte{0xB9, '5'}, "№5"},
+		{"yo", []byte{0xA8, 0xB8}, "Ёё"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := append([]byte(`<?xml version="1.0" encoding="windows-1251"?>`), tt.body...)
+			got, enc, err := ToUTF8WithStrip(raw, true)
+			if err != nil {
+				t.Fatalf("ToUTF8WithStrip() error = %v", err)
+			}
+			if enc != "cp1251" {
+				t.Errorf("encoding = %q, want cp1251", enc)
+			}
+			if got != tt.want {
+				t.Errorf("ToUTF8WithStrip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestStripEncodingDeclarations(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -0,0 +1,104 @@
+package fb2c
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Golden-file tests convert every testdata/*.fb2 file and compare the
+// output byte for byte with testdata/golden/<name>.<format>.
+//
+// Regenerate the golden files after an intended output change with:
+//
+//	UPDATE_GOLDEN=1 go test -run TestGolden .
+
+// goldenFormats maps a golden file suffix to the output extension and
+// MOBI type used to produce it
+var goldenFormats = []struct {
+	suffix   string
+	ext      string
+	mobiType string
+}{
+	{"mobi", ".mobi", "old"},
+	{"kf8.azw3", ".azw3", "new"},
+	{"joint.mobi", ".mobi", "both"},
+	{"epub", ".epub", "old"},
+}
+
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.fb2")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	if len(inputs) == 0 {
+		t.Skip("no testdata/*.fb2 files")
+	}
+
+	update := os.Getenv("UPDATE_GOLDEN") != ""
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".fb2")
+
+		for _, format := range goldenFormats {
+			t.Run(name+"."+format.suffix, func(t *testing.T) {
+				got := convertGolden(t, input, format.ext, format.mobiType)
+				goldenPath := filepath.Join("testdata", "golden", name+"."+format.suffix)
+
+				if update {
+					if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+						t.Fatalf("MkdirAll() error = %v", err)
+					}
+					if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+						t.Fatalf("WriteFile() error = %v", err)
+					}
+					return
+				}
+
+				want, err := os.ReadFile(goldenPath)
+				if err != nil {
+					t.Fatalf("Failed to read golden file (run with UPDATE_GOLDEN=1 to create it): %v", err)
+				}
+
+				if !bytes.Equal(got, want) {
+					t.Errorf("Output differs from %s at byte %d (got %d bytes, want %d); "+
+						"run with UPDATE_GOLDEN=1 if the change is intended",
+						goldenPath, firstDiff(got, want), len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+// convertGolden converts input with deterministic output enabled
+func convertGolden(t *testing.T, input, ext, mobiType string) []byte {
+	t.Helper()
+
+	options := DefaultConvertOptions()
+	options.MobiType = mobiType
+	options.Deterministic = true
+
+	output := filepath.Join(t.TempDir(), "out"+ext)
+	if err := ConvertFileWithOptions(input, output, options); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	return data
+}
+
+// firstDiff returns the offset of the first differing byte
+func firstDiff(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -1,14 +1,31 @@
 package fb2c
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/htol/fb2c/epub"
 	"github.com/htol/fb2c/fb2"
 	"github.com/htol/fb2c/mobi"
+	"github.com/htol/fb2c/mobi/index"
 	"github.com/htol/fb2c/opf"
+	"golang.org/x/text/encoding/charmap"
 )
 
 // TestConvertSimpleFB2 tests end-to-end conversion of a simple FB2 file
@@ -362,3 +379,2058 @@ func BenchmarkConversion(b *testing.B) {
 		os.Remove(outputFile)
 	}
 }
+
+// TestWriteBook tests writing a hand-built OEB book in every format
+func TestWriteBook(t *testing.T) {
+	newBook := func() *opf.OEBBook {
+		book := opf.NewOEBBook()
+		book.Metadata.Title = "Hand Built"
+		book.Content = "<html><body><p>Hello</p></body></html>"
+		return book
+	}
+
+	for _, format := range []string{"epub", "mobi", "mobi6", "kf8", "azw3", "joint"} {
+		t.Run(format, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := WriteBook(newBook(), format, DefaultConvertOptions(), &output); err != nil {
+				t.Fatalf("WriteBook() failed: %v", err)
+			}
+
+			data := output.Bytes()
+			if format == "epub" {
+				if !bytes.HasPrefix(data, []byte("PK")) {
+					t.Error("EPUB output is not a ZIP archive")
+				}
+				return
+			}
+			if len(data) < 68 || string(data[60:64]) != "BOOK" {
+				t.Error("Output doesn't have a PalmDB BOOK header")
+			}
+		})
+	}
+
+	var output bytes.Buffer
+	if err := WriteBook(newBook(), "pdf", DefaultConvertOptions(), &output); err == nil {
+		t.Error("WriteBook() should fail for unknown format")
+	}
+}
+
+// TestTOCOverride tests replacing the extracted TOC with a supplied one
+func TestTOCOverride(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	converter := NewConverter()
+	options := DefaultConvertOptions()
+	options.TOCOverride = []TOCOverrideEntry{
+		{Title: "First", Anchor: "#ch1", Level: 1},
+		{Title: "Second", Anchor: "ch2", Level: 3},
+		{Title: "Missing", Anchor: "#nowhere", Level: 1},
+	}
+	converter.SetOptions(options)
+
+	var output bytes.Buffer
+	if err := converter.ConvertStream(bytes.NewReader(fb2Data), &output); err != nil {
+		t.Fatalf("ConvertStream() failed: %v", err)
+	}
+
+	warnings := converter.Warnings()
+	if len(warnings) != 1 {
+		t.Fatalf("Warnings = %v, want 1 warning about the missing anchor", warnings)
+	}
+	if !bytes.Contains([]byte(warnings[0]), []byte("nowhere")) {
+		t.Errorf("Warning %q doesn't mention the missing anchor", warnings[0])
+	}
+
+	toc := converter.buildTOCOverride(`<a name="ch1"></a><a name="ch2"></a>`)
+	if len(toc.Entries) != 3 {
+		t.Fatalf("Entry count = %d, want 3", len(toc.Entries))
+	}
+	second := toc.Entries[1]
+	if second.Level != 2 || second.Parent != toc.Entries[0] {
+		t.Errorf("Second entry level = %d, want 2 nested under the first", second.Level)
+	}
+	if second.Href != "#ch2" {
+		t.Errorf("Second entry href = %q, want '#ch2'", second.Href)
+	}
+}
+
+func TestBookmarks(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "book.epub")
+
+	converter := NewConverter()
+	options := DefaultConvertOptions()
+	options.Bookmarks = []Bookmark{
+		{Label: "Second chapter", Anchor: "#ch2"},
+		{Label: "Missing", Anchor: "nowhere"},
+	}
+	converter.SetOptions(options)
+	if err := converter.Convert("testdata/golden_basic.fb2", output); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+
+	warnings := converter.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "nowhere") {
+		t.Errorf("Warnings = %v, want 1 warning about the missing anchor", warnings)
+	}
+
+	ncx := readEPUBFiles(t, output)["OEBPS/toc.ncx"]
+	navMap := strings.Index(ncx, "</navMap>")
+	navList := strings.Index(ncx, `<navList id="bookmarks">`)
+	if navList == -1 || navList < navMap {
+		t.Fatalf("toc.ncx has no bookmarks navList after the navMap:\n%s", ncx)
+	}
+	if !strings.Contains(ncx[navList:], `<content src="content.xhtml#ch2"/>`) {
+		t.Error("Bookmark navTarget doesn't point at its anchor")
+	}
+	if strings.Contains(ncx, "Missing") {
+		t.Error("Bookmark with a missing anchor was written")
+	}
+}
+
+// readEPUBFiles returns the contents of every file in an EPUB by name
+func readEPUBFiles(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatalf("Failed to open EPUB: %v", err)
+	}
+	defer zr.Close()
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+// imageOnlyFB2 builds a comic-style FB2 with one PNG page per section
+func imageOnlyFB2(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	data := base64.StdEncoding.EncodeToString(img.Bytes())
+
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Comic</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body>
+		<section><image l:href="#p1.png"/></section>
+		<section><image l:href="#p2.png"/></section>
+	</body>
+	<binary id="p1.png" content-type="image/png">` + data + `</binary>
+	<binary id="p2.png" content-type="image/png">` + data + `</binary>
+</FictionBook>`)
+}
+
+// TestFixedLayoutEPUB tests pre-paginated EPUB output for image-only books
+func TestFixedLayoutEPUB(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "comic.fb2")
+	if err := os.WriteFile(input, imageOnlyFB2(t, 600, 800), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	options := DefaultConvertOptions()
+	options.FixedLayout = true
+	output := filepath.Join(dir, "comic.epub")
+	if err := ConvertFileWithOptions(input, output, options); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+
+	files := readEPUBFiles(t, output)
+
+	opfData := files["OEBPS/content.opf"]
+	for _, want := range []string{`version="3.0"`, "pre-paginated", `properties="nav"`, `<itemref idref="page-2"/>`} {
+		if !strings.Contains(opfData, want) {
+			t.Errorf("content.opf doesn't contain %s", want)
+		}
+	}
+
+	page, ok := files["OEBPS/page-0001.xhtml"]
+	if !ok {
+		t.Fatal("page-0001.xhtml not written")
+	}
+	if !strings.Contains(page, `<meta name="viewport" content="width=600, height=800"/>`) {
+		t.Error("Page viewport doesn't match image size")
+	}
+	if _, ok := files["OEBPS/content.xhtml"]; ok {
+		t.Error("Fixed-layout EPUB shouldn't contain reflowable content.xhtml")
+	}
+}
+
+// TestFixedLayoutKF8 tests the KF8 fixed-layout EXTH records
+func TestFixedLayoutKF8(t *testing.T) {
+	options := DefaultConvertOptions()
+	options.MobiType = "new"
+	options.FixedLayout = true
+
+	converter := NewConverter()
+	converter.SetOptions(options)
+
+	var output bytes.Buffer
+	if err := converter.ConvertStream(bytes.NewReader(imageOnlyFB2(t, 300, 400)), &output); err != nil {
+		t.Fatalf("ConvertStream() failed: %v", err)
+	}
+	if !bytes.Contains(output.Bytes(), []byte("300x400")) {
+		t.Error("KF8 output doesn't contain original-resolution record")
+	}
+
+	// Books with text fall back to reflowable output with a warning
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+	output.Reset()
+	if err := converter.ConvertStream(bytes.NewReader(fb2Data), &output); err != nil {
+		t.Fatalf("ConvertStream() failed: %v", err)
+	}
+	if len(converter.Warnings()) != 1 {
+		t.Errorf("Warnings = %v, want fixed-layout fallback warning", converter.Warnings())
+	}
+}
+
+func TestAccentColor(t *testing.T) {
+	cover := image.NewRGBA(image.Rect(0, 0, 40, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{R: 0x20, G: 0x40, B: 0xa0, A: 0xff}
+			if y < 10 {
+				c = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			}
+			cover.Set(x, y, c)
+		}
+	}
+	var png1 bytes.Buffer
+	if err := png.Encode(&png1, cover); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		wantMeta string
+	}{
+		{"decodable cover", base64.StdEncoding.EncodeToString(png1.Bytes()), `<meta name="accent-color" content="#2040a0"/>`},
+		{"undecodable cover", base64.StdEncoding.EncodeToString([]byte("not an image")), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "book.fb2")
+			fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Colorful</book-title>
+			<coverpage><image l:href="#cover.png"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="cover.png" content-type="image/png">` + tt.data + `</binary>
+</FictionBook>`
+			if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			options := DefaultConvertOptions()
+			options.AccentColor = true
+			output := filepath.Join(dir, "book.epub")
+			if err := ConvertFileWithOptions(input, output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+
+			opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+			if tt.wantMeta == "" {
+				if strings.Contains(opfData, "accent-color") {
+					t.Error("accent-color written for an undecodable cover")
+				}
+			} else if !strings.Contains(opfData, tt.wantMeta) {
+				t.Errorf("content.opf doesn't contain %s:\n%s", tt.wantMeta, opfData)
+			}
+		})
+	}
+}
+
+func TestEPUBCompression(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "comic.fb2")
+	if err := os.WriteFile(input, imageOnlyFB2(t, 60, 80), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	output := filepath.Join(dir, "comic.epub")
+	if err := ConvertFileWithOptions(input, output, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatalf("Failed to open EPUB: %v", err)
+	}
+	defer zr.Close()
+
+	if first := zr.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("First entry = %s (method %d), want stored mimetype", first.Name, first.Method)
+	}
+
+	images := 0
+	for _, f := range zr.File[1:] {
+		want := zip.Deflate
+		if strings.HasSuffix(f.Name, ".png") {
+			want = zip.Store
+			images++
+		}
+		if f.Method != want {
+			t.Errorf("%s method = %d, want %d", f.Name, f.Method, want)
+		}
+	}
+	if images == 0 {
+		t.Error("EPUB has no image entries")
+	}
+	if files := readEPUBFiles(t, output); !strings.Contains(files["OEBPS/content.opf"], "image/png") {
+		t.Error("content.opf doesn't list the images")
+	}
+}
+
+func TestEPUBSeriesMetadata(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<author><first-name>Ivan</first-name><last-name>Petrov</last-name></author>
+			<author><first-name>Anna</first-name><last-name>Sidorova</last-name></author>
+			<book-title>Second Book</book-title>
+			<lang>en</lang>
+			<sequence name="Saga &amp; Co" number="2"/>
+			<sequence name="Collected Works" number="7"/>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	common := []string{
+		`<meta name="calibre:series" content="Saga &amp; Co"/>`,
+		`<meta name="calibre:series_index" content="2"/>`,
+		`<meta name="fb2:sequence" content="Collected Works (#7)"/>`,
+		`<meta name="calibre:author_sort" content="Petrov, Ivan &amp; Sidorova, Anna"/>`,
+	}
+	tests := []struct {
+		version int
+		want    []string
+	}{
+		{2, common},
+		{3, append(common,
+			`<meta property="belongs-to-collection" id="collection1">Saga &amp; Co</meta>`,
+			`<meta refines="#collection1" property="group-position">2</meta>`,
+			`<meta property="belongs-to-collection" id="collection2">Collected Works</meta>`,
+			`<meta refines="#collection2" property="collection-type">series</meta>`,
+		)},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("EPUB%d", tt.version), func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.EPUBVersion = tt.version
+			output := filepath.Join(dir, fmt.Sprintf("book%d.epub", tt.version))
+			if err := ConvertFileWithOptions(input, output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+
+			opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+			for _, want := range tt.want {
+				if !strings.Contains(opfData, want) {
+					t.Errorf("content.opf doesn't contain %s:\n%s", want, opfData)
+				}
+			}
+			if tt.version == 2 && strings.Contains(opfData, "belongs-to-collection") {
+				t.Error("EPUB 2 content.opf has EPUB 3 collections")
+			}
+		})
+	}
+}
+
+func TestEPUBSubjects(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<genre>sf</genre>
+			<genre>detective</genre>
+			<book-title>Subjects</book-title>
+			<keywords>space, robots, science fiction</keywords>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	output := filepath.Join(dir, "book.epub")
+	if err := ConvertFileWithOptions(input, output, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+
+	opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+	// "science fiction" repeats the label of the sf genre
+	want := []string{"Science Fiction", "Detective Fiction", "space", "robots"}
+	if n := strings.Count(opfData, "<dc:subject>"); n != len(want) {
+		t.Errorf("content.opf has %d dc:subject elements, want %d:\n%s", n, len(want), opfData)
+	}
+	for _, subject := range want {
+		if !strings.Contains(opfData, "<dc:subject>"+subject+"</dc:subject>") {
+			t.Errorf("content.opf has no subject %q", subject)
+		}
+	}
+}
+
+func TestNicknameOnlyAuthor(t *testing.T) {
+	metadata, err := ExtractMetadata("testdata/nickname_author.fb2")
+	if err != nil {
+		t.Fatalf("ExtractMetadata() failed: %v", err)
+	}
+	if len(metadata.Authors) != 1 || metadata.Authors[0] != "Dark Quill" {
+		t.Errorf("Authors = %q, want [Dark Quill]", metadata.Authors)
+	}
+	if metadata.AuthorSort != "Dark Quill" {
+		t.Errorf("AuthorSort = %q, want 'Dark Quill'", metadata.AuthorSort)
+	}
+
+	output := filepath.Join(t.TempDir(), "book.epub")
+	if err := ConvertFileWithOptions("testdata/nickname_author.fb2", output, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+	opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+	if n := strings.Count(opfData, "<dc:creator"); n != 1 {
+		t.Errorf("content.opf has %d dc:creator elements, want 1", n)
+	}
+	want := `<dc:creator opf:role="aut" opf:file-as="Dark Quill">Dark Quill</dc:creator>`
+	if !strings.Contains(opfData, want) {
+		t.Errorf("content.opf doesn't contain %s:\n%s", want, opfData)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Damaged</book-title>
+			<coverpage><image l:href="#missing.jpg"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p><image l:href="#broken.png"/></section></body>
+	<binary id="broken.png" content-type="image/png">` + base64.StdEncoding.EncodeToString([]byte("not an image")) + `</binary>
+</FictionBook>`)
+
+	// Best effort: converts and reports the problems
+	converter := NewConverter()
+	var output bytes.Buffer
+	if err := converter.ConvertStream(bytes.NewReader(fb2Data), &output); err != nil {
+		t.Fatalf("ConvertStream() failed: %v", err)
+	}
+	warnings := strings.Join(converter.Warnings(), "\n")
+	for _, want := range []string{"broken.png", "missing.jpg"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("Warnings don't mention %s: %v", want, converter.Warnings())
+		}
+	}
+
+	// Strict: fails with the problems
+	options := DefaultConvertOptions()
+	options.Strict = true
+	converter.SetOptions(options)
+	output.Reset()
+	err := converter.ConvertStream(bytes.NewReader(fb2Data), &output)
+	var degraded *DegradedError
+	if !errors.As(err, &degraded) {
+		t.Fatalf("ConvertStream() error = %v, want *DegradedError", err)
+	}
+	if len(degraded.Problems) != 2 {
+		t.Errorf("Problems = %q, want 2", degraded.Problems)
+	}
+	if output.Len() != 0 {
+		t.Error("Strict conversion wrote output despite problems")
+	}
+
+	// Strict with a clean book succeeds
+	if err := converter.Convert("testdata/golden_basic.fb2", filepath.Join(t.TempDir(), "book.mobi")); err != nil {
+		t.Errorf("Strict Convert() of a clean book failed: %v", err)
+	}
+}
+
+func TestCatalogEntry(t *testing.T) {
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 4, 6))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	input := filepath.Join(t.TempDir(), "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<genre>sf</genre>
+			<genre>adventure</genre>
+			<author><first-name>Jane</first-name><last-name>Doe</last-name></author>
+			<book-title>Catalogued</book-title>
+			<annotation><p>A short summary.</p></annotation>
+			<coverpage><image l:href="#cover.png"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+		<document-info><id>catalogued-0001</id></document-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="cover.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(cover.Bytes()) + `</binary>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	entry, err := CatalogEntry(input)
+	if err != nil {
+		t.Fatalf("CatalogEntry() error = %v", err)
+	}
+	if entry.ID != "urn:fb2:catalogued-0001" {
+		t.Errorf("ID = %q, want urn:fb2:catalogued-0001", entry.ID)
+	}
+	if entry.Title != "Catalogued" || entry.Language != "en" {
+		t.Errorf("Title, Language = %q, %q", entry.Title, entry.Language)
+	}
+	if strings.Join(entry.Authors, "|") != "Jane Doe" {
+		t.Errorf("Authors = %q, want [Jane Doe]", entry.Authors)
+	}
+	if !strings.Contains(entry.Summary, "A short summary.") {
+		t.Errorf("Summary = %q", entry.Summary)
+	}
+	if strings.Join(entry.Categories, "|") != "sf|adventure" {
+		t.Errorf("Categories = %q, want [sf adventure]", entry.Categories)
+	}
+	if entry.Updated.IsZero() {
+		t.Error("Updated is not set")
+	}
+	if !bytes.Equal(entry.Cover, cover.Bytes()) || entry.CoverType != "image/png" {
+		t.Errorf("Cover is %d bytes of %q, want the PNG cover", len(entry.Cover), entry.CoverType)
+	}
+	if len(entry.Links) == 0 || entry.Links[0].Rel != OPDSRelImage || entry.Links[0].Href != "cover.png" {
+		t.Errorf("Links = %+v, want a cover acquisition link", entry.Links)
+	}
+}
+
+func TestLinkedImage(t *testing.T) {
+	dir := t.TempDir()
+
+	epubPath := filepath.Join(dir, "book.epub")
+	if err := ConvertFileWithOptions("testdata/linked_image.fb2", epubPath, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+	files := readEPUBFiles(t, epubPath)
+	want := `<a href="#island"><img src="map.png" alt="Map of the island"/></a>`
+	if !strings.Contains(files["OEBPS/content.xhtml"], want) {
+		t.Errorf("content.xhtml doesn't contain %s:\n%s", want, files["OEBPS/content.xhtml"])
+	}
+	if _, ok := files["OEBPS/map.png"]; !ok {
+		t.Error("EPUB doesn't contain the linked image map.png")
+	}
+	if !regexp.MustCompile(`(id|name)="island"`).MatchString(files["OEBPS/content.xhtml"]) {
+		t.Error("content.xhtml doesn't contain the link target")
+	}
+
+	opts := DefaultConvertOptions()
+	opts.Compression = false
+	mobiPath := filepath.Join(dir, "book.mobi")
+	if err := ConvertFileWithOptions("testdata/linked_image.fb2", mobiPath, opts); err != nil {
+		t.Fatalf("Convert() to MOBI failed: %v", err)
+	}
+	data, err := os.ReadFile(mobiPath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !regexp.MustCompile(`<a filepos=\d{10}><img recindex="\d+" alt="Map of the island"/></a>`).Match(data) {
+		t.Error("MOBI text doesn't contain the linked image")
+	}
+}
+
+func TestForceEncoding(t *testing.T) {
+	// Mislabeled as UTF-8, actually windows-1251
+	raw, err := charmap.Windows1251.NewEncoder().String(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>Война и мир</book-title><lang>ru</lang></title-info></description>
+	<body><section><p>Текст</p></section></body>
+</FictionBook>`)
+	if err != nil {
+		t.Fatalf("Encode error = %v", err)
+	}
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	if err := os.WriteFile(input, []byte(raw), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	convert := func(opts ConvertOptions) (string, error) {
+		output := filepath.Join(dir, "book.epub")
+		if err := ConvertFileWithOptions(input, output, opts); err != nil {
+			return "", err
+		}
+		return readEPUBFiles(t, output)["OEBPS/content.opf"], nil
+	}
+
+	opfData, err := convert(DefaultConvertOptions())
+	if err != nil {
+		t.Fatalf("Convert() failed: %v", err)
+	}
+	if strings.Contains(opfData, "Война и мир") {
+		t.Fatal("Mislabeled input decoded correctly without ForceEncoding; test input is wrong")
+	}
+
+	opts := DefaultConvertOptions()
+	opts.ForceEncoding = "windows-1251"
+	opfData, err = convert(opts)
+	if err != nil {
+		t.Fatalf("Convert() with ForceEncoding failed: %v", err)
+	}
+	if !strings.Contains(opfData, "<dc:title>Война и мир</dc:title>") {
+		t.Errorf("content.opf doesn't have the decoded title:\n%s", opfData)
+	}
+
+	opts.ForceEncoding = "no-such-encoding"
+	if _, err := convert(opts); err == nil {
+		t.Error("Convert() with an unsupported ForceEncoding succeeded")
+	}
+}
+
+func TestEncodingConflictWarning(t *testing.T) {
+	input := "\xef\xbb\xbf" + `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>Книга</book-title><lang>ru</lang></title-info></description>
+	<body><section><p>Текст</p></section></body>
+</FictionBook>`
+
+	converter := NewConverter()
+	var output bytes.Buffer
+	if err := converter.ConvertStream(strings.NewReader(input), &output); err != nil {
+		t.Fatalf("ConvertStream() error = %v", err)
+	}
+
+	found := false
+	for _, w := range converter.Warnings() {
+		if strings.Contains(w, "byte order mark") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Warnings() = %q, want a BOM/declaration conflict warning", converter.Warnings())
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	dir := t.TempDir()
+
+	epubPath := filepath.Join(dir, "book.epub")
+	if err := ConvertFileWithOptions("testdata/footnotes.fb2", epubPath, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+	content := readEPUBFiles(t, epubPath)["OEBPS/content.xhtml"]
+	for _, want := range []string{
+		`<a href="#n1" id="ref_n1" class="noteref"><sup>[1]</sup></a>`,
+		`<a href="#ref_n1">`,
+		"A metal urn",
+	} {
+		if !strings.Contains(content, want) {
+			t.Errorf("content.xhtml doesn't contain %s:\n%s", want, content)
+		}
+	}
+	if !regexp.MustCompile(`(id|name)="n1"`).MatchString(content) {
+		t.Error("content.xhtml doesn't contain the note target")
+	}
+
+	opts := DefaultConvertOptions()
+	opts.Compression = false
+	mobiPath := filepath.Join(dir, "book.mobi")
+	if err := ConvertFileWithOptions("testdata/footnotes.fb2", mobiPath, opts); err != nil {
+		t.Fatalf("Convert() to MOBI failed: %v", err)
+	}
+	data, err := os.ReadFile(mobiPath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	text := string(data[bytes.Index(data, []byte("<html>")):])
+
+	// Forward and back links point at the tags of their targets
+	for _, link := range []struct{ pattern, target string }{
+		{`<a filepos=(\d{10}) id="ref_n1" class="noteref">`, `name="n1"`},
+		{`<a filepos=(\d{10})>&#8617;</a>`, `id="ref_n1"`},
+	} {
+		m := regexp.MustCompile(link.pattern).FindStringSubmatch(text)
+		if m == nil {
+			t.Errorf("MOBI text doesn't match %s", link.pattern)
+			continue
+		}
+		offset, _ := strconv.Atoi(m[1])
+		tag := text[offset:]
+		if end := strings.Index(tag, ">"); end >= 0 {
+			tag = tag[:end]
+		}
+		if !strings.Contains(tag, link.target) {
+			t.Errorf("filepos %d points at %q, want the tag with %s", offset, tag, link.target)
+		}
+	}
+}
+
+func TestStylesheet(t *testing.T) {
+	opts := DefaultConvertOptions()
+	opts.CSS = "body { margin: 0; }"
+	epubPath := filepath.Join(t.TempDir(), "book.epub")
+	if err := ConvertFileWithOptions("testdata/stylesheet.fb2", epubPath, opts); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+	files := readEPUBFiles(t, epubPath)
+
+	css, ok := files["OEBPS/styles.css"]
+	if !ok {
+		t.Fatal("EPUB doesn't contain styles.css")
+	}
+	document := strings.Index(css, "p.letter { font-style: italic; }")
+	option := strings.Index(css, "body { margin: 0; }")
+	if document < 0 || option < document {
+		t.Errorf("styles.css = %q, want the document stylesheet followed by the CSS option", css)
+	}
+	if !strings.Contains(files["OEBPS/content.opf"], `href="styles.css" media-type="text/css"`) {
+		t.Error("content.opf doesn't list styles.css")
+	}
+	if !strings.Contains(files["OEBPS/content.xhtml"], `<link rel="stylesheet" type="text/css" href="styles.css"/>`) {
+		t.Error("content.xhtml doesn't link styles.css")
+	}
+}
+
+func TestTranslatorMetadata(t *testing.T) {
+	epubPath := filepath.Join(t.TempDir(), "book.epub")
+	if err := ConvertFileWithOptions("testdata/translated.fb2", epubPath, DefaultConvertOptions()); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+	opf := readEPUBFiles(t, epubPath)["OEBPS/content.opf"]
+
+	for _, want := range []string{
+		`<dc:creator opf:role="aut" opf:file-as="Rasskazov, Anton">Anton Rasskazov</dc:creator>`,
+		`<dc:contributor opf:role="trl" opf:file-as="Perevod, Mary">Mary Perevod</dc:contributor>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("content.opf doesn't contain %s:\n%s", want, opf)
+		}
+	}
+}
+
+func TestISBNIdentifier(t *testing.T) {
+	tests := []struct {
+		isbn string
+		want string
+	}{
+		{"978-0-306-40615-7", "<dc:identifier>urn:isbn:9780306406157</dc:identifier>"},
+		{"978-0-306-40615-8", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.isbn, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "book.fb2")
+			fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>Numbered</book-title><lang>en</lang></title-info>
+		<publish-info><isbn>` + tt.isbn + `</isbn></publish-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+			if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+
+			output := filepath.Join(dir, "book.epub")
+			if err := ConvertFileWithOptions(input, output, DefaultConvertOptions()); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+
+			opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+			if tt.want == "" {
+				if strings.Contains(opfData, "urn:isbn:") {
+					t.Errorf("content.opf has an ISBN identifier for an invalid ISBN:\n%s", opfData)
+				}
+				if !strings.Contains(opfData, "urn:uuid:") {
+					t.Error("content.opf has no UUID identifier")
+				}
+			} else if !strings.Contains(opfData, tt.want) {
+				t.Errorf("content.opf doesn't contain %s:\n%s", tt.want, opfData)
+			}
+		})
+	}
+}
+
+func TestGenreSubjects(t *testing.T) {
+	metadata, err := ExtractMetadataFromBytes([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<genre>sf_history</genre>
+			<genre>unknown_code</genre>
+			<book-title>What If</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`))
+	if err != nil {
+		t.Fatalf("ExtractMetadataFromBytes() error = %v", err)
+	}
+
+	book := NewConverter().createOPFBook(metadata, "<html></html>", nil, nil)
+	opfData, err := book.GenerateOPF()
+	if err != nil {
+		t.Fatalf("GenerateOPF() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"<dc:subject>Alternative History</dc:subject>",
+		"<dc:subject>unknown_code</dc:subject>",
+		`<meta name="fb2:genre" content="sf_history"></meta>`,
+	} {
+		if !strings.Contains(string(opfData), want) {
+			t.Errorf("OPF doesn't contain %s:\n%s", want, opfData)
+		}
+	}
+}
+
+func TestStableBookIdentifier(t *testing.T) {
+	identifierRegex := regexp.MustCompile(`<dc:identifier id="bookid">([^<]*)</dc:identifier>`)
+	convert := func(t *testing.T, title, id string, deterministic bool) string {
+		t.Helper()
+		dir := t.TempDir()
+		input := filepath.Join(dir, "book.fb2")
+		fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<author><first-name>Ivan</first-name><last-name>Petrov</last-name></author>
+			<book-title>` + title + `</book-title><lang>en</lang>
+		</title-info>
+		<document-info><id>` + id + `</id></document-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+		if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		output := filepath.Join(dir, "book.epub")
+		options := DefaultConvertOptions()
+		options.Deterministic = deterministic
+		if err := ConvertFileWithOptions(input, output, options); err != nil {
+			t.Fatalf("Convert() to EPUB failed: %v", err)
+		}
+		opf := readEPUBFiles(t, output)["OEBPS/content.opf"]
+		match := identifierRegex.FindStringSubmatch(opf)
+		if match == nil {
+			t.Fatalf("content.opf has no book identifier:\n%s", opf)
+		}
+		return match[1]
+	}
+
+	const docID = "0A1B2C3D-4E5F-6071-8293-A4B5C6D7E8F9"
+	if got, want := convert(t, "First", docID, false), "urn:uuid:0a1b2c3d-4e5f-6071-8293-a4b5c6d7e8f9"; got != want {
+		t.Errorf("identifier with UUID document id = %q, want %q", got, want)
+	}
+
+	first := convert(t, "First", "not-a-uuid", false)
+	if again := convert(t, "First", "not-a-uuid", false); again != first {
+		t.Errorf("identifier changed between conversions: %q, then %q", first, again)
+	}
+	if !strings.HasPrefix(first, "urn:uuid:") {
+		t.Errorf("derived identifier = %q, want a urn:uuid", first)
+	}
+	if other := convert(t, "Second", "not-a-uuid", false); other == first {
+		t.Errorf("books with different titles share identifier %q", first)
+	}
+	// Deterministic output must not change how the identifier is derived
+	if deterministic := convert(t, "First", "not-a-uuid", true); deterministic != first {
+		t.Errorf("deterministic identifier = %q, want %q", deterministic, first)
+	}
+}
+
+func TestEPUB3Nav(t *testing.T) {
+	epubPath := filepath.Join(t.TempDir(), "book.epub")
+	opts := DefaultConvertOptions()
+	opts.EPUBVersion = 3
+	if err := ConvertFileWithOptions("testdata/golden_basic.fb2", epubPath, opts); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+	files := readEPUBFiles(t, epubPath)
+
+	opf := files["OEBPS/content.opf"]
+	for _, want := range []string{
+		`version="3.0"`,
+		`<meta property="dcterms:modified">`,
+		`<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>`,
+		`<itemref idref="nav" linear="no"/>`,
+	} {
+		if !strings.Contains(opf, want) {
+			t.Errorf("content.opf doesn't contain %s:\n%s", want, opf)
+		}
+	}
+
+	nav, ok := files["OEBPS/nav.xhtml"]
+	if !ok {
+		t.Fatal("EPUB 3 output has no nav.xhtml")
+	}
+	if !strings.Contains(nav, `<nav epub:type="toc" id="toc">`) {
+		t.Errorf("nav.xhtml has no toc nav:\n%s", nav)
+	}
+	if !strings.Contains(nav, `<a href="content.xhtml#toc-1">`) {
+		t.Errorf("nav.xhtml doesn't link the first TOC entry:\n%s", nav)
+	}
+	if _, ok := files["OEBPS/toc.ncx"]; !ok {
+		t.Error("EPUB 3 output dropped toc.ncx")
+	}
+
+	content := files["OEBPS/content.xhtml"]
+	if !strings.Contains(content, "<!DOCTYPE html>\n") || strings.Contains(content, "XHTML 1.1") {
+		t.Errorf("content.xhtml doesn't have the HTML5 doctype:\n%.200s", content)
+	}
+	if strings.Contains(content, "<a name=") || !strings.Contains(content, `<a id="ch1"></a>`) {
+		t.Errorf("content.xhtml doesn't use id anchors:\n%s", content)
+	}
+}
+
+func TestEPUB3NavUntitledSection(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description><title-info><book-title>Untitled &amp; Short</book-title><lang>en</lang></title-info></description>
+	<body><section><p>Text without chapters.</p></section></body>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	output := filepath.Join(dir, "book.epub")
+	opts := DefaultConvertOptions()
+	opts.EPUBVersion = 3
+	if err := ConvertFileWithOptions(input, output, opts); err != nil {
+		t.Fatalf("Convert() to EPUB failed: %v", err)
+	}
+
+	nav := readEPUBFiles(t, output)["OEBPS/nav.xhtml"]
+	if strings.Contains(nav, "<ol>\n    </ol>") {
+		t.Errorf("nav.xhtml has an empty list:\n%s", nav)
+	}
+	if !strings.Contains(nav, `<li><a href="content.xhtml#toc-1">Untitled &amp; Short</a></li>`) {
+		t.Errorf("nav.xhtml doesn't link the content:\n%s", nav)
+	}
+}
+
+func TestEPUBCoverPage(t *testing.T) {
+	var cover bytes.Buffer
+	if err := jpeg.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 30, 45)), nil); err != nil {
+		t.Fatalf("jpeg.Encode() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Covered</book-title>
+			<coverpage><image l:href="#cover.jpg"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="cover.jpg" content-type="image/jpg">` + base64.StdEncoding.EncodeToString(cover.Bytes()) + `</binary>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for _, version := range []int{2, 3} {
+		t.Run(fmt.Sprintf("EPUB %d", version), func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.EPUBVersion = version
+			output := filepath.Join(t.TempDir(), "book.epub")
+			if err := ConvertFileWithOptions(input, output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+			files := readEPUBFiles(t, output)
+
+			page, ok := files["OEBPS/cover.xhtml"]
+			if !ok {
+				t.Fatal("EPUB has no cover.xhtml")
+			}
+			if !strings.Contains(page, `<img src="cover.jpg"`) {
+				t.Errorf("cover.xhtml doesn't show the cover image:\n%s", page)
+			}
+			// The text doesn't repeat the cover
+			if content := files["OEBPS/content.xhtml"]; strings.Contains(content, "cover.jpg") {
+				t.Errorf("content.xhtml shows the cover image again:\n%s", content)
+			}
+
+			opfData := files["OEBPS/content.opf"]
+			imageItem := `<item id="res-cover.jpg" href="cover.jpg" media-type="image/jpeg"`
+			if version == 3 {
+				imageItem += ` properties="cover-image"`
+			}
+			for _, want := range []string{
+				imageItem + "/>",
+				`<meta name="cover" content="res-cover.jpg"/>`,
+				`<item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>`,
+				"<spine toc=\"ncx\">\n    <itemref idref=\"cover\"/>\n",
+			} {
+				if !strings.Contains(opfData, want) {
+					t.Errorf("content.opf doesn't contain %s:\n%s", want, opfData)
+				}
+			}
+		})
+	}
+}
+
+func TestRightToLeft(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>ספר</book-title><lang>he</lang></title-info>
+	</description>
+	<body><section><p>שלום עולם</p></section></body>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		direction string
+		wantRTL   bool
+	}{
+		{"", true},
+		{"auto", true},
+		{"ltr", false},
+	}
+
+	for _, tt := range tests {
+		t.Run("direction "+tt.direction, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.Direction = tt.direction
+			output := filepath.Join(t.TempDir(), "book.epub")
+			if err := ConvertFileWithOptions(input, output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+			files := readEPUBFiles(t, output)
+
+			checks := []struct {
+				file, want string
+			}{
+				{"OEBPS/content.opf", `<spine toc="ncx" page-progression-direction="rtl">`},
+				{"OEBPS/content.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml" dir="rtl">`},
+				{"OEBPS/content.xhtml", `<body dir="rtl">`},
+			}
+			for _, check := range checks {
+				if got := strings.Contains(files[check.file], check.want); got != tt.wantRTL {
+					t.Errorf("%s contains %s = %v, want %v:\n%s", check.file, check.want, got, tt.wantRTL, files[check.file])
+				}
+			}
+		})
+	}
+}
+
+func TestMOBIFullName(t *testing.T) {
+	const title = "A Title Longer Than The Thirty-One Byte Database Name"
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>` + title + `</book-title><lang>en</lang></title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	for _, mobiType := range []string{"old", "new", "both"} {
+		t.Run(mobiType, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			records := palmRecords(t, convertMOBI(t, options, strings.NewReader(fb2Data)))
+			record := records[0]
+
+			offset := binary.BigEndian.Uint32(record[0x54:0x58])
+			length := binary.BigEndian.Uint32(record[0x58:0x5C])
+			if int(offset+length) > len(record) {
+				t.Fatalf("full name at %d+%d is outside the %d byte record 0", offset, length, len(record))
+			}
+			if got := string(record[offset : offset+length]); got != title {
+				t.Errorf("full name = %q, want %q", got, title)
+			}
+		})
+	}
+}
+
+func TestMOBIImageRecindex(t *testing.T) {
+	encode := func(size int) []byte {
+		var img bytes.Buffer
+		if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, size, size))); err != nil {
+			t.Fatalf("png.Encode() error = %v", err)
+		}
+		return img.Bytes()
+	}
+	cover, pic := encode(16), encode(8)
+
+	for _, withCover := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cover %v", withCover), func(t *testing.T) {
+			coverpage, coverBinary := "", ""
+			if withCover {
+				coverpage = `<coverpage><image l:href="#cover.png"/></coverpage>`
+				coverBinary = `<binary id="cover.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(cover) + `</binary>`
+			}
+			fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info><book-title>Pictured</book-title>` + coverpage + `<lang>en</lang></title-info>
+	</description>
+	<body><section><p>Before</p><image l:href="#pic.png"/><p>After</p></section></body>
+	<binary id="pic.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(pic) + `</binary>
+	` + coverBinary + `
+</FictionBook>`
+
+			options := DefaultConvertOptions()
+			options.Compression = false
+			records := palmRecords(t, convertMOBI(t, options, strings.NewReader(fb2Data)))
+
+			firstImage := int(binary.BigEndian.Uint32(records[0][0x6C:0x70]))
+			if firstImage == 0xFFFFFFFF || firstImage >= len(records) {
+				t.Fatalf("FirstImageIndex = %d, want an image record", firstImage)
+			}
+
+			var text []byte
+			for i := 1; i < firstImage; i++ {
+				text = append(text, records[i]...)
+			}
+			match := regexp.MustCompile(`<img recindex="(\d+)"[^>]*>\s*<p[^>]*>After`).FindSubmatch(text)
+			if match == nil {
+				t.Fatalf("text has no recindex image before \"After\":\n%s", text)
+			}
+			recindex, _ := strconv.Atoi(string(match[1]))
+			if got := records[firstImage+recindex-1]; !bytes.Equal(got, pic) {
+				t.Errorf("recindex %s points at record %d, which isn't the image", match[1], firstImage+recindex-1)
+			}
+		})
+	}
+}
+
+func TestMOBICoverThumbnail(t *testing.T) {
+	var cover bytes.Buffer
+	if err := jpeg.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 400, 600)), nil); err != nil {
+		t.Fatalf("jpeg.Encode() error = %v", err)
+	}
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Covered</book-title>
+			<coverpage><image l:href="#cover.jpg"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+	<binary id="cover.jpg" content-type="image/jpeg">` + base64.StdEncoding.EncodeToString(cover.Bytes()) + `</binary>
+</FictionBook>`
+
+	for _, mobiType := range []string{"old", "new", "both"} {
+		t.Run(mobiType, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			records := palmRecords(t, convertMOBI(t, options, strings.NewReader(fb2Data)))
+
+			// Collect the EXTH records following the MOBI header
+			record0 := records[0]
+			exth := record0[16+binary.BigEndian.Uint32(record0[20:24]):]
+			if string(exth[:4]) != "EXTH" {
+				t.Fatal("record 0 has no EXTH header")
+			}
+			values := make(map[uint32]uint32)
+			pos := 12
+			for i := uint32(0); i < binary.BigEndian.Uint32(exth[8:12]); i++ {
+				typ := binary.BigEndian.Uint32(exth[pos:])
+				size := int(binary.BigEndian.Uint32(exth[pos+4:]))
+				if size == 12 {
+					values[typ] = binary.BigEndian.Uint32(exth[pos+8:])
+				}
+				pos += size
+			}
+
+			coverOffset, ok := values[mobi.EXTHCoverOffset]
+			if !ok {
+				t.Fatal("no EXTH 201 cover offset")
+			}
+			thumbOffset, ok := values[mobi.EXTHThumbOffset]
+			if !ok {
+				t.Fatal("no EXTH 202 thumbnail offset")
+			}
+			if fake, ok := values[mobi.EXTHHasFakeCover]; !ok || fake != 0 {
+				t.Errorf("EXTH 203 = %d (present %v), want 0", fake, ok)
+			}
+
+			firstImage := binary.BigEndian.Uint32(record0[0x6C:0x70])
+			if got := records[firstImage+coverOffset]; !bytes.Equal(got, cover.Bytes()) {
+				t.Errorf("cover offset %d doesn't point at the cover", coverOffset)
+			}
+			thumb, err := jpeg.Decode(bytes.NewReader(records[firstImage+thumbOffset]))
+			if err != nil {
+				t.Fatalf("thumbnail record isn't a JPEG: %v", err)
+			}
+			if got := thumb.Bounds(); got.Dx() != 220 || got.Dy() != mobi.ThumbnailHeight {
+				t.Errorf("thumbnail size = %dx%d, want 220x%d", got.Dx(), got.Dy(), mobi.ThumbnailHeight)
+			}
+		})
+	}
+}
+
+func TestMOBIFLISFCIS(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>Closed</book-title><lang>en</lang></title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+
+	for _, mobiType := range []string{"old", "new", "both"} {
+		t.Run(mobiType, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			records := palmRecords(t, convertMOBI(t, options, strings.NewReader(fb2Data)))
+
+			record0 := records[0]
+			for _, rec := range []struct {
+				magic  string
+				offset int
+			}{{"FCIS", 0xC8}, {"FLIS", 0xD0}} {
+				index := int(binary.BigEndian.Uint32(record0[rec.offset:]))
+				if index >= len(records) {
+					t.Errorf("%s index = %#x, want a record", rec.magic, index)
+					continue
+				}
+				if got := string(records[index][:4]); got != rec.magic {
+					t.Errorf("%s index %d points at a %q record", rec.magic, index, got)
+				}
+				if count := binary.BigEndian.Uint32(record0[rec.offset+4:]); count != 1 {
+					t.Errorf("%s count = %d, want 1", rec.magic, count)
+				}
+			}
+		})
+	}
+}
+
+func TestMOBIHeaderRecordLayout(t *testing.T) {
+	var pic bytes.Buffer
+	if err := png.Encode(&pic, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatalf("png.Encode() error = %v", err)
+	}
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info><book-title>Laid Out</book-title><lang>en</lang></title-info>
+	</description>
+	<body>
+		<section><title><p>One</p></title><p>` + strings.Repeat("First chapter text. ", 400) + `</p></section>
+		<section><title><p>Two</p></title><image l:href="#pic.png"/><p>Second</p></section>
+	</body>
+	<binary id="pic.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(pic.Bytes()) + `</binary>
+</FictionBook>`
+
+	records := palmRecords(t, convertMOBI(t, DefaultConvertOptions(), strings.NewReader(fb2Data)))
+
+	record0 := records[0]
+	textRecords := int(binary.BigEndian.Uint16(record0[0x08:0x0A]))
+	firstContent := int(binary.BigEndian.Uint16(record0[0xC0:0xC2]))
+	lastContent := int(binary.BigEndian.Uint16(record0[0xC2:0xC4]))
+	firstNonBook := int(binary.BigEndian.Uint32(record0[0x50:0x54]))
+	firstImage := int(binary.BigEndian.Uint32(record0[0x6C:0x70]))
+	flis := int(binary.BigEndian.Uint32(record0[0xD0:0xD4]))
+	indx := int(binary.BigEndian.Uint32(record0[0xF4:0xF8]))
+
+	if textRecords < 2 {
+		t.Fatalf("text record count = %d, want the text split over several records", textRecords)
+	}
+	if firstContent != 1 {
+		t.Errorf("FirstContentRec = %d, want 1", firstContent)
+	}
+	if firstNonBook != 1+textRecords {
+		t.Errorf("FirstNonBookIndex = %d, want %d, the record after the text", firstNonBook, 1+textRecords)
+	}
+	if indx != firstNonBook || indx >= len(records) || string(records[indx][:4]) != "INDX" {
+		t.Errorf("INDXRecordOffset = %d, want the INDX record at %d", indx, firstNonBook)
+	}
+	if firstImage >= len(records) || !bytes.Equal(records[firstImage], pic.Bytes()) {
+		t.Errorf("FirstImageIndex = %d doesn't point at the image", firstImage)
+	}
+	if lastContent != flis-1 || lastContent != firstImage {
+		t.Errorf("LastContentRec = %d, want %d, the last image before FLIS at %d", lastContent, firstImage, flis)
+	}
+}
+
+func TestMOBILocale(t *testing.T) {
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>Книга</book-title><lang>ru</lang></title-info>
+	</description>
+	<body><section><p>Текст</p></section></body>
+</FictionBook>`
+
+	for _, mobiType := range []string{"old", "new"} {
+		t.Run(mobiType, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			records := palmRecords(t, convertMOBI(t, options, strings.NewReader(fb2Data)))
+			record0 := records[0]
+			if got := binary.BigEndian.Uint32(record0[0x5C:0x60]); got != mobi.LocaleCode("ru") || got == 0 {
+				t.Errorf("Locale = %#x, want %#x for ru", got, mobi.LocaleCode("ru"))
+			}
+		})
+	}
+}
+
+func TestKF8FDST(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	for _, mobiType := range []string{"new", "both"} {
+		t.Run(mobiType, func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			records := palmRecords(t, convertMOBI(t, options, bytes.NewReader(fb2Data)))
+
+			record0 := records[0]
+			index := int(binary.BigEndian.Uint32(record0[0xC0:0xC4]))
+			count := binary.BigEndian.Uint32(record0[0xC4:0xC8])
+			if index >= len(records) {
+				t.Fatalf("FDST index = %#x, want a record", index)
+			}
+			fdst := records[index]
+			if string(fdst[:4]) != "FDST" {
+				t.Fatalf("FDST index %d points at a %q record", index, fdst[:4])
+			}
+			if offset := binary.BigEndian.Uint32(fdst[4:8]); offset != 12 {
+				t.Errorf("FDST entries at offset %d, want 12", offset)
+			}
+
+			// The book has a single HTML flow covering all the text
+			entries := binary.BigEndian.Uint32(fdst[8:12])
+			if entries != 1 || count != entries {
+				t.Fatalf("FDST has %d entries and the header says %d, want 1 flow", entries, count)
+			}
+			textLength := binary.BigEndian.Uint32(record0[4:8])
+			if start, end := binary.BigEndian.Uint32(fdst[12:16]), binary.BigEndian.Uint32(fdst[16:20]); start != 0 || end != textLength {
+				t.Errorf("FDST flow = %d-%d, want 0-%d", start, end, textLength)
+			}
+		})
+	}
+}
+
+func TestKF8HeaderVersion(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	options := DefaultConvertOptions()
+	options.MobiType = "new"
+	records := palmRecords(t, convertMOBI(t, options, bytes.NewReader(fb2Data)))
+	record0 := records[0]
+
+	for _, field := range []struct {
+		name   string
+		offset int
+		want   uint32
+	}{
+		{"HeaderLength", 0x14, mobi.KF8HeaderSize},
+		{"FileVersion", 0x24, 8},
+		{"MinVersion", 0x68, 8},
+	} {
+		if got := binary.BigEndian.Uint32(record0[field.offset:]); got != field.want {
+			t.Errorf("%s = %d, want %d", field.name, got, field.want)
+		}
+	}
+	if exth := record0[16+mobi.KF8HeaderSize:]; string(exth[:4]) != "EXTH" {
+		t.Errorf("EXTH doesn't follow the %d byte KF8 header", mobi.KF8HeaderSize)
+	}
+}
+
+func TestMOBINCXGuide(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	options := DefaultConvertOptions()
+	options.MobiType = "old"
+	data := convertMOBI(t, options, bytes.NewReader(fb2Data))
+	records := palmRecords(t, data)
+	record0 := records[0]
+	text := mobiText(data)
+
+	// The guide's toc reference points at the inline TOC
+	m := regexp.MustCompile(`<reference type="toc"[^>]*filepos=(\d{10})`).FindSubmatch(text)
+	if m == nil {
+		t.Fatal("no toc guide reference with a filepos")
+	}
+	filepos, _ := strconv.Atoi(string(m[1]))
+	if filepos >= len(text) || !bytes.HasPrefix(text[filepos:], []byte(`<a id="inline_toc">`)) {
+		t.Errorf("toc guide filepos %d doesn't point at the inline TOC", filepos)
+	}
+
+	// The header's index points at the NCX, whose entries point at the
+	// chapter anchors
+	indx := int(binary.BigEndian.Uint32(record0[0xF4:0xF8]))
+	if indx >= len(records) || string(records[indx][:4]) != "INDX" {
+		t.Fatalf("INDXRecordOffset = %d doesn't point at an INDX record", indx)
+	}
+	header := records[indx]
+	count := 1 + int(binary.BigEndian.Uint32(header[24:28])) + int(binary.BigEndian.Uint32(header[52:56]))
+	entries, err := index.ParseNCX(records[indx : indx+count])
+	if err != nil {
+		t.Fatalf("ParseNCX() failed: %v", err)
+	}
+
+	want := []struct{ label, anchor string }{
+		{"Chapter One", `name="ch1"`},
+		{"Chapter Two", `name="ch2"`},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("NCX has %d entries, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Label != want[i].label {
+			t.Errorf("entry %d label = %q, want %q", i, entry.Label, want[i].label)
+		}
+		if int(entry.Offset+entry.Length) > len(text) {
+			t.Errorf("entry %d runs to %d, past the %d byte text", i, entry.Offset+entry.Length, len(text))
+			continue
+		}
+		tag := text[entry.Offset:]
+		if end := bytes.IndexByte(tag, '>'); tag[0] != '<' || end < 0 || !bytes.Contains(tag[:end], []byte(want[i].anchor)) {
+			t.Errorf("entry %d at offset %d isn't the %s anchor", i, entry.Offset, want[i].anchor)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	want := []string{StageParsed, StageMetadata, StageHTML, StageRecords, StageFinalized}
+
+	convert := map[string]func(c *Converter) error{
+		"Convert": func(c *Converter) error {
+			return c.Convert("testdata/golden_basic.fb2", filepath.Join(t.TempDir(), "book.epub"))
+		},
+		"ConvertStream": func(c *Converter) error {
+			data, err := os.ReadFile("testdata/golden_basic.fb2")
+			if err != nil {
+				return err
+			}
+			return c.ConvertStream(bytes.NewReader(data), io.Discard)
+		},
+	}
+
+	for name, run := range convert {
+		t.Run(name, func(t *testing.T) {
+			var stages []string
+			last := 0.0
+			options := DefaultConvertOptions()
+			options.Progress = func(stage string, pct float64) {
+				if pct < last || pct > 1 {
+					t.Errorf("stage %s at %v after %v", stage, pct, last)
+				}
+				last = pct
+				stages = append(stages, stage)
+			}
+			converter := NewConverter()
+			converter.SetOptions(options)
+
+			if err := run(converter); err != nil {
+				t.Fatalf("conversion failed: %v", err)
+			}
+			if strings.Join(stages, ",") != strings.Join(want, ",") {
+				t.Errorf("stages = %v, want %v", stages, want)
+			}
+			if last != 1 {
+				t.Errorf("last progress = %v, want 1", last)
+			}
+		})
+	}
+}
+
+func TestConvertContextCanceled(t *testing.T) {
+	data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	// Cancel once the HTML is generated, before anything is written
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := DefaultConvertOptions()
+	options.Progress = func(stage string, pct float64) {
+		if stage == StageHTML {
+			cancel()
+		}
+	}
+	converter := NewConverter()
+	converter.SetOptions(options)
+
+	var output bytes.Buffer
+	if err := converter.ConvertContext(ctx, bytes.NewReader(data), &output); !errors.Is(err, context.Canceled) {
+		t.Errorf("ConvertContext() error = %v, want context.Canceled", err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("ConvertContext() wrote %d bytes after cancellation", output.Len())
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "book.mobi")
+	if err := converter.ConvertFileContext(ctx, "testdata/golden_basic.fb2", outputPath); !errors.Is(err, context.Canceled) {
+		t.Errorf("ConvertFileContext() error = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("ConvertFileContext() created %s after cancellation", outputPath)
+	}
+}
+
+func TestConvertBytes(t *testing.T) {
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info><book-title>In Memory</book-title><lang>en</lang></title-info>
+	</description>
+	<body><section><title><p>Only</p></title><p>Never touches the disk.</p></section></body>
+</FictionBook>`)
+
+	epubData, err := ConvertBytes(fb2Data, "epub")
+	if err != nil {
+		t.Fatalf("ConvertBytes(epub) failed: %v", err)
+	}
+	if !bytes.HasPrefix(epubData, []byte("PK\x03\x04")) {
+		t.Fatalf("EPUB output starts with %q, want a zip local file header", epubData[:min(4, len(epubData))])
+	}
+	zr, err := zip.NewReader(bytes.NewReader(epubData), int64(len(epubData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() failed: %v", err)
+	}
+	if len(zr.File) == 0 || zr.File[0].Name != "mimetype" {
+		t.Error("EPUB doesn't start with the mimetype entry")
+	}
+
+	for _, format := range []string{"mobi", "kf8", "both"} {
+		data, err := ConvertBytes(fb2Data, format)
+		if err != nil {
+			t.Fatalf("ConvertBytes(%s) failed: %v", format, err)
+		}
+		if len(data) < 68 || string(data[60:68]) != "BOOKMOBI" {
+			t.Errorf("ConvertBytes(%s) isn't a MOBI PalmDB", format)
+		}
+	}
+
+	if _, err := ConvertBytes(fb2Data, "pdf"); err == nil {
+		t.Error("ConvertBytes(pdf) succeeded, want an unknown format error")
+	}
+}
+
+func TestPlainTextOutput(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "book.txt")
+	if err := ConvertFile("testdata/golden_basic.fb2", outputPath); err != nil {
+		t.Fatalf("ConvertFile() failed: %v", err)
+	}
+	text, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+	inMemory, err := ConvertBytes(fb2Data, "txt")
+	if err != nil {
+		t.Fatalf("ConvertBytes(txt) failed: %v", err)
+	}
+	if !bytes.Equal(inMemory, text) {
+		t.Error("ConvertBytes(txt) differs from the .txt file")
+	}
+
+	for _, want := range []string{
+		"Chapter One\n\n",
+		"\n\nThe first paragraph of the first chapter.\n\n",
+		"Roses are red,\nViolets are blue.",
+	} {
+		if !strings.Contains(string(text), want) {
+			t.Errorf("text doesn't contain %q", want)
+		}
+	}
+	if bytes.ContainsAny(text, "<>") {
+		t.Errorf("text contains markup:\n%s", text)
+	}
+}
+
+func TestConvertStreamFBZ(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+	var fbz bytes.Buffer
+	zw := zip.NewWriter(&fbz)
+	zw.Create("__MACOSX/._book.fb2")
+	w, _ := zw.Create("book.fb2")
+	w.Write(fb2Data)
+	zw.Close()
+
+	convert := func(input []byte) []byte {
+		t.Helper()
+		converter := NewConverter()
+		var output bytes.Buffer
+		if err := converter.ConvertStream(bytes.NewReader(input), &output); err != nil {
+			t.Fatalf("ConvertStream() failed: %v", err)
+		}
+		return mobiText(output.Bytes())
+	}
+
+	got, want := convert(fbz.Bytes()), convert(fb2Data)
+	if len(want) == 0 || !bytes.Equal(got, want) {
+		t.Errorf("zipped input converted to %d bytes of text, plain input to %d", len(got), len(want))
+	}
+}
+
+func TestReadMOBIText(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	for _, mobiType := range []string{"old", "new", "both"} {
+		t.Run(mobiType, func(t *testing.T) {
+			converter := NewConverter()
+			options := DefaultConvertOptions()
+			options.MobiType = mobiType
+			converter.SetOptions(options)
+
+			var output bytes.Buffer
+			if err := converter.ConvertStream(bytes.NewReader(fb2Data), &output); err != nil {
+				t.Fatalf("ConvertStream() failed: %v", err)
+			}
+			text, err := mobi.ReadText(output.Bytes())
+			if err != nil {
+				t.Fatalf("ReadText() error = %v", err)
+			}
+			for _, want := range []string{"Chapter One", "All that glitters is not gold."} {
+				if !strings.Contains(text, want) {
+					t.Errorf("text has no %q:\n%s", want, text)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertDir(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+
+	inputDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(inputDir, "plain.fb2"), fb2Data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var fbz bytes.Buffer
+	zw := zip.NewWriter(&fbz)
+	w, _ := zw.Create("book.fb2")
+	w.Write(fb2Data)
+	zw.Close()
+	if err := os.MkdirAll(filepath.Join(inputDir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "sub", "zipped.fb2.zip"), fbz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "broken.fbz"), []byte("not a book"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(inputDir, "notes.txt"), []byte("ignored"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := t.TempDir()
+	options := DefaultConvertOptions()
+	options.Format = "epub"
+	results, err := ConvertDir(inputDir, outputDir, options)
+	if err != nil {
+		t.Fatalf("ConvertDir() failed: %v", err)
+	}
+
+	want := map[string]string{
+		"plain.fb2":          "plain.epub",
+		"sub/zipped.fb2.zip": "sub/zipped.epub",
+		"broken.fbz":         "",
+	}
+	if len(results) != len(want) {
+		t.Fatalf("ConvertDir() returned %d results, want %d: %+v", len(results), len(want), results)
+	}
+	for _, result := range results {
+		rel, _ := filepath.Rel(inputDir, result.Input)
+		output, ok := want[filepath.ToSlash(rel)]
+		switch {
+		case !ok:
+			t.Errorf("unexpected input %s", rel)
+		case output == "":
+			if result.Err == nil {
+				t.Errorf("%s converted, want an error", rel)
+			}
+		case result.Err != nil:
+			t.Errorf("%s failed: %v", rel, result.Err)
+		case result.Output != filepath.Join(outputDir, filepath.FromSlash(output)):
+			t.Errorf("%s written to %s, want %s", rel, result.Output, output)
+		default:
+			data, err := os.ReadFile(result.Output)
+			if err != nil || !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+				t.Errorf("%s: output %s isn't an EPUB (%v)", rel, output, err)
+			}
+		}
+	}
+}
+
+func TestSniffedImageMediaType(t *testing.T) {
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	pngData := base64.StdEncoding.EncodeToString(img.Bytes())
+
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<book-title>Mislabeled</book-title>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p><image l:href="#declared.jpg"/><image l:href="#undeclared"/></section></body>
+	<binary id="declared.jpg" content-type="image/jpeg">` + pngData + `</binary>
+	<binary id="undeclared">` + pngData + `</binary>
+</FictionBook>`)
+
+	epub, err := ConvertBytes(fb2Data, "epub")
+	if err != nil {
+		t.Fatalf("ConvertBytes() failed: %v", err)
+	}
+	output := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(output, epub, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]
+	for _, id := range []string{"declared.jpg", "undeclared"} {
+		item := regexp.MustCompile(`<item [^>]*href="[^"]*` + regexp.QuoteMeta(id) + `"[^>]*>`).FindString(opfData)
+		if !strings.Contains(item, `media-type="image/png"`) {
+			t.Errorf("manifest item for %s = %q, want media-type image/png", id, item)
+		}
+	}
+}
+
+func TestAnnotationDescription(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "book.fb2")
+	fb2Data := `<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+	<description>
+		<title-info>
+			<book-title>Described</book-title>
+			<annotation><p>One <emphasis>two</emphasis>.</p><p>Three.</p></annotation>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><p>Text</p></section></body>
+</FictionBook>`
+	if err := os.WriteFile(input, []byte(fb2Data), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	for version, want := range map[int]string{
+		2: "One two. Three.",
+		3: "&lt;p&gt;One &lt;em&gt;two&lt;/em&gt;.&lt;/p&gt;\n&lt;p&gt;Three.&lt;/p&gt;</dc:description>",
+	} {
+		t.Run(fmt.Sprintf("EPUB %d", version), func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.EPUBVersion = version
+			output := filepath.Join(t.TempDir(), "book.epub")
+			if err := ConvertFileWithOptions(input, output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+			if opfData := readEPUBFiles(t, output)["OEBPS/content.opf"]; !strings.Contains(opfData, want) {
+				t.Errorf("content.opf doesn't contain %s:\n%s", want, opfData)
+			}
+		})
+	}
+}
+
+func TestTitlePage(t *testing.T) {
+	var cover bytes.Buffer
+	if err := jpeg.Encode(&cover, image.NewGray(image.Rect(0, 0, 60, 90)), nil); err != nil {
+		t.Fatal(err)
+	}
+	fb2Data := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+	<description>
+		<title-info>
+			<author><first-name>Jane</first-name><last-name>Roe</last-name></author>
+			<book-title>Entitled</book-title>
+			<annotation><p>A book about titles.</p></annotation>
+			<coverpage><image l:href="#cover.jpg"/></coverpage>
+			<lang>en</lang>
+		</title-info>
+	</description>
+	<body><section><title><p>One</p></title><p>Text</p></section></body>
+	<binary id="cover.jpg" content-type="image/jpeg">` + base64.StdEncoding.EncodeToString(cover.Bytes()) + `</binary>
+</FictionBook>`)
+
+	convert := func(t *testing.T, options ConvertOptions, ext string) []byte {
+		t.Helper()
+		dir := t.TempDir()
+		input := filepath.Join(dir, "book.fb2")
+		output := filepath.Join(dir, "book"+ext)
+		if err := os.WriteFile(input, fb2Data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		options.GenerateTitlePage = true
+		if err := ConvertFileWithOptions(input, output, options); err != nil {
+			t.Fatalf("Convert() failed: %v", err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	titlePage := regexp.MustCompile(`<div id="title_page"[^>]*>\s*<div style="text-align: center; page-break-after: always;">\s*<h1>Entitled</h1>\s*<h2>Jane Roe</h2>`)
+
+	t.Run("EPUB", func(t *testing.T) {
+		options := DefaultConvertOptions()
+		options.EPUBVersion = 3
+		output := filepath.Join(t.TempDir(), "book.epub")
+		if err := os.WriteFile(output, convert(t, options, ".epub"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files := readEPUBFiles(t, output)
+
+		content := files["OEBPS/content.xhtml"]
+		loc := titlePage.FindStringIndex(content)
+		if loc == nil {
+			t.Fatalf("content.xhtml has no title page:\n%s", content)
+		}
+		// The annotation is on the title page only
+		if n := strings.Count(content, "A book about titles."); n != 1 {
+			t.Errorf("content.xhtml shows the annotation %d times, want once:\n%s", n, content)
+		}
+		// The cover has its own page ahead of the text
+		if _, ok := files["OEBPS/cover.xhtml"]; !ok || strings.Contains(content, `alt="Cover"`) {
+			t.Errorf("title page doesn't follow the cover page:\n%s", content)
+		}
+		if want := `<reference type="title-page" title="Title Page" href="content.xhtml#title_page"/>`; !strings.Contains(files["OEBPS/content.opf"], want) {
+			t.Errorf("content.opf doesn't contain %s", want)
+		}
+		if want := `<a epub:type="titlepage" href="content.xhtml#title_page">`; !strings.Contains(files["OEBPS/nav.xhtml"], want) {
+			t.Errorf("nav.xhtml doesn't contain %s", want)
+		}
+	})
+
+	t.Run("MOBI 6", func(t *testing.T) {
+		options := DefaultConvertOptions()
+		options.TitlePageBeforeCover = true
+		text := mobiText(convert(t, options, ".mobi"))
+
+		// The text starts with the title page; the guide points at it and
+		// at the cover that follows
+		for typ, target := range map[string]string{"title-page": `<div id="title_page">`, "cover": `<a id="cover_page">`} {
+			m := regexp.MustCompile(`<reference type="` + typ + `"[^>]*filepos=(\d{10})`).FindSubmatch(text)
+			if m == nil {
+				t.Errorf("no %s guide reference with a filepos", typ)
+				continue
+			}
+			filepos, _ := strconv.Atoi(string(m[1]))
+			if filepos >= len(text) || !bytes.HasPrefix(text[filepos:], []byte(target)) {
+				t.Errorf("%s guide filepos %d doesn't point at %s", typ, filepos, target)
+			}
+		}
+		if !titlePage.Match(text) {
+			t.Error("MOBI text has no title page")
+		}
+	})
+
+	t.Run("KF8", func(t *testing.T) {
+		options := DefaultConvertOptions()
+		options.MobiType = "new"
+		if text := mobiText(convert(t, options, ".azw3")); !titlePage.Match(text) {
+			t.Error("KF8 text has no title page")
+		}
+	})
+}
+
+// convertMOBI converts an FB2 book with options and returns the MOBI
+// output
+func convertMOBI(t *testing.T, options ConvertOptions, fb2Data io.Reader) []byte {
+	t.Helper()
+	converter := NewConverter()
+	converter.SetOptions(options)
+
+	var output bytes.Buffer
+	if err := converter.ConvertStream(fb2Data, &output); err != nil {
+		t.Fatalf("ConvertStream() failed: %v", err)
+	}
+	return output.Bytes()
+}
+
+// palmRecords splits a MOBI or KF8 file into its PalmDB records
+func palmRecords(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	if len(data) < 78 {
+		t.Fatalf("File too short for a PalmDB header: %d bytes", len(data))
+	}
+	n := int(binary.BigEndian.Uint16(data[76:78]))
+	if len(data) < 78+8*n {
+		t.Fatalf("File too short for %d PalmDB records", n)
+	}
+	records := make([][]byte, n)
+	for i := range n {
+		start := binary.BigEndian.Uint32(data[78+8*i:])
+		end := uint32(len(data))
+		if i+1 < n {
+			end = binary.BigEndian.Uint32(data[78+8*(i+1):])
+		}
+		if start > end || end > uint32(len(data)) {
+			t.Fatalf("Record %d spans %d-%d, outside the file", i, start, end)
+		}
+		records[i] = data[start:end]
+	}
+	return records
+}
+
+// mobiText returns the text of a MOBI 6 or KF8 book, or nil if it can't
+// be read
+func mobiText(data []byte) []byte {
+	text, err := mobi.ReadText(data)
+	if err != nil {
+		return nil
+	}
+	return []byte(text)
+}
+
+func TestReproducibleEPUB(t *testing.T) {
+	fb2Data, err := os.ReadFile("testdata/golden_basic.fb2")
+	if err != nil {
+		t.Fatalf("Failed to read FB2 file: %v", err)
+	}
+	// Several binaries, so the manifest has more than one resource to order
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	var binaries strings.Builder
+	for _, id := range []string{"zeta.png", "alpha.png", "mid.png"} {
+		binaries.WriteString(`<binary id="` + id + `" content-type="image/png">` + base64.StdEncoding.EncodeToString(img.Bytes()) + "</binary>\n")
+	}
+	fb2Data = bytes.Replace(fb2Data, []byte("</FictionBook>"), []byte(binaries.String()+"</FictionBook>"), 1)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.fb2")
+	if err := os.WriteFile(input, fb2Data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := DefaultConvertOptions()
+	options.Deterministic = true
+	options.EPUBVersion = 3
+	var first []byte
+	for i := range 3 {
+		output := filepath.Join(dir, fmt.Sprintf("book%d.epub", i))
+		if err := ConvertFileWithOptions(input, output, options); err != nil {
+			t.Fatalf("Convert() failed: %v", err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = data
+		} else if !bytes.Equal(data, first) {
+			t.Fatalf("conversion %d differs from the first", i+1)
+		}
+	}
+}
+
+func TestConvertedEPUBValidates(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		t.Run(fmt.Sprintf("EPUB %d", version), func(t *testing.T) {
+			options := DefaultConvertOptions()
+			options.EPUBVersion = version
+			options.GenerateTitlePage = true
+			output := filepath.Join(t.TempDir(), "book.epub")
+			if err := ConvertFileWithOptions("testdata/footnotes.fb2", output, options); err != nil {
+				t.Fatalf("Convert() failed: %v", err)
+			}
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			validator := epub.NewValidator(data)
+			if !validator.Validate() || validator.HasWarnings() {
+				t.Errorf("Converted EPUB failed validation:\n%s", validator.String())
+			}
+		})
+	}
+}
+
+func TestEPUBValidate(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		t.Run(fmt.Sprintf("EPUB %d", version), func(t *testing.T) {
+			epubPath := filepath.Join(t.TempDir(), "book.epub")
+			converter := NewConverter()
+			opts := DefaultConvertOptions()
+			opts.EPUBVersion = version
+			opts.ValidateEPUB = true
+			converter.SetOptions(opts)
+			if err := converter.Convert("testdata/golden_basic.fb2", epubPath); err != nil {
+				t.Fatalf("Convert() to EPUB failed: %v", err)
+			}
+			for _, w := range converter.Warnings() {
+				t.Errorf("Unexpected warning: %s", w)
+			}
+		})
+	}
+}
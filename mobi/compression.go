@@ -3,11 +3,14 @@ package mobi
 
 import (
 	"bytes"
+	"fmt"
 )
 
 // PalmDOC compression uses LZ77-style compression with special encodings
 
-// CompressPalmDOC compresses data using PalmDOC compression
+// CompressPalmDOC compresses data using PalmDOC compression, one
+// 4096-byte record at a time. The records are simply concatenated, so
+// DecompressPalmDOC restores the input from the result.
 func CompressPalmDOC(data []byte) []byte {
 	var output bytes.Buffer
 
@@ -17,16 +20,7 @@ func CompressPalmDOC(data []byte) []byte {
 		if end > len(data) {
 			end = len(data)
 		}
-		record := data[i:end]
-
-		compressed := compressRecord(record)
-		output.Write(compressed)
-
-		// Add trailing overlap byte for non-final records
-		if end < len(data) {
-			// The last byte of each record is duplicated as first byte of next
-			output.WriteByte(record[len(record)-1])
-		}
+		output.Write(compressRecord(data[i:end]))
 	}
 
 	return output.Bytes()
@@ -40,10 +34,11 @@ func compressRecord(data []byte) []byte {
 	for pos < len(data) {
 		// Try LZ77 compression first (look for 3-10 byte repeats within 2047 bytes)
 		if match := findLZMatch(data, pos); match.length >= 3 {
-			// Encode as: 0x8000 + ((distance & 0x3FFF) << 3) + (length - 3)
+			// Encode as 10dddddd dddddlll: an 11-bit distance and a
+			// 3-bit length-3 after the 0b10 marker
 			code := uint16(0x8000)
-			code |= uint16((match.distance & 0x3FFF) << 3)
-			code |= uint16(match.length - 3)
+			code |= uint16(match.distance&0x7FF) << 3
+			code |= uint16(match.length-3) & 0x07
 
 			// Write big-endian
 			output.WriteByte(byte(code >> 8))
@@ -61,17 +56,12 @@ func compressRecord(data []byte) []byte {
 			continue
 		}
 
-		// Check for binary sequences
-		if seq := findBinarySequence(data, pos); seq.length > 0 {
-			// Encode as: 0x8001 + ((length - 1) << 8) + byte
-			code := uint16(0x8001)
-			code |= uint16(seq.length-1) << 8
-			code |= uint16(seq.byteValue)
-
-			output.WriteByte(byte(code >> 8))
-			output.WriteByte(byte(code & 0xFF))
-
-			pos += seq.length
+		// Bytes that would read as codes are escaped: a count of 1-8
+		// followed by that many literal bytes
+		if run := escapedRunLength(data, pos); run > 0 {
+			output.WriteByte(byte(run))
+			output.Write(data[pos : pos+run])
+			pos += run
 			continue
 		}
 
@@ -83,6 +73,24 @@ func compressRecord(data []byte) []byte {
 	return output.Bytes()
 }
 
+// isPalmDOCLiteral reports whether c stands for itself in PalmDOC
+// compressed data. Other bytes (0x01-0x08 and 0x80-0xFF) are codes.
+func isPalmDOCLiteral(c byte) bool {
+	return c == 0x00 || c >= 0x09 && c <= 0x7F
+}
+
+// escapedRunLength returns the number of bytes, up to 8, from pos that
+// need escaping, or 0 if data[pos] is a plain literal
+func escapedRunLength(data []byte, pos int) int {
+	const maxRun = 8
+
+	n := 0
+	for pos+n < len(data) && n < maxRun && !isPalmDOCLiteral(data[pos+n]) {
+		n++
+	}
+	return n
+}
+
 // lzMatch represents an LZ77 match
 type lzMatch struct {
 	distance int
@@ -156,102 +164,68 @@ func findLZMatch(data []byte, pos int) lzMatch {
 	return lzMatch{}
 }
 
-// binarySeq represents a binary sequence match
-type binarySeq struct {
-	length    int
-	byteValue byte
-}
-
-// findBinarySequence looks for repeated binary sequences
-func findBinarySequence(data []byte, pos int) binarySeq {
-	// Binary sequences: 0x00-0x07 or 0x80-0xFF repeated
-	// Encoded as: length 2-8, then the byte value
-
-	const (
-		minLen = 2
-		maxLen = 8
-	)
-
-	if pos >= len(data) {
-		return binarySeq{}
-	}
+// DecompressPalmDOC decompresses PalmDOC-compressed data. Decoding stops
+// at the first truncated or out-of-range code.
+func DecompressPalmDOC(data []byte) []byte {
+	output := make([]byte, 0, len(data)*2)
 
-	firstByte := data[pos]
+	for pos := 0; pos < len(data); {
+		c := data[pos]
+		pos++
 
-	// Check if it's a binary sequence byte (0x00-0x07 or 0x80-0xFF)
-	if (firstByte >= 0x00 && firstByte <= 0x07) || (firstByte >= 0x80 && firstByte <= 0xFF) {
-		// Count repeats
-		length := 1
-		for pos+length < len(data) && data[pos+length] == firstByte && length < maxLen {
-			length++
-		}
+		switch {
+		case isPalmDOCLiteral(c):
+			output = append(output, c)
 
-		if length >= minLen {
-			return binarySeq{
-				length:    length,
-				byteValue: firstByte,
+		case c <= 0x08:
+			// The next c bytes are literals
+			if pos+int(c) > len(data) {
+				return output
 			}
-		}
-	}
-
-	return binarySeq{}
-}
-
-// DecompressPalmDOC decompresses PalmDOC-compressed data
-// Note: This is a simplified implementation for testing
-func DecompressPalmDOC(data []byte) []byte {
-	var output bytes.Buffer
+			output = append(output, data[pos:pos+int(c)]...)
+			pos += int(c)
 
-	pos := 0
-	for pos < len(data) {
-		byte1 := data[pos]
-		pos++
-
-		if byte1 == 0x80 || (byte1&0x80) != 0 {
-			// Compressed sequence
+		case c <= 0xBF:
+			// Length-distance pair: 10dddddd dddddlll
 			if pos >= len(data) {
-				break
+				return output
 			}
-
-			byte2 := data[pos]
+			code := uint16(c)<<8 | uint16(data[pos])
 			pos++
-
-			// Combine to 16-bit value
-			code := uint16(byte1)<<8 | uint16(byte2)
-
-			if code == 0x8000 {
-				// LZ77 match - need next byte for full offset
-				if pos >= len(data) {
-					break
-				}
-				// This is a placeholder - full decompression would be more complex
-				output.WriteByte('?')
-			} else if code == 0x8001 {
-				// Binary sequence - need next byte
-				if pos >= len(data) {
-					break
-				}
-				length := int((code >> 8) & 0x3F)
-				val := data[pos]
-				pos++
-				for i := 0; i < length; i++ {
-					output.WriteByte(val)
-				}
-			} else if byte1&0x80 != 0 && byte2 != 0x00 {
-				// Space + char compression: char ^ 0x80
-				output.WriteByte(' ')
-				output.WriteByte(byte2 ^ 0x80)
-			} else {
-				// Literal
-				output.WriteByte(byte1)
+			distance := int(code>>3) & 0x7FF
+			length := int(code&0x07) + 3
+			if distance == 0 || distance > len(output) {
+				return output
+			}
+			// Byte by byte, since the copy may overlap its own output
+			start := len(output) - distance
+			for i := 0; i < length; i++ {
+				output = append(output, output[start+i])
 			}
-		} else {
-			// Literal byte
-			output.WriteByte(byte1)
+
+		default:
+			// Space followed by c ^ 0x80
+			output = append(output, ' ', c^0x80)
 		}
 	}
 
-	return output.Bytes()
+	return output
+}
+
+// RoundTripPalmDOC compresses data, decompresses the result and reports
+// the first difference from data, if any. It checks the compressor
+// against the decompressor in tests.
+func RoundTripPalmDOC(data []byte) error {
+	got := DecompressPalmDOC(CompressPalmDOC(data))
+	for i := 0; i < len(data) && i < len(got); i++ {
+		if got[i] != data[i] {
+			return fmt.Errorf("round trip differs at byte %d: got %#02x, want %#02x", i, got[i], data[i])
+		}
+	}
+	if len(got) != len(data) {
+		return fmt.Errorf("round trip returned %d bytes, want %d", len(got), len(data))
+	}
+	return nil
 }
 
 // CompressRecord compresses a record and returns it, possibly using multiple compression methods
@@ -2,12 +2,19 @@
 package mobi
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"strings"
+	"unicode"
 )
 
+// EXTHFlagPresent is the MOBI header EXTH flag bit signalling that an EXTH
+// block follows the MOBI header
+const EXTHFlagPresent = 0x40
+
 // EXTH record type constants
 const (
 	EXTHAuthor          = 100
@@ -32,11 +39,13 @@ const (
 	EXTHRetailPrice     = 118
 	EXTHCurrency        = 119
 	EXTHKF8Bounded      = 121
+	EXTHFixedLayout     = 122
 	EXTHResourceCount   = 125
 	EXTHCreatorSoftware = 200
 	EXTHCoverOffset     = 201
 	EXTHThumbOffset     = 202
 	EXTHHasFakeCover    = 203
+	EXTHOrigResolution  = 307
 	EXTHK8CoverImage    = 129
 	EXTHTitle           = 503
 	EXTHMajorMajor      = 501
@@ -160,6 +169,23 @@ func (w *EXTHWriter) AddK8CoverImage(imageID string) {
 	w.addRecord(EXTHK8CoverImage, imageID)
 }
 
+// AddResourceCount adds the number of resource records (KF8)
+func (w *EXTHWriter) AddResourceCount(count uint32) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, count)
+	w.addRecord(EXTHResourceCount, string(data))
+}
+
+// AddFixedLayout marks the book as fixed-layout (KF8)
+func (w *EXTHWriter) AddFixedLayout() {
+	w.addRecord(EXTHFixedLayout, "true")
+}
+
+// AddOriginalResolution adds the page resolution of a fixed-layout book
+func (w *EXTHWriter) AddOriginalResolution(width, height int) {
+	w.addRecord(EXTHOrigResolution, fmt.Sprintf("%dx%d", width, height))
+}
+
 // AddCreatorSoftware adds a creator software record
 func (w *EXTHWriter) AddCreatorSoftware(software string) {
 	w.addRecord(EXTHCreatorSoftware, software)
@@ -206,12 +232,16 @@ func (w *EXTHWriter) addStringList(recordType uint32, strings []string) {
 	w.addRecord(recordType, combined)
 }
 
-// Write writes the EXTH header and records
+// Write writes the EXTH header and records. Nothing is written when there
+// are no records. The block is assembled in memory and checked against its
+// declared length before being written, so output is never partial.
 func (w *EXTHWriter) Write(output io.Writer) (int, error) {
 	if len(w.records) == 0 {
 		return 0, nil
 	}
 
+	var buf bytes.Buffer
+
 	// Calculate total length
 	// Header: 12 bytes (4 identifier + 4 length + 4 count)
 	// Each record: 8 bytes overhead (4 type + 4 length) + data length
@@ -227,30 +257,38 @@ func (w *EXTHWriter) Write(output io.Writer) (int, error) {
 		RecordCount:  uint32(len(w.records)),
 	}
 
-	if err := binary.Write(output, binary.BigEndian, header.Identifier); err != nil {
+	if err := binary.Write(&buf, binary.BigEndian, header.Identifier); err != nil {
 		return 0, fmt.Errorf("failed to write EXTH identifier: %w", err)
 	}
-	if err := binary.Write(output, binary.BigEndian, header.HeaderLength); err != nil {
+	if err := binary.Write(&buf, binary.BigEndian, header.HeaderLength); err != nil {
 		return 0, fmt.Errorf("failed to write EXTH length: %w", err)
 	}
-	if err := binary.Write(output, binary.BigEndian, header.RecordCount); err != nil {
+	if err := binary.Write(&buf, binary.BigEndian, header.RecordCount); err != nil {
 		return 0, fmt.Errorf("failed to write EXTH record count: %w", err)
 	}
 
 	// Write records
 	for _, record := range w.records {
-		if err := binary.Write(output, binary.BigEndian, record.RecordType); err != nil {
+		if err := binary.Write(&buf, binary.BigEndian, record.RecordType); err != nil {
 			return 0, fmt.Errorf("failed to write EXTH record type: %w", err)
 		}
 		// Record length includes the 8 bytes for type and length fields, plus data
-		if err := binary.Write(output, binary.BigEndian, uint32(8+len(record.Data))); err != nil {
+		if err := binary.Write(&buf, binary.BigEndian, uint32(8+len(record.Data))); err != nil {
 			return 0, fmt.Errorf("failed to write EXTH record length: %w", err)
 		}
-		if _, err := output.Write(record.Data); err != nil {
+		if _, err := buf.Write(record.Data); err != nil {
 			return 0, fmt.Errorf("failed to write EXTH record data: %w", err)
 		}
 	}
 
+	if buf.Len() != totalLength {
+		return 0, fmt.Errorf("EXTH length mismatch: declared %d, encoded %d", totalLength, buf.Len())
+	}
+
+	if _, err := output.Write(buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("failed to write EXTH: %w", err)
+	}
+
 	return totalLength, nil
 }
 
@@ -271,6 +309,32 @@ func (w *EXTHWriter) GetTotalLength() int {
 	return totalLength
 }
 
+// DefaultMaxDescriptionLength is the default cap, in characters, of the
+// EXTH description record. Some devices reject much longer records.
+const DefaultMaxDescriptionLength = 4000
+
+// TruncateDescription shortens a description to at most maxLen characters,
+// cutting at a word boundary where possible and appending an ellipsis.
+// A maxLen of zero or less disables the cap.
+func TruncateDescription(description string, maxLen int) string {
+	runes := []rune(description)
+	if maxLen <= 0 || len(runes) <= maxLen {
+		return description
+	}
+
+	// Leave room for the ellipsis, and back off to a word boundary unless
+	// that would lose more than half of the text
+	runes = runes[:maxLen-1]
+	for i := len(runes) - 1; i > len(runes)/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			runes = runes[:i]
+			break
+		}
+	}
+
+	return strings.TrimRightFunc(string(runes), unicode.IsSpace) + "…"
+}
+
 // AddFromMetadata adds common metadata fields
 func (w *EXTHWriter) AddFromMetadata(title, author, publisher, isbn, year, description, copyright, language string) {
 	w.AddTitle(title)
@@ -2,13 +2,16 @@
 package mobi
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
 const (
 	// MOBI header constants
 	MOBIHeaderSize = 232 // MOBI header size (from MOBI marker to end)
+	KF8HeaderSize  = 264 // KF8 header size, with the KF8 index fields
 	MOBIVersion    = 6   // MOBI 6
 
 	// Compression types
@@ -23,6 +26,9 @@ const (
 	// Record sizes
 	StandardRecordSize = 4096       // Standard record size for MOBI 6
 	KF8JointRecordSize = 0x10000000 // Record size for KF8 joint files (bit mask)
+
+	// Extra record data flags: trailing entries after each text record
+	ExtraDataMultibyte = 0x1 // Multibyte character overlap
 )
 
 // MOBIHeader represents the MOBI header (MOBI 6 format, 232 bytes from MOBI marker)
@@ -89,6 +95,16 @@ type MOBIHeader struct {
 	Unknown236          uint32   // 0xEC (+0xDC): Unknown (use 0xFFFFFFFF)
 	ExtraRecordFlags    uint32   // 0xF0 (+0xE0): Extra record data flags (0 = no extra data)
 	INDXRecordOffset    uint32   // 0xF4 (+0xE4): INDX record offset (0xFFFFFFFF if none)
+
+	// KF8 fields, only written when HeaderLength is KF8HeaderSize
+	FragmentIndex uint32 // 0xF8 (+0xE8): Fragment (chunk) index (0xFFFFFFFF if none)
+	SkeletonIndex uint32 // 0xFC (+0xEC): Skeleton index (0xFFFFFFFF if none)
+	DATPIndex     uint32 // 0x100 (+0xF0): DATP record (0xFFFFFFFF if none)
+	GuideIndex    uint32 // 0x104 (+0xF4): Guide index (0xFFFFFFFF if none)
+	Unknown264    uint32 // 0x108 (+0xF8): Unknown (use 0xFFFFFFFF)
+	Unknown268    uint32 // 0x10C (+0xFC): Unknown (use 0x00000000)
+	Unknown272    uint32 // 0x110 (+0x100): Unknown (use 0xFFFFFFFF)
+	Unknown276    uint32 // 0x114 (+0x104): Unknown (use 0x00000000)
 }
 
 // NewMOBIHeader creates a new MOBI header with default values
@@ -154,25 +170,78 @@ func NewMOBIHeader(textSize, recordCount int) *MOBIHeader {
 		Unknown236:          0xFFFFFFFF,
 		ExtraRecordFlags:    0,
 		INDXRecordOffset:    0xFFFFFFFF,
+		FragmentIndex:       0xFFFFFFFF,
+		SkeletonIndex:       0xFFFFFFFF,
+		DATPIndex:           0xFFFFFFFF,
+		GuideIndex:          0xFFFFFFFF,
+		Unknown264:          0xFFFFFFFF,
+		Unknown272:          0xFFFFFFFF,
 	}
 
 	return h
 }
 
-// Write writes the complete MOBI header to a writer.
-// The struct is properly aligned with the MOBI specification, so we can
-// write it all at once with binary.Write without padding issues.
+// Write writes the MOBI header to a writer: the PalmDOC header and
+// HeaderLength bytes from the MOBI marker, which leaves out the KF8 fields
+// of MOBI 6 headers. The struct is properly aligned with the MOBI
+// specification, so it is encoded at once with binary.Write.
 func (h *MOBIHeader) Write(w io.Writer) error {
-	return binary.Write(w, binary.BigEndian, h)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, h); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes()[:h.Size()])
+	return err
+}
+
+// Size returns the length of the encoded header from the start of record 0
+func (h *MOBIHeader) Size() int {
+	return min(16+int(h.HeaderLength), binary.Size(h))
 }
 
-// SetFullName sets the book full name
+// SetFullName sets the length of the book full name. Record0 writes the
+// name and sets its offset.
 func (h *MOBIHeader) SetFullName(name string) {
-	// In production, this would write the name to data and set offset/length
-	// For now, just set the length
 	h.FullNameLength = uint32(len(name))
 }
 
+// Record0 encodes the first record of the book: the header, the EXTH
+// header if it has records, and the full name. It sets the EXTH flag and
+// the full name offset and length to match. Like Calibre, the name is
+// followed by two zero bytes and padded to a multiple of four bytes.
+func (h *MOBIHeader) Record0(exth *EXTHWriter, name string) ([]byte, error) {
+	exthLength := 0
+	if exth != nil && exth.GetRecordCount() > 0 {
+		h.EXTHFlags |= EXTHFlagPresent
+		exthLength = exth.GetTotalLength()
+	} else {
+		h.EXTHFlags &^= EXTHFlagPresent
+	}
+	h.FullNameOffset = uint32(h.Size() + exthLength)
+	h.FullNameLength = uint32(len(name))
+
+	var buf bytes.Buffer
+	if err := h.Write(&buf); err != nil {
+		return nil, err
+	}
+	if exthLength > 0 {
+		n, err := exth.Write(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write EXTH: %w", err)
+		}
+		if n != exthLength {
+			return nil, fmt.Errorf("EXTH length mismatch: expected %d, wrote %d", exthLength, n)
+		}
+	}
+	buf.WriteString(name)
+	buf.Write([]byte{0, 0})
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes(), nil
+}
+
 // SetEXTHFlags sets the EXTH flags
 func (h *MOBIHeader) SetEXTHFlags(flags uint32) {
 	h.EXTHFlags = flags
@@ -183,3 +252,12 @@ func (h *MOBIHeader) SetContentRecords(first, last uint16) {
 	h.FirstContentRec = first
 	h.LastContentRec = last
 }
+
+// SetFDST points a KF8 header at its FDST record. KF8 reuses the content
+// record fields at 0xC0 for the FDST record index and the following
+// field for the number of flows it lists.
+func (h *MOBIHeader) SetFDST(index, count uint32) {
+	h.FirstContentRec = uint16(index >> 16)
+	h.LastContentRec = uint16(index)
+	h.Unknown5 = count
+}
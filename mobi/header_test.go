@@ -33,6 +33,37 @@ func TestMOBIHeaderSize(t *testing.T) {
 	}
 }
 
+// TestKF8HeaderSize verifies that a KF8 header length brings in the KF8
+// index fields after INDXRecordOffset
+func TestKF8HeaderSize(t *testing.T) {
+	h := NewMOBIHeader(1000, 1)
+	h.HeaderLength = KF8HeaderSize
+	h.SkeletonIndex = 7
+	h.SetFDST(5, 1)
+
+	var buf bytes.Buffer
+	if err := h.Write(&buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	if len(data) != 16+KF8HeaderSize || h.Size() != len(data) {
+		t.Fatalf("KF8 header size = %d bytes (Size() = %d), want %d", len(data), h.Size(), 16+KF8HeaderSize)
+	}
+	if got := binary.BigEndian.Uint32(data[0xF8:]); got != 0xFFFFFFFF {
+		t.Errorf("FragmentIndex = %#x, want 0xFFFFFFFF", got)
+	}
+	if got := binary.BigEndian.Uint32(data[0xFC:]); got != 7 {
+		t.Errorf("SkeletonIndex = %d, want 7", got)
+	}
+	if got := binary.BigEndian.Uint32(data[0xC0:]); got != 5 {
+		t.Errorf("FDST index = %d, want 5", got)
+	}
+	if got := binary.BigEndian.Uint32(data[0xC4:]); got != 1 {
+		t.Errorf("FDST count = %d, want 1", got)
+	}
+}
+
 // TestMOBIHeaderFieldOffsets verifies that critical fields are at the correct
 // offsets according to the MobileRead Wiki specification for MOBI (232 bytes)
 func TestMOBIHeaderFieldOffsets(t *testing.T) {
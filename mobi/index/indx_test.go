@@ -1,129 +1,13 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
 	"testing"
 )
 
-// TestNewINDX tests INDX creation
-func TestNewINDX(t *testing.T) {
-	indx := NewINDX(0)
-
-	if indx.Header.HeaderLength != INDXHeaderSize {
-		t.Errorf("HeaderLength = %d, want %d", indx.Header.HeaderLength, INDXHeaderSize)
-	}
-
-	if indx.Header.IndexType != 0 {
-		t.Errorf("IndexType = %d, want 0", indx.Header.IndexType)
-	}
-
-	if indx.Header.Encoding != 65001 {
-		t.Errorf("Encoding = %d, want 65001 (UTF-8)", indx.Header.Encoding)
-	}
-
-	if indx.TAGX == nil {
-		t.Error("TAGX should not be nil")
-	}
-
-	if indx.IDXT == nil {
-		t.Error("IDXT should not be nil")
-	}
-
-	if indx.CNCX == nil {
-		t.Error("CNCX should not be nil")
-	}
-}
-
-// TestTAGXAddTag tests TAGX tag addition
-func TestTAGXAddTag(t *testing.T) {
-	tagx := NewTAGX()
-
-	tagx.AddTag(1, 1, 0x01)
-	tagx.AddTag(2, 1, 0x02)
-
-	if len(tagx.Entries) != 2 {
-		t.Fatalf("Entries count = %d, want 2", len(tagx.Entries))
-	}
-
-	if tagx.Entries[0].TagID != 1 {
-		t.Errorf("First entry TagID = %d, want 1", tagx.Entries[0].TagID)
-	}
-
-	if tagx.Entries[1].TagID != 2 {
-		t.Errorf("Second entry TagID = %d, want 2", tagx.Entries[1].TagID)
-	}
-}
-
-// TestTAGXEncode tests TAGX encoding
-func TestTAGXEncode(t *testing.T) {
-	tagx := NewTAGX()
-	tagx.AddTag(1, 1, 0x01)
-	tagx.AddTag(2, 1, 0x02)
-
-	data, err := tagx.Encode()
-	if err != nil {
-		t.Fatalf("Encode() failed: %v", err)
-	}
-
-	// TAGX: 4 bytes header + N * 4 bytes entries
-	expectedLen := 4 + 2*4
-	if len(data) != expectedLen {
-		t.Errorf("Encoded length = %d, want %d", len(data), expectedLen)
-	}
-
-	// First 4 bytes should be number of tags (2)
-	if data[0] != 0 || data[1] != 0 || data[2] != 0 || data[3] != 2 {
-		t.Errorf("Header = %v, want [0, 0, 0, 2]", data[:4])
-	}
-}
-
-// TestINDXAddString tests CNCX string addition
-func TestINDXAddString(t *testing.T) {
-	indx := NewINDX(0)
-
-	idx1 := indx.AddString("Chapter 1")
-	if idx1 != 0 {
-		t.Errorf("First string index = %d, want 0", idx1)
-	}
-
-	idx2 := indx.AddString("Chapter 2")
-	if idx2 != 1 {
-		t.Errorf("Second string index = %d, want 1", idx2)
-	}
-
-	if len(indx.CNCX) != 2 {
-		t.Errorf("CNCX length = %d, want 2", len(indx.CNCX))
-	}
-}
-
-// TestINDXAddEntry tests IDXT entry addition
-func TestINDXAddEntry(t *testing.T) {
-	indx := NewINDX(0)
-
-	tagValues := map[uint32][]uint32{
-		1: {100},
-		2: {200},
-	}
-
-	indx.AddEntry(1000, 0, tagValues)
-
-	if indx.Header.RecordCount != 1 {
-		t.Errorf("RecordCount = %d, want 1", indx.Header.RecordCount)
-	}
-
-	if len(indx.IDXT) != 1 {
-		t.Errorf("IDXT length = %d, want 1", len(indx.IDXT))
-	}
-
-	entry := indx.IDXT[0]
-	if entry.Offset != 1000 {
-		t.Errorf("Entry offset = %d, want 1000", entry.Offset)
-	}
-
-	if entry.RecordIndex != 0 {
-		t.Errorf("Entry RecordIndex = %d, want 0", entry.RecordIndex)
-	}
-}
-
 // TestTOCIndexBuilder tests TOC index builder
 func TestTOCIndexBuilder(t *testing.T) {
 	builder := NewTOCIndexBuilder()
@@ -215,51 +99,6 @@ func TestCalculateRecordOffsetEmpty(t *testing.T) {
 	}
 }
 
-// TestTOCIndexBuilderBuild tests TOC INDX building
-func TestTOCIndexBuilderBuild(t *testing.T) {
-	builder := NewTOCIndexBuilder()
-
-	// Set up text records
-	records := [][]byte{
-		make([]byte, 1000),
-		make([]byte, 1000),
-	}
-	builder.SetTextRecords(records)
-
-	// Add TOC entries
-	builder.AddEntry("Chapter 1", "#ch1", 1, 0)
-	builder.AddEntry("Chapter 2", "#ch2", 1, 500)
-
-	// Build INDX
-	indx, err := builder.Build()
-	if err != nil {
-		t.Fatalf("Build() failed: %v", err)
-	}
-
-	// Verify TAGX entries (4 tags: name, offset, level, parent)
-	if len(indx.TAGX.Entries) != 4 {
-		t.Errorf("TAGX entries count = %d, want 4", len(indx.TAGX.Entries))
-	}
-
-	// Verify IDXT entries
-	if len(indx.IDXT) != 2 {
-		t.Errorf("IDXT entries count = %d, want 2", len(indx.IDXT))
-	}
-
-	// Verify CNCX strings
-	if len(indx.CNCX) != 2 {
-		t.Errorf("CNCX strings count = %d, want 2", len(indx.CNCX))
-	}
-
-	if indx.CNCX[0] != "Chapter 1" {
-		t.Errorf("CNCX[0] = %s, want 'Chapter 1'", indx.CNCX[0])
-	}
-
-	if indx.CNCX[1] != "Chapter 2" {
-		t.Errorf("CNCX[1] = %s, want 'Chapter 2'", indx.CNCX[1])
-	}
-}
-
 // TestSortTOC tests TOC sorting
 func TestSortTOC(t *testing.T) {
 	entries := []TOCEntry{
@@ -371,3 +210,136 @@ func TestCalculateOffsetsFromHTML(t *testing.T) {
 			entries[1].Offset, entries[0].Offset)
 	}
 }
+
+// TestBuildNCX tests that the NCX index keeps the TOC hierarchy
+func TestBuildNCX(t *testing.T) {
+	builder := NewTOCIndexBuilder()
+	builder.AddEntry("Part 1", "#p1", 1, 0)
+	builder.AddEntry("Chapter 1", "#c1", 2, 10)
+	builder.AddEntry("Section 1.1", "#s1", 3, 20)
+	builder.AddEntry("Chapter 2", "#c2", 2, 30)
+	builder.AddEntry("Part 2", "#p2", 1, 40)
+
+	records, err := builder.BuildNCX(50)
+	if err != nil {
+		t.Fatalf("BuildNCX() failed: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Got %d records, want header, entries and CNCX", len(records))
+	}
+	for i, rec := range records {
+		if len(rec)%4 != 0 {
+			t.Errorf("Record %d length %d is not 4-byte aligned", i, len(rec))
+		}
+	}
+
+	entries, err := ParseNCX(records)
+	if err != nil {
+		t.Fatalf("ParseNCX() failed: %v", err)
+	}
+
+	want := []NCXEntry{
+		{Label: "Part 1", Offset: 0, Length: 40, Depth: 0, Parent: -1, FirstChild: 2, LastChild: 3},
+		{Label: "Part 2", Offset: 40, Length: 10, Depth: 0, Parent: -1, FirstChild: -1, LastChild: -1},
+		{Label: "Chapter 1", Offset: 10, Length: 20, Depth: 1, Parent: 0, FirstChild: 4, LastChild: 4},
+		{Label: "Chapter 2", Offset: 30, Length: 10, Depth: 1, Parent: 0, FirstChild: -1, LastChild: -1},
+		{Label: "Section 1.1", Offset: 20, Length: 10, Depth: 2, Parent: 2, FirstChild: -1, LastChild: -1},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Got %d entries, want %d", len(entries), len(want))
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("Entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+// TestBuildNCXManyEntries tests splitting large indexes over several records
+func TestBuildNCXManyEntries(t *testing.T) {
+	builder := NewTOCIndexBuilder()
+	for i := range 5000 {
+		builder.AddEntry(fmt.Sprintf("A rather long chapter title number %d", i), "", 1, uint32(i*100))
+	}
+
+	records, err := builder.BuildNCX(500000)
+	if err != nil {
+		t.Fatalf("BuildNCX() failed: %v", err)
+	}
+	for i, rec := range records {
+		if len(rec) > 0x10000 {
+			t.Errorf("Record %d is %d bytes, over the 64 KiB limit", i, len(rec))
+		}
+	}
+
+	entries, err := ParseNCX(records)
+	if err != nil {
+		t.Fatalf("ParseNCX() failed: %v", err)
+	}
+	if len(entries) != 5000 {
+		t.Fatalf("Got %d entries, want 5000", len(entries))
+	}
+	if entries[4999].Label != "A rather long chapter title number 4999" {
+		t.Errorf("Last label = %q", entries[4999].Label)
+	}
+}
+
+// TestEncodeIndexRecordIDXT tests that the IDXT block of an entry record
+// locates the start of every entry
+func TestEncodeIndexRecordIDXT(t *testing.T) {
+	entries := [][]byte{
+		encodeIndexEntry("00", ncxTags, map[uint8][]uint32{TagOffset: {0}}),
+		encodeIndexEntry("01", ncxTags, map[uint8][]uint32{TagOffset: {300}, TagLength: {70000}}),
+		encodeIndexEntry("02", ncxTags, map[uint8][]uint32{TagOffset: {5}}),
+	}
+	rec := encodeIndexRecord(entries)
+
+	idxt := int(binary.BigEndian.Uint32(rec[20:]))
+	if string(rec[idxt:idxt+4]) != "IDXT" {
+		t.Fatalf("Index offset %d does not point at the IDXT block", idxt)
+	}
+	if count := binary.BigEndian.Uint32(rec[24:]); count != uint32(len(entries)) {
+		t.Errorf("Entry count = %d, want %d", count, len(entries))
+	}
+
+	start := INDXHeaderSize
+	for i, e := range entries {
+		off := int(binary.BigEndian.Uint16(rec[idxt+4+2*i:]))
+		if off != start {
+			t.Errorf("Entry %d offset = %d, want %d", i, off, start)
+		}
+		if !bytes.Equal(rec[off:off+len(e)], e) {
+			t.Errorf("Entry %d does not start at its IDXT offset", i)
+		}
+		start += len(e)
+	}
+}
+
+// TestBuildCNCXOffsets tests that label references are byte offsets of the
+// VWI-prefixed labels in their CNCX record
+func TestBuildCNCXOffsets(t *testing.T) {
+	long := strings.Repeat("Ж", 200) // 400 bytes, a two-byte VWI length
+	labels := []string{"Chapter 1", long, "Глава 3"}
+
+	records, offsets := buildCNCX(labels)
+	if len(records) != 1 {
+		t.Fatalf("Got %d CNCX records, want 1", len(records))
+	}
+	if records[0][0] != 0x89 {
+		t.Errorf("First length = %#02x, want the VWI 0x89 for 9 bytes", records[0][0])
+	}
+
+	want := []uint32{0, 10, 10 + 2 + 400}
+	for i, label := range labels {
+		if offsets[i] != want[i] {
+			t.Errorf("Label %d offset = %d, want %d", i, offsets[i], want[i])
+		}
+		got, err := cncxString(records, offsets[i])
+		if err != nil {
+			t.Fatalf("Label %d: cncxString() error = %v", i, err)
+		}
+		if got != label {
+			t.Errorf("Label %d = %q, want %q", i, got, label)
+		}
+	}
+}
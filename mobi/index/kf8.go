@@ -0,0 +1,86 @@
+package index
+
+import "fmt"
+
+// KF8 skeleton and fragment index tag IDs
+const (
+	TagChunkCount     = 1 // Number of fragments inserted into a skeleton
+	TagSelector       = 2 // Offset of the fragment selector in the CNCX records
+	TagFileNumber     = 3 // Skeleton (file) a fragment is inserted into
+	TagSequenceNumber = 4 // Number of the fragment across the book
+	TagGeometry       = 6 // Start and length in the text
+)
+
+// skeletonTags lists the skeleton index tags. Like Kindlegen output, every
+// skeleton entry holds its values twice, which the two-bit masks count.
+var skeletonTags = []indexTag{
+	{TagChunkCount, 1, 0x03},
+	{TagGeometry, 2, 0x0C},
+}
+
+// fragmentTags lists the fragment index tags
+var fragmentTags = []indexTag{
+	{TagSelector, 1, 0x01},
+	{TagFileNumber, 1, 0x02},
+	{TagSequenceNumber, 1, 0x04},
+	{TagGeometry, 2, 0x08},
+}
+
+// SkeletonEntry is a skeleton: the markup of one file in the text, into
+// which ChunkCount fragments are inserted
+type SkeletonEntry struct {
+	ChunkCount int
+	Offset     uint32
+	Length     uint32
+}
+
+// FragmentEntry is a piece of text inserted at InsertPos of the file
+// rebuilt from skeleton FileNumber. Selector locates the element it
+// belongs to, such as "P-//*[@aid='0']".
+type FragmentEntry struct {
+	InsertPos  uint32
+	Selector   string
+	FileNumber int
+	Sequence   int
+	Offset     uint32
+	Length     uint32
+}
+
+// BuildSkeletonIndex builds the records of the KF8 skeleton index, one
+// entry per file, named after the file number
+func BuildSkeletonIndex(entries []SkeletonEntry) [][]byte {
+	names := make([]string, len(entries))
+	encoded := make([][]byte, len(entries))
+	for i, e := range entries {
+		names[i] = fmt.Sprintf("SKEL%010d", i)
+		encoded[i] = encodeIndexEntry(names[i], skeletonTags, map[uint8][]uint32{
+			TagChunkCount: {uint32(e.ChunkCount), uint32(e.ChunkCount)},
+			TagGeometry:   {e.Offset, e.Length, e.Offset, e.Length},
+		})
+	}
+	return buildIndex(skeletonTags, names, encoded, nil)
+}
+
+// BuildFragmentIndex builds the records of the KF8 fragment (chunk)
+// index, with the selectors in CNCX records. Entries are named after
+// their insert position and must be sorted by it.
+func BuildFragmentIndex(entries []FragmentEntry) [][]byte {
+	selectors := make([]string, len(entries))
+	for i, e := range entries {
+		selectors[i] = e.Selector
+	}
+	cncxRecords, selectorOffsets := buildCNCX(selectors)
+
+	names := make([]string, len(entries))
+	encoded := make([][]byte, len(entries))
+	for i, e := range entries {
+		names[i] = fmt.Sprintf("%010d", e.InsertPos)
+		encoded[i] = encodeIndexEntry(names[i], fragmentTags, map[uint8][]uint32{
+			TagSelector:       {selectorOffsets[i]},
+			TagFileNumber:     {uint32(e.FileNumber)},
+			TagSequenceNumber: {uint32(e.Sequence)},
+			TagGeometry:       {e.Offset, e.Length},
+		})
+	}
+	return buildIndex(fragmentTags, names, encoded, cncxRecords)
+}
@@ -0,0 +1,76 @@
+package index
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestBuildSkeletonIndex(t *testing.T) {
+	records := BuildSkeletonIndex([]SkeletonEntry{
+		{ChunkCount: 3, Offset: 0, Length: 120},
+		{ChunkCount: 1, Offset: 900, Length: 80},
+	})
+
+	entries, cncx, err := parseIndex(records)
+	if err != nil {
+		t.Fatalf("parseIndex() failed: %v", err)
+	}
+	if len(cncx) != 0 {
+		t.Errorf("skeleton index has %d CNCX records, want none", len(cncx))
+	}
+	if len(entries) != 2 {
+		t.Fatalf("skeleton index has %d entries, want 2", len(entries))
+	}
+
+	e := entries[1]
+	if e.name != "SKEL0000000001" {
+		t.Errorf("entry name = %q, want SKEL0000000001", e.name)
+	}
+	if got := e.values[TagChunkCount]; !slices.Equal(got, []uint32{1, 1}) {
+		t.Errorf("chunk count = %v, want [1 1]", got)
+	}
+	if got := e.values[TagGeometry]; !slices.Equal(got, []uint32{900, 80, 900, 80}) {
+		t.Errorf("geometry = %v, want [900 80 900 80]", got)
+	}
+}
+
+func TestBuildFragmentIndex(t *testing.T) {
+	var fragments []FragmentEntry
+	for i := range 3 {
+		fragments = append(fragments, FragmentEntry{
+			InsertPos: uint32(100 * i),
+			Selector:  fmt.Sprintf("P-//*[@aid='%d']", i),
+			Sequence:  i,
+			Offset:    uint32(100 * i),
+			Length:    100,
+		})
+	}
+
+	entries, cncx, err := parseIndex(BuildFragmentIndex(fragments))
+	if err != nil {
+		t.Fatalf("parseIndex() failed: %v", err)
+	}
+	if len(entries) != len(fragments) {
+		t.Fatalf("fragment index has %d entries, want %d", len(entries), len(fragments))
+	}
+
+	for i, e := range entries {
+		if want := fmt.Sprintf("%010d", 100*i); e.name != want {
+			t.Errorf("entry %d name = %q, want %q", i, e.name, want)
+		}
+		selector, err := cncxString(cncx, e.values[TagSelector][0])
+		if err != nil {
+			t.Fatalf("entry %d selector: %v", i, err)
+		}
+		if selector != fragments[i].Selector {
+			t.Errorf("entry %d selector = %q, want %q", i, selector, fragments[i].Selector)
+		}
+		if got := e.values[TagSequenceNumber]; !slices.Equal(got, []uint32{uint32(i)}) {
+			t.Errorf("entry %d sequence = %v, want [%d]", i, got, i)
+		}
+		if got := e.values[TagGeometry]; !slices.Equal(got, []uint32{uint32(100 * i), 100}) {
+			t.Errorf("entry %d geometry = %v, want [%d 100]", i, got, 100*i)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/htol/fb2c/varint"
+)
+
+// NCX tag IDs as used by Kindle readers for the book navigation index
+const (
+	TagOffset     = 1  // Start of the entry in the uncompressed text
+	TagLength     = 2  // Length of the entry's text, including its children
+	TagLabel      = 3  // Offset of the label in the CNCX records
+	TagDepth      = 4  // Nesting level, 0 for top-level entries
+	TagParent     = 21 // Index of the parent entry
+	TagFirstChild = 22 // Index of the first child entry
+	TagLastChild  = 23 // Index of the last child entry
+)
+
+// indexTag is a TAGX tag definition: the tag ID, the number of values in
+// a set and the control byte mask. Multi-bit masks hold the number of
+// value sets of an entry.
+type indexTag struct {
+	id    uint8
+	count uint8
+	mask  uint8
+}
+
+// ncxTags lists the NCX tags in TAGX order
+var ncxTags = []indexTag{
+	{TagOffset, 1, 0x01},
+	{TagLength, 1, 0x02},
+	{TagLabel, 1, 0x04},
+	{TagDepth, 1, 0x08},
+	{TagParent, 1, 0x10},
+	{TagFirstChild, 1, 0x20},
+	{TagLastChild, 1, 0x40},
+}
+
+const (
+	// maxIndexRecordSize is the size limit of a single INDX record, imposed
+	// by the 16-bit IDXT offsets
+	maxIndexRecordSize = 0x10000
+
+	// cncxRecordSize is where CNCX strings are split into a new record,
+	// leaving room so that no label straddles the 64 KiB boundary
+	cncxRecordSize = 0x10000 - 1024
+)
+
+// NCXEntry is a decoded entry of a hierarchical NCX index. Parent,
+// FirstChild and LastChild are entry indices, or -1 when absent.
+type NCXEntry struct {
+	Label      string
+	Offset     uint32
+	Length     uint32
+	Depth      int
+	Parent     int
+	FirstChild int
+	LastChild  int
+}
+
+// BuildNCX builds the records of a hierarchical NCX index: the INDX
+// header record with the TAGX table, the INDX entry records and the CNCX
+// string records, in the order they must appear in the PalmDB. textLength
+// is the uncompressed text length, used for the length of the last
+// entries.
+//
+// Entries are stored breadth-first so that the children of every entry
+// form a contiguous range referenced by the first/last child tags. This is
+// what lets readers show the TOC as a nested menu.
+func (b *TOCIndexBuilder) BuildNCX(textLength uint32) ([][]byte, error) {
+	if len(b.entries) == 0 {
+		return nil, errors.New("no TOC entries")
+	}
+
+	nodes := b.ncxEntries(textLength)
+
+	labels := make([]string, len(nodes))
+	for i, node := range nodes {
+		labels[i] = node.Label
+	}
+	cncxRecords, labelOffsets := buildCNCX(labels)
+
+	names := make([]string, len(nodes))
+	entries := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		names[i] = entryName(i)
+		entries[i] = encodeNCXEntry(names[i], node, labelOffsets[i])
+	}
+
+	return buildIndex(ncxTags, names, entries, cncxRecords), nil
+}
+
+// buildIndex assembles the records of an index from its encoded entries:
+// the INDX header record, the entry records, split so that none exceeds
+// the record size limit, and the CNCX records
+func buildIndex(tags []indexTag, names []string, entries [][]byte, cncxRecords [][]byte) [][]byte {
+	var (
+		dataRecords [][]byte
+		lastNames   []string
+		counts      []int
+		encoded     [][]byte
+		size        int
+		last        string
+	)
+	flush := func() {
+		if len(encoded) == 0 {
+			return
+		}
+		dataRecords = append(dataRecords, encodeIndexRecord(encoded))
+		lastNames = append(lastNames, last)
+		counts = append(counts, len(encoded))
+		encoded, size = nil, 0
+	}
+	for i, data := range entries {
+		// Header, entries, IDXT tag and one offset per entry, padded
+		if INDXHeaderSize+size+len(data)+4+2*(len(encoded)+1)+8 > maxIndexRecordSize {
+			flush()
+		}
+		encoded = append(encoded, data)
+		last = names[i]
+		size += len(data)
+	}
+	flush()
+
+	header := encodeIndexHeader(tags, len(entries), len(dataRecords), len(cncxRecords), lastNames, counts)
+
+	records := [][]byte{header}
+	records = append(records, dataRecords...)
+	records = append(records, cncxRecords...)
+	return records
+}
+
+// ncxEntries converts the builder entries, kept in document order, into
+// breadth-first NCX entries with resolved lengths and relations
+func (b *TOCIndexBuilder) ncxEntries(textLength uint32) []NCXEntry {
+	minLevel := b.entries[0].Level
+	for _, e := range b.entries {
+		minLevel = min(minLevel, e.Level)
+	}
+
+	// Breadth-first order: a stable sort by level keeps siblings in
+	// document order and makes every set of children contiguous
+	order := make([]int, len(b.entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return b.entries[order[i]].Level < b.entries[order[j]].Level
+	})
+	position := make([]int, len(b.entries))
+	for pos, i := range order {
+		position[i] = pos
+	}
+
+	nodes := make([]NCXEntry, len(order))
+	for pos, i := range order {
+		e := b.entries[i]
+
+		// An entry spans its children, up to the next entry that is not
+		// nested in it
+		end := textLength
+		for j := i + 1; j < len(b.entries); j++ {
+			if b.entries[j].Level <= e.Level {
+				end = b.entries[j].Offset
+				break
+			}
+		}
+		length := uint32(0)
+		if end > e.Offset {
+			length = end - e.Offset
+		}
+
+		parent := -1
+		if e.ParentIndex >= 0 {
+			parent = position[e.ParentIndex]
+		}
+		nodes[pos] = NCXEntry{
+			Label:      e.Label,
+			Offset:     e.Offset,
+			Length:     length,
+			Depth:      e.Level - minLevel,
+			Parent:     parent,
+			FirstChild: -1,
+			LastChild:  -1,
+		}
+	}
+
+	for pos := range nodes {
+		if p := nodes[pos].Parent; p >= 0 {
+			if nodes[p].FirstChild < 0 {
+				nodes[p].FirstChild = pos
+			}
+			nodes[p].LastChild = pos
+		}
+	}
+	return nodes
+}
+
+// buildCNCX packs strings into CNCX records and returns the reference of
+// each string (record number << 16 | offset in record)
+func buildCNCX(labels []string) ([][]byte, []uint32) {
+	var records [][]byte
+	var buf bytes.Buffer
+	offsets := make([]uint32, len(labels))
+
+	for i, label := range labels {
+		data := append(varint.EncodeForward(uint32(len(label))), label...)
+		if buf.Len() > 0 && buf.Len()+len(data) > cncxRecordSize {
+			records = append(records, alignBlock(buf.Bytes()))
+			buf = bytes.Buffer{}
+		}
+		offsets[i] = uint32(len(records))<<16 | uint32(buf.Len())
+		buf.Write(data)
+	}
+	if buf.Len() > 0 {
+		records = append(records, alignBlock(buf.Bytes()))
+	}
+	return records, offsets
+}
+
+// entryName returns the index key of an entry: its number as uppercase
+// hex with an even number of digits
+func entryName(i int) string {
+	name := fmt.Sprintf("%X", i)
+	if len(name)%2 != 0 {
+		name = "0" + name
+	}
+	return name
+}
+
+// encodeNCXEntry encodes an NCX entry, leaving out absent relations
+func encodeNCXEntry(name string, node NCXEntry, label uint32) []byte {
+	values := map[uint8][]uint32{
+		TagOffset: {node.Offset},
+		TagLength: {node.Length},
+		TagLabel:  {label},
+		TagDepth:  {uint32(node.Depth)},
+	}
+	if node.Parent >= 0 {
+		values[TagParent] = []uint32{uint32(node.Parent)}
+	}
+	if node.FirstChild >= 0 {
+		values[TagFirstChild] = []uint32{uint32(node.FirstChild)}
+		values[TagLastChild] = []uint32{uint32(node.LastChild)}
+	}
+	return encodeIndexEntry(name, ncxTags, values)
+}
+
+// encodeIndexEntry encodes an entry: length-prefixed name, control byte and
+// the values of the tags set in the control byte, in TAGX order
+func encodeIndexEntry(name string, tags []indexTag, values map[uint8][]uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+
+	var control byte
+	for _, tag := range tags {
+		if v, ok := values[tag.id]; ok {
+			sets := len(v) / int(tag.count)
+			control |= byte(sets<<bits.TrailingZeros8(tag.mask)) & tag.mask
+		}
+	}
+	buf.WriteByte(control)
+
+	for _, tag := range tags {
+		for _, v := range values[tag.id] {
+			buf.Write(varint.EncodeForward(v))
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeIndexRecord builds an INDX entry record followed by its IDXT
+func encodeIndexRecord(entries [][]byte) []byte {
+	var body bytes.Buffer
+	offsets := make([]int, len(entries))
+	for i, e := range entries {
+		offsets[i] = INDXHeaderSize + body.Len()
+		body.Write(e)
+	}
+	block := alignBlock(body.Bytes())
+
+	idxt := []byte("IDXT")
+	for _, off := range offsets {
+		idxt = binary.BigEndian.AppendUint16(idxt, uint16(off))
+	}
+	idxt = alignBlock(idxt)
+
+	header := make([]byte, INDXHeaderSize)
+	copy(header, "INDX")
+	binary.BigEndian.PutUint32(header[4:], INDXHeaderSize)
+	binary.BigEndian.PutUint32(header[12:], 1) // Entry record
+	binary.BigEndian.PutUint32(header[20:], uint32(INDXHeaderSize+len(block)))
+	binary.BigEndian.PutUint32(header[24:], uint32(len(entries)))
+	copy(header[28:36], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+
+	return append(append(header, block...), idxt...)
+}
+
+// encodeIndexHeader builds the INDX header record: header fields, the
+// TAGX table and the geometry of the entry records (last entry name and
+// entry count of each record, located through an IDXT)
+func encodeIndexHeader(tags []indexTag, entryCount, recordCount, cncxCount int, lastNames []string, counts []int) []byte {
+	tagx := []byte("TAGX")
+	tagx = binary.BigEndian.AppendUint32(tagx, uint32(12+4*(len(tags)+1)))
+	tagx = binary.BigEndian.AppendUint32(tagx, 1) // Control byte count
+	for _, tag := range tags {
+		tagx = append(tagx, tag.id, tag.count, tag.mask, 0)
+	}
+	tagx = append(tagx, 0, 0, 0, 1) // End of table
+
+	var geometry bytes.Buffer
+	offsets := make([]int, recordCount)
+	for i := range recordCount {
+		offsets[i] = INDXHeaderSize + len(tagx) + geometry.Len()
+		geometry.WriteByte(byte(len(lastNames[i])))
+		geometry.WriteString(lastNames[i])
+		binary.Write(&geometry, binary.BigEndian, uint16(counts[i]))
+	}
+	body := alignBlock(append(tagx, geometry.Bytes()...))
+
+	idxt := []byte("IDXT")
+	for _, off := range offsets {
+		idxt = binary.BigEndian.AppendUint16(idxt, uint16(off))
+	}
+	idxt = alignBlock(idxt)
+
+	header := make([]byte, INDXHeaderSize)
+	copy(header, "INDX")
+	binary.BigEndian.PutUint32(header[4:], INDXHeaderSize)
+	binary.BigEndian.PutUint32(header[20:], uint32(INDXHeaderSize+len(body)))
+	binary.BigEndian.PutUint32(header[24:], uint32(recordCount))
+	binary.BigEndian.PutUint32(header[28:], 65001) // UTF-8
+	copy(header[32:36], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	binary.BigEndian.PutUint32(header[36:], uint32(entryCount))
+	binary.BigEndian.PutUint32(header[52:], uint32(cncxCount))
+	binary.BigEndian.PutUint32(header[180:], INDXHeaderSize) // TAGX offset
+
+	return append(append(header, body...), idxt...)
+}
+
+// alignBlock pads data with zeros to a multiple of four bytes
+func alignBlock(data []byte) []byte {
+	if pad := (4 - len(data)%4) % 4; pad > 0 {
+		data = append(data, make([]byte, pad)...)
+	}
+	return data
+}
+
+// ParseNCX decodes a hierarchical NCX index from its records, in PalmDB
+// order: the INDX header record, the entry records and the CNCX records.
+func ParseNCX(records [][]byte) ([]NCXEntry, error) {
+	raw, cncx, err := parseIndex(records)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]NCXEntry, 0, len(raw))
+	for i, e := range raw {
+		entry := NCXEntry{Parent: -1, FirstChild: -1, LastChild: -1}
+		for id, values := range e.values {
+			v := values[0]
+			switch id {
+			case TagOffset:
+				entry.Offset = v
+			case TagLength:
+				entry.Length = v
+			case TagLabel:
+				s, err := cncxString(cncx, v)
+				if err != nil {
+					return nil, fmt.Errorf("entry %d: %w", i, err)
+				}
+				entry.Label = s
+			case TagDepth:
+				entry.Depth = int(v)
+			case TagParent:
+				entry.Parent = int(v)
+			case TagFirstChild:
+				entry.FirstChild = int(v)
+			case TagLastChild:
+				entry.LastChild = int(v)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// indexEntry is a decoded index entry: its name and tag values
+type indexEntry struct {
+	name   string
+	values map[uint8][]uint32
+}
+
+// parseIndex decodes the entries of an index from its records, in PalmDB
+// order: the INDX header record, the entry records and the CNCX records,
+// which it returns for resolving string references.
+func parseIndex(records [][]byte) ([]indexEntry, [][]byte, error) {
+	if len(records) == 0 {
+		return nil, nil, errors.New("no index records")
+	}
+	header := records[0]
+	if len(header) < INDXHeaderSize || string(header[:4]) != "INDX" {
+		return nil, nil, errors.New("missing INDX header")
+	}
+	recordCount := int(binary.BigEndian.Uint32(header[24:]))
+	cncxCount := int(binary.BigEndian.Uint32(header[52:]))
+	if len(records) < 1+recordCount+cncxCount {
+		return nil, nil, fmt.Errorf("index needs %d records, have %d", 1+recordCount+cncxCount, len(records))
+	}
+
+	// TAGX: tag, value count, mask, end-of-table flag
+	tagxOffset := int(binary.BigEndian.Uint32(header[180:]))
+	if len(header) < tagxOffset+12 || string(header[tagxOffset:tagxOffset+4]) != "TAGX" {
+		return nil, nil, errors.New("missing TAGX table")
+	}
+	tagxLen := int(binary.BigEndian.Uint32(header[tagxOffset+4:]))
+	if len(header) < tagxOffset+tagxLen {
+		return nil, nil, errors.New("truncated TAGX table")
+	}
+	var tags []indexTag
+	for p := tagxOffset + 12; p+4 <= tagxOffset+tagxLen; p += 4 {
+		if header[p+3] == 1 {
+			break
+		}
+		tags = append(tags, indexTag{header[p], header[p+1], header[p+2]})
+	}
+
+	var entries []indexEntry
+	for _, rec := range records[1 : 1+recordCount] {
+		if len(rec) < INDXHeaderSize || string(rec[:4]) != "INDX" {
+			return nil, nil, errors.New("missing INDX entry record header")
+		}
+		idxt := int(binary.BigEndian.Uint32(rec[20:]))
+		count := int(binary.BigEndian.Uint32(rec[24:]))
+		if len(rec) < idxt+4+2*count || string(rec[idxt:idxt+4]) != "IDXT" {
+			return nil, nil, errors.New("missing IDXT in entry record")
+		}
+		for i := range count {
+			p := int(binary.BigEndian.Uint16(rec[idxt+4+2*i:]))
+			if p >= len(rec) || p+1+int(rec[p]) >= len(rec) {
+				return nil, nil, fmt.Errorf("entry offset %d out of range", p)
+			}
+			entry := indexEntry{
+				name:   string(rec[p+1 : p+1+int(rec[p])]),
+				values: make(map[uint8][]uint32),
+			}
+			p += 1 + int(rec[p])
+			control := rec[p]
+			p++
+
+			for _, tag := range tags {
+				sets := int(control&tag.mask) >> bits.TrailingZeros8(tag.mask)
+				for range sets * int(tag.count) {
+					v, size, err := varint.DecodeForward(rec[p:])
+					if err != nil {
+						return nil, nil, fmt.Errorf("entry %d: %w", len(entries), err)
+					}
+					entry.values[tag.id] = append(entry.values[tag.id], v)
+					p += size
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if total := int(binary.BigEndian.Uint32(header[36:])); total != len(entries) {
+		return nil, nil, fmt.Errorf("index declares %d entries, found %d", total, len(entries))
+	}
+	return entries, records[1+recordCount : 1+recordCount+cncxCount], nil
+}
+
+// cncxString resolves a CNCX string reference
+func cncxString(cncx [][]byte, ref uint32) (string, error) {
+	rec, off := int(ref>>16), int(ref&0xFFFF)
+	if rec >= len(cncx) || off >= len(cncx[rec]) {
+		return "", fmt.Errorf("label reference %#x out of range", ref)
+	}
+	n, size, err := varint.DecodeForward(cncx[rec][off:])
+	if err != nil {
+		return "", err
+	}
+	start := off + size
+	if start+int(n) > len(cncx[rec]) {
+		return "", fmt.Errorf("label at %#x is truncated", ref)
+	}
+	return string(cncx[rec][start : start+int(n)]), nil
+}
@@ -49,13 +49,11 @@ func (f *FDST) AddChunk(chunk *Chunk) {
 
 // Write writes the FDST to a writer
 func (f *FDST) Write(w io.Writer) error {
-	// Calculate total length
-	// Header: 12 bytes
-	// Each entry: 8 bytes (4 + 4)
-	totalLen := 12 + (len(f.Entries) * 8)
-
-	f.Header.Magic = 0x46545354 // 'FDST' in big-endian
-	f.Header.HeaderLen = uint32(totalLen)
+	// Header: 12 bytes, followed by 8 bytes (4 + 4) for each entry.
+	// HeaderLen is the offset of the entries.
+	f.Header.Magic = 0x46445354 // 'FDST' in big-endian
+	f.Header.HeaderLen = 12
+	f.Header.NumEntries = uint32(len(f.Entries))
 
 	// Write header
 	if err := binary.Write(w, binary.BigEndian, f.Header.Magic); err != nil {
@@ -3,6 +3,8 @@ package kf8
 
 import (
 	"fmt"
+	"regexp"
+	"slices"
 	"strings"
 )
 
@@ -108,17 +110,23 @@ func (fm *FlowManager) convertResourceRef(resourceID string) string {
 	return fmt.Sprintf("kindle:embed:%s", resourceID)
 }
 
-// ConvertLinks converts all links in flows to Kindle format
-func (fm *FlowManager) ConvertLinks() {
+// ConvertLinks converts all links in flows to Kindle format. skeleton holds
+// the chunks of the primary flow, which internal links are resolved
+// against; it is updated to match the converted content.
+func (fm *FlowManager) ConvertLinks(skeleton *Skeleton) {
 	for _, flow := range fm.flows {
 		if flow.Type == FlowTypeHTML {
-			flow.Content = fm.convertHTMLLinks(flow.Content, flow.ID)
+			chunks := skeleton
+			if flow.Index != 0 {
+				chunks = nil
+			}
+			flow.Content = fm.convertHTMLLinks(flow.Content, chunks)
 		}
 	}
 }
 
 // convertHTMLLinks converts href links to Kindle format
-func (fm *FlowManager) convertHTMLLinks(html, flowID string) string {
+func (fm *FlowManager) convertHTMLLinks(html string, skeleton *Skeleton) string {
 	// Convert href links to kindle:flow: or kindle:embed:
 	// This is a simplified implementation
 
@@ -129,7 +137,7 @@ func (fm *FlowManager) convertHTMLLinks(html, flowID string) string {
 	html = convertImageLinks(html)
 
 	// Convert anchor links (<a href="...">)
-	html = convertAnchorLinks(html)
+	html = convertAnchorLinks(html, skeleton)
 
 	return html
 }
@@ -156,12 +164,97 @@ func convertImageLinks(html string) string {
 	return html
 }
 
-// convertAnchorLinks converts anchor href attributes
-func convertAnchorLinks(html string) string {
-	// Convert internal links to kindle:flow:
-	// Keep external links as-is
+// anchorHrefRegex matches the href attribute of a link, capturing the
+// value
+var anchorHrefRegex = regexp.MustCompile(`<a\s[^>]*?\bhref=["']([^"']*)["']`)
 
-	return html
+// idAttrRegex matches the start tag of an element with an id, capturing
+// the id
+var idAttrRegex = regexp.MustCompile(`<[a-zA-Z][^>]*?\sid=["']([^"']+)["']`)
+
+// kindlePosDigits is the alphabet of the numbers in kindle:pos links
+const kindlePosDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+
+// kindlePos returns the kindle:pos link to offset off of the fragment
+// with sequence number fid. Every link has the same length.
+func kindlePos(fid, off int) string {
+	return "kindle:pos:fid:" + base32Digits(fid, 4) + ":off:" + base32Digits(off, 10)
+}
+
+// base32Digits formats n in base 32 with at least width digits
+func base32Digits(n, width int) string {
+	var digits []byte
+	for n > 0 || len(digits) < width {
+		digits = append(digits, kindlePosDigits[n%32])
+		n /= 32
+	}
+	slices.Reverse(digits)
+	return string(digits)
+}
+
+// convertAnchorLinks rewrites internal links to the element with the
+// linked id to kindle:pos links into the chunk holding the element.
+// External links and links to missing ids are left as is. The chunks of
+// skeleton are moved to match the rewritten HTML.
+func convertAnchorLinks(html string, skeleton *Skeleton) string {
+	if skeleton == nil || len(skeleton.Chunks) == 0 {
+		return html
+	}
+
+	ids := make(map[string]bool)
+	for _, m := range idAttrRegex.FindAllStringSubmatch(html, -1) {
+		ids[m[1]] = true
+	}
+
+	// Replace link targets with placeholders of the final length, so that
+	// element offsets don't change once the links are filled in
+	placeholder := kindlePos(0, 0)
+	var out strings.Builder
+	var edits []textEdit
+	var links []int // Start of each placeholder in out
+	var targets []string
+	last := 0
+	for _, m := range anchorHrefRegex.FindAllStringSubmatchIndex(html, -1) {
+		href := html[m[2]:m[3]]
+		_, id, ok := strings.Cut(href, "#")
+		if !ok || !ids[id] || !IsInternalLink(href) {
+			continue
+		}
+		out.WriteString(html[last:m[2]])
+		links = append(links, out.Len())
+		targets = append(targets, id)
+		out.WriteString(placeholder)
+		edits = append(edits, textEdit{Start: m[2], End: m[3], Length: len(placeholder)})
+		last = m[3]
+	}
+	if len(links) == 0 {
+		return html
+	}
+	out.WriteString(html[last:])
+	converted := []byte(out.String())
+	skeleton.applyEdits(edits)
+
+	offsets := make(map[string]int)
+	for _, m := range idAttrRegex.FindAllSubmatchIndex(converted, -1) {
+		id := string(converted[m[2]:m[3]])
+		if _, seen := offsets[id]; !seen {
+			offsets[id] = m[0]
+		}
+	}
+
+	for i, start := range links {
+		offset := offsets[targets[i]]
+		fid, off := 0, offset
+		if chunk, ok := skeleton.GetChunkByOffset(offset); ok {
+			fid, off = chunk.ID, offset-chunk.Offset
+		}
+		copy(converted[start:], kindlePos(fid, off))
+	}
+
+	for _, chunk := range skeleton.Chunks {
+		chunk.Content = string(converted[chunk.Offset : chunk.Offset+chunk.Length])
+	}
+	return string(converted)
 }
 
 // FlowTable represents the flow table (resource index)
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/htol/fb2c/mobi/index"
 )
 
 const (
@@ -287,6 +289,35 @@ func (s *Skeleton) BuildHierarchy() {
 	}
 }
 
+// textEdit replaces the bytes from Start to End of a text with Length
+// bytes
+type textEdit struct {
+	Start, End, Length int
+}
+
+// applyEdits moves the chunks to where their text is after the edits,
+// which must be sorted and not overlap. A chunk boundary inside an edit
+// moves to its end.
+func (s *Skeleton) applyEdits(edits []textEdit) {
+	moved := func(pos int) int {
+		shift := 0
+		for _, e := range edits {
+			if e.Start >= pos {
+				break
+			}
+			pos = max(pos, e.End)
+			shift += e.Length - (e.End - e.Start)
+		}
+		return pos + shift
+	}
+
+	for _, chunk := range s.Chunks {
+		start, end := moved(chunk.Offset), moved(chunk.Offset+chunk.Length)
+		chunk.Offset, chunk.Length = start, end-start
+	}
+	s.TotalLength = moved(s.TotalLength)
+}
+
 // GetChunkDepth calculates the nesting depth of a chunk
 func (s *Skeleton) GetChunkDepth(chunk *Chunk) int {
 	depth := 0
@@ -298,7 +329,8 @@ func (s *Skeleton) GetChunkDepth(chunk *Chunk) int {
 	return depth
 }
 
-// AssignAIDAttributes adds aid attributes to HTML elements
+// AssignAIDAttributes adds aid attributes to HTML elements and returns the
+// resulting HTML. The chunks are updated to describe it.
 func (s *Skeleton) AssignAIDAttributes() string {
 	var result strings.Builder
 
@@ -316,10 +348,7 @@ func (s *Skeleton) AssignAIDAttributes() string {
 				// Don't add aid to these tags
 			} else {
 				// Find the tag name end
-				tagEnd := strings.Index(content[tagStart:], " ")
-				if tagEnd < 0 {
-					tagEnd = strings.Index(content[tagStart:], ">")
-				}
+				tagEnd := strings.IndexAny(content[tagStart:], " \t\r\n/>")
 				if tagEnd > 0 {
 					// Insert aid attribute
 					insertPos := tagStart + tagEnd
@@ -329,8 +358,35 @@ func (s *Skeleton) AssignAIDAttributes() string {
 			}
 		}
 
+		chunk.Offset = result.Len()
+		chunk.Length = len(content)
+		chunk.Content = content
 		result.WriteString(content)
 	}
+	s.TotalLength = result.Len()
 
 	return result.String()
 }
+
+// SkeletonIndex returns the KF8 skeleton index entries. The text is kept
+// in document order, so its single file has an empty skeleton that every
+// chunk is inserted into at its own offset.
+func (s *Skeleton) SkeletonIndex() []index.SkeletonEntry {
+	return []index.SkeletonEntry{{ChunkCount: len(s.Chunks)}}
+}
+
+// FragmentIndex returns the KF8 fragment index entries, one per chunk,
+// selected by the aid of the chunk
+func (s *Skeleton) FragmentIndex() []index.FragmentEntry {
+	entries := make([]index.FragmentEntry, len(s.Chunks))
+	for i, chunk := range s.Chunks {
+		entries[i] = index.FragmentEntry{
+			InsertPos: uint32(chunk.Offset),
+			Selector:  fmt.Sprintf("P-//*[@aid='%s']", chunk.AID),
+			Sequence:  i,
+			Offset:    uint32(chunk.Offset),
+			Length:    uint32(chunk.Length),
+		}
+	}
+	return entries
+}
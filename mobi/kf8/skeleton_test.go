@@ -1,6 +1,7 @@
 package kf8
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -97,6 +98,19 @@ func TestGenerateAID(t *testing.T) {
 	}
 }
 
+func TestAssignAIDAttributesTagName(t *testing.T) {
+	skel := NewSkeleton()
+	if err := skel.ChunkHTML("<html>\n<head>\n<guide>\n  <reference type=\"toc\"/>\n</guide>\n</head>\n<body><p>Some text</p></body>\n</html>"); err != nil {
+		t.Fatalf("ChunkHTML() failed: %v", err)
+	}
+
+	content := skel.AssignAIDAttributes()
+	want := `<html aid="` + skel.Chunks[0].AID + `">`
+	if !strings.HasPrefix(content, want) {
+		t.Errorf("content starts with %q, want %q", content[:min(len(content), 30)], want)
+	}
+}
+
 func TestGetChunkByAID(t *testing.T) {
 	skel := NewSkeleton()
 	skel.ChunkHTML("<html><body>Test</body></html>")
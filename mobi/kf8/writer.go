@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/htol/fb2c/mobi"
+	"github.com/htol/fb2c/mobi/index"
 	"github.com/htol/fb2c/opf"
 )
 
@@ -79,16 +80,12 @@ func (w *KF8Writer) Write(output io.Writer) error {
 
 		// Assign AID attributes
 		content = w.skeleton.AssignAIDAttributes()
-
-		// Generate FDST from skeleton
-		if w.options.GenerateFDST {
-			w.fdst.GenerateFromSkeleton(w.skeleton)
-		}
 	} else {
 		content = w.book.Content
 	}
 
 	// 2. Set up flows if enabled
+	flows := []string{content}
 	if w.options.SupportFlows {
 		// Create primary HTML flow
 		w.flowManager.CreateFlow("primary", FlowTypeHTML, content)
@@ -100,34 +97,59 @@ func (w *KF8Writer) Write(output io.Writer) error {
 		w.addResourcesToFlows()
 
 		// Convert links to Kindle format
-		w.flowManager.ConvertLinks()
+		w.flowManager.ConvertLinks(w.skeleton)
 
-		// Use primary flow content
-		primaryFlow, _ := w.flowManager.GetPrimaryFlow()
-		content = primaryFlow.Content
+		flows = flows[:0]
+		for _, flow := range w.flowManager.GetFlows() {
+			flows = append(flows, flow.Content)
+		}
 	}
 
-	// 3. Update book content
-	w.book.Content = content
+	// 3. Write the records
+	return w.writeRecords(output, flows)
+}
 
-	// 4. Update MOBI header for KF8
-	w.setupKF8Header()
+// recordLayout is where writeRecords placed the records the KF8 header
+// points at. Indices are -1 for records that weren't written.
+type recordLayout struct {
+	firstText, lastText int
+	firstImage          int
+	fragment, skeleton  int
+	resources           int // Image records, the thumbnail included
+	fdst, flows         int
+	flis, fcis          int
+}
 
-	// 5. Write MOBI (with KF8 extensions)
-	if err := w.mobiWriter.Write(output); err != nil {
-		return fmt.Errorf("failed to write MOBI: %w", err)
-	}
+// setupKF8Header configures the MOBI header and EXTH for KF8 once the
+// record layout is known
+func (w *KF8Writer) setupKF8Header(h *mobi.MOBIHeader, exth *mobi.EXTHWriter, layout recordLayout) {
+	// Signal KF8 through MOBIType instead of RecordSize
+	// RecordSize field is uint16, can't hold 0x10000000
+	h.MOBIType = 248 // 248 = KF8
+	h.FileVersion = KF8Version
+	h.MinVersion = KF8Version
+	h.HeaderLength = mobi.KF8HeaderSize
 
-	return nil
-}
+	// Use PalmDOC compression like Calibre
+	h.Compression = mobi.PalmDOCCompression
+	h.ExtraRecordFlags = mobi.ExtraDataMultibyte // See mobi.TextRecords
+
+	if layout.fdst != -1 {
+		h.SetFDST(uint32(layout.fdst), uint32(layout.flows))
+	} else {
+		h.SetContentRecords(uint16(layout.firstText), uint16(layout.lastText))
+	}
+	if layout.firstImage != -1 {
+		h.FirstImageIndex = uint32(layout.firstImage)
+	}
+	if layout.fragment != -1 {
+		h.FragmentIndex = uint32(layout.fragment)
+		h.SkeletonIndex = uint32(layout.skeleton)
+	}
+	h.FLISIndex = uint32(layout.flis)
+	h.FCISIndex = uint32(layout.fcis)
 
-// setupKF8Header configures the MOBI header for KF8
-func (w *KF8Writer) setupKF8Header() {
-	// This would update the MOBI header with KF8-specific values
-	// In a full implementation, would:
-	// - Set MOBI version to 8
-	// - Add KF8-specific flags
-	// - Set up additional indices
+	exth.AddResourceCount(uint32(layout.resources))
 }
 
 // addResourcesToFlows adds manifest resources to flows
@@ -196,41 +218,47 @@ func ConvertOEBToKF8WithOptions(book *opf.OEBBook, output io.Writer, options KF8
 // WriteJointFile writes a joint MOBI file (MOBI 6 + KF8)
 // For now, we create pure KF8 like Calibre (smaller, works better)
 func (w *KF8Writer) WriteJointFile(output io.Writer) error {
-	// Save original content
-	originalContent := w.book.Content
-
-	// Create a single PalmDB writer for the joint file
-	palmWriter := mobi.NewPalmDBWriter(w.mobiWriter.GetBookName(), false)
-
-	recordIndex := 0
-
 	// === KF8 SECTION (like Calibre - no MOBI 6 section) ===
 
-	// 1. Prepare KF8 content (with chunking)
-	var kf8Content string
+	// Prepare KF8 content (with chunking)
+	kf8Content := w.book.Content
 	if w.options.EnableChunking {
-		if err := w.skeleton.ChunkHTML(originalContent); err != nil {
+		if err := w.skeleton.ChunkHTML(kf8Content); err != nil {
 			return fmt.Errorf("failed to chunk HTML: %w", err)
 		}
 		w.skeleton.BuildHierarchy()
 		kf8Content = w.skeleton.AssignAIDAttributes()
+	}
 
-		// Generate FDST from skeleton
-		if w.options.GenerateFDST {
-			w.fdst.GenerateFromSkeleton(w.skeleton)
-		}
-	} else {
-		kf8Content = originalContent
+	// Resolve internal links against the chunks
+	primary := w.flowManager.CreateFlow("primary", FlowTypeHTML, kf8Content)
+	w.flowManager.ConvertLinks(w.skeleton)
+
+	return w.writeRecords(output, []string{primary.Content})
+}
+
+// writeRecords writes the PalmDB records of a KF8 book whose text is made
+// of the given flows, the HTML first
+func (w *KF8Writer) writeRecords(output io.Writer, flows []string) error {
+	kf8Content := strings.Join(flows, "")
+
+	// Create a single PalmDB writer for all records
+	palmWriter := mobi.NewPalmDBWriter(w.mobiWriter.GetBookName(), false)
+	if w.options.Deterministic || w.book.Metadata.DocumentID != "" {
+		palmWriter.SetUniqueIDSeed(mobi.BookUniqueID(w.book))
 	}
 
-	// 2. Add KF8 text records FIRST (before images)
-	// Use PalmDOC compression like Calibre
-	kf8TextData := mobi.CompressPalmDOC([]byte(kf8Content))
+	// Reserve record 0 for the header, which is filled in last once the
+	// record layout is known
+	headerRec := palmWriter.ReserveRecord(0, 0)
+	recordIndex := headerRec + 1
 
-	// Remember first text record index (will be record 1 after prepending header)
+	// 2. Add KF8 text records FIRST (before images)
+	// Remember first text record index
 	firstTextRec := recordIndex
 
-	kf8TextRecords := w.splitTextRecords(kf8TextData)
+	// Use PalmDOC compression like Calibre
+	kf8TextRecords := mobi.TextRecords([]byte(kf8Content), true)
 	for _, rec := range kf8TextRecords {
 		palmWriter.AddRecord(rec, 0, uint32(recordIndex))
 		recordIndex++
@@ -238,7 +266,26 @@ func (w *KF8Writer) WriteJointFile(output io.Writer) error {
 
 	lastTextRec := recordIndex - 1
 
-	// 3. Add images AFTER text
+	// Fragment and skeleton indices map the chunks back to their files
+	fragmentRec, skeletonRec := -1, -1
+	if len(w.skeleton.Chunks) > 0 {
+		fragmentRec = recordIndex
+		for _, rec := range index.BuildFragmentIndex(w.skeleton.FragmentIndex()) {
+			palmWriter.AddRecord(rec, 0, uint32(recordIndex))
+			recordIndex++
+		}
+		skeletonRec = recordIndex
+		for _, rec := range index.BuildSkeletonIndex(w.skeleton.SkeletonIndex()) {
+			palmWriter.AddRecord(rec, 0, uint32(recordIndex))
+			recordIndex++
+		}
+	}
+
+	// 3. Add images AFTER text, then a thumbnail of the cover. Cover and
+	// thumbnail are referenced from EXTH relative to the first image.
+	firstImageRec := -1
+	coverOffset, thumbOffset := -1, -1
+	var coverData []byte
 	ids := w.book.GetManifestIDs()
 	for _, id := range ids {
 		res, ok := w.book.GetResource(id)
@@ -246,38 +293,69 @@ func (w *KF8Writer) WriteJointFile(output io.Writer) error {
 			continue
 		}
 		if len(res.MediaType) >= 6 && res.MediaType[0:5] == "image" {
+			if firstImageRec == -1 {
+				firstImageRec = recordIndex
+			}
+			if id == w.book.Metadata.CoverID {
+				coverOffset = recordIndex - firstImageRec
+				coverData = res.Data
+			}
 			palmWriter.AddRecord(res.Data, 0, uint32(recordIndex))
 			recordIndex++
 		}
 	}
+	if coverOffset != -1 {
+		thumbnail := w.book.Metadata.Thumbnail
+		if thumbnail == nil {
+			thumbnail = coverData
+		}
+		thumbOffset = recordIndex - firstImageRec
+		palmWriter.AddRecord(mobi.GenerateThumbnail(thumbnail), 0, uint32(recordIndex))
+		recordIndex++
+	}
+	resources := 0
+	if firstImageRec != -1 {
+		resources = recordIndex - firstImageRec
+	}
 
-	// 4. Add KF8-specific indices (FDST, skeleton, etc.)
-	if w.options.GenerateFDST && w.fdst != nil {
+	// 4. Add KF8-specific indices. The FDST divides the text into flows.
+	fdstRec := -1
+	if w.options.GenerateFDST {
+		w.fdst = NewFDST()
+		offset := uint32(0)
+		for _, flow := range flows {
+			w.fdst.AddEntry(offset, offset+uint32(len(flow)))
+			offset += uint32(len(flow))
+		}
 		var fdstBuf bytes.Buffer
-		if err := w.fdst.Write(&fdstBuf); err == nil {
-			palmWriter.AddRecord(fdstBuf.Bytes(), 0, uint32(recordIndex))
-			recordIndex++
+		if err := w.fdst.Write(&fdstBuf); err != nil {
+			return fmt.Errorf("failed to write FDST: %w", err)
 		}
+		fdstRec = recordIndex
+		palmWriter.AddRecord(fdstBuf.Bytes(), 0, uint32(recordIndex))
+		recordIndex++
 	}
 
+	// 5. Close with the FLIS, FCIS and EOF records
+	flisRec := recordIndex
+	palmWriter.AddRecord(mobi.FLISRecord(), 0, uint32(recordIndex))
+	recordIndex++
+	fcisRec := recordIndex
+	palmWriter.AddRecord(mobi.FCISRecord(uint32(len(kf8Content))), 0, uint32(recordIndex))
+	recordIndex++
+	palmWriter.AddRecord(mobi.EOFRecord(), 0, uint32(recordIndex))
+	recordIndex++
+
 	// === HEADER (written last, like Calibre) ===
-	// Create MOBI 6 header with KF8 flag (RecordSize=0x10000000)
-	// This tells readers to expect KF8 content
+	// setupKF8Header turns the MOBI header into a KF8 one
 
 	mobiHeader := mobi.NewMOBIHeader(len(kf8Content),
 		mobi.CalculateRecordCount(len(kf8Content)))
-	mobiHeader.SetFullName(w.mobiWriter.GetBookName())
-	// Signal KF8 through MOBIType instead of RecordSize
-	// RecordSize field is uint16, can't hold 0x10000000
-	mobiHeader.MOBIType = 248  // 248 = KF8
-	mobiHeader.FileVersion = 8 // KF8 format version
-
-	// Use PalmDOC compression like Calibre
-	mobiHeader.Compression = mobi.PalmDOCCompression // 2 = PalmDOC compression
-
-	// Adjust firstTextRec/lastTextRec for prepended header (+1 offset)
-	mobiHeader.SetContentRecords(uint16(firstTextRec+1), uint16(lastTextRec+1))
-
+	mobiHeader.SetFullName(w.mobiWriter.FullName())
+	mobiHeader.Locale = mobi.LocaleCode(w.book.Metadata.Language)
+	if w.options.Deterministic || w.book.Metadata.DocumentID != "" {
+		mobiHeader.UniqueID = mobi.BookUniqueID(w.book)
+	}
 	// Create EXTH header with metadata (like Calibre)
 	exthWriter := mobi.NewEXTHWriter()
 	authors := make([]string, 0)
@@ -290,53 +368,49 @@ func (w *KF8Writer) WriteJointFile(output io.Writer) error {
 		w.book.Metadata.Publisher,
 		w.book.Metadata.ISBN,
 		w.book.Metadata.Year,
-		w.book.Metadata.Annotation,
+		mobi.TruncateDescription(w.book.Metadata.Annotation, w.options.MaxDescriptionLength),
 		w.book.Metadata.Rights,
 		w.book.Metadata.Language,
 	)
-
-	// Set EXTH flag BEFORE writing header
-	mobiHeader.SetEXTHFlags(0x50) // Has EXTH header (like mobi writer)
-
-	// Encode MOBI header
-	var headerBuf bytes.Buffer
-	if err := mobiHeader.Write(&headerBuf); err != nil {
-		return fmt.Errorf("failed to write MOBI header: %w", err)
+	for _, translator := range w.book.Metadata.Translator {
+		exthWriter.AddContributor(translator.FullName)
 	}
-
-	// Write EXTH after MOBI header
-	exthData := bytes.NewBuffer(nil)
-	if _, err := exthWriter.Write(exthData); err != nil {
-		return fmt.Errorf("failed to write EXTH: %w", err)
+	if w.options.FixedLayout {
+		mobi.AddFixedLayoutEXTH(exthWriter, w.book)
+	}
+	if coverOffset != -1 {
+		exthWriter.AddCoverOffset(uint32(coverOffset))
+		exthWriter.AddThumbnailOffset(uint32(thumbOffset))
+		exthWriter.AddHasFakeCover(0)
 	}
-	headerBuf.Write(exthData.Bytes())
-
-	// Get all records and prepend header
-	allRecords := palmWriter.GetRecords()
-	allRecordEntries := palmWriter.GetRecordEntries()
-
-	// Create new record list with header at the beginning
-	newRecords := make([][]byte, 0, len(allRecords)+1)
-	newRecordEntries := make([]mobi.RecordIndexEntry, 0, len(allRecordEntries)+1)
 
-	// Add header as record 0
-	newRecords = append(newRecords, headerBuf.Bytes())
-	newRecordEntries = append(newRecordEntries, mobi.RecordIndexEntry{
-		Attributes: 0,
-		UniqueID:   0,
+	w.setupKF8Header(mobiHeader, exthWriter, recordLayout{
+		firstText:  firstTextRec,
+		lastText:   lastTextRec,
+		firstImage: firstImageRec,
+		fragment:   fragmentRec,
+		skeleton:   skeletonRec,
+		resources:  resources,
+		fdst:       fdstRec,
+		flows:      len(flows),
+		flis:       flisRec,
+		fcis:       fcisRec,
 	})
 
-	// Add all other records with adjusted unique IDs
-	for i, rec := range allRecords {
-		newRecords = append(newRecords, rec)
-		newRecordEntries = append(newRecordEntries, mobi.RecordIndexEntry{
-			Attributes: allRecordEntries[i].Attributes,
-			UniqueID:   uint32(i + 1),
-		})
+	// Set EXTH flag BEFORE writing header, only if records will be written
+	if exthWriter.GetRecordCount() > 0 {
+		mobiHeader.SetEXTHFlags(0x50) // Has EXTH header (like mobi writer)
+	} else {
+		mobiHeader.SetEXTHFlags(0)
+	}
+
+	// Encode MOBI header, EXTH and full name
+	record0, err := mobiHeader.Record0(exthWriter, w.mobiWriter.FullName())
+	if err != nil {
+		return fmt.Errorf("failed to write MOBI header: %w", err)
 	}
 
-	// Set the records back to PalmDBWriter
-	palmWriter.SetRecords(newRecords, newRecordEntries)
+	palmWriter.SetRecord(headerRec, record0)
 
 	// Write the complete PalmDB
 	if err := palmWriter.Write(output); err != nil {
@@ -346,20 +420,6 @@ func (w *KF8Writer) WriteJointFile(output io.Writer) error {
 	return nil
 }
 
-// splitTextRecords splits text into 4KB records
-func (w *KF8Writer) splitTextRecords(data []byte) [][]byte {
-	var records [][]byte
-	const recordSize = 4096
-	for i := 0; i < len(data); i += recordSize {
-		end := i + recordSize
-		if end > len(data) {
-			end = len(data)
-		}
-		records = append(records, data[i:end])
-	}
-	return records
-}
-
 // GenerateResourceLinks generates Kindle resource links for all manifest resources
 func (w *KF8Writer) GenerateResourceLinks() map[string]string {
 	links := make(map[string]string)
@@ -0,0 +1,176 @@
+package kf8
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/htol/fb2c/mobi"
+	"github.com/htol/fb2c/opf"
+)
+
+// palmRecords splits a PalmDB file into its records
+func palmRecords(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	n := int(binary.BigEndian.Uint16(data[76:78]))
+	records := make([][]byte, n)
+	for i := range n {
+		start := binary.BigEndian.Uint32(data[78+8*i:])
+		end := uint32(len(data))
+		if i+1 < n {
+			end = binary.BigEndian.Uint32(data[78+8*(i+1):])
+		}
+		records[i] = data[start:end]
+	}
+	return records
+}
+
+func TestKF8SkeletonAndFragmentIndex(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata = opf.Metadata{Title: "Chunked", Language: "en"}
+	var content strings.Builder
+	content.WriteString("<html><body>")
+	for i := range 200 {
+		fmt.Fprintf(&content, "<p>Paragraph %d with some text to fill the chunks.</p>", i)
+	}
+	content.WriteString("</body></html>")
+	book.Content = content.String()
+
+	writer := NewKF8Writer(book)
+	var output bytes.Buffer
+	if err := writer.Write(&output); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	chunks := len(writer.GetSkeleton().Chunks)
+	if chunks < 2 {
+		t.Fatalf("content was split into %d chunks, want several", chunks)
+	}
+
+	records := palmRecords(t, output.Bytes())
+	record0 := records[0]
+	for _, index := range []struct {
+		name    string
+		offset  int
+		entries int
+	}{
+		{"fragment", 0xF8, chunks},
+		{"skeleton", 0xFC, len(writer.GetSkeleton().SkeletonIndex())},
+	} {
+		i := int(binary.BigEndian.Uint32(record0[index.offset:]))
+		if i >= len(records) || string(records[i][:4]) != "INDX" {
+			t.Errorf("%s index %#x doesn't point at an INDX record", index.name, i)
+			continue
+		}
+		if got := int(binary.BigEndian.Uint32(records[i][36:])); got != index.entries {
+			t.Errorf("%s index has %d entries, want %d", index.name, got, index.entries)
+		}
+	}
+
+	// Chunks describe the text they were written to
+	var text strings.Builder
+	for _, chunk := range writer.GetSkeleton().Chunks {
+		if chunk.Offset != text.Len() {
+			t.Errorf("chunk %d at offset %d, want %d", chunk.ID, chunk.Offset, text.Len())
+		}
+		text.WriteString(chunk.Content)
+	}
+	if !strings.Contains(text.String(), `aid="0"`) {
+		t.Error("chunk content has no aid attributes")
+	}
+}
+
+func TestConvertLinksAcrossChunks(t *testing.T) {
+	filler := strings.Repeat("<p>Filler text that pushes the target into a later chunk.</p>", 200)
+	html := `<html><body><p id="start">Start <a href="#end">to end</a></p>` + filler +
+		`<p id="end">End <a href="#start">to start</a> <a href="http://example.com/#x">out</a> <a href="#missing">gone</a></p></body></html>`
+
+	skeleton := NewSkeleton()
+	if err := skeleton.ChunkHTML(html); err != nil {
+		t.Fatalf("ChunkHTML() failed: %v", err)
+	}
+	content := skeleton.AssignAIDAttributes()
+
+	fm := NewFlowManager()
+	flow := fm.CreateFlow("primary", FlowTypeHTML, content)
+	fm.ConvertLinks(skeleton)
+	converted := flow.Content
+
+	// Chunks still tile the converted text
+	var text strings.Builder
+	for _, chunk := range skeleton.Chunks {
+		if chunk.Offset != text.Len() {
+			t.Fatalf("chunk %d at offset %d, want %d", chunk.ID, chunk.Offset, text.Len())
+		}
+		text.WriteString(chunk.Content)
+	}
+	if text.String() != converted {
+		t.Fatal("chunk content doesn't match the converted text")
+	}
+
+	for _, id := range []string{"start", "end"} {
+		offset := strings.LastIndex(converted[:strings.Index(converted, ` id="`+id+`"`)], "<")
+		chunk, ok := skeleton.GetChunkByOffset(offset)
+		if !ok {
+			t.Fatalf("no chunk holds #%s", id)
+		}
+		want := `href="` + kindlePos(chunk.ID, offset-chunk.Offset) + `"`
+		if !strings.Contains(converted, want) {
+			t.Errorf("link to #%s isn't %s", id, want)
+		}
+		if id == "end" && chunk.ID == 0 {
+			t.Error("both targets are in the first chunk")
+		}
+	}
+
+	for _, kept := range []string{`href="http://example.com/#x"`, `href="#missing"`} {
+		if !strings.Contains(converted, kept) {
+			t.Errorf("converted HTML lost %s", kept)
+		}
+	}
+}
+
+func TestKindlePos(t *testing.T) {
+	if got, want := kindlePos(1, 40), "kindle:pos:fid:0001:off:0000000018"; got != want {
+		t.Errorf("kindlePos(1, 40) = %q, want %q", got, want)
+	}
+}
+
+func TestWriteJointFileHeaderByteIdentical(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata = opf.Metadata{Title: "Joint", Language: "en"}
+	book.Content = "<html><body><h1>One</h1><p>" + strings.Repeat("Some text. ", 1000) + "</p></body></html>"
+	book.AddResource("pic.png", "pic.png", "image/png", []byte("\x89PNG fake image"))
+
+	writer := NewKF8Writer(book)
+	options := DefaultKF8WriteOptions()
+	options.Deterministic = true
+	writer.SetOptions(options)
+	var output bytes.Buffer
+	if err := writer.WriteJointFile(&output); err != nil {
+		t.Fatalf("WriteJointFile() error = %v", err)
+	}
+
+	// Rebuild the file the way the joint writer used to: the records
+	// after the header on their own, then copied behind the header with
+	// renumbered unique IDs
+	records := palmRecords(t, output.Bytes())
+	rebuilt := mobi.NewPalmDBWriter(writer.mobiWriter.GetBookName(), false)
+	rebuilt.SetUniqueIDSeed(mobi.BookUniqueID(book))
+	newRecords := [][]byte{records[0]}
+	newEntries := []mobi.RecordIndexEntry{{}}
+	for i, rec := range records[1:] {
+		newRecords = append(newRecords, rec)
+		newEntries = append(newEntries, mobi.RecordIndexEntry{UniqueID: uint32(i + 1)})
+	}
+	rebuilt.SetRecords(newRecords, newEntries)
+
+	var want bytes.Buffer
+	if err := rebuilt.Write(&want); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if !bytes.Equal(output.Bytes(), want.Bytes()) {
+		t.Error("joint file differs from one with the header prepended to the record list")
+	}
+}
@@ -0,0 +1,55 @@
+package mobi
+
+import "strings"
+
+// MOBI locales are Windows language identifiers: the primary language in
+// the low 10 bits and the sublanguage (region) above them.
+
+// localeLanguages maps ISO 639-1 codes to primary language identifiers
+var localeLanguages = map[string]uint32{
+	"ar": 0x01, "bg": 0x02, "ca": 0x03, "zh": 0x04, "cs": 0x05,
+	"da": 0x06, "de": 0x07, "el": 0x08, "en": 0x09, "es": 0x0A,
+	"fi": 0x0B, "fr": 0x0C, "he": 0x0D, "hu": 0x0E, "is": 0x0F,
+	"it": 0x10, "ja": 0x11, "ko": 0x12, "nl": 0x13, "no": 0x14,
+	"nb": 0x14, "nn": 0x14, "pl": 0x15, "pt": 0x16, "ro": 0x18,
+	"ru": 0x19, "hr": 0x1A, "sr": 0x1A, "sk": 0x1B, "sq": 0x1C,
+	"sv": 0x1D, "th": 0x1E, "tr": 0x1F, "ur": 0x20, "id": 0x21,
+	"uk": 0x22, "be": 0x23, "sl": 0x24, "et": 0x25, "lv": 0x26,
+	"lt": 0x27, "fa": 0x29, "vi": 0x2A, "hy": 0x2B, "az": 0x2C,
+	"eu": 0x2D, "mk": 0x2F, "af": 0x36, "ka": 0x37, "hi": 0x39,
+	"ms": 0x3E, "kk": 0x3F, "sw": 0x41, "uz": 0x43, "tt": 0x44,
+	"bn": 0x45, "ta": 0x49, "te": 0x4A, "mr": 0x4E, "gl": 0x56,
+}
+
+// localeRegions maps language-region pairs to sublanguage identifiers.
+// Languages given without a region use sublanguage 0 (neutral).
+var localeRegions = map[string]uint32{
+	"ar-sa": 0x01, "ar-eg": 0x03,
+	"de-de": 0x01, "de-ch": 0x02, "de-at": 0x03,
+	"en-us": 0x01, "en-gb": 0x02, "en-au": 0x03, "en-ca": 0x04, "en-nz": 0x05, "en-ie": 0x06,
+	"es-es": 0x03, "es-mx": 0x02, "es-ar": 0x0B,
+	"fr-fr": 0x01, "fr-be": 0x02, "fr-ca": 0x03, "fr-ch": 0x04,
+	"it-it": 0x01, "it-ch": 0x02,
+	"nl-nl": 0x01, "nl-be": 0x02,
+	"pt-br": 0x01, "pt-pt": 0x02,
+	"ru-ru": 0x01, "uk-ua": 0x01, "be-by": 0x01,
+	"sv-se": 0x01, "sv-fi": 0x02,
+	"zh-tw": 0x01, "zh-cn": 0x02, "zh-hk": 0x03, "zh-sg": 0x04,
+}
+
+// LocaleCode returns the MOBI locale for a BCP 47 language tag such as
+// "ru" or "en-US", or 0 when the language is unknown
+func LocaleCode(lang string) uint32 {
+	tag := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"))
+	primary, region, _ := strings.Cut(tag, "-")
+
+	code, ok := localeLanguages[primary]
+	if !ok {
+		return 0
+	}
+	if region != "" {
+		region, _, _ = strings.Cut(region, "-")
+		code |= localeRegions[primary+"-"+region] << 10
+	}
+	return code
+}
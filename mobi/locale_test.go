@@ -0,0 +1,28 @@
+package mobi
+
+import "testing"
+
+func TestLocaleCode(t *testing.T) {
+	tests := []struct {
+		lang string
+		want uint32
+	}{
+		{"ru", 0x19},
+		{"ru-RU", 0x19 | 1<<10},
+		{"en", 0x09},
+		{"en-US", 0x09 | 1<<10},
+		{"en_GB", 0x09 | 2<<10},
+		{"pt-BR", 0x16 | 1<<10},
+		{"de-Latn-CH", 0x07},
+		{"DE", 0x07},
+		{"en-XX", 0x09},
+		{"xx", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		if got := LocaleCode(tt.lang); got != tt.want {
+			t.Errorf("LocaleCode(%q) = %#x, want %#x", tt.lang, got, tt.want)
+		}
+	}
+}
@@ -5,9 +5,13 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math/big"
+	"slices"
 	"strings"
+
+	"github.com/htol/fb2c/opf"
 )
 
 const (
@@ -15,6 +19,14 @@ const (
 	PalmDBHeaderSize = 78
 	PalmDBType       = "BOOK"
 	PalmDBCreator    = "MOBI"
+
+	// PalmDBNameLength is the longest database name, leaving room for the
+	// terminating zero in the 32-byte name field
+	PalmDBNameLength = 31
+
+	// MaxRecords is the most records a PalmDB file can hold, as the
+	// record count is 16-bit. Books that need more can't be written.
+	MaxRecords = 0xFFFF
 )
 
 // PalmDBHeader represents a Palm Database header
@@ -60,13 +72,7 @@ func NewPalmDBHeader(name string, numRecords int) *PalmDBHeader {
 
 	// Transliterate name to ASCII and copy (max 31 chars + null terminator)
 	// PalmDB spec requires ASCII/CP1252 in name field, not UTF-8
-	asciiName := transliterateName(name)
-	copy(h.Name[:], asciiName)
-	if len(asciiName) > 31 {
-		h.Name[31] = 0
-	} else {
-		h.Name[len(asciiName)] = 0
-	}
+	copy(h.Name[:], transliterateName(name))
 
 	// Set type and creator
 	copy(h.Type[:], PalmDBType)
@@ -172,27 +178,46 @@ func generateRandomID() uint32 {
 	return uint32(n.Uint64()) + 1
 }
 
+// BookUniqueID derives a stable non-zero unique ID from the book's FB2
+// document id, or from its title and content when it has none
+func BookUniqueID(book *opf.OEBBook) uint32 {
+	h := fnv.New32a()
+	if book.Metadata.DocumentID != "" {
+		h.Write([]byte(book.Metadata.DocumentID))
+	} else {
+		h.Write([]byte(book.Metadata.Title))
+		h.Write([]byte{0})
+		h.Write([]byte(book.Content))
+	}
+	id := h.Sum32()
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
 // transliterateName converts Cyrillic characters to Latin transliteration
-// This ensures the PalmDB name field contains only ASCII characters as required by the PalmDB spec
+// This ensures the PalmDB name field contains only ASCII characters as required by the PalmDB spec.
+// Control characters, which can't appear in Palm names, are dropped, and
+// the result is cut to PalmDBNameLength.
 func transliterateName(name string) string {
 	result := &strings.Builder{}
 
 	for _, r := range name {
-		if r < 128 {
-			// ASCII - keep as is (but avoid null bytes)
-			if r != 0 {
-				result.WriteRune(r)
-			}
-		} else {
+		switch {
+		case r < 0x20 || r == 0x7F || (r >= 0x80 && r < 0xA0):
+			// Control character
+		case r < 0x80:
+			result.WriteRune(r)
+		default:
 			// Cyrillic - map to Latin approximation
 			result.WriteString(transliterateRune(r))
 		}
 	}
 
 	resultStr := result.String()
-	// Truncate to 31 chars max (for PalmDB name field)
-	if len(resultStr) > 31 {
-		resultStr = resultStr[:31]
+	if len(resultStr) > PalmDBNameLength {
+		resultStr = resultStr[:PalmDBNameLength]
 	}
 
 	return resultStr
@@ -347,6 +372,7 @@ type PalmDBWriter struct {
 	header        *PalmDBHeader
 	records       [][]byte
 	recordEntries []RecordIndexEntry
+	uniqueIDSeed  uint32 // 0 = random
 	debug         bool
 }
 
@@ -369,6 +395,27 @@ func (w *PalmDBWriter) AddRecord(data []byte, attributes uint8, uniqueID uint32)
 	})
 }
 
+// ReserveRecord appends an empty placeholder record and returns its index.
+// The data is filled in later with SetRecord, which lets callers place
+// headers that depend on later records without rebuilding the record list.
+func (w *PalmDBWriter) ReserveRecord(attributes uint8, uniqueID uint32) int {
+	w.AddRecord(nil, attributes, uniqueID)
+	return len(w.records) - 1
+}
+
+// InsertRecord inserts a record before the record at index, shifting the
+// following records up by one. Their unique IDs are left unchanged.
+func (w *PalmDBWriter) InsertRecord(index int, data []byte, attributes uint8, uniqueID uint32) {
+	if index < 0 || index > len(w.records) {
+		return
+	}
+	w.records = slices.Insert(w.records, index, data)
+	w.recordEntries = slices.Insert(w.recordEntries, index, RecordIndexEntry{
+		Attributes: attributes,
+		UniqueID:   uniqueID,
+	})
+}
+
 // SetRecord sets the data for an existing record
 func (w *PalmDBWriter) SetRecord(index int, data []byte) {
 	if index >= 0 && index < len(w.records) {
@@ -378,8 +425,17 @@ func (w *PalmDBWriter) SetRecord(index int, data []byte) {
 
 // Write writes the complete PalmDB file
 func (w *PalmDBWriter) Write(output io.Writer) error {
+	// The record count and the record indices in MOBI headers are 16-bit
+	// and would silently wrap
+	if len(w.records) > MaxRecords {
+		return fmt.Errorf("book needs %d PalmDB records, more than the format limit of %d; reduce the number of images or split the book", len(w.records), MaxRecords)
+	}
+
 	// Update header with actual record count
 	w.header = NewPalmDBHeader(w.name, len(w.records))
+	if w.uniqueIDSeed != 0 {
+		w.header.UniqueIDSeed = w.uniqueIDSeed
+	}
 
 	// Calculate record offsets (header + index + offset after them)
 	dataOffset := PalmDBHeaderSize + (len(w.recordEntries) * 8)
@@ -410,17 +466,17 @@ func (w *PalmDBWriter) Write(output io.Writer) error {
 	return nil
 }
 
+// SetUniqueIDSeed sets a fixed unique ID seed instead of a random one
+func (w *PalmDBWriter) SetUniqueIDSeed(seed uint32) {
+	w.uniqueIDSeed = seed
+}
+
 // SetName sets the database name
 func (w *PalmDBWriter) SetName(name string) {
 	if w.header != nil {
 		// Transliterate name to ASCII for PalmDB compatibility
-		asciiName := transliterateName(name)
-		copy(w.header.Name[:], asciiName)
-		if len(asciiName) > 31 {
-			w.header.Name[31] = 0
-		} else {
-			w.header.Name[len(asciiName)] = 0
-		}
+		w.header.Name = [32]byte{}
+		copy(w.header.Name[:], transliterateName(name))
 	}
 }
 
@@ -0,0 +1,124 @@
+package mobi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ReadText returns the text of a MOBI 6 or KF8 book: the content records
+// of record 0's PalmDOC header, stripped of their trailing entries,
+// decompressed and concatenated. For a joint MOBI 6/KF8 file this is the
+// MOBI 6 part. It is meant for reading back books written by this package,
+// so only uncompressed and PalmDOC-compressed, unencrypted text is
+// supported.
+func ReadText(data []byte) (string, error) {
+	records, err := palmDBRecords(data)
+	if err != nil {
+		return "", err
+	}
+
+	record0 := records[0]
+	if len(record0) < 16 {
+		return "", fmt.Errorf("record 0 is too short: %d bytes", len(record0))
+	}
+	compression := binary.BigEndian.Uint16(record0[0x00:])
+	textRecords := int(binary.BigEndian.Uint16(record0[0x08:]))
+	if encryption := binary.BigEndian.Uint16(record0[0x0C:]); encryption != 0 {
+		return "", fmt.Errorf("text is encrypted (type %d)", encryption)
+	}
+	if compression != NoCompression && compression != PalmDOCCompression {
+		return "", fmt.Errorf("unsupported compression type %d", compression)
+	}
+	if textRecords >= len(records) {
+		return "", fmt.Errorf("%d text records declared, file has %d records", textRecords, len(records))
+	}
+
+	// Trailing entries are only declared by MOBI headers long enough to
+	// hold the extra record data flags
+	var extraFlags uint32
+	if len(record0) >= 0xF4 && string(record0[0x10:0x14]) == "MOBI" &&
+		binary.BigEndian.Uint32(record0[0x14:]) >= 0xE4 {
+		extraFlags = binary.BigEndian.Uint32(record0[0xF0:])
+	}
+
+	var text []byte
+	for _, record := range records[1 : textRecords+1] {
+		record = trimTrailingEntries(record, extraFlags)
+		if compression == PalmDOCCompression {
+			record = DecompressPalmDOC(record)
+		}
+		text = append(text, record...)
+	}
+	return string(text), nil
+}
+
+// palmDBRecords splits a PalmDB file into its records using the record
+// list after the 78-byte header
+func palmDBRecords(data []byte) ([][]byte, error) {
+	if len(data) < 78 {
+		return nil, fmt.Errorf("file too short for a PalmDB header: %d bytes", len(data))
+	}
+	if string(data[60:68]) != "BOOKMOBI" {
+		return nil, fmt.Errorf("not a MOBI file: type/creator %q", data[60:68])
+	}
+
+	count := int(binary.BigEndian.Uint16(data[76:]))
+	if count == 0 || 78+8*count > len(data) {
+		return nil, fmt.Errorf("invalid record count %d", count)
+	}
+	offsets := make([]int, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int(binary.BigEndian.Uint32(data[78+8*i:]))
+	}
+	offsets[count] = len(data)
+
+	records := make([][]byte, count)
+	for i := range records {
+		start, end := offsets[i], offsets[i+1]
+		if start > end || end > len(data) {
+			return nil, fmt.Errorf("record %d has invalid offsets %d-%d", i, start, end)
+		}
+		records[i] = data[start:end]
+	}
+	return records, nil
+}
+
+// trimTrailingEntries removes the trailing entries that flags declare
+// from the end of a text record. Each entry for flag bits 1-15 ends with
+// its size as a backward-read variable-width integer; the multibyte entry
+// (bit 0) comes last and its final byte holds the overlap length.
+func trimTrailingEntries(record []byte, flags uint32) []byte {
+	for bit := 15; bit > 0; bit-- {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		size := backwardVarint(record)
+		if size <= 0 || size > len(record) {
+			return record
+		}
+		record = record[:len(record)-size]
+	}
+	if flags&ExtraDataMultibyte != 0 && len(record) > 0 {
+		size := int(record[len(record)-1]&0x3) + 1
+		if size > len(record) {
+			return record[:0]
+		}
+		record = record[:len(record)-size]
+	}
+	return record
+}
+
+// backwardVarint decodes the variable-width integer at the end of data:
+// up to four bytes of seven bits, the first of them marked by the high bit
+func backwardVarint(data []byte) int {
+	value, shift := 0, 0
+	for i := len(data) - 1; i >= 0 && i >= len(data)-4; i-- {
+		b := data[i]
+		value |= int(b&0x7F) << shift
+		shift += 7
+		if b&0x80 != 0 {
+			break
+		}
+	}
+	return value
+}
@@ -0,0 +1,73 @@
+package mobi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/htol/fb2c/opf"
+)
+
+func TestReadText(t *testing.T) {
+	// Long enough for several records, with multibyte characters falling
+	// across record boundaries
+	paragraph := "<p>Съешь же ещё этих мягких французских булок, да выпей чаю.</p>"
+	content := "<html><body><h1>Глава 1</h1>" + strings.Repeat(paragraph, 300) + "</body></html>"
+
+	for _, compression := range []int{PalmDOCCompression, NoCompression} {
+		book := opf.NewOEBBook()
+		book.Metadata = opf.Metadata{Title: "Test Book", Language: "ru"}
+		book.Content = content
+
+		options := DefaultWriteOptions()
+		options.CompressionType = compression
+		var output bytes.Buffer
+		if err := ConvertOEBToMOBIWithOptions(book, &output, options); err != nil {
+			t.Fatalf("ConvertOEBToMOBIWithOptions() error = %v", err)
+		}
+
+		text, err := ReadText(output.Bytes())
+		if err != nil {
+			t.Fatalf("ReadText() error = %v", err)
+		}
+		if !strings.Contains(text, "Глава 1") {
+			t.Errorf("compression %d: text has no chapter title", compression)
+		}
+		if got := strings.Count(text, paragraph); got != 300 {
+			t.Errorf("compression %d: text has %d intact paragraphs, want 300", compression, got)
+		}
+	}
+}
+
+func TestReadTextErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "too short"},
+		{"not MOBI", make([]byte, 100), "not a MOBI file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadText(tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ReadText() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimTrailingEntries(t *testing.T) {
+	text := []byte("text")
+	// A multibyte entry of two bytes, then an entry for flag bit 1 whose
+	// size byte (high bit set, size 3) counts itself
+	record := append(append([]byte{}, text...), 0xA0, 0xB0, 2, 'x', 'y', 0x83)
+
+	if got := trimTrailingEntries(record, ExtraDataMultibyte|0x2); !bytes.Equal(got, text) {
+		t.Errorf("trimTrailingEntries() = %q, want %q", got, text)
+	}
+	if got := trimTrailingEntries(text, 0); !bytes.Equal(got, text) {
+		t.Errorf("trimTrailingEntries() without flags = %q, want %q", got, text)
+	}
+}
@@ -0,0 +1,48 @@
+package mobi
+
+import "encoding/binary"
+
+// FLIS, FCIS and end-of-file records close the record list of a MOBI
+// file. Their content is fixed apart from the text size in FCIS, but some
+// Kindle firmware relies on them for last-read position and progress.
+
+// FLISRecord returns a standard FLIS record (36 bytes)
+func FLISRecord() []byte {
+	data := make([]byte, 36)
+	copy(data, "FLIS")
+	binary.BigEndian.PutUint32(data[4:8], 8)
+	binary.BigEndian.PutUint16(data[8:10], 65)
+	binary.BigEndian.PutUint16(data[10:12], 0)
+	binary.BigEndian.PutUint32(data[12:16], 0)
+	binary.BigEndian.PutUint32(data[16:20], 0xFFFFFFFF)
+	binary.BigEndian.PutUint16(data[20:22], 1)
+	binary.BigEndian.PutUint16(data[22:24], 3)
+	binary.BigEndian.PutUint32(data[24:28], 3)
+	binary.BigEndian.PutUint32(data[28:32], 1)
+	binary.BigEndian.PutUint32(data[32:36], 0xFFFFFFFF)
+	return data
+}
+
+// FCISRecord returns a standard FCIS record (44 bytes) for the given
+// uncompressed text size
+func FCISRecord(textSize uint32) []byte {
+	data := make([]byte, 44)
+	copy(data, "FCIS")
+	binary.BigEndian.PutUint32(data[4:8], 20)
+	binary.BigEndian.PutUint32(data[8:12], 16)
+	binary.BigEndian.PutUint32(data[12:16], 1)
+	binary.BigEndian.PutUint32(data[16:20], 0)
+	binary.BigEndian.PutUint32(data[20:24], textSize)
+	binary.BigEndian.PutUint32(data[24:28], 0)
+	binary.BigEndian.PutUint32(data[28:32], 32)
+	binary.BigEndian.PutUint32(data[32:36], 8)
+	binary.BigEndian.PutUint16(data[36:38], 1)
+	binary.BigEndian.PutUint16(data[38:40], 1)
+	binary.BigEndian.PutUint32(data[40:44], 0)
+	return data
+}
+
+// EOFRecord returns the end-of-file record (4 zero bytes)
+func EOFRecord() []byte {
+	return make([]byte, 4)
+}
@@ -0,0 +1,79 @@
+package mobi
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// Decoders for the cover formats found in FB2 files
+	_ "image/gif"
+	_ "image/png"
+)
+
+// ThumbnailHeight is the height of generated cover thumbnails, the size
+// Kindle library views display
+const ThumbnailHeight = 330
+
+// GenerateThumbnail returns a JPEG copy of a cover image scaled down to
+// ThumbnailHeight pixels high. Images that are already that small are
+// returned as is, as are images that can't be decoded, so the library
+// view shows something either way.
+func GenerateThumbnail(cover []byte) []byte {
+	src, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		return cover
+	}
+	bounds := src.Bounds()
+	if bounds.Dy() <= ThumbnailHeight {
+		return cover
+	}
+
+	height := ThumbnailHeight
+	width := bounds.Dx() * height / bounds.Dy()
+	if width < 1 {
+		width = 1
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, width, height), &jpeg.Options{Quality: 80}); err != nil {
+		return cover
+	}
+	return buf.Bytes()
+}
+
+// scaleDown resizes an image to width x height by averaging the source
+// pixels that fall into each destination pixel (box filter)
+func scaleDown(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
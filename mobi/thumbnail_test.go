@@ -0,0 +1,39 @@
+package mobi
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestGenerateThumbnail(t *testing.T) {
+	encode := func(width, height int) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+			t.Fatalf("png.Encode() error = %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	small := encode(100, 150)
+	if got := GenerateThumbnail(small); !bytes.Equal(got, small) {
+		t.Error("GenerateThumbnail() changed an image already below thumbnail size")
+	}
+
+	junk := []byte("not an image")
+	if got := GenerateThumbnail(junk); !bytes.Equal(got, junk) {
+		t.Error("GenerateThumbnail() didn't return undecodable data as is")
+	}
+
+	thumb, format, err := image.Decode(bytes.NewReader(GenerateThumbnail(encode(1000, 1500))))
+	if err != nil {
+		t.Fatalf("thumbnail doesn't decode: %v", err)
+	}
+	if format != "jpeg" {
+		t.Errorf("thumbnail format = %s, want jpeg", format)
+	}
+	if got := thumb.Bounds(); got.Dx() != 220 || got.Dy() != ThumbnailHeight {
+		t.Errorf("thumbnail size = %dx%d, want 220x%d", got.Dx(), got.Dy(), ThumbnailHeight)
+	}
+}
@@ -2,13 +2,12 @@
 package mobi
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"regexp"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/htol/fb2c/mobi/index"
 	"github.com/htol/fb2c/opf"
@@ -16,20 +15,29 @@ import (
 
 // WriteOptions contains options for writing MOBI files
 type WriteOptions struct {
-	CompressionType int // NoCompression=1, PalmDOCCompression=2, HuffCDCompression=17480
-	WithEXTH        bool
-	Title           string
-	CoverImage      []byte
-	GenerateTOC     bool
-	debug           bool
+	CompressionType      int // NoCompression=1, PalmDOCCompression=2, HuffCDCompression=17480
+	WithEXTH             bool
+	Title                string
+	CoverImage           []byte
+	ThumbnailImage       []byte // Used instead of a copy of the cover when set
+	GenerateTOC          bool
+	Deterministic        bool // Derive unique IDs from the book instead of random values
+	FixedLayout          bool // Mark the book as fixed-layout (KF8 only)
+	MaxDescriptionLength int  // Cap for the EXTH description in characters (0 = no cap)
+	debug                bool
+
+	// DatabaseName is the PalmDB name, used instead of the title when set.
+	// Either way it is made ASCII and cut to PalmDBNameLength bytes.
+	DatabaseName string
 }
 
 // DefaultWriteOptions returns default write options
 func DefaultWriteOptions() WriteOptions {
 	return WriteOptions{
-		CompressionType: NoCompression,
-		WithEXTH:        true,
-		GenerateTOC:     true,
+		CompressionType:      NoCompression,
+		WithEXTH:             true,
+		GenerateTOC:          true,
+		MaxDescriptionLength: DefaultMaxDescriptionLength,
 	}
 }
 
@@ -52,123 +60,78 @@ func (w *Writer) SetOptions(options WriteOptions) {
 	w.options = options
 }
 
-// GetBookName returns the book name for the database
+// GetBookName returns the book name for the database: DatabaseName or
+// the full name, transliterated to ASCII and cut to PalmDBNameLength bytes
 func (w *Writer) GetBookName() string {
-	name := w.options.Title
+	name := w.options.DatabaseName
 	if name == "" {
-		name = w.book.Metadata.Title
+		name = w.FullName()
 	}
-	if len(name) > 31 {
-		name = name[:31]
+	return transliterateName(name)
+}
+
+// FullName returns the full book name written to record 0, which unlike
+// the database name isn't truncated
+func (w *Writer) FullName() string {
+	if w.options.Title != "" {
+		return w.options.Title
 	}
-	return name
+	return w.book.Metadata.Title
 }
 
 // Write writes the MOBI file
 func (w *Writer) Write(output io.Writer) error {
-	// 1. Resolve image sources and calculate final text size
-	// We do this in two passes to get absolute record indices
-	hasTOC := w.options.GenerateTOC && len(w.book.TOC.Children) > 0
-
-	// Pass 1: Dummy resolution to get final text size
-	dummyContent := w.resolveImageSources(w.book.Content, 0)
-	textRecordCount := (len(dummyContent) + 4095) / 4096
-	// firstImageRecord is 0-based absolute index: Header (0) + TextRecords + TOC (optional)
-	firstImageRecord := 1 + textRecordCount
-	if hasTOC {
-		firstImageRecord++
-	}
-
-	// Pass 2: Final resolution with relative indices (1st image = 1)
-	resolvedContent := w.resolveImageSources(w.book.Content, 0)
+	// 1. Resolve image sources and calculate final text size. Image
+	// references are relative to FirstImageIndex (1st image = 1), so they
+	// don't depend on the number of text records.
+	resolvedContent := resolveInternalLinks(w.resolveImageSources(w.book.Content))
 	textData := []byte(resolvedContent)
 
 	uncompressedSize := len(textData)
 
 	// Split and compress records
 	// PalmDOC requires comperssing 4096-byte chunks of UNCOMPRESSED text
-	var textRecords [][]byte
-	const recordSize = 4096
-
-	for i := 0; i < len(textData); i += recordSize {
-		end := i + recordSize
-		if end > len(textData) {
-			end = len(textData)
-		}
-
-		chunk := textData[i:end]
-
-		if w.options.CompressionType == PalmDOCCompression {
-			// Compress individual chunk
-			compressed := compressRecord(chunk)
-			textRecords = append(textRecords, compressed)
-		} else {
-			textRecords = append(textRecords, chunk)
-		}
-	}
-
-	palmWriter := NewPalmDBWriter(w.getBookName(), w.options.debug)
-
-	// Calculate record information before creating header
-	// Record count is exact number of records we generated
-	recordCount := len(textRecords)
-
-	recordIndex := 0
-	firstTextRecord := 1 // After MOBI header record 0
-	lastTextRecord := firstTextRecord + recordCount - 1
+	textRecords := TextRecords(textData, w.options.CompressionType == PalmDOCCompression)
 
-	// Calculate first image index (after text records)
-	// If cover exists, it will be at firstTextRecord + recordCount
-	// Otherwise, it's after all text records
-	hasCover := w.options.CoverImage != nil
-	hasImages := w.book.HasImages()
-	firstImageIndex := uint32(0xFFFFFFFF)   // Default: no images
-	firstNonBookIndex := uint32(0xFFFFFFFF) // Default: no non-book records
-
-	if hasCover || hasImages {
-		firstImageIndex = uint32(firstTextRecord + recordCount)
-		firstNonBookIndex = uint32(firstTextRecord + recordCount)
-	}
-
-	// Create MOBI header with correct record indices
-	// Use uncompressedSize for header
-	mobiHeaderRecord, err := w.createMOBIHeaderRecord(uncompressedSize, firstTextRecord, lastTextRecord, firstImageIndex, firstNonBookIndex)
-	if err != nil {
-		return fmt.Errorf("failed to create MOBI header: %w", err)
+	palmWriter := NewPalmDBWriter(w.GetBookName(), w.options.debug)
+	if w.options.Deterministic || w.book.Metadata.DocumentID != "" {
+		palmWriter.SetUniqueIDSeed(BookUniqueID(w.book))
 	}
 
-	palmWriter.AddRecord(mobiHeaderRecord, 0, uint32(recordIndex))
-	recordIndex++
+	// Reserve record 0 for the header, which is built last once the
+	// record layout is known
+	headerRec := palmWriter.ReserveRecord(0, 0)
+	recordIndex := headerRec + 1
 
 	// 2. Add text records
+	firstTextRecord := recordIndex
 	for _, rec := range textRecords {
 		palmWriter.AddRecord(rec, 0, uint32(recordIndex))
 		recordIndex++
 	}
 
+	// Everything after the text is non-book: indices, images and the
+	// structural records
+	firstNonBookIndex := uint32(recordIndex)
+
 	// 3. Add TOC Index Record (NCX) - Standard place is after text
 	var tocIndexOffset uint32 = 0xFFFFFFFF
 	if w.options.GenerateTOC && len(w.book.TOC.Children) > 0 {
 		// Use resolvedContent for accurate TOC offset calculation
-		tocINDX, err := w.GenerateTOCIndex(resolvedContent, textRecords)
+		indxRecords, err := w.GenerateTOCIndex(resolvedContent, textRecords)
 		if err != nil {
 			return fmt.Errorf("failed to generate TOC index: %w", err)
 		}
 
-		indxData, err := tocINDX.Encode()
-		if err != nil {
-			return fmt.Errorf("failed to encode TOC INDX: %w", err)
-		}
-
 		tocIndexOffset = uint32(recordIndex)
-		palmWriter.AddRecord(indxData, 0, tocIndexOffset)
-		recordIndex++
+		for _, rec := range indxRecords {
+			palmWriter.AddRecord(rec, 0, uint32(recordIndex))
+			recordIndex++
+		}
 	}
 
 	// 4. Add Images in consistent order: Cover -> Thumbnail -> Manifest
-
-	// 4. Add Images in consistent order: Cover -> Thumbnail -> Manifest
-	firstImageIndex = uint32(0xFFFFFFFF)
+	firstImageIndex := uint32(0xFFFFFFFF)
 	coverID := w.book.Metadata.CoverID
 
 	if w.options.CoverImage != nil || w.book.HasImages() {
@@ -181,7 +144,11 @@ func (w *Writer) Write(output io.Writer) error {
 			recordIndex++
 
 			// 2. Add thumbnail immediately after cover
-			thumbnailData := w.generateThumbnail(w.options.CoverImage)
+			thumbnailData := w.options.ThumbnailImage
+			if thumbnailData == nil {
+				thumbnailData = w.options.CoverImage
+			}
+			thumbnailData = w.generateThumbnail(thumbnailData)
 			if thumbnailData != nil {
 				thumbnailRecord := w.createImageRecord(thumbnailData, "thumb.jpg")
 				palmWriter.AddRecord(thumbnailRecord, 0, uint32(recordIndex))
@@ -198,27 +165,27 @@ func (w *Writer) Write(output io.Writer) error {
 
 	// 5. Add Mandatory Structural Records (FLIS, FCIS, EOF)
 	flisIndex := uint32(recordIndex)
-	palmWriter.AddRecord(createFLISRecord(), 0, flisIndex)
+	palmWriter.AddRecord(FLISRecord(), 0, flisIndex)
 	recordIndex++
 
 	fcisIndex := uint32(recordIndex)
-	palmWriter.AddRecord(createFCISRecord(uint32(uncompressedSize)), 0, fcisIndex)
+	palmWriter.AddRecord(FCISRecord(uint32(uncompressedSize)), 0, fcisIndex)
 	recordIndex++
 
-	// EOF record (4 zero bytes)
-	palmWriter.AddRecord([]byte{0x00, 0x00, 0x00, 0x00}, 0, uint32(recordIndex))
+	// EOF record
+	palmWriter.AddRecord(EOFRecord(), 0, uint32(recordIndex))
 	recordIndex++
 
-	// Refactoring createMOBIHeaderRecord call to include FLIS/FCIS/INDX
-	mobiHeaderRecord, err = w.createMOBIHeaderRecordExtended(uncompressedSize,
-		recordCount, // Valid text record count for Record 0
+	// 6. Fill in the header now that the record layout is known
+	mobiHeaderRecord, err := w.createMOBIHeaderRecordExtended(uncompressedSize,
+		len(textRecords), // Valid text record count for Record 0
 		firstTextRecord, int(lastContentRec),
 		firstImageIndex, firstNonBookIndex,
 		flisIndex, fcisIndex, tocIndexOffset)
 	if err != nil {
-		return fmt.Errorf("failed to create extended MOBI header: %w", err)
+		return fmt.Errorf("failed to create MOBI header: %w", err)
 	}
-	palmWriter.SetRecord(0, mobiHeaderRecord)
+	palmWriter.SetRecord(headerRec, mobiHeaderRecord)
 
 	if err := palmWriter.Write(output); err != nil {
 		return fmt.Errorf("failed to write PalmDB: %w", err)
@@ -227,18 +194,6 @@ func (w *Writer) Write(output io.Writer) error {
 	return nil
 }
 
-// getBookName returns the book name for the database
-func (w *Writer) getBookName() string {
-	name := w.options.Title
-	if name == "" {
-		name = w.book.Metadata.Title
-	}
-	if len(name) > 31 {
-		name = name[:31]
-	}
-	return name
-}
-
 // createMOBIHeaderRecord creates the MOBI header record
 func (w *Writer) createMOBIHeaderRecord(textSize int, firstTextRec, lastTextRec int, firstImageIndex, firstNonBookIndex uint32) ([]byte, error) {
 	// Wrapper to maintain backward compatibility if needed, but we'll use Extended internally
@@ -249,11 +204,12 @@ func (w *Writer) createMOBIHeaderRecord(textSize int, firstTextRec, lastTextRec
 
 // createMOBIHeaderRecordExtended is an extended version that includes mandatory indices
 func (w *Writer) createMOBIHeaderRecordExtended(textSize int, textRecordCount int, firstTextRec, lastTextRec int, firstImageIndex, firstNonBookIndex, flisIndex, fcisIndex, indxOffset uint32) ([]byte, error) {
-	var buf bytes.Buffer
-
 	// Create MOBI header with REAL text record count (Record 0)
 	// This ensures the reader stops DECODING text before it hits binary images.
 	mobiHeader := NewMOBIHeader(textSize, textRecordCount)
+	if w.options.Deterministic || w.book.Metadata.DocumentID != "" {
+		mobiHeader.UniqueID = BookUniqueID(w.book)
+	}
 
 	// Set content record indices
 	mobiHeader.FirstContentRec = uint16(firstTextRec)
@@ -261,8 +217,8 @@ func (w *Writer) createMOBIHeaderRecordExtended(textSize int, textRecordCount in
 
 	// Set header flags for UTF-8 and structure
 	mobiHeader.TextEncoding = UTF8Encoding
-	mobiHeader.Locale = 1049        // Russian (Language 25 + Sublanguage 1<<10)
-	mobiHeader.ExtraRecordFlags = 0 // Disable trailers for simplicity and compatibility
+	mobiHeader.Locale = LocaleCode(w.book.Metadata.Language)
+	mobiHeader.ExtraRecordFlags = ExtraDataMultibyte // See TextRecords
 
 	// Set mandatory structural indices
 	mobiHeader.FCISIndex = fcisIndex
@@ -277,12 +233,13 @@ func (w *Writer) createMOBIHeaderRecordExtended(textSize int, textRecordCount in
 	mobiHeader.FirstNonBookIndex = firstNonBookIndex
 
 	// Set title
-	bookName := w.getBookName()
+	bookName := w.FullName()
 	mobiHeader.SetFullName(bookName)
 
-	// Create EXTH header
+	// Create EXTH header. Record0 sets the EXTH flag only when records are
+	// actually written.
+	exthWriter := NewEXTHWriter()
 	if w.options.WithEXTH {
-		exthWriter := NewEXTHWriter()
 		authors := make([]string, 0)
 		for _, author := range w.book.Metadata.Authors {
 			authors = append(authors, author.FullName)
@@ -294,10 +251,17 @@ func (w *Writer) createMOBIHeaderRecordExtended(textSize int, textRecordCount in
 			w.book.Metadata.Publisher,
 			w.book.Metadata.ISBN,
 			w.book.Metadata.Year,
-			w.book.Metadata.Annotation,
+			TruncateDescription(w.book.Metadata.Annotation, w.options.MaxDescriptionLength),
 			w.book.Metadata.Rights,
 			w.book.Metadata.Language,
 		)
+		for _, translator := range w.book.Metadata.Translator {
+			exthWriter.AddContributor(translator.FullName)
+		}
+
+		if w.options.FixedLayout {
+			AddFixedLayoutEXTH(exthWriter, w.book)
+		}
 
 		if w.options.CoverImage != nil {
 			exthWriter.AddCoverOffset(0)
@@ -306,27 +270,18 @@ func (w *Writer) createMOBIHeaderRecordExtended(textSize int, textRecordCount in
 			exthWriter.AddK8CoverImage("kindle:embed:0001")
 			mobiHeader.EXTHFlags = mobiHeader.EXTHFlags | 0x10
 		}
+	}
 
-		exthLength := exthWriter.GetTotalLength()
-		mobiHeader.FullNameOffset = uint32(248 + exthLength)
-
-		if err := mobiHeader.Write(&buf); err != nil {
-			return nil, err
-		}
+	return mobiHeader.Record0(exthWriter, bookName)
+}
 
-		if _, err := exthWriter.Write(&buf); err != nil {
-			return nil, fmt.Errorf("failed to write EXTH: %w", err)
-		}
-		buf.WriteString(bookName)
-	} else {
-		mobiHeader.FullNameOffset = 248
-		if err := mobiHeader.Write(&buf); err != nil {
-			return nil, err
-		}
-		buf.WriteString(bookName)
+// AddFixedLayoutEXTH adds the fixed-layout records, using the largest
+// image as the original page resolution
+func AddFixedLayoutEXTH(exthWriter *EXTHWriter, book *opf.OEBBook) {
+	exthWriter.AddFixedLayout()
+	if width, height := book.MaxImageSize(); width > 0 && height > 0 {
+		exthWriter.AddOriginalResolution(width, height)
 	}
-
-	return buf.Bytes(), nil
 }
 
 // addImagesFiltered adds images from manifest, skipping the cover if provided
@@ -348,73 +303,78 @@ func (w *Writer) addImagesFiltered(palmWriter *PalmDBWriter, recordIndex *int, s
 	}
 }
 
-// createFLISRecord creates a standard FLIS record (36 bytes)
-func createFLISRecord() []byte {
-	data := make([]byte, 36)
-	copy(data, "FLIS")
-	binary.BigEndian.PutUint32(data[4:8], 8)
-	binary.BigEndian.PutUint16(data[8:10], 65)
-	binary.BigEndian.PutUint16(data[10:12], 0)
-	binary.BigEndian.PutUint32(data[12:16], 0)
-	binary.BigEndian.PutUint32(data[16:20], 0xFFFFFFFF)
-	binary.BigEndian.PutUint16(data[20:22], 1)
-	binary.BigEndian.PutUint16(data[22:24], 3)
-	binary.BigEndian.PutUint32(data[24:28], 3)
-	binary.BigEndian.PutUint32(data[28:32], 1)
-	binary.BigEndian.PutUint32(data[32:36], 0xFFFFFFFF)
-	return data
-}
-
-// createFCISRecord creates a standard FCIS record (44 bytes) for text size
-func createFCISRecord(textSize uint32) []byte {
-	data := make([]byte, 44)
-	copy(data, "FCIS")
-	binary.BigEndian.PutUint32(data[4:8], 20)
-	binary.BigEndian.PutUint32(data[8:12], 16)
-	binary.BigEndian.PutUint32(data[12:16], 1)
-	binary.BigEndian.PutUint32(data[16:20], 0)
-	binary.BigEndian.PutUint32(data[20:24], textSize)
-	binary.BigEndian.PutUint32(data[24:28], 0)
-	binary.BigEndian.PutUint32(data[28:32], 32)
-	binary.BigEndian.PutUint32(data[32:36], 8)
-	binary.BigEndian.PutUint16(data[36:38], 1)
-	binary.BigEndian.PutUint16(data[38:40], 1)
-	binary.BigEndian.PutUint32(data[40:44], 0)
-	return data
-}
-
-// splitTextRecords splits text into 4KB records
-func (w *Writer) splitTextRecords(data []byte) [][]byte {
+// TextRecords splits text into records of StandardRecordSize uncompressed
+// bytes, PalmDOC-compressed if compress is set, each followed by its
+// multibyte trailing entry (ExtraDataMultibyte). Records are cut on byte
+// boundaries, as readers expect; when the cut falls inside a UTF-8
+// sequence, the entry carries the rest of the sequence (which the next
+// record also starts with) so readers can decode the character whole.
+// The entry is those bytes followed by a byte holding their count.
+func TextRecords(text []byte, compress bool) [][]byte {
 	var records [][]byte
 
-	const recordSize = 4096
-	for i := 0; i < len(data); i += recordSize {
-		end := i + recordSize
-		if end > len(data) {
-			end = len(data)
+	for i := 0; i < len(text); i += StandardRecordSize {
+		end := i + StandardRecordSize
+		if end > len(text) {
+			end = len(text)
+		}
+		chunk := text[i:end]
+		if compress {
+			chunk = compressRecord(chunk)
 		}
-		record := data[i:end]
-		// In MOBI 6 with ExtraRecordFlags=0, we should NOT add trailers.
-		// If we ever support ExtraRecordFlags=1, we would add them here.
+
+		overlap := multibyteOverlap(text, end)
+		record := make([]byte, 0, len(chunk)+len(overlap)+1)
+		record = append(record, chunk...)
+		record = append(record, overlap...)
+		record = append(record, byte(len(overlap)))
 		records = append(records, record)
 	}
 
 	return records
 }
 
+// multibyteOverlap returns the bytes after end that complete a UTF-8
+// sequence started before end, or nil if end is a character boundary
+func multibyteOverlap(text []byte, end int) []byte {
+	if end >= len(text) {
+		return nil
+	}
+
+	// Find the lead byte of the character holding the last byte before end
+	start := end - 1
+	for start > 0 && end-start < utf8.UTFMax && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	size := 0
+	switch lead := text[start]; {
+	case lead&0xE0 == 0xC0:
+		size = 2
+	case lead&0xF0 == 0xE0:
+		size = 3
+	case lead&0xF8 == 0xF0:
+		size = 4
+	}
+	if start+size <= end {
+		return nil
+	}
+
+	stop := start + size
+	if stop > len(text) {
+		stop = len(text)
+	}
+	return text[end:stop]
+}
+
 // createImageRecord creates an image record
 func (w *Writer) createImageRecord(data []byte, filename string) []byte {
 	return data
 }
 
-// generateThumbnail creates a thumbnail from cover image
-// For now, returns the original image as thumbnail (simplified approach)
-// A full implementation would resize to thumbnail dimensions (e.g., 154x240)
+// generateThumbnail creates a thumbnail from cover image (see
+// GenerateThumbnail)
 func (w *Writer) generateThumbnail(coverData []byte) []byte {
-	// Simplified: return the same image as thumbnail
-	// In a full implementation, this would resize the image to thumbnail dimensions
-	// using an image processing library
-	return coverData
+	return GenerateThumbnail(coverData)
 }
 
 // addImages is kept for backward compatibility but calls addImagesFiltered
@@ -445,8 +405,9 @@ func joinStrings(strs []string, sep string) string {
 	return result
 }
 
-// GenerateTOCIndex generates a TOC index from the book's TOC with proper offsets
-func (w *Writer) GenerateTOCIndex(htmlContent string, textRecords [][]byte) (*index.INDX, error) {
+// GenerateTOCIndex generates the NCX index records for the book's TOC with
+// proper offsets. Nested TOC entries keep their parent/child relations.
+func (w *Writer) GenerateTOCIndex(htmlContent string, textRecords [][]byte) ([][]byte, error) {
 	builder := index.NewTOCIndexBuilder()
 
 	// Set text records for offset calculation
@@ -467,7 +428,7 @@ func (w *Writer) GenerateTOCIndex(htmlContent string, textRecords [][]byte) (*in
 		builder.AddEntry(entry.Label, entry.Href, uint32(entry.Level), offset)
 	}
 
-	return builder.Build()
+	return builder.BuildNCX(uint32(len(htmlContent)))
 }
 
 // ConvertOEBToMOBI is a convenience function to convert OEBBook to MOBI
@@ -490,10 +451,14 @@ func SortManifestIDs(book *opf.OEBBook) []string {
 	return ids
 }
 
-// resolveImageSources replaces src="filename" with src="recindex:N"
-// If baseIndex is 0, it uses relative indexing (1, 2, 3...)
-// If baseIndex is > 0, it uses absolute 1-based indexing (baseIndex + 1, baseIndex + 2...)
-func (w *Writer) resolveImageSources(content string, baseIndex uint32) string {
+// imageSrcRegex matches the src attribute of an image
+var imageSrcRegex = regexp.MustCompile(`src=["']([^"']+)["']`)
+
+// resolveImageSources replaces src="filename" with recindex="N", the
+// 1-based index of the image record relative to FirstImageIndex. The
+// numbering follows the order Write adds image records in: cover,
+// thumbnail, then the other manifest images sorted by id.
+func (w *Writer) resolveImageSources(content string) string {
 	imageMap := make(map[string]int)
 	coverID := w.book.Metadata.CoverID
 
@@ -528,8 +493,7 @@ func (w *Writer) resolveImageSources(content string, baseIndex uint32) string {
 	}
 
 	// 4. Perform replacements
-	re := regexp.MustCompile(`src=["']([^"']+)["']`)
-	return re.ReplaceAllStringFunc(content, func(match string) string {
+	return imageSrcRegex.ReplaceAllStringFunc(content, func(match string) string {
 		quote := match[4]
 		url := match[5 : len(match)-1]
 		// Remove # prefix if present
@@ -544,3 +508,57 @@ func (w *Writer) resolveImageSources(content string, baseIndex uint32) string {
 		return match
 	})
 }
+
+// internalLinkRegex matches links to an id in the same document
+var internalLinkRegex = regexp.MustCompile(`href=["']#([^"']+)["']`)
+
+// anchorRegex matches tags with an id or name attribute, capturing the value
+var anchorRegex = regexp.MustCompile(`<[^>]*?\s(?:id|name)=["']([^"']+)["']`)
+
+// resolveInternalLinks replaces links to ids in the book with filepos
+// attributes holding the byte offset of the target, which is how MOBI
+// readers follow links. Links to ids that don't exist are left as is.
+func resolveInternalLinks(content string) string {
+	anchors := anchorOffsets(content)
+
+	// Fixed-width placeholders first, so filling in the offsets doesn't
+	// move the targets
+	const placeholder = "filepos=0000000000"
+	var targets []string
+	withPlaceholders := internalLinkRegex.ReplaceAllStringFunc(content, func(match string) string {
+		id := internalLinkRegex.FindStringSubmatch(match)[1]
+		if _, ok := anchors[id]; !ok {
+			return match
+		}
+		targets = append(targets, id)
+		return placeholder
+	})
+	if len(targets) == 0 {
+		return content
+	}
+
+	anchors = anchorOffsets(withPlaceholders)
+	var buf strings.Builder
+	rest := withPlaceholders
+	for _, id := range targets {
+		i := strings.Index(rest, placeholder)
+		buf.WriteString(rest[:i])
+		buf.WriteString(fmt.Sprintf("filepos=%010d", anchors[id]))
+		rest = rest[i+len(placeholder):]
+	}
+	buf.WriteString(rest)
+	return buf.String()
+}
+
+// anchorOffsets maps each id or name in the HTML to the offset of the
+// first tag that has it
+func anchorOffsets(html string) map[string]int {
+	offsets := make(map[string]int)
+	for _, m := range anchorRegex.FindAllStringSubmatchIndex(html, -1) {
+		id := html[m[2]:m[3]]
+		if _, ok := offsets[id]; !ok {
+			offsets[id] = m[0]
+		}
+	}
+	return offsets
+}
@@ -2,8 +2,13 @@ package mobi
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
+	"github.com/htol/fb2c/mobi/index"
 	"github.com/htol/fb2c/opf"
 )
 
@@ -70,8 +75,6 @@ func TestGetBookName(t *testing.T) {
 }
 
 func TestSplitTextRecords(t *testing.T) {
-	writer := NewWriter(opf.NewOEBBook())
-
 	tests := []struct {
 		name     string
 		data     []byte
@@ -106,16 +109,67 @@ func TestSplitTextRecords(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			records := writer.splitTextRecords(tt.data)
+			records := TextRecords(tt.data, false)
 			if len(records) != tt.wantRecs {
-				t.Errorf("splitTextRecords() returned %v records, want %v", len(records), tt.wantRecs)
+				t.Errorf("TextRecords() returned %v records, want %v", len(records), tt.wantRecs)
 			}
 
-			// Verify each record is max 4096 bytes (except possibly last)
+			// Verify each record holds max 4096 bytes of text, before its
+			// trailing entry
+			var text []byte
 			for i, rec := range records {
+				n := int(rec[len(rec)-1])
+				rec = rec[:len(rec)-1-n]
 				if len(rec) > 4096 {
 					t.Errorf("Record %v has length %v, want max 4096", i, len(rec))
 				}
+				text = append(text, rec...)
+			}
+			if !bytes.Equal(text, tt.data) {
+				t.Errorf("Records do not add up to the text")
+			}
+		})
+	}
+}
+
+func TestPalmDBName(t *testing.T) {
+	title := "Преступление и наказание. Роман в шести частях"
+
+	tests := []struct {
+		name         string
+		databaseName string
+		want         string
+	}{
+		{"Cyrillic title", "", "Prestuplenie i nakazanie. Roman"},
+		{"override", "Crime_and\tPunishment\x7f", "Crime_andPunishment"},
+		{"long override", "Crime and Punishment, a novel in six parts", "Crime and Punishment, a novel i"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			book := opf.NewOEBBook()
+			book.Metadata = opf.Metadata{Title: title, Language: "ru"}
+			book.Content = "<html><body><p>Text</p></body></html>"
+
+			writer := NewWriter(book)
+			options := DefaultWriteOptions()
+			options.DatabaseName = tt.databaseName
+			writer.SetOptions(options)
+
+			if name := writer.GetBookName(); name != tt.want {
+				t.Errorf("GetBookName() = %q, want %q", name, tt.want)
+			}
+
+			var output bytes.Buffer
+			if err := writer.Write(&output); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			header := output.Bytes()[:32]
+			if header[31] != 0 {
+				t.Errorf("PalmDB name isn't zero-terminated: %q", header)
+			}
+			if got := string(bytes.TrimRight(header, "\x00")); got != tt.want {
+				t.Errorf("PalmDB name = %q, want %q", got, tt.want)
 			}
 		})
 	}
@@ -242,6 +296,96 @@ func TestEXTHWriter(t *testing.T) {
 	}
 }
 
+func TestEXTHHeaderConsistency(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata = opf.Metadata{Title: "Test Book"}
+
+	tests := []struct {
+		name     string
+		withEXTH bool
+	}{
+		{"with EXTH", true},
+		{"without EXTH", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := NewWriter(book)
+			writer.options.WithEXTH = tt.withEXTH
+
+			record, err := writer.createMOBIHeaderRecord(100, 1, 1, 0xFFFFFFFF, 0xFFFFFFFF)
+			if err != nil {
+				t.Fatalf("createMOBIHeaderRecord() error = %v", err)
+			}
+
+			flags := binary.BigEndian.Uint32(record[0x80:0x84])
+			hasFlag := flags&EXTHFlagPresent != 0
+			if hasFlag != tt.withEXTH {
+				t.Fatalf("EXTH flag = %v, want %v", hasFlag, tt.withEXTH)
+			}
+
+			headerLength := binary.BigEndian.Uint32(record[20:24])
+			exthOffset := 16 + int(headerLength)
+			hasEXTH := string(record[exthOffset:exthOffset+4]) == "EXTH"
+			if hasEXTH != hasFlag {
+				t.Fatalf("EXTH block present = %v, but flag = %v", hasEXTH, hasFlag)
+			}
+			checkFullName(t, record, "Test Book")
+			if flags := binary.BigEndian.Uint32(record[0xF0:0xF4]); flags != ExtraDataMultibyte {
+				t.Errorf("extra record data flags = %#x, want %#x", flags, ExtraDataMultibyte)
+			}
+			if !hasEXTH {
+				return
+			}
+
+			// Declared length and record count must match the encoded records
+			exthLength := int(binary.BigEndian.Uint32(record[exthOffset+4 : exthOffset+8]))
+			recordCount := int(binary.BigEndian.Uint32(record[exthOffset+8 : exthOffset+12]))
+			pos := exthOffset + 12
+			for i := 0; i < recordCount; i++ {
+				pos += int(binary.BigEndian.Uint32(record[pos+4 : pos+8]))
+			}
+			if pos-exthOffset != exthLength {
+				t.Errorf("EXTH declared length = %d, records span %d bytes", exthLength, pos-exthOffset)
+			}
+
+			fullNameOffset := binary.BigEndian.Uint32(record[0x54:0x58])
+			if int(fullNameOffset) != exthOffset+exthLength {
+				t.Errorf("FullNameOffset = %d, want %d", fullNameOffset, exthOffset+exthLength)
+			}
+		})
+	}
+}
+
+// checkFullName checks that record 0 holds the full name at the offset
+// and length its header declares
+func checkFullName(t *testing.T, record []byte, want string) {
+	t.Helper()
+
+	offset := int(binary.BigEndian.Uint32(record[0x54:0x58]))
+	length := int(binary.BigEndian.Uint32(record[0x58:0x5C]))
+	if offset+length > len(record) {
+		t.Fatalf("full name at %d+%d is outside the %d byte record", offset, length, len(record))
+	}
+	if got := string(record[offset : offset+length]); got != want {
+		t.Errorf("full name = %q, want %q", got, want)
+	}
+	if len(record)%4 != 0 {
+		t.Errorf("record 0 length = %d, want a multiple of 4", len(record))
+	}
+}
+
+func TestEXTHWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := NewEXTHWriter().Write(&buf)
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if n != 0 || buf.Len() != 0 {
+		t.Errorf("Empty EXTH wrote %d bytes, want 0", buf.Len())
+	}
+}
+
 func TestPalmDOCCompression(t *testing.T) {
 	tests := []struct {
 		name string
@@ -270,3 +414,275 @@ func TestPalmDOCCompression(t *testing.T) {
 		})
 	}
 }
+
+func TestPalmDOCRoundTrip(t *testing.T) {
+	noise := make([]byte, 9000)
+	for i := range noise {
+		noise[i] = byte(i * 7 % 256)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"ascii", []byte("The quick brown fox jumps over the lazy dog. Hello World Test")},
+		{"repeated", []byte(strings.Repeat("AAAAABBBBBCCCCC", 600))},
+		{"run", bytes.Repeat([]byte{'x'}, 5000)},
+		{"binary", noise},
+		{"control", []byte{0x00, 0x01, 0x08, 0x09, 0x7F, 0x80, 0xBF, 0xC0, 0xFF, ' ', 0x40, ' ', 0x7F}},
+		{"cyrillic", []byte(strings.Repeat("Съешь же ещё этих мягких французских булок, да выпей чаю. ", 200))},
+		{"html", []byte(strings.Repeat(`<p class="text">Абзац <a href="#n1">[1]</a></p>`+"\n", 300))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RoundTripPalmDOC(tt.input); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCompressRecordLZ77(t *testing.T) {
+	// " a" packs into one byte, then "bcdefghij" repeats at distance 12
+	input := []byte("abcdefghij, abcdefghij")
+	compressed := compressRecord(input)
+
+	want := append([]byte("abcdefghij,"), 0xE1, 0x80|12>>5, 12<<3&0xFF|(9-3))
+	if !bytes.Equal(compressed, want) {
+		t.Errorf("compressRecord() = % x, want % x", compressed, want)
+	}
+	if got := DecompressPalmDOC(compressed); !bytes.Equal(got, input) {
+		t.Errorf("DecompressPalmDOC() = %q, want %q", got, input)
+	}
+
+	// Matches as far back as the 11-bit distance allows
+	far := []byte("0123456789" + strings.Repeat("-", 2037) + "0123456789")
+	if err := RoundTripPalmDOC(far); err != nil {
+		t.Error(err)
+	}
+	if got := compressRecord(far); got[len(got)-2] != 0xBF || got[len(got)-1] != 0xFF {
+		t.Errorf("compressRecord() ends % x, want a distance 2047 length 10 pair bf ff", got[len(got)-2:])
+	}
+}
+
+func TestDecompressPalmDOC(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"literals", []byte("abc\x00"), "abc\x00"},
+		{"escaped", []byte{0x02, 0xD0, 0x96, 'x'}, "\xd0\x96x"},
+		{"space", []byte{'a', 'b' ^ 0x80}, "a b"},
+		{"pair", []byte{'a', 'b', 'c', 0x80, 3<<3 | 2}, "abcabcab"},
+		{"overlap", []byte{'a', 0x80, 1<<3 | 7}, "aaaaaaaaaaa"},
+		{"truncated pair", []byte{'a', 0x80}, "a"},
+		{"bad distance", []byte{'a', 0x80, 2 << 3}, "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(DecompressPalmDOC(tt.input)); got != tt.want {
+				t.Errorf("DecompressPalmDOC() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateDescription(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		maxLen int
+		want   string
+	}{
+		{"short", "Short text", 100, "Short text"},
+		{"no cap", "Some long text", 0, "Some long text"},
+		{"word boundary", "The quick brown fox jumps", 15, "The quick…"},
+		{"no spaces", "abcdefghij", 5, "abcd…"},
+		{"multibyte", "Съешь же ещё этих мягких булок", 12, "Съешь же…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateDescription(tt.input, tt.maxLen)
+			if got != tt.want {
+				t.Errorf("TruncateDescription(%q, %d) = %q, want %q", tt.input, tt.maxLen, got, tt.want)
+			}
+			if tt.maxLen > 0 && len([]rune(got)) > tt.maxLen {
+				t.Errorf("Result has %d characters, want at most %d", len([]rune(got)), tt.maxLen)
+			}
+		})
+	}
+}
+
+func TestEXTHDescriptionCap(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata = opf.Metadata{
+		Title:      "Test Book",
+		Annotation: strings.Repeat("word ", 2000),
+	}
+
+	writer := NewWriter(book)
+	writer.options.MaxDescriptionLength = 100
+
+	record, err := writer.createMOBIHeaderRecord(100, 1, 1, 0xFFFFFFFF, 0xFFFFFFFF)
+	if err != nil {
+		t.Fatalf("createMOBIHeaderRecord() error = %v", err)
+	}
+	if bytes.Contains(record, []byte(strings.Repeat("word ", 30))) {
+		t.Error("EXTH description was not capped")
+	}
+	if !bytes.Contains(record, []byte("word…")) {
+		t.Error("Capped EXTH description doesn't end with an ellipsis")
+	}
+}
+
+func TestPalmDBWriterInsertRecord(t *testing.T) {
+	w := NewPalmDBWriter("test", false)
+	header := w.ReserveRecord(0, 0)
+	w.AddRecord([]byte("b"), 0, 2)
+	w.InsertRecord(1, []byte("a"), 0, 1)
+	w.AddRecord([]byte("c"), 0, 3)
+	w.SetRecord(header, []byte("header"))
+
+	want := []string{"header", "a", "b", "c"}
+	records := w.GetRecords()
+	entries := w.GetRecordEntries()
+	if len(records) != len(want) || len(entries) != len(want) {
+		t.Fatalf("Got %d records and %d entries, want %d", len(records), len(entries), len(want))
+	}
+	for i, rec := range records {
+		if string(rec) != want[i] {
+			t.Errorf("Record %d = %q, want %q", i, rec, want[i])
+		}
+		if entries[i].UniqueID != uint32(i) {
+			t.Errorf("Record %d unique ID = %d, want %d", i, entries[i].UniqueID, i)
+		}
+	}
+}
+
+func TestWriteTooManyRecords(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata.Title = "Huge"
+	book.Content = "<html><body><p>Text</p></body></html>"
+	for i := range MaxRecords {
+		book.AddResource(fmt.Sprintf("img%05d", i), fmt.Sprintf("img%05d.png", i), "image/png", []byte{byte(i)})
+	}
+
+	var output bytes.Buffer
+	err := ConvertOEBToMOBI(book, &output)
+	if err == nil || !strings.Contains(err.Error(), "65535") {
+		t.Fatalf("ConvertOEBToMOBI() error = %v, want the record limit error", err)
+	}
+	if output.Len() != 0 {
+		t.Errorf("ConvertOEBToMOBI() wrote %d bytes of a corrupt file", output.Len())
+	}
+}
+
+func TestNestedTOCIndex(t *testing.T) {
+	book := opf.NewOEBBook()
+	book.Metadata.Title = "Nested"
+	book.Content = `<html><body><h1 id="p1">Part 1</h1><h2 id="c1">Chapter 1</h2><p>One</p>` +
+		`<h2 id="c2">Chapter 2</h2><p>Two</p><h1 id="p2">Part 2</h1><p>Three</p></body></html>`
+	book.TOC = opf.TOCEntry{ID: "root"}
+	part1 := book.TOC.AddChild("p1", "Part 1", "#p1")
+	part1.AddChild("c1", "Chapter 1", "#c1")
+	part1.AddChild("c2", "Chapter 2", "#c2")
+	book.TOC.AddChild("p2", "Part 2", "#p2")
+
+	var output bytes.Buffer
+	if err := ConvertOEBToMOBI(book, &output); err != nil {
+		t.Fatalf("ConvertOEBToMOBI() error = %v", err)
+	}
+
+	// Split the PalmDB into records
+	data := output.Bytes()
+	count := int(binary.BigEndian.Uint16(data[76:]))
+	records := make([][]byte, count)
+	for i := range count {
+		start := binary.BigEndian.Uint32(data[78+8*i:])
+		end := uint32(len(data))
+		if i+1 < count {
+			end = binary.BigEndian.Uint32(data[78+8*(i+1):])
+		}
+		records[i] = data[start:end]
+	}
+
+	indxRecord := binary.BigEndian.Uint32(records[0][0xF4:])
+	if indxRecord == 0xFFFFFFFF {
+		t.Fatal("MOBI header has no INDX record")
+	}
+	entries, err := index.ParseNCX(records[indxRecord:])
+	if err != nil {
+		t.Fatalf("ParseNCX() error = %v", err)
+	}
+
+	want := []index.NCXEntry{
+		{Label: "Part 1", Depth: 0, Parent: -1, FirstChild: 2, LastChild: 3},
+		{Label: "Part 2", Depth: 0, Parent: -1, FirstChild: -1, LastChild: -1},
+		{Label: "Chapter 1", Depth: 1, Parent: 0, FirstChild: -1, LastChild: -1},
+		{Label: "Chapter 2", Depth: 1, Parent: 0, FirstChild: -1, LastChild: -1},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("Got %d NCX entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.Label != w.Label || e.Depth != w.Depth || e.Parent != w.Parent ||
+			e.FirstChild != w.FirstChild || e.LastChild != w.LastChild {
+			t.Errorf("Entry %d = %+v, want %+v", i, e, w)
+		}
+	}
+
+	// A part spans its chapters
+	content := book.Content
+	if got, want := entries[0].Offset, uint32(strings.Index(content, `<h1 id="p1"`)); got != want {
+		t.Errorf("Part 1 offset = %d, want %d", got, want)
+	}
+	if got, want := entries[0].Offset+entries[0].Length, uint32(strings.Index(content, `<h1 id="p2"`)); got != want {
+		t.Errorf("Part 1 ends at %d, want %d", got, want)
+	}
+}
+
+func TestTextRecordsMultibyteOverlap(t *testing.T) {
+	// Two-byte Cyrillic letters after a one-byte prefix put a character
+	// across every record boundary
+	text := []byte("x" + strings.Repeat("ж", 6000))
+
+	records := TextRecords(text, false)
+	if want := (len(text) + StandardRecordSize - 1) / StandardRecordSize; len(records) != want {
+		t.Fatalf("TextRecords() returned %d records, want %d", len(records), want)
+	}
+
+	var joined []byte
+	for i, record := range records {
+		n := int(record[len(record)-1] & 0x3)
+		body := record[:len(record)-1-n]
+		overlap := record[len(record)-1-n : len(record)-1]
+		start := i * StandardRecordSize
+
+		if !bytes.Equal(body, text[start:start+len(body)]) {
+			t.Fatalf("record %d text doesn't match the input", i)
+		}
+		if i < len(records)-1 && n != 1 {
+			t.Errorf("record %d overlap = %d bytes, want 1", i, n)
+		}
+		if !utf8.Valid(append(append([]byte{}, text[:start+len(body)]...), overlap...)) {
+			t.Errorf("record %d splits a character: overlap %x", i, overlap)
+		}
+		joined = append(joined, body...)
+	}
+	if !bytes.Equal(joined, text) {
+		t.Error("records don't add up to the input text")
+	}
+
+	// Compressed records carry the same trailing entry
+	for i, record := range TextRecords(text, true) {
+		if got, want := record[len(record)-1], records[i][len(records[i])-1]; got != want {
+			t.Errorf("compressed record %d overlap size = %d, want %d", i, got, want)
+		}
+	}
+}
@@ -2,6 +2,11 @@
 package opf
 
 import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"sort"
 	"time"
 )
@@ -20,10 +25,23 @@ type OEBBook struct {
 	// TOC is the table of contents
 	TOC TOCEntry
 
+	// Bookmarks is a secondary navigation list, separate from the TOC
+	Bookmarks []Bookmark
+
+	// TitlePage is the content ID of the title page in Content, if it has
+	// one, for the guide and landmarks
+	TitlePage string
+
 	// The primary content HTML
 	Content string
 }
 
+// Bookmark is a labelled navigation target inside the content
+type Bookmark struct {
+	Label  string
+	Anchor string // Content ID, without leading '#'
+}
+
 // Resource represents a file in the publication
 type Resource struct {
 	ID       string
@@ -63,7 +81,9 @@ func (b *OEBBook) AddToSpine(id string) {
 	b.Spine = append(b.Spine, id)
 }
 
-// GetManifestIDs returns sorted manifest IDs
+// GetManifestIDs returns the manifest IDs in sorted order. Writers list
+// resources in this order rather than ranging over the Manifest map, so
+// the same book always produces the same output.
 func (b *OEBBook) GetManifestIDs() []string {
 	ids := make([]string, 0, len(b.Manifest))
 	for id := range b.Manifest {
@@ -83,9 +103,37 @@ func (b *OEBBook) HasImages() bool {
 	return false
 }
 
+// ImageSize returns the pixel dimensions of an image resource
+func (b *OEBBook) ImageSize(id string) (width, height int, ok bool) {
+	res, found := b.Manifest[id]
+	if !found {
+		return 0, 0, false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(res.Data))
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// MaxImageSize returns the largest width and height over all image
+// resources whose dimensions can be decoded
+func (b *OEBBook) MaxImageSize() (width, height int) {
+	for _, id := range b.GetManifestIDs() {
+		w, h, ok := b.ImageSize(id)
+		if !ok {
+			continue
+		}
+		width = max(width, w)
+		height = max(height, h)
+	}
+	return width, height
+}
+
 // Metadata represents OPF metadata
 type Metadata struct {
 	Title       string
+	TitleMarkup string // Title as XHTML for display, if it has inline markup
 	Authors     []Author
 	Translator  []Author // For translated works
 	Contributors []string
@@ -97,25 +145,42 @@ type Metadata struct {
 	PubDate     time.Time
 	Language    string
 	Languages   []string
+	Direction   string // Reading direction: "rtl" for right-to-left books, else "ltr" or ""
 	Series      string
 	SeriesIndex int
-	Genres      []string
+	// OtherSeries are further series the book belongs to, after Series
+	OtherSeries []SeriesInfo
+	Genres      []string // Subjects
+	GenreCodes  []string // Source genre codes of the subjects
 	Keywords    []string
 	Annotation  string
 	Comments    string
 
+	// AnnotationHTML is the annotation as XHTML paragraphs, if known
+	AnnotationHTML string
+
 	// Cover image
 	Cover     []byte
 	CoverID   string // Resource ID in manifest
 	CoverExt  string // jpg, png, etc.
+	Thumbnail []byte // Separate thumbnail image, if any
 
 	// Additional metadata
-	Source      string // Original file path
+	Source      string   // Original file path
+	Sources     []string // dc:source values: provenance of the content
+	SourceOCR   string   // Who scanned or recognized the source text
+	DocumentID  string   // FB2 document id, used as the book identifier if it is a UUID
 	Rights      string // Copyright info
 	Subject     string // DC:subject
 	Description string // DC:description
 }
 
+// SeriesInfo is a series the book belongs to
+type SeriesInfo struct {
+	Name  string
+	Index int // 0 if unknown
+}
+
 // Author represents an author with structured name parts
 type Author struct {
 	FirstName  string
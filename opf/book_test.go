@@ -204,9 +204,11 @@ func TestGenerateOPF(t *testing.T) {
 		PubDate:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
 		Series:      "Test Series",
 		SeriesIndex: 1,
+		OtherSeries: []SeriesInfo{{Name: "Other Series", Index: 4}},
 		Genres:      []string{"Fiction", "Adventure"},
 		Annotation:  "A test book annotation",
 		CoverID:     "cover.jpg",
+		Sources:     []string{"urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a"},
 	}
 	book.Metadata.Authors = []Author{
 		NewAuthor("John", "Q", "Doe", ""),
@@ -237,6 +239,8 @@ func TestGenerateOPF(t *testing.T) {
 		`<dc:creator`,
 		`<dc:publisher>Test Publisher</dc:publisher>`,
 		`<dc:language>en</dc:language>`,
+		`<dc:source>urn:uuid:0b3c2a9e-7f41-4d2c-9a55-3f1e2d4c5b6a</dc:source>`,
+		`<meta name="fb2:sequence" content="Other Series (#4)"></meta>`,
 		`<manifest>`,
 		`<spine`,
 		`<item id="html"`,
@@ -401,6 +405,9 @@ func TestGenerateTitlePage(t *testing.T) {
 			t.Errorf("Title page missing required string: %s\nGot: %s", required, titlePage)
 		}
 	}
+	if contains(titlePage, `\n`) {
+		t.Errorf("Title page contains a literal \\n:\n%s", titlePage)
+	}
 
 	t.Logf("Generated title page:\n%s", titlePage)
 }
@@ -221,15 +221,17 @@ func (p *HTMLProcessor) GenerateTitlePage(metadata Metadata) string {
 `)
 
 	// Title
-	if metadata.Title != "" {
-		buf.WriteString(fmt.Sprintf(`<h1>%s</h1>\n`, htmlEscape(metadata.Title)))
+	if metadata.TitleMarkup != "" {
+		buf.WriteString(fmt.Sprintf("<h1>%s</h1>\n", metadata.TitleMarkup))
+	} else if metadata.Title != "" {
+		buf.WriteString(fmt.Sprintf("<h1>%s</h1>\n", htmlEscape(metadata.Title)))
 	}
 
 	// Authors
 	if len(metadata.Authors) > 0 {
 		for _, author := range metadata.Authors {
 			if author.FullName != "" {
-				buf.WriteString(fmt.Sprintf(`<h2>%s</h2>\n`, htmlEscape(author.FullName)))
+				buf.WriteString(fmt.Sprintf("<h2>%s</h2>\n", htmlEscape(author.FullName)))
 			}
 		}
 		buf.WriteString("<br/>\n")
@@ -241,22 +243,29 @@ func (p *HTMLProcessor) GenerateTitlePage(metadata Metadata) string {
 		if metadata.SeriesIndex > 0 {
 			seriesText += fmt.Sprintf(" (#%d)", metadata.SeriesIndex)
 		}
-		buf.WriteString(fmt.Sprintf(`<h3>%s</h3>\n`, htmlEscape(seriesText)))
+		buf.WriteString(fmt.Sprintf("<h3>%s</h3>\n", htmlEscape(seriesText)))
 		buf.WriteString("<br/>\n")
 	}
 
 	// Publisher info
 	if metadata.Publisher != "" {
-		buf.WriteString(fmt.Sprintf(`<p>%s</p>\n`, htmlEscape(metadata.Publisher)))
+		buf.WriteString(fmt.Sprintf("<p>%s</p>\n", htmlEscape(metadata.Publisher)))
 	}
 
 	if metadata.Year != "" {
-		buf.WriteString(fmt.Sprintf(`<p>%s</p>\n`, htmlEscape(metadata.Year)))
+		buf.WriteString(fmt.Sprintf("<p>%s</p>\n", htmlEscape(metadata.Year)))
 	}
 
 	// ISBN
 	if metadata.ISBN != "" {
-		buf.WriteString(fmt.Sprintf(`<p>ISBN: %s</p>\n`, htmlEscape(metadata.ISBN)))
+		buf.WriteString(fmt.Sprintf("<p>ISBN: %s</p>\n", htmlEscape(metadata.ISBN)))
+	}
+
+	// Annotation, with its paragraphs and emphasis when available
+	if metadata.AnnotationHTML != "" {
+		buf.WriteString("<div class=\"annotation\">\n" + metadata.AnnotationHTML + "</div>\n")
+	} else if metadata.Annotation != "" {
+		buf.WriteString(fmt.Sprintf("<div class=\"annotation\"><p>%s</p></div>\n", htmlEscape(metadata.Annotation)))
 	}
 
 	buf.WriteString("</div>\n")
@@ -27,7 +27,7 @@ type OPFMetadata struct {
 	XMLNSOPF     string   `xml:"xmlns:opf,attr"`
 	DCTitle      string   `xml:"dc:title"`
 	DCCreators   []OPFDCreator `xml:"dc:creator"`
-	DCContributors []string `xml:"dc:contributor"`
+	DCContributors []OPFDCContributor `xml:"dc:contributor"`
 	DCPublisher  string   `xml:"dc:publisher,omitempty"`
 	DCIdentifier OPFIdentifier `xml:"dc:identifier"`
 	DCDate       OPFDate `xml:"dc:date"`
@@ -35,6 +35,7 @@ type OPFMetadata struct {
 	DCSubject    []string `xml:"dc:subject"`
 	DCDescription string  `xml:"dc:description,omitempty"`
 	DCRights     string   `xml:"dc:rights,omitempty"`
+	DCSource     []string `xml:"dc:source"`
 	Meta         []OPFMeta `xml:"meta"`
 }
 
@@ -46,6 +47,14 @@ type OPFDCreator struct {
 	Text    string   `xml:",chardata"`
 }
 
+// OPFDCContributor represents a contributor (translator, illustrator, etc.)
+type OPFDCContributor struct {
+	XMLName xml.Name `xml:"dc:contributor"`
+	Role    string   `xml:"opf:role,attr,omitempty"`
+	FileAs  string   `xml:"opf:file-as,attr,omitempty"`
+	Text    string   `xml:",chardata"`
+}
+
 // OPFIdentifier represents a unique identifier
 type OPFIdentifier struct {
 	XMLName xml.Name `xml:"dc:identifier"`
@@ -150,6 +159,7 @@ func (b *OEBBook) buildOPFMetadata(uniqueID string) OPFMetadata {
 		DCDescription: b.Metadata.Annotation,
 		DCRights:     b.Metadata.Rights,
 		DCSubject:    b.Metadata.Genres,
+		DCSource:     b.Metadata.Sources,
 	}
 
 	// Creators (authors, translators, etc.)
@@ -166,8 +176,15 @@ func (b *OEBBook) buildOPFMetadata(uniqueID string) OPFMetadata {
 	}
 
 	// Contributors
+	for _, translator := range b.Metadata.Translator {
+		m.DCContributors = append(m.DCContributors, OPFDCContributor{
+			Role:   "trl",
+			FileAs: translator.SortName,
+			Text:   translator.FullName,
+		})
+	}
 	for _, contributor := range b.Metadata.Contributors {
-		m.DCContributors = append(m.DCContributors, contributor)
+		m.DCContributors = append(m.DCContributors, OPFDCContributor{Text: contributor})
 	}
 
 	// Identifier (ISBN or UUID)
@@ -211,6 +228,33 @@ func (b *OEBBook) buildOPFMetadata(uniqueID string) OPFMetadata {
 		}
 	}
 
+	// Genre codes behind the subjects, for round-tripping
+	for _, code := range b.Metadata.GenreCodes {
+		m.Meta = append(m.Meta, OPFMeta{
+			Name:    "fb2:genre",
+			Content: code,
+		})
+	}
+
+	// calibre has a single series; further ones keep their FB2 name
+	for _, series := range b.Metadata.OtherSeries {
+		content := series.Name
+		if series.Index > 0 {
+			content += fmt.Sprintf(" (#%d)", series.Index)
+		}
+		m.Meta = append(m.Meta, OPFMeta{
+			Name:    "fb2:sequence",
+			Content: content,
+		})
+	}
+
+	if b.Metadata.SourceOCR != "" {
+		m.Meta = append(m.Meta, OPFMeta{
+			Name:    "fb2:src-ocr",
+			Content: b.Metadata.SourceOCR,
+		})
+	}
+
 	// Cover meta
 	if b.Metadata.CoverID != "" {
 		m.Meta = append(m.Meta, OPFMeta{
@@ -0,0 +1,45 @@
+package fb2c
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/htol/fb2c/fb2"
+)
+
+// DegradedError is returned in strict mode when the book could only be
+// converted with parts of it missing or broken
+type DegradedError struct {
+	Problems []string
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("degraded conversion: %s", strings.Join(e.Problems, "; "))
+}
+
+// addProblem records a problem that best-effort conversion works around
+// and strict conversion rejects
+func (c *Converter) addProblem(msg string) {
+	c.problems = append(c.problems, msg)
+	c.addWarning(msg)
+}
+
+// checkParseProblems records the problems the parser skipped over and a
+// cover that doesn't resolve to an image
+func (c *Converter) checkParseProblems(metadata *fb2.Metadata) {
+	for _, msg := range c.parser.Warnings() {
+		c.addProblem(msg)
+	}
+	if metadata.CoverID != "" && len(metadata.Cover) == 0 {
+		c.addProblem(fmt.Sprintf("cover image %q not found", metadata.CoverID))
+	}
+}
+
+// strictError returns a *DegradedError in strict mode if any problems were
+// recorded
+func (c *Converter) strictError() error {
+	if !c.options.Strict || len(c.problems) == 0 {
+		return nil
+	}
+	return &DegradedError{Problems: c.problems}
+}
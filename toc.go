@@ -0,0 +1,109 @@
+package fb2c
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/htol/fb2c/fb2"
+	"github.com/htol/fb2c/opf"
+)
+
+// anchorRegex matches id and name attributes that can be link targets
+var anchorRegex = regexp.MustCompile(`\b(?:id|name)="([^"]+)"`)
+
+// TOCOverrideEntry is a table of contents entry supplied by the caller
+type TOCOverrideEntry struct {
+	Title  string
+	Anchor string // Target content ID, with or without leading '#'
+	Level  int    // Nesting level, 1 = top level
+}
+
+// Bookmark is a labelled link to an anchor in the content, such as a
+// paragraph anchor (see fb2.ParagraphAnchor)
+type Bookmark struct {
+	Label  string
+	Anchor string // Target content ID, with or without leading '#'
+}
+
+// contentAnchors returns the set of IDs that can be link targets in html
+func contentAnchors(html string) map[string]bool {
+	anchors := make(map[string]bool)
+	for _, m := range anchorRegex.FindAllStringSubmatch(html, -1) {
+		anchors[m[1]] = true
+	}
+	return anchors
+}
+
+// buildBookmarks converts the bookmarks option for the OPF book, dropping
+// bookmarks whose anchor isn't in the generated HTML
+func (c *Converter) buildBookmarks(html string) []opf.Bookmark {
+	if len(c.options.Bookmarks) == 0 {
+		return nil
+	}
+
+	anchors := contentAnchors(html)
+	var bookmarks []opf.Bookmark
+	for i, bookmark := range c.options.Bookmarks {
+		id := strings.TrimPrefix(bookmark.Anchor, "#")
+		if !anchors[id] {
+			c.addProblem(fmt.Sprintf("bookmark %d (%q): anchor %q not found in content; skipping", i+1, bookmark.Label, bookmark.Anchor))
+			continue
+		}
+		bookmarks = append(bookmarks, opf.Bookmark{Label: bookmark.Label, Anchor: id})
+	}
+	return bookmarks
+}
+
+// buildTOCOverride converts the TOC override into TOC data, warning about
+// anchors that don't resolve to an ID in the generated HTML
+func (c *Converter) buildTOCOverride(html string) *fb2.TOCData {
+	anchors := contentAnchors(html)
+
+	toc := &fb2.TOCData{
+		Entries: []*fb2.TOCEntry{},
+	}
+
+	// Parent at each level, used to link entries into a tree
+	parents := make(map[int]*fb2.TOCEntry)
+	prevLevel := 0
+
+	for i, override := range c.options.TOCOverride {
+		id := strings.TrimPrefix(override.Anchor, "#")
+		if !anchors[id] {
+			c.addProblem(fmt.Sprintf("TOC override entry %d (%q): anchor %q not found in content", i+1, override.Title, override.Anchor))
+		}
+
+		// Keep levels contiguous so every entry has a parent
+		level := override.Level
+		if level < 1 {
+			level = 1
+		}
+		if level > prevLevel+1 {
+			level = prevLevel + 1
+		}
+		prevLevel = level
+
+		entry := &fb2.TOCEntry{
+			ID:     id,
+			Label:  override.Title,
+			Href:   "#" + id,
+			Level:  level,
+			Parent: parents[level-1],
+		}
+		parents[level] = entry
+		toc.Entries = append(toc.Entries, entry)
+	}
+
+	return toc
+}
+
+// addWarning records a non-fatal conversion problem
+func (c *Converter) addWarning(msg string) {
+	c.warnings = append(c.warnings, msg)
+}
+
+// Warnings returns the warnings collected during the last conversion
+func (c *Converter) Warnings() []string {
+	return c.warnings
+}